@@ -2,6 +2,8 @@ package conditional
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/rgumi/depoy/util"
@@ -10,6 +12,27 @@ import (
 // the metrics which are allowed for the condtions
 var allowedOperators = []string{">", "==", "<"}
 
+const (
+	// OperatorAnd is true if all conditions of a composite condition are true
+	OperatorAnd = "and"
+	// OperatorOr is true if any condition of a composite condition is true
+	OperatorOr = "or"
+)
+
+const (
+	// ChangeDelta compares the absolute change of a metric
+	ChangeDelta = "delta"
+	// ChangePercent compares the change of a metric in percent
+	ChangePercent = "percent"
+)
+
+const (
+	// SourceBackend evaluates a condition using the metrics of the backend
+	SourceBackend = "backend"
+	// SourceRoute evaluates a condition using the metrics of the whole route
+	SourceRoute = "route"
+)
+
 // Condition is used to evaluate the state
 // of a backend and take action according to
 // the values defined here
@@ -18,10 +41,19 @@ type Condition struct {
 	Status bool `json:"status" yaml:"-"`
 	// Name of the metric
 	Metric string `json:"metric" yaml:"metric"`
-	// allowed operators: < > ==
+	// Source of the metric: backend (default) or route. Metrics of the route
+	// are the aggregate of all backends of the route as observed by the clients
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	// allowed operators: < > == and the composite operators and, or
 	Operator string `json:"operator" yaml:"operator"`
+	// Conditions which are combined by a composite operator. They are evaluated
+	// using the metrics of the source of the composite condition
+	Conditions []*Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
 	// Threshhold that is checked
 	Threshold float64 `json:"threshold" yaml:"threshold"`
+	// Change compares the change of the metric since the previous evaluation
+	// instead of its value: delta (absolute) or percent
+	Change string `json:"change,omitempty" yaml:"change,omitempty"`
 	// Duration for which the condition has to be met
 	ActiveFor util.ConfigDuration `json:"active_for" yaml:"activeFor" default:"\"5s\""`
 	// Duration for which an active alert needs to be inactive to be resolved
@@ -30,38 +62,94 @@ type Condition struct {
 	TriggerTime time.Time `json:"-" yaml:"-"`
 	// Condtional function to evaluate condition using backend metrics rates
 	IsTrue func(m map[string]float64) bool `json:"-" yaml:"-"`
+	// value of the metric in the previous evaluation
+	previous *float64
 }
 
 func (c *Condition) Compile() func(m map[string]float64) {
-
+	var compare func(value float64) bool
 	switch c.Operator {
 	case "<":
-		c.IsTrue = func(m map[string]float64) bool {
-			if value, found := m[c.Metric]; found && value < c.Threshold {
-				return true
-			}
-			return false
-		}
+		compare = func(value float64) bool { return value < c.Threshold }
 
 	case "==":
-		c.IsTrue = func(m map[string]float64) bool {
-			if value, found := m[c.Metric]; found && value == c.Threshold {
-				return true
-			}
-			return false
-		}
+		compare = func(value float64) bool { return value == c.Threshold }
 
 	case ">":
+		compare = func(value float64) bool { return value > c.Threshold }
+
+	case OperatorAnd, OperatorOr:
+		for _, child := range c.Conditions {
+			child.Compile()
+		}
+		// the metric of a composite condition is only used to identify it
+		if c.Metric == "" {
+			c.Metric = c.String()
+		}
+		// and is false if any condition is false, or is true if any condition is true.
+		// All conditions are evaluated as conditions of a change keep the previous value
+		all := c.Operator == OperatorAnd
 		c.IsTrue = func(m map[string]float64) bool {
-			if value, found := m[c.Metric]; found && value > c.Threshold {
-				return true
+			result := all
+			for _, child := range c.Conditions {
+				if child.IsTrue(m) != all {
+					result = !all
+				}
 			}
-			return false
+			return result
 		}
+		return nil
+	}
+	if compare == nil {
+		return nil
+	}
+	c.previous = nil
+	c.IsTrue = func(m map[string]float64) bool {
+		value, found := c.value(m)
+		return found && compare(value)
 	}
 	return nil
 }
 
+// value returns the value of the metric which is compared. If the condition is
+// a change, it is the change compared to the previous evaluation. Therefore,
+// conditions of a change have to be evaluated exactly once per window
+func (c *Condition) value(m map[string]float64) (float64, bool) {
+	current, found := m[c.Metric]
+	if c.Change == "" || !found {
+		return current, found
+	}
+	previous := c.previous
+	c.previous = &current
+	if previous == nil {
+		return 0, false
+	}
+	if c.Change == ChangePercent {
+		if *previous == 0 {
+			return 0, false
+		}
+		return (current - *previous) / math.Abs(*previous) * 100, true
+	}
+	return current - *previous, true
+}
+
+// String returns the expression of the condition, e.g. (5xxRate > 0.1 or ResponseTime > 500)
+func (c *Condition) String() string {
+	switch {
+	case c.Change == ChangeDelta:
+		return fmt.Sprintf("delta(%s) %s %v", c.Metric, c.Operator, c.Threshold)
+	case c.Change == ChangePercent:
+		return fmt.Sprintf("percent(%s) %s %v", c.Metric, c.Operator, c.Threshold)
+	case c.Operator != OperatorAnd && c.Operator != OperatorOr:
+		return fmt.Sprintf("%s %s %v", c.Metric, c.Operator, c.Threshold)
+	}
+	expressions := make([]string, len(c.Conditions))
+	for i, child := range c.Conditions {
+		expressions[i] = child.String()
+	}
+	return "(" + strings.Join(expressions, " "+c.Operator+" ") + ")"
+}
+
 // NewCondition returns a new condition for the given parameters
 // Initializes correctly by setting up IsTrue to a conditional function
 func NewCondition(metric, operator string, threshhold float64, activeFor, resolveIn time.Duration) *Condition {
@@ -89,6 +177,70 @@ allowed:
 	return cond
 }
 
+// NewChangeCondition returns a new condition which compares the change of the metric
+// compared to the previous evaluation. change is either delta or percent
+func NewChangeCondition(metric, operator, change string, threshhold float64, activeFor, resolveIn time.Duration) *Condition {
+	if change != ChangeDelta && change != ChangePercent {
+		panic(fmt.Errorf("Change not allowed. Only delta, percent allowed"))
+	}
+	cond := NewCondition(metric, operator, threshhold, activeFor, resolveIn)
+	cond.Change = change
+	return cond
+}
+
+// NewCompositeCondition returns a new condition which combines the conditions
+// using the operator and or or
+func NewCompositeCondition(operator string, activeFor, resolveIn time.Duration, conditions ...*Condition) *Condition {
+	if operator != OperatorAnd && operator != OperatorOr {
+		panic(fmt.Errorf("Operator not allowed. Only and, or allowed"))
+	}
+	if len(conditions) == 0 || activeFor == 0 {
+		panic(fmt.Errorf("Parameters cannot be empty"))
+	}
+
+	cond := new(Condition)
+	cond.Operator = operator
+	cond.Conditions = conditions
+	cond.ActiveFor = util.ConfigDuration{activeFor}
+	cond.ResolveIn = util.ConfigDuration{resolveIn}
+	cond.Compile()
+
+	return cond
+}
+
+// Validate checks the operator, source and change of the condition and its conditions
+func (c *Condition) Validate() error {
+	switch c.Operator {
+	case OperatorAnd, OperatorOr:
+		if len(c.Conditions) == 0 {
+			return fmt.Errorf("Condition %s requires conditions", c.Operator)
+		}
+		for _, child := range c.Conditions {
+			if err := child.Validate(); err != nil {
+				return err
+			}
+		}
+	case "<", ">", "==":
+		if c.Metric == "" {
+			return fmt.Errorf("Metric of condition cannot be empty")
+		}
+	default:
+		return fmt.Errorf("Unsupported operator of condition (%s)", c.Operator)
+	}
+	if c.Source != "" && c.Source != SourceBackend && c.Source != SourceRoute {
+		return fmt.Errorf("Unsupported source of condition (%s)", c.Source)
+	}
+	if c.Change != "" && c.Change != ChangeDelta && c.Change != ChangePercent {
+		return fmt.Errorf("Unsupported change of condition (%s)", c.Change)
+	}
+	return nil
+}
+
+// IsRouteSource checks if the condition is evaluated using the metrics of the route
+func (c *Condition) IsRouteSource() bool {
+	return c.Source == SourceRoute
+}
+
 func (c *Condition) GetActiveFor() time.Duration {
 	return c.ActiveFor.Duration
 }
@@ -0,0 +1,141 @@
+package conditional
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_CompositeCondition_Nesting(t *testing.T) {
+	errors := NewCondition("5xxRate", ">", 0.1, time.Second, 0)
+	slow := NewCondition("ResponseTime", ">", 500, time.Second, 0)
+	busy := NewCondition("ContentLength", ">", 1000, time.Second, 0)
+	// 5xxRate > 0.1 or (ResponseTime > 500 and ContentLength > 1000)
+	cond := NewCompositeCondition(OperatorOr, time.Second, 0,
+		errors,
+		NewCompositeCondition(OperatorAnd, time.Second, 0, slow, busy),
+	)
+
+	tests := []struct {
+		rates    map[string]float64
+		expected bool
+	}{
+		{map[string]float64{"5xxRate": 0.2, "ResponseTime": 100, "ContentLength": 10}, true},
+		{map[string]float64{"5xxRate": 0, "ResponseTime": 600, "ContentLength": 2000}, true},
+		{map[string]float64{"5xxRate": 0, "ResponseTime": 600, "ContentLength": 10}, false},
+		{map[string]float64{"5xxRate": 0, "ResponseTime": 100, "ContentLength": 2000}, false},
+		{map[string]float64{}, false},
+	}
+	for _, test := range tests {
+		if got := cond.IsTrue(test.rates); got != test.expected {
+			t.Errorf("Expected %s to be %v for %v", cond, test.expected, test.rates)
+		}
+	}
+	if cond.Metric != "(5xxRate > 0.1 or (ResponseTime > 500 and ContentLength > 1000))" {
+		t.Errorf("Expected the composite condition to be named by its expression, got %s", cond.Metric)
+	}
+}
+
+func Test_CompositeCondition_Compile(t *testing.T) {
+	// conditions of a config are compiled after they were unmarshaled
+	cond := &Condition{
+		Operator: OperatorAnd,
+		Metric:   "unhealthy",
+		Conditions: []*Condition{
+			{Metric: "5xxRate", Operator: ">", Threshold: 0.1},
+			{Operator: OperatorOr, Conditions: []*Condition{
+				{Metric: "ResponseTime", Operator: ">", Threshold: 500},
+				{Metric: "4xxRate", Operator: ">", Threshold: 0.5},
+			}},
+		},
+	}
+	cond.Compile()
+
+	if !cond.IsTrue(map[string]float64{"5xxRate": 0.2, "4xxRate": 0.6}) {
+		t.Error("Expected the nested or to be true")
+	}
+	if cond.IsTrue(map[string]float64{"5xxRate": 0.2, "4xxRate": 0.1, "ResponseTime": 100}) {
+		t.Error("Expected the and to be false if the nested or is false")
+	}
+	if cond.Metric != "unhealthy" {
+		t.Errorf("Expected the configured name to be kept, got %s", cond.Metric)
+	}
+}
+
+func Test_CompositeCondition_Invalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected an unknown operator to panic")
+		}
+	}()
+	NewCompositeCondition("xor", time.Second, 0, NewCondition("5xxRate", ">", 0.1, time.Second, 0))
+}
+
+func Test_ChangeCondition_Delta(t *testing.T) {
+	// 5xxRate increased by more than 0.05 compared to the previous window
+	cond := NewChangeCondition("5xxRate", ">", ChangeDelta, 0.05, time.Second, 0)
+
+	windows := []float64{0.01, 0.02, 0.1, 0.12, 0.12, 0.3}
+	expected := []bool{false, false, true, false, false, true}
+	for i, rate := range windows {
+		if got := cond.IsTrue(map[string]float64{"5xxRate": rate}); got != expected[i] {
+			t.Errorf("Expected window %d (%v) to be %v", i, rate, expected[i])
+		}
+	}
+}
+
+func Test_ChangeCondition_Percent(t *testing.T) {
+	// ResponseTime increased by more than 50%
+	cond := NewChangeCondition("ResponseTime", ">", ChangePercent, 50, time.Second, 0)
+
+	windows := []map[string]float64{
+		{"ResponseTime": 0},
+		{"ResponseTime": 100}, // no change in percent from 0
+		{},                    // missing windows are skipped
+		{"ResponseTime": 200},
+		{"ResponseTime": 250},
+		{"ResponseTime": 100},
+	}
+	expected := []bool{false, false, false, true, false, false}
+	for i, rates := range windows {
+		if got := cond.IsTrue(rates); got != expected[i] {
+			t.Errorf("Expected window %d (%v) to be %v", i, rates, expected[i])
+		}
+	}
+}
+
+func Test_ChangeCondition_Composite(t *testing.T) {
+	// the change of the second condition is tracked although the first is true
+	change := NewChangeCondition("ResponseTime", ">", ChangeDelta, 100, time.Second, 0)
+	cond := NewCompositeCondition(OperatorOr, time.Second, 0,
+		NewCondition("5xxRate", ">", 0.1, time.Second, 0), change)
+
+	cond.IsTrue(map[string]float64{"5xxRate": 0.2, "ResponseTime": 100})
+	cond.IsTrue(map[string]float64{"5xxRate": 0.2, "ResponseTime": 300})
+	if !cond.IsTrue(map[string]float64{"5xxRate": 0, "ResponseTime": 450}) {
+		t.Error("Expected the change since the previous window to be evaluated")
+	}
+	if err := (&Condition{Metric: "5xxRate", Operator: ">", Change: "ratio"}).Validate(); err == nil {
+		t.Error("Expected an unknown change to be rejected")
+	}
+}
+
+func Test_Condition_Source(t *testing.T) {
+	tests := map[string]bool{"": true, SourceBackend: true, SourceRoute: true, "client": false}
+	for source, valid := range tests {
+		cond := NewCondition("ErrorRate", "<", 0.1, time.Second, 0)
+		cond.Source = source
+		if err := cond.Validate(); (err == nil) != valid {
+			t.Errorf("Expected source %q to be valid: %t, got %v", source, valid, err)
+		}
+		if cond.IsRouteSource() != (source == SourceRoute) {
+			t.Errorf("Expected only source %q to use the metrics of the route", SourceRoute)
+		}
+	}
+
+	// the source of the conditions of a composite condition is validated
+	child := NewCondition("ErrorRate", "<", 0.1, time.Second, 0)
+	child.Source = "client"
+	if err := NewCompositeCondition(OperatorAnd, time.Second, 0, child).Validate(); err == nil {
+		t.Error("Expected an unknown source of a nested condition to be rejected")
+	}
+}
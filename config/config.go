@@ -8,6 +8,7 @@ import (
 
 	"github.com/creasty/defaults"
 	"github.com/rgumi/depoy/gateway"
+	"github.com/rgumi/depoy/route"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/dealancer/validate.v2"
@@ -16,8 +17,9 @@ import (
 // UnmarshalFunc implements the UnmarshalFunc interface
 type UnmarshalFunc func(data []byte, v interface{}) error
 
-// ParseFromBinary uses the provided unmarshalFunc to create a new gateway object from b
-func ParseFromBinary(unmarshal UnmarshalFunc, b []byte) (*gateway.Gateway, error) {
+// ParseInputGateway uses the provided unmarshalFunc to read the config of b.
+// The defaults of all routes are set
+func ParseInputGateway(unmarshal UnmarshalFunc, b []byte) (*InputGateway, error) {
 	var err error
 	existingGateway := NewInputeGateway()
 	err = unmarshal(b, existingGateway)
@@ -25,21 +27,38 @@ func ParseFromBinary(unmarshal UnmarshalFunc, b []byte) (*gateway.Gateway, error
 	if err != nil {
 		return nil, err
 	}
-	newGateway := ConvertInputGatewayToGateway(existingGateway)
 	for _, existingRoute := range existingGateway.Routes {
 		if err := defaults.Set(existingRoute); err != nil {
 			return nil, err
 		}
+	}
+	return existingGateway, nil
+}
 
-		log.Infof("Adding existing route %v to  new Gateway", existingRoute.Name)
-		newRoute, err := ConvertInputRouteToRoute(existingRoute)
+// ParseFromBinary uses the provided unmarshalFunc to create a new gateway object from b
+func ParseFromBinary(unmarshal UnmarshalFunc, b []byte) (*gateway.Gateway, error) {
+	existingGateway, err := ParseInputGateway(unmarshal, b)
+	if err != nil {
+		return nil, err
+	}
+	newGateway := ConvertInputGatewayToGateway(existingGateway)
+	for _, existingNotifier := range existingGateway.Notifiers {
+		notifier, err := ConvertInputNotifierToNotifier(existingNotifier)
 		if err != nil {
 			return nil, err
 		}
-		if err = existingRoute.Strategy.Validate(newRoute); err != nil {
+		newGateway.MetricsRepo.AddNotifier(notifier)
+	}
+	if existingGateway.StatsD != nil {
+		sink, err := ConvertInputStatsDToStatsDSink(existingGateway.StatsD)
+		if err != nil {
 			return nil, err
 		}
-		err = existingRoute.Strategy.Copy(newRoute)
+		newGateway.MetricsRepo.SetStatsD(sink)
+	}
+	for _, existingRoute := range existingGateway.Routes {
+		log.Infof("Adding existing route %v to  new Gateway", existingRoute.Name)
+		newRoute, err := buildRoute(existingRoute)
 		if err != nil {
 			return nil, err
 		}
@@ -55,6 +74,21 @@ func ParseFromBinary(unmarshal UnmarshalFunc, b []byte) (*gateway.Gateway, error
 	return newGateway, nil
 }
 
+// buildRoute creates the route of the config including its backends and strategy
+func buildRoute(existingRoute *InputRoute) (*route.Route, error) {
+	newRoute, err := ConvertInputRouteToRoute(existingRoute)
+	if err != nil {
+		return nil, err
+	}
+	if err = existingRoute.Strategy.Validate(newRoute); err != nil {
+		return nil, err
+	}
+	if err = existingRoute.Strategy.Copy(newRoute); err != nil {
+		return nil, err
+	}
+	return newRoute, nil
+}
+
 // LoadFromFile can be used at startup to read the config from a yaml-file
 func LoadFromFile(file string) *gateway.Gateway {
 	start := time.Now()
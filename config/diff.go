@@ -0,0 +1,466 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/creasty/defaults"
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/conditional"
+	"github.com/rgumi/depoy/gateway"
+	"github.com/rgumi/depoy/route"
+	"github.com/rgumi/depoy/router"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigDiff is the delta between two configs of a gateway
+type ConfigDiff struct {
+	// GatewayChanged is true if the settings of the gateway itself changed
+	// (e.g. addr, timeouts, notifiers) which requires a restart of the gateway
+	GatewayChanged bool          `json:"gateway_changed"`
+	AddedRoutes    []*InputRoute `json:"added_routes"`
+	RemovedRoutes  []string      `json:"removed_routes"`
+	ModifiedRoutes []*RouteDiff  `json:"modified_routes"`
+}
+
+// RouteDiff is the delta between two configs of a route. If the settings of
+// the route changed, the route is recreated. Otherwise only its backends are updated
+type RouteDiff struct {
+	Name             string           `json:"name"`
+	Route            *InputRoute      `json:"-"` // new config of the route
+	SettingsChanged  bool             `json:"settings_changed"`
+	AddedBackends    []*InputBackend  `json:"added_backends"`
+	RemovedBackends  []string         `json:"removed_backends"`
+	ModifiedBackends []*InputBackend  `json:"modified_backends"`
+	WeightChanges    map[string]uint8 `json:"weight_changes"` // new weight by backend name
+}
+
+// Empty returns true if the configs are equal
+func (d *ConfigDiff) Empty() bool {
+	return !d.GatewayChanged && len(d.AddedRoutes) == 0 && len(d.RemovedRoutes) == 0 && len(d.ModifiedRoutes) == 0
+}
+
+func (d *RouteDiff) empty() bool {
+	return !d.SettingsChanged && len(d.AddedBackends) == 0 && len(d.RemovedBackends) == 0 &&
+		len(d.ModifiedBackends) == 0 && len(d.WeightChanges) == 0
+}
+
+// Snapshot returns the current config of the gateway. Routes and backends
+// are sorted by name so that snapshots can be compared
+func Snapshot(g *gateway.Gateway) *InputGateway {
+	snapshot := ConvertGatewayToInputGateway(g)
+	sort.Slice(snapshot.Routes, func(i, j int) bool {
+		return snapshot.Routes[i].Name < snapshot.Routes[j].Name
+	})
+	for _, r := range snapshot.Routes {
+		sort.Slice(r.Backends, func(i, j int) bool {
+			return r.Backends[i].Name < r.Backends[j].Name
+		})
+	}
+	return snapshot
+}
+
+// Diff returns the changes which are required to get from the old to the new config.
+// Routes and backends are matched by name. The weight of a backend is compared
+// separately so that it can be changed without replacing the backend
+func Diff(oldConfig, newConfig *InputGateway) (*ConfigDiff, error) {
+	diff := new(ConfigDiff)
+	oldSettings, err := gatewaySettings(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := gatewaySettings(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	diff.GatewayChanged = !bytes.Equal(oldSettings, newSettings)
+
+	oldRoutes := make(map[string]*InputRoute, len(oldConfig.Routes))
+	for _, r := range oldConfig.Routes {
+		oldRoutes[r.Name] = r
+	}
+	newRoutes := make(map[string]bool, len(newConfig.Routes))
+	for _, newRoute := range newConfig.Routes {
+		newRoutes[newRoute.Name] = true
+		oldRoute, found := oldRoutes[newRoute.Name]
+		if !found {
+			diff.AddedRoutes = append(diff.AddedRoutes, newRoute)
+			continue
+		}
+		routeDiff, err := diffRoute(oldRoute, newRoute)
+		if err != nil {
+			return nil, err
+		}
+		if !routeDiff.empty() {
+			diff.ModifiedRoutes = append(diff.ModifiedRoutes, routeDiff)
+		}
+	}
+	for _, oldRoute := range oldConfig.Routes {
+		if !newRoutes[oldRoute.Name] {
+			diff.RemovedRoutes = append(diff.RemovedRoutes, oldRoute.Name)
+		}
+	}
+	return diff, nil
+}
+
+func diffRoute(oldRoute, newRoute *InputRoute) (*RouteDiff, error) {
+	diff := &RouteDiff{Name: newRoute.Name, Route: newRoute, WeightChanges: make(map[string]uint8)}
+	oldSettings, err := routeSettings(oldRoute)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := routeSettings(newRoute)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(oldSettings, newSettings) {
+		// the route is recreated including all of its backends
+		diff.SettingsChanged = true
+		return diff, nil
+	}
+
+	oldBackends := make(map[string]*InputBackend, len(oldRoute.Backends))
+	for _, b := range oldRoute.Backends {
+		oldBackends[b.Name] = b
+	}
+	newBackends := make(map[string]bool, len(newRoute.Backends))
+	for _, newBackend := range newRoute.Backends {
+		newBackends[newBackend.Name] = true
+		oldBackend, found := oldBackends[newBackend.Name]
+		if !found {
+			diff.AddedBackends = append(diff.AddedBackends, newBackend)
+			continue
+		}
+		oldSettings, err := backendSettings(oldBackend)
+		if err != nil {
+			return nil, err
+		}
+		newSettings, err := backendSettings(newBackend)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(oldSettings, newSettings) {
+			diff.ModifiedBackends = append(diff.ModifiedBackends, newBackend)
+		} else if oldBackend.Weigth != newBackend.Weigth {
+			diff.WeightChanges[newBackend.Name] = newBackend.Weigth
+		}
+	}
+	for _, oldBackend := range oldRoute.Backends {
+		if !newBackends[oldBackend.Name] {
+			diff.RemovedBackends = append(diff.RemovedBackends, oldBackend.Name)
+		}
+	}
+	return diff, nil
+}
+
+// gatewaySettings returns the comparable config of the gateway without its routes
+func gatewaySettings(g *InputGateway) ([]byte, error) {
+	settings := *g
+	settings.Routes = nil
+	settings.Notifiers = make([]*InputNotifier, len(g.Notifiers))
+	for i, n := range g.Notifiers {
+		notifier := *n
+		defaults.Set(&notifier)
+		settings.Notifiers[i] = &notifier
+	}
+	if g.StatsD != nil {
+		statsD := *g.StatsD
+		defaults.Set(&statsD)
+		settings.StatsD = &statsD
+	}
+	return json.Marshal(settings)
+}
+
+// routeSettings returns the comparable config of the route without its backends
+// and with the defaults which are set when the route is created
+func routeSettings(r *InputRoute) ([]byte, error) {
+	settings := *r
+	settings.Backends = nil
+	settings.Switchover = nil
+	if settings.CookieName == "" {
+		settings.CookieName = route.DefaultCookieName(r.Name)
+	}
+	healthCheck := r.HealthCheck == nil || *r.HealthCheck
+	settings.HealthCheck = &healthCheck
+	if r.AdaptiveTimeout != nil {
+		adaptiveTimeout := *r.AdaptiveTimeout
+		defaults.Set(&adaptiveTimeout)
+		settings.AdaptiveTimeout = &adaptiveTimeout
+	}
+	if r.OutlierDetection != nil {
+		outlierDetection := *r.OutlierDetection
+		defaults.Set(&outlierDetection)
+		settings.OutlierDetection = &outlierDetection
+	}
+	if r.AdaptiveWeights != nil {
+		adaptiveWeights := *r.AdaptiveWeights
+		defaults.Set(&adaptiveWeights)
+		settings.AdaptiveWeights = &adaptiveWeights
+	}
+	if r.Fallback != nil {
+		fallback := *r.Fallback
+		defaults.Set(&fallback)
+		settings.Fallback = &fallback
+	}
+	if r.AccessLog != nil {
+		// the access log cannot be copied. Its defaults are set as on creation
+		defaults.Set(r.AccessLog)
+	}
+	if r.CanaryRule != nil {
+		canaryRule := *r.CanaryRule
+		defaults.Set(&canaryRule)
+		settings.CanaryRule = &canaryRule
+	}
+	return json.Marshal(settings)
+}
+
+// backendSettings returns the comparable config of the backend without
+// its state, weight and the condition which is added by the healthcheck
+func backendSettings(b *InputBackend) ([]byte, error) {
+	settings := *b
+	settings.ID = uuid.Nil
+	settings.Weigth = 0
+	settings.Active = false
+	settings.ActiveAlerts = nil
+	// the healthcheck url defaults to the root of the addr
+	if healthcheckURL, err := url.Parse(b.Healthcheckurl); err == nil && healthcheckURL.Host == "" {
+		if addr, err := url.Parse(b.Addr); err == nil {
+			settings.Healthcheckurl = addr.Scheme + "://" + addr.Host + "/"
+		}
+	}
+	settings.Metricthresholds = nil
+	for _, cond := range b.Metricthresholds {
+		if !route.IsHealthCheckCondition(cond) {
+			settings.Metricthresholds = append(settings.Metricthresholds, conditionSettings(cond))
+		}
+	}
+	return json.Marshal(settings)
+}
+
+func conditionSettings(cond *conditional.Condition) *conditional.Condition {
+	settings := &conditional.Condition{
+		Metric:    cond.Metric,
+		Source:    cond.Source,
+		Operator:  cond.Operator,
+		Threshold: cond.Threshold,
+		Change:    cond.Change,
+		ActiveFor: cond.ActiveFor,
+		ResolveIn: cond.ResolveIn,
+	}
+	for _, child := range cond.Conditions {
+		settings.Conditions = append(settings.Conditions, conditionSettings(child))
+	}
+	return settings
+}
+
+// ApplyDiff changes the routes of the running gateway according to the diff.
+// Unchanged routes and backends keep their metrics and connections. All new
+// routes and backends are created and the changes are checked before the gateway
+// is changed so that an invalid config does not change the gateway. Changes of the gateway settings
+// cannot be applied and require a new gateway
+func ApplyDiff(g *gateway.Gateway, diff *ConfigDiff) error {
+	if diff.GatewayChanged {
+		return fmt.Errorf("Changes of the gateway settings cannot be applied to a running gateway")
+	}
+
+	newRoutes := make(map[string]*route.Route)
+	deleteNewRoutes := func() {
+		for _, newRoute := range newRoutes {
+			newRoute.Delete()
+		}
+	}
+	newBackends := make(map[string][]*route.Backend)
+	for _, inputRoute := range diff.AddedRoutes {
+		newRoute, err := buildRoute(inputRoute)
+		if err != nil {
+			deleteNewRoutes()
+			return err
+		}
+		newRoutes[inputRoute.Name] = newRoute
+	}
+	for _, routeDiff := range diff.ModifiedRoutes {
+		if g.GetRoute(routeDiff.Name) == nil {
+			deleteNewRoutes()
+			return fmt.Errorf("Route %s does not exist", routeDiff.Name)
+		}
+		if routeDiff.SettingsChanged {
+			newRoute, err := buildRoute(routeDiff.Route)
+			if err != nil {
+				deleteNewRoutes()
+				return err
+			}
+			newRoutes[routeDiff.Name] = newRoute
+			continue
+		}
+		for _, inputBackend := range append(routeDiff.AddedBackends, routeDiff.ModifiedBackends...) {
+			newBackend, err := buildBackend(routeDiff.Name, inputBackend)
+			if err != nil {
+				deleteNewRoutes()
+				return err
+			}
+			newBackends[routeDiff.Name] = append(newBackends[routeDiff.Name], newBackend)
+		}
+	}
+
+	if err := checkDiff(g, diff, newRoutes); err != nil {
+		deleteNewRoutes()
+		return err
+	}
+
+	for _, name := range diff.RemovedRoutes {
+		log.Warnf("Removing route %s as it is not part of the new config", name)
+		g.RemoveRoute(name)
+	}
+	for _, routeDiff := range diff.ModifiedRoutes {
+		if routeDiff.SettingsChanged {
+			log.Warnf("Recreating route %s as its settings changed", routeDiff.Name)
+			g.RemoveRoute(routeDiff.Name)
+			continue
+		}
+		if err := applyBackendChanges(g.GetRoute(routeDiff.Name), routeDiff, newBackends[routeDiff.Name]); err != nil {
+			deleteNewRoutes()
+			return err
+		}
+	}
+	for name, newRoute := range newRoutes {
+		if err := g.RegisterRoute(newRoute); err != nil {
+			deleteNewRoutes()
+			return fmt.Errorf("Failed to register route %s: %v", name, err)
+		}
+		// registered routes are deleted by the gateway
+		delete(newRoutes, name)
+		newRoute.Reload()
+	}
+	g.Reload()
+	return nil
+}
+
+// checkDiff returns an error if the diff cannot be applied to the gateway, e.g. if a
+// removed backend is part of a switchover or a new route conflicts with a kept route
+func checkDiff(g *gateway.Gateway, diff *ConfigDiff, newRoutes map[string]*route.Route) error {
+	if g.MetricsRepo == nil {
+		return fmt.Errorf("Gateway MetricsRepo is nil")
+	}
+	replaced := make(map[string]bool, len(diff.RemovedRoutes)+len(newRoutes))
+	for _, name := range diff.RemovedRoutes {
+		replaced[name] = true
+	}
+	for _, routeDiff := range diff.ModifiedRoutes {
+		if routeDiff.SettingsChanged {
+			replaced[routeDiff.Name] = true
+			continue
+		}
+		if err := checkBackendChanges(g.GetRoute(routeDiff.Name), routeDiff); err != nil {
+			return err
+		}
+	}
+
+	routes := []*route.Route{}
+	for name, existingRoute := range g.Routes {
+		if !replaced[name] {
+			routes = append(routes, existingRoute)
+		}
+	}
+	for name, newRoute := range newRoutes {
+		for _, other := range routes {
+			if other.Name == name {
+				return fmt.Errorf("Route with name %s already exists", name)
+			}
+			if other.Prefix == newRoute.Prefix && other.Host == newRoute.Host &&
+				router.CanonicalQuery(other.Query) == router.CanonicalQuery(newRoute.Query) {
+				return fmt.Errorf("Route %s has the same prefix (%s), host (%s) and query as %s",
+					name, newRoute.Prefix, newRoute.Host, other.Name)
+			}
+		}
+		routes = append(routes, newRoute)
+	}
+	return nil
+}
+
+// checkBackendChanges returns an error if the backend changes of the diff cannot be
+// applied to the route (see applyBackendChanges)
+func checkBackendChanges(r *route.Route, diff *RouteDiff) error {
+	existing := make(map[string]*route.Backend, len(r.Backends))
+	for _, backend := range r.Backends {
+		existing[backend.Name] = backend
+	}
+	switchover := r.CurrentSwitchover()
+
+	removed := append([]string{}, diff.RemovedBackends...)
+	for _, modified := range diff.ModifiedBackends {
+		removed = append(removed, modified.Name)
+	}
+	for _, name := range removed {
+		backend, found := existing[name]
+		if !found {
+			return fmt.Errorf("Backend %s of %s does not exist", name, r.Name)
+		}
+		if switchover != nil && (switchover.From.ID == backend.ID || switchover.To.ID == backend.ID) {
+			return fmt.Errorf("Cannot remove backend %s of %s with switchover %d associated with it",
+				name, r.Name, switchover.ID)
+		}
+	}
+	for _, added := range diff.AddedBackends {
+		if _, found := existing[added.Name]; found {
+			return fmt.Errorf("Backend %s of %s already exists", added.Name, r.Name)
+		}
+	}
+	for name := range diff.WeightChanges {
+		if _, found := existing[name]; !found {
+			return fmt.Errorf("Backend %s of %s does not exist", name, r.Name)
+		}
+	}
+	return nil
+}
+
+// buildBackend creates the backend of the config
+func buildBackend(routeName string, inputBackend *InputBackend) (*route.Backend, error) {
+	for _, cond := range inputBackend.Metricthresholds {
+		cond.Compile()
+	}
+	newBackend, err := ConvertInputBackendToBackend(inputBackend)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backend %s of %s: %v", inputBackend.Name, routeName, err)
+	}
+	return newBackend, nil
+}
+
+// applyBackendChanges replaces the removed and modified backends of the route
+// with the new backends and updates the weights of the unchanged backends
+func applyBackendChanges(r *route.Route, diff *RouteDiff, newBackends []*route.Backend) error {
+	existingIDs := make(map[string]uuid.UUID, len(r.Backends))
+	for id, backend := range r.Backends {
+		existingIDs[backend.Name] = id
+	}
+	for _, name := range diff.RemovedBackends {
+		if err := r.RemoveBackend(existingIDs[name]); err != nil {
+			return err
+		}
+	}
+	for _, modified := range diff.ModifiedBackends {
+		if err := r.RemoveBackend(existingIDs[modified.Name]); err != nil {
+			return err
+		}
+	}
+	for _, newBackend := range newBackends {
+		if newBackend.ID == uuid.Nil {
+			// a modified backend keeps its ID
+			newBackend.ID = existingIDs[newBackend.Name]
+		}
+		if _, err := r.AddExistingBackend(newBackend); err != nil {
+			return err
+		}
+	}
+	for name, weight := range diff.WeightChanges {
+		if err := r.UpdateBackendWeight(existingIDs[name], weight); err != nil {
+			return err
+		}
+	}
+	if len(newBackends) > 0 {
+		r.Reload()
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/gateway"
+	"github.com/rgumi/depoy/route"
+)
+
+// testConfig returns the JSON config of a gateway. Each route is given as
+// name:prefix and each backend as name=weight
+func testConfig(routes map[string][]string) []byte {
+	inputRoutes := []string{}
+	for r, backends := range routes {
+		parts := strings.SplitN(r, ":", 2)
+		inputBackends := []string{}
+		for _, b := range backends {
+			var name string
+			var weight int
+			fmt.Sscanf(strings.Replace(b, "=", " ", 1), "%s %d", &name, &weight)
+			inputBackends = append(inputBackends, fmt.Sprintf(
+				`{"name": %q, "addr": "http://127.0.0.1:9999", "weight": %d}`, name, weight))
+		}
+		inputRoutes = append(inputRoutes, fmt.Sprintf(
+			`{"name": %q, "prefix": %q, "rewrite": "/", "healthcheck_bool": false,
+			"strategy": {"type": "canary"}, "backends": [%s]}`,
+			parts[0], parts[1], strings.Join(inputBackends, ",")))
+	}
+	return []byte(fmt.Sprintf(`{"addr": ":0", "routes": [%s]}`, strings.Join(inputRoutes, ",")))
+}
+
+func parseTestConfig(t *testing.T, routes map[string][]string) *InputGateway {
+	inputGateway, err := ParseInputGateway(json.Unmarshal, testConfig(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inputGateway
+}
+
+func newTestGateway(t *testing.T, routes map[string][]string) *gateway.Gateway {
+	g, err := ParseFromBinary(json.Unmarshal, testConfig(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func testBackend(r *route.Route, name string) *route.Backend {
+	for _, backend := range r.Backends {
+		if backend.Name == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+func Test_Diff_Unchanged(t *testing.T) {
+	routes := map[string][]string{"a:/a/": {"v1=80", "v2=20"}, "b:/b/": {"v1=100"}}
+	g := newTestGateway(t, routes)
+	defer g.Shutdown(context.Background())
+
+	diff, err := Diff(Snapshot(g), parseTestConfig(t, routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("Expected the snapshot to equal its config, got %+v", diff)
+	}
+}
+
+func Test_Diff(t *testing.T) {
+	old := parseTestConfig(t, map[string][]string{
+		"a:/a/": {"v1=80", "v2=20"}, "b:/b/": {"v1=100"}, "c:/c/": {"v1=100"},
+	})
+	newConfig := parseTestConfig(t, map[string][]string{
+		"a:/a/": {"v1=50", "v3=50"}, "b:/bb/": {"v1=100"}, "d:/d/": {"v1=100"},
+	})
+	diff, err := Diff(old, newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.GatewayChanged {
+		t.Error("Expected the gateway to be unchanged")
+	}
+	if len(diff.AddedRoutes) != 1 || diff.AddedRoutes[0].Name != "d" {
+		t.Errorf("Expected route d to be added, got %+v", diff.AddedRoutes)
+	}
+	if len(diff.RemovedRoutes) != 1 || diff.RemovedRoutes[0] != "c" {
+		t.Errorf("Expected route c to be removed, got %v", diff.RemovedRoutes)
+	}
+	if len(diff.ModifiedRoutes) != 2 {
+		t.Fatalf("Expected routes a and b to be modified, got %+v", diff.ModifiedRoutes)
+	}
+	for _, routeDiff := range diff.ModifiedRoutes {
+		switch routeDiff.Name {
+		case "a":
+			if routeDiff.SettingsChanged || len(routeDiff.ModifiedBackends) != 0 {
+				t.Errorf("Expected only the backends of a to change, got %+v", routeDiff)
+			}
+			if len(routeDiff.AddedBackends) != 1 || routeDiff.AddedBackends[0].Name != "v3" {
+				t.Errorf("Expected v3 to be added, got %+v", routeDiff.AddedBackends)
+			}
+			if len(routeDiff.RemovedBackends) != 1 || routeDiff.RemovedBackends[0] != "v2" {
+				t.Errorf("Expected v2 to be removed, got %v", routeDiff.RemovedBackends)
+			}
+			if len(routeDiff.WeightChanges) != 1 || routeDiff.WeightChanges["v1"] != 50 {
+				t.Errorf("Expected the weight of v1 to change, got %v", routeDiff.WeightChanges)
+			}
+		case "b":
+			if !routeDiff.SettingsChanged {
+				t.Errorf("Expected the prefix of b to change the settings, got %+v", routeDiff)
+			}
+		}
+	}
+
+	newConfig.Addr = ":1"
+	if diff, _ = Diff(old, newConfig); !diff.GatewayChanged {
+		t.Error("Expected the changed addr to change the gateway")
+	}
+}
+
+func Test_ApplyDiff(t *testing.T) {
+	g := newTestGateway(t, map[string][]string{
+		"a:/a/": {"v1=80", "v2=20"}, "c:/c/": {"v1=100"},
+	})
+	defer g.Shutdown(context.Background())
+	a := g.GetRoute("a")
+	v1 := testBackend(a, "v1")
+
+	diff, err := Diff(Snapshot(g), parseTestConfig(t, map[string][]string{
+		"a:/a/": {"v1=50", "v3=50"}, "d:/d/": {"v1=100"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ApplyDiff(g, diff); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.GetRoute("a") != a {
+		t.Error("Expected route a to be kept")
+	}
+	if testBackend(a, "v1") != v1 || v1.Weigth != 50 {
+		t.Errorf("Expected v1 to be kept with the new weight, got %+v", testBackend(a, "v1"))
+	}
+	if testBackend(a, "v2") != nil || testBackend(a, "v3") == nil {
+		t.Error("Expected v2 to be replaced by v3")
+	}
+	if g.GetRoute("c") != nil || g.GetRoute("d") == nil {
+		t.Error("Expected route c to be replaced by d")
+	}
+	if _, found := g.MetricsRepo.Backends[v1.ID]; !found {
+		t.Error("Expected the monitoring of v1 to be kept")
+	}
+
+	if diff, _ = Diff(Snapshot(g), parseTestConfig(t, map[string][]string{
+		"a:/a/": {"v1=50", "v3=50"}, "d:/d/": {"v1=100"},
+	})); !diff.Empty() {
+		t.Errorf("Expected the gateway to match the applied config, got %+v", diff)
+	}
+}
+
+func Test_ApplyDiff_InvalidConfig(t *testing.T) {
+	g := newTestGateway(t, map[string][]string{"a:/a/": {"v1=100"}})
+	defer g.Shutdown(context.Background())
+
+	newConfig := parseTestConfig(t, map[string][]string{"a:/a/": {"v1=100", "v2=0"}, "d:/d/": {"v1=100"}})
+	for _, r := range newConfig.Routes {
+		if r.Name == "a" {
+			r.Backends[1].Addr = "http://%zz"
+		}
+	}
+	diff, err := Diff(Snapshot(g), newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ApplyDiff(g, diff); err == nil {
+		t.Fatal("Expected the invalid backend to be rejected")
+	}
+	if g.GetRoute("d") != nil || len(g.GetRoute("a").Backends) != 1 {
+		t.Error("Expected the gateway to be unchanged")
+	}
+}
+
+func Test_ApplyDiff_SwitchoverBackend(t *testing.T) {
+	g := newTestGateway(t, map[string][]string{"a:/a/": {"v1=100", "v2=0"}, "c:/c/": {"v1=100"}})
+	defer g.Shutdown(context.Background())
+	a := g.GetRoute("a")
+	if _, err := a.StartSwitchOver("v1", "v2", nil, time.Hour, 0, 0, 10, nil, nil,
+		false, false, false, 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 cannot be removed as it is part of the switchover
+	diff, err := Diff(Snapshot(g), parseTestConfig(t, map[string][]string{
+		"a:/a/": {"v1=100"}, "d:/d/": {"v1=100"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ApplyDiff(g, diff); err == nil {
+		t.Fatal("Expected the removal of the switchover backend to be rejected")
+	}
+	if g.GetRoute("c") == nil || g.GetRoute("d") != nil {
+		t.Error("Expected the routes of the gateway to be unchanged")
+	}
+	if testBackend(a, "v2") == nil || a.CurrentSwitchover() == nil {
+		t.Error("Expected route a to keep its backends and switchover")
+	}
+}
@@ -2,7 +2,12 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/rgumi/depoy/metrics"
 )
 
 /*
@@ -14,11 +19,24 @@ var (
 	PersistConfigOnExit bool
 	ConfigFile          string
 	LogLevel            int
+	// DrainGracePeriod is the maximal duration the Gateway waits for in-flight
+	// requests to finish after receiving SIGTERM
+	DrainGracePeriod time.Duration
+	// SwitchoverStateFile is the file in which the state of the active switchovers
+	// is persisted so that they are resumed after a restart (empty = disabled)
+	SwitchoverStateFile     string
+	SwitchoverStateInterval time.Duration
 	// gateway
 	GatewayAddr  string
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
+	// MaxRequestsPerConn, MaxConnsPerIP, MaxHeaderBytes and DisableKeepalive
+	// configure the connections of downstream clients. 0 means unlimited
+	MaxRequestsPerConn int
+	MaxConnsPerIP      int
+	MaxHeaderBytes     int
+	DisableKeepalive   bool
 	// metrics
 	// MetricsChannelPuffersize defines the maximal puffer size of the
 	// Metric Channel. This can be increased by there are too many concurrent
@@ -27,10 +45,30 @@ var (
 	// ScrapeMetricsChannelPuffersize defines the maximal puffer size of
 	// the Scrape Metric Channel. This should never be a problem
 	ScrapeMetricsChannelPuffersize int
+	// MetricsChannelPolicy defines if requests wait for space in the Metric Channel
+	// (block) or if their metrics are dropped (drop) once it is full
+	MetricsChannelPolicy string
 	// Granulartiy defines the granularity of the metrics that are evaluated
 	// in the Monitoring-Job. The higher the value, the more historic data will be used
 	Granulartiy     time.Duration
 	RetentionPeriod time.Duration
+	// MaxBuckets is the maximal number of metrics which are stored per backend
+	// in memory. Older metrics are evicted first
+	MaxBuckets int
+	// ScrapeTimeout is the time after which a scrape of a backend is cancelled
+	ScrapeTimeout time.Duration
+	// ScrapeErrorThreshold is the number of consecutive failed scrapes of a
+	// backend after which a ScrapeError alert is sent
+	ScrapeErrorThreshold int
+	// ResponseTimeBuckets are the comma-separated upper bounds of the buckets of
+	// the response time histogram in milliseconds
+	ResponseTimeBuckets string
+	// InfluxDB is used as storage of the metrics if InfluxDBURL is set.
+	// Otherwise the metrics are stored in memory
+	InfluxDBURL    string
+	InfluxDBOrg    string
+	InfluxDBBucket string
+	InfluxDBToken  string
 )
 
 func init() {
@@ -38,15 +76,44 @@ func init() {
 	flag.BoolVar(&PersistConfigOnExit, "global.persistconfig", true, "defines if configs of gateway are stored on exit")
 	flag.StringVar(&ConfigFile, "global.configfile", "", "configfile to get and store config of gateway")
 	flag.IntVar(&LogLevel, "global.loglevel", 3, "loglevel of the application (default=warn)")
+	flag.DurationVar(&DrainGracePeriod, "global.drainGracePeriod", 30*time.Second, "time to wait for in-flight requests on SIGTERM before shutting down")
+	flag.StringVar(&SwitchoverStateFile, "global.switchoverStateFile", "", "file to persist active switchovers to and resume them from on startup")
+	flag.DurationVar(&SwitchoverStateInterval, "global.switchoverStateInterval", 10*time.Second, "interval in which the active switchovers are persisted")
 	// gateway defaults (overwritten by configfile)
 	flag.StringVar(&GatewayAddr, "gateway.addr", ":8080", "The address that the gateway listens on (overwritten by configfile)")
 	ReadTimeout = time.Duration(*flag.Int("gateway.readtimeout", 5, "read timeout of in seconds (overwritten by configfile)")) * time.Second
 	WriteTimeout = time.Duration(*flag.Int("gateway.writeTimeout", 5, "write timeout in seconds (overwritten by configfile)")) * time.Second
 	IdleTimeout = time.Duration(*flag.Int("gateway.idleTimeout", 30, "write timeout in seconds (overwritten by configfile)")) * time.Second
+	flag.IntVar(&MaxRequestsPerConn, "gateway.maxRequestsPerConn", 0, "maximal number of requests per client connection (overwritten by configfile)")
+	flag.IntVar(&MaxConnsPerIP, "gateway.maxConnsPerIP", 0, "maximal number of concurrent connections per client ip (overwritten by configfile)")
+	flag.IntVar(&MaxHeaderBytes, "gateway.maxHeaderBytes", 0, "maximal size of request headers in bytes (overwritten by configfile)")
+	flag.BoolVar(&DisableKeepalive, "gateway.disableKeepalive", false, "close client connections after each response (overwritten by configfile)")
 	// metrics defaults
 	flag.IntVar(&MetricsChannelPuffersize, "metrics.metricsPuffersize", 200, "Size of the puffer for the metric channel")
 	flag.IntVar(&ScrapeMetricsChannelPuffersize, "metrics.scrapePuffersize", 50, "Size of the puffer for the scrapeMetric channel")
+	flag.StringVar(&MetricsChannelPolicy, "metrics.channelPolicy", metrics.ChannelPolicyDrop, "handling of metrics if the metric channel is full (block or drop)")
 	RetentionPeriod = time.Duration(*flag.Int("metrics.retentionPeriod", 5, "number of minutes after a collected metric is deleted")) * time.Minute
 	Granulartiy = time.Duration(*flag.Int("metrics.granulartiy", 5, "number of second that define the granularity of stored metrics")) * time.Second
+	flag.IntVar(&MaxBuckets, "metrics.maxBuckets", 0, "maximal number of stored metrics per backend (default unlimited)")
+	flag.DurationVar(&ScrapeTimeout, "metrics.scrapeTimeout", metrics.DefaultScrapeTimeout, "time after which a scrape of a backend is cancelled")
+	flag.IntVar(&ScrapeErrorThreshold, "metrics.scrapeErrorThreshold", metrics.DefaultScrapeErrorThreshold, "consecutive failed scrapes of a backend before an alert is sent (0 disables the alert)")
+	flag.StringVar(&ResponseTimeBuckets, "metrics.responseTimeBuckets", "", "comma-separated buckets of the response time histogram in ms (default 5,10,25,50,100,250,500,1000,2500,5000,10000)")
+	flag.StringVar(&InfluxDBURL, "metrics.influxdb.url", "", "url of the InfluxDB which stores the metrics (default in-memory storage)")
+	flag.StringVar(&InfluxDBOrg, "metrics.influxdb.org", "", "organization of the InfluxDB bucket")
+	flag.StringVar(&InfluxDBBucket, "metrics.influxdb.bucket", "depoy", "bucket of the InfluxDB which stores the metrics")
+	flag.StringVar(&InfluxDBToken, "metrics.influxdb.token", "", "API token of the InfluxDB (default env INFLUXDB_TOKEN)")
+
+}
 
+// ParseBuckets parses the comma-separated buckets of a histogram
+func ParseBuckets(s string) ([]float64, error) {
+	buckets := []float64{}
+	for _, bucket := range strings.Split(s, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(bucket), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bucket %q of histogram is not a number", bucket)
+		}
+		buckets = append(buckets, value)
+	}
+	return buckets, nil
 }
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/creasty/defaults"
 	"github.com/google/uuid"
@@ -15,50 +17,148 @@ import (
 )
 
 type InputBackend struct {
-	ID               uuid.UUID                `json:"id" yaml:"id" validate:"empty=false"`
-	Name             string                   `json:"name" yaml:"name" validate:"empty=false"`
-	Addr             string                   `json:"addr" yaml:"addr"`
-	Weigth           uint8                    `json:"weight" yaml:"weight"`
-	Active           bool                     `json:"active" yaml:"active"`
-	Scrapeurl        string                   `json:"scrape_url" yaml:"scrapeUrl"`
-	Scrapemetrics    []string                 `json:"scrape_metrics" yaml:"scrapeMetrics"`
-	Metricthresholds []*conditional.Condition `json:"metric_thresholds" yaml:"metricThresholds"`
-	Healthcheckurl   string                   `json:"healthcheck_url" yaml:"healthcheckUrl"`
-	ActiveAlerts     map[string]metrics.Alert `json:"active_alerts" yaml:"-"`
+	ID                 uuid.UUID                `json:"id" yaml:"id" validate:"empty=false"`
+	Name               string                   `json:"name" yaml:"name" validate:"empty=false"`
+	Addr               string                   `json:"addr" yaml:"addr"`
+	Weigth             uint8                    `json:"weight" yaml:"weight"`
+	Active             bool                     `json:"active" yaml:"active"`
+	Scrapeurl          string                   `json:"scrape_url" yaml:"scrapeUrl"`
+	Scrapemetrics      []string                 `json:"scrape_metrics" yaml:"scrapeMetrics"`
+	ScrapeFormat       string                   `json:"scrape_format,omitempty" yaml:"scrapeFormat,omitempty"`
+	ScrapeAuth         *metrics.ScrapeAuth      `json:"scrape_auth,omitempty" yaml:"scrapeAuth,omitempty"`
+	ScrapeInterval     util.ConfigDuration      `json:"scrape_interval" yaml:"scrapeInterval"`
+	Metricthresholds   []*conditional.Condition `json:"metric_thresholds" yaml:"metricThresholds"`
+	Healthcheckurl     string                   `json:"healthcheck_url" yaml:"healthcheckUrl"`
+	Timeout            util.ConfigDuration      `json:"timeout" yaml:"timeout"`
+	HealthCheckTimeout util.ConfigDuration      `json:"healthcheck_timeout" yaml:"healthcheckTimeout"`
+	HealthCheckProbe   *route.Probe             `json:"healthcheck_probe,omitempty" yaml:"healthcheckProbe,omitempty"`
+	MonitoringWindow   util.ConfigDuration      `json:"monitoring_window" yaml:"monitoringWindow"`
+	Transport          *route.Transport         `json:"transport,omitempty" yaml:"transport,omitempty"`
+	ActiveAlerts       map[string]metrics.Alert `json:"active_alerts" yaml:"-"`
 }
 
 type InputGateway struct {
-	Addr         string              `yaml:"addr" json:"addr" default:":8080"`
-	ReadTimeout  util.ConfigDuration `yaml:"read_timeout" json:"readTimeout" default:"\"5s\""`
-	WriteTimeout util.ConfigDuration `yaml:"write_timeout" json:"writeTimeout" default:"\"5s\""`
-	IdleTimeout  util.ConfigDuration `yaml:"idle_timeout" json:"idleTimeout" default:"\"10s\""`
-	Routes       []*InputRoute       `yaml:"routes" json:"routes"`
+	Addr               string              `yaml:"addr" json:"addr" default:":8080"`
+	ReadTimeout        util.ConfigDuration `yaml:"read_timeout" json:"readTimeout" default:"\"5s\""`
+	WriteTimeout       util.ConfigDuration `yaml:"write_timeout" json:"writeTimeout" default:"\"5s\""`
+	IdleTimeout        util.ConfigDuration `yaml:"idle_timeout" json:"idleTimeout" default:"\"10s\""`
+	MaxRequestsPerConn int                 `yaml:"max_requests_per_conn" json:"maxRequestsPerConn"`
+	MaxConnsPerIP      int                 `yaml:"max_conns_per_ip" json:"maxConnsPerIP"`
+	MaxHeaderBytes     int                 `yaml:"max_header_bytes" json:"maxHeaderBytes"`
+	DisableKeepalive   bool                `yaml:"disable_keepalive" json:"disableKeepalive"`
+	JSONErrors         bool                `yaml:"json_errors,omitempty" json:"jsonErrors,omitempty"`
+	Routes             []*InputRoute       `yaml:"routes" json:"routes"`
+	Notifiers          []*InputNotifier    `yaml:"notifiers,omitempty" json:"notifiers,omitempty"`
+	StatsD             *InputStatsD        `yaml:"statsd,omitempty" json:"statsd,omitempty"`
+}
+
+// InputStatsD configures the StatsD server which receives the metrics of every request
+type InputStatsD struct {
+	Addr       string  `yaml:"addr" json:"addr"`
+	Prefix     string  `yaml:"prefix" json:"prefix" default:"depoy"`
+	SampleRate float64 `yaml:"sample_rate" json:"sampleRate" default:"1"`
+}
+
+// InputNotifier configures a notifier which receives the alerts of all backends
+type InputNotifier struct {
+	Type     string              `yaml:"type" json:"type" default:"webhook"`
+	URL      string              `yaml:"url" json:"url"`
+	Template string              `yaml:"template,omitempty" json:"template,omitempty"`
+	Retries  int                 `yaml:"retries" json:"retries" default:"3"`
+	Backoff  util.ConfigDuration `yaml:"backoff" json:"backoff" default:"\"1s\""`
+	Debounce util.ConfigDuration `yaml:"debounce" json:"debounce"` // only used by slack
 }
 
 type InputRoute struct {
-	Name                string              `json:"name" yaml:"name" validate:"empty=false"`
-	Prefix              string              `json:"prefix" yaml:"prefix" validate:"empty=false"`
-	Methods             []string            `json:"methods" yaml:"methods" default:"[\"GET\", \"POST\", \"PUT\", \"DELETE\", \"PATCH\", \"HEAD\", \"OPTIONS\", \"TRACE\"]"`
-	Host                string              `json:"host" yaml:"host" default:"*"`
-	Rewrite             string              `json:"rewrite" yaml:"rewrite" validate:"empty=false"`
-	CookieTTL           util.ConfigDuration `json:"cookie_ttl" yaml:"cookieTTL"`
-	Strategy            *route.Strategy     `json:"strategy" yaml:"strategy" validate:"nil=false"`
-	Switchover          *InputSwitchover    `json:"switchover" yaml:"-"`
-	HealthCheck         *bool               `json:"healthcheck_bool" yaml:"healthcheckBool"`
-	HealthCheckInterval util.ConfigDuration `json:"healthcheck_interval" yaml:"healthcheckInterval" default:"\"5s\""`
-	MonitoringInterval  util.ConfigDuration `json:"monitoring_interval" yaml:"monitoringInterval" default:"\"5s\""`
-	ReadTimeout         util.ConfigDuration `json:"read_timeout" yaml:"readTimeout" default:"\"5s\""`
-	WriteTimeout        util.ConfigDuration `json:"write_timeout" yaml:"writeTimeout" default:"\"5s\""`
-	IdleTimeout         util.ConfigDuration `json:"idle_timeout" yaml:"idleTimeout" default:"\"5s\""`
-	ScrapeInterval      util.ConfigDuration `json:"scrape_interval" yaml:"scrapeInterval" default:"\"5s\""`
-	Proxy               string              `json:"proxy" yaml:"proxy"`
-	Backends            []*InputBackend     `json:"backends" yaml:"backends"`
+	Name                string                `json:"name" yaml:"name" validate:"empty=false"`
+	Prefix              string                `json:"prefix" yaml:"prefix" validate:"empty=false"`
+	Methods             []string              `json:"methods" yaml:"methods" default:"[\"GET\", \"POST\", \"PUT\", \"DELETE\", \"PATCH\", \"HEAD\", \"OPTIONS\", \"TRACE\"]"`
+	Host                string                `json:"host" yaml:"host" default:"*"`
+	Rewrite             string                `json:"rewrite" yaml:"rewrite" validate:"empty=false"`
+	StripPrefix         bool                  `json:"strip_prefix" yaml:"stripPrefix"`
+	Query               map[string]string     `json:"query,omitempty" yaml:"query,omitempty"`
+	CookieTTL           util.ConfigDuration   `json:"cookie_ttl" yaml:"cookieTTL"`
+	CookieName          string                `json:"cookie_name,omitempty" yaml:"cookieName,omitempty"`
+	SessionKeyEnv       string                `json:"session_key_env,omitempty" yaml:"sessionKeyEnv,omitempty"` // env variable which contains the key of the session cookie
+	Strategy            *route.Strategy       `json:"strategy" yaml:"strategy" validate:"nil=false"`
+	Switchover          *InputSwitchover      `json:"switchover" yaml:"-"`
+	HealthCheck         *bool                 `json:"healthcheck_bool" yaml:"healthcheckBool"`
+	HealthCheckInterval util.ConfigDuration   `json:"healthcheck_interval" yaml:"healthcheckInterval" default:"\"5s\""`
+	HealthyThreshold    int                   `json:"healthy_threshold" yaml:"healthyThreshold" default:"1"`
+	UnhealthyThreshold  int                   `json:"unhealthy_threshold" yaml:"unhealthyThreshold" default:"1"`
+	HealthCheckJitter   float64               `json:"healthcheck_jitter" yaml:"healthcheckJitter"`
+	MonitoringInterval  util.ConfigDuration   `json:"monitoring_interval" yaml:"monitoringInterval" default:"\"5s\""`
+	ReadTimeout         util.ConfigDuration   `json:"read_timeout" yaml:"readTimeout" default:"\"5s\""`
+	WriteTimeout        util.ConfigDuration   `json:"write_timeout" yaml:"writeTimeout" default:"\"5s\""`
+	IdleTimeout         util.ConfigDuration   `json:"idle_timeout" yaml:"idleTimeout" default:"\"5s\""`
+	Timeout             util.ConfigDuration   `json:"timeout" yaml:"timeout"`
+	MaxIdleConns        int                   `json:"max_idle_conns,omitempty" yaml:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int                   `json:"max_idle_conns_per_host,omitempty" yaml:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int                   `json:"max_conns_per_host,omitempty" yaml:"maxConnsPerHost,omitempty"`
+	ScrapeInterval      util.ConfigDuration   `json:"scrape_interval" yaml:"scrapeInterval" default:"\"5s\""`
+	Proxy               string                `json:"proxy" yaml:"proxy"`
+	StatusRemap         map[int]int           `json:"status_remap,omitempty" yaml:"statusRemap,omitempty"`
+	RecordOrigStatus    bool                  `json:"record_original_status" yaml:"recordOriginalStatus"`
+	Allowlist           *route.Allowlist      `json:"allowlist,omitempty" yaml:"allowlist,omitempty"`
+	Subsets             []*route.Subset       `json:"subsets,omitempty" yaml:"subsets,omitempty"`
+	StreamingUpload     bool                  `json:"streaming_upload" yaml:"streamingUpload"`
+	FlushInterval       util.ConfigDuration   `json:"flush_interval" yaml:"flushInterval"` // negative = flush every write
+	Retries             int                   `json:"retries" yaml:"retries"`
+	RetryMethods        []string              `json:"retry_methods,omitempty" yaml:"retryMethods,omitempty"`
+	Compression         bool                  `json:"compression" yaml:"compression"`
+	CompressionTypes    []string              `json:"compression_types,omitempty" yaml:"compressionTypes,omitempty"`
+	MaxRequestBodyBytes int64                 `json:"max_request_body_bytes" yaml:"maxRequestBodyBytes"`
+	RateLimit           *route.RateLimit      `json:"rate_limit,omitempty" yaml:"rateLimit,omitempty"`
+	CORS                *route.CORS           `json:"cors,omitempty" yaml:"cors,omitempty"`
+	Mirror              string                `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	CanaryRule          *route.CanaryRule     `json:"canary_rule,omitempty" yaml:"canaryRule,omitempty"`
+	RequestHeaders      route.Headers         `json:"request_headers,omitempty" yaml:"requestHeaders,omitempty"`
+	ResponseHeaders     route.Headers         `json:"response_headers,omitempty" yaml:"responseHeaders,omitempty"`
+	UpstreamHost        string                `json:"upstream_host,omitempty" yaml:"upstreamHost,omitempty"`
+	TrustForwarded      bool                  `json:"trust_forwarded" yaml:"trustForwarded"`
+	Redirects           string                `json:"redirects,omitempty" yaml:"redirects,omitempty"`
+	MaxRedirects        int                   `json:"max_redirects,omitempty" yaml:"maxRedirects,omitempty"`
+	AccessLog           *route.AccessLog      `json:"access_log,omitempty" yaml:"accessLog,omitempty"`
+	ErrorPages          route.ErrorPages      `json:"error_pages,omitempty" yaml:"errorPages,omitempty"`
+	JSONErrors          bool                  `json:"json_errors,omitempty" yaml:"jsonErrors,omitempty"`
+	Fallback            *route.Fallback       `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+	RequestIDHeader     string                `json:"request_id_header" yaml:"requestIDHeader" default:"X-Request-Id"`
+	AdaptiveTimeout     *InputAdaptiveTimeout `json:"adaptive_timeout,omitempty" yaml:"adaptiveTimeout,omitempty"`
+	OutlierDetection    *InputOutlier         `json:"outlier_detection,omitempty" yaml:"outlierDetection,omitempty"`
+	AdaptiveWeights     *InputAdaptiveWeights `json:"adaptive_weights,omitempty" yaml:"adaptiveWeights,omitempty"`
+	Backends            []*InputBackend       `json:"backends" yaml:"backends"`
+}
+
+// InputAdaptiveTimeout configures the adaptive timeout of a route
+// which is a multiple of the recent p99 response time of a backend
+type InputAdaptiveTimeout struct {
+	Multiplier float64             `json:"multiplier" yaml:"multiplier" default:"3"`
+	Floor      util.ConfigDuration `json:"floor" yaml:"floor" default:"\"50ms\""`
+	Ceiling    util.ConfigDuration `json:"ceiling" yaml:"ceiling"`
+	MinSamples int                 `json:"min_samples" yaml:"minSamples" default:"100"`
+}
+
+// InputOutlier configures the outlier detection of a route which
+// temporarily ejects backends with a high 5xx rate
+type InputOutlier struct {
+	Threshold float64             `json:"threshold" yaml:"threshold" default:"0.5"`
+	Interval  util.ConfigDuration `json:"interval" yaml:"interval"`
+	Cooldown  util.ConfigDuration `json:"cooldown" yaml:"cooldown" default:"\"30s\""`
+}
+
+// InputAdaptiveWeights configures the adaptive weights of a route which
+// shift the traffic from slower to faster backends
+type InputAdaptiveWeights struct {
+	Aggressiveness float64             `json:"aggressiveness" yaml:"aggressiveness" default:"1"`
+	MinShare       float64             `json:"min_share" yaml:"minShare" default:"0.1"`
+	Interval       util.ConfigDuration `json:"interval" yaml:"interval"`
 }
 
 // InputSwitchover is required to add a switchover to a route
 // it is a wrapper for the actual SwitchOver struct and replaces
 // the actual backends (from and to) with their corrosponding ids
 type InputSwitchover struct {
+	ID           int                      `json:"id"` // set by the gateway
 	Route        string                   `json:"route"`
 	Status       string                   `json:"status"`
 	From         string                   `json:"from"`
@@ -66,6 +166,19 @@ type InputSwitchover struct {
 	Conditions   []*conditional.Condition `json:"conditions" validate:"empty=false"`
 	Timeout      util.ConfigDuration      `json:"timeout" default:"\"2m\""`
 	WeightChange uint8                    `json:"weight_change" default:"5"`
+	// Steps are the ordered target weights of To, e.g. [1, 5, 25, 50, 100].
+	// If set, they are used instead of WeightChange
+	Steps []int `json:"steps,omitempty"`
+	// AbortOn are the metrics of which an Alarming alert of To fails the switchover immediately
+	AbortOn []string `json:"abort_on,omitempty"`
+	// MaxDuration after which the switchover is stopped if it is not complete (0 = unlimited)
+	MaxDuration util.ConfigDuration `json:"max_duration"`
+	// RemoveOnSuccess removes the old backend after the switchover was successful.
+	// Before it is removed, it serves its pinned sessions for the Linger duration
+	RemoveOnSuccess bool                `json:"remove_on_success,omitempty" default:"false"`
+	Linger          util.ConfigDuration `json:"linger"`
+	// StartAt schedules the switchover. If it is in the past, it starts immediately
+	StartAt time.Time `json:"start_at"`
 	// Force overwrites the current config of the backends to enable switchover (if required)
 	Force bool `json:"force,omitempty" default:"false"`
 	// If switchover fails, rollback all changes to the weights and stop switchover
@@ -73,6 +186,8 @@ type InputSwitchover struct {
 	// The amount of times a cycle is allowed to fail before switchover is stopped
 	AllowedFailures int `json:"allowed_failures" default:"5"`
 	FailureCounter  int `json:"failure_counter"`
+	// Progress is the current state of the ramp. It is ignored on creation
+	Progress *route.SwitchoverProgress `json:"progress,omitempty"`
 }
 
 func NewInputBackend() *InputBackend {
@@ -103,16 +218,24 @@ func NewInputeGateway() *InputGateway {
 
 func ConvertBackendToInputBackend(b *route.Backend) *InputBackend {
 	inputBackend := &InputBackend{
-		ID:               b.ID,
-		Name:             b.Name,
-		Addr:             b.Addr.String(),
-		Weigth:           b.Weigth,
-		Active:           b.Active,
-		Scrapeurl:        b.Scrapeurl.String(),
-		Scrapemetrics:    b.Scrapemetrics,
-		Metricthresholds: b.Metricthresholds,
-		Healthcheckurl:   b.Healthcheckurl.String(),
-		ActiveAlerts:     b.ActiveAlerts,
+		ID:                 b.ID,
+		Name:               b.Name,
+		Addr:               b.Addr.String(),
+		Weigth:             b.Weigth,
+		Active:             b.Active,
+		Scrapeurl:          b.Scrapeurl.String(),
+		Scrapemetrics:      b.Scrapemetrics,
+		ScrapeFormat:       b.ScrapeFormat,
+		ScrapeAuth:         b.ScrapeAuth,
+		ScrapeInterval:     util.ConfigDuration{Duration: b.ScrapeInterval},
+		Metricthresholds:   b.Metricthresholds,
+		Healthcheckurl:     b.Healthcheckurl.String(),
+		Timeout:            util.ConfigDuration{Duration: b.Timeout},
+		HealthCheckTimeout: util.ConfigDuration{Duration: b.HealthCheckTimeout},
+		HealthCheckProbe:   b.HealthCheckProbe,
+		MonitoringWindow:   util.ConfigDuration{Duration: b.MonitoringWindow},
+		Transport:          b.Transport,
+		ActiveAlerts:       b.ActiveAlerts,
 	}
 	return inputBackend
 }
@@ -130,6 +253,15 @@ func ConvertInputBackendToBackend(b *InputBackend) (*route.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := metrics.NewScrapeParser(b.ScrapeFormat); err != nil {
+		return nil, err
+	}
+	if err := b.ScrapeAuth.Validate(); err != nil {
+		return nil, err
+	}
+	if err := b.HealthCheckProbe.Validate(); err != nil {
+		return nil, err
+	}
 	backend, err := route.NewBackend(
 		b.Name,
 		addr,
@@ -143,6 +275,14 @@ func ConvertInputBackendToBackend(b *InputBackend) (*route.Backend, error) {
 		return nil, err
 	}
 	backend.ID = b.ID
+	backend.Timeout = b.Timeout.Duration
+	backend.HealthCheckTimeout = b.HealthCheckTimeout.Duration
+	backend.HealthCheckProbe = b.HealthCheckProbe
+	backend.MonitoringWindow = b.MonitoringWindow.Duration
+	backend.Transport = b.Transport
+	backend.ScrapeFormat = b.ScrapeFormat
+	backend.ScrapeAuth = b.ScrapeAuth
+	backend.ScrapeInterval = b.ScrapeInterval.Duration
 	return backend, nil
 }
 
@@ -153,6 +293,8 @@ func ConvertRouteToInputRoute(r *route.Route) *InputRoute {
 		Name:                r.Name,
 		Prefix:              r.Prefix,
 		Rewrite:             r.Rewrite,
+		StripPrefix:         r.StripPrefix,
+		Query:               r.Query,
 		Strategy:            r.Strategy,
 		Proxy:               r.Proxy,
 		ReadTimeout:         util.ConfigDuration{r.ReadTimeout},
@@ -160,12 +302,69 @@ func ConvertRouteToInputRoute(r *route.Route) *InputRoute {
 		ScrapeInterval:      util.ConfigDuration{r.ScrapeInterval},
 		Backends:            []*InputBackend{},
 		CookieTTL:           util.ConfigDuration{r.CookieTTL},
+		CookieName:          r.CookieName,
+		SessionKeyEnv:       r.SessionKeyEnv,
 		HealthCheck:         &r.HealthCheck,
 		HealthCheckInterval: util.ConfigDuration{r.HealthCheckInterval},
+		HealthyThreshold:    r.HealthyThreshold,
+		UnhealthyThreshold:  r.UnhealthyThreshold,
+		HealthCheckJitter:   r.HealthCheckJitter,
 		MonitoringInterval:  util.ConfigDuration{r.MonitoringInterval},
 		Host:                r.Host,
 		IdleTimeout:         util.ConfigDuration{r.IdleTimeout},
+		Timeout:             util.ConfigDuration{Duration: r.Timeout},
+		MaxIdleConns:        r.MaxIdleConns,
+		MaxIdleConnsPerHost: r.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     r.MaxConnsPerHost,
 		Methods:             r.Methods,
+		StatusRemap:         r.StatusRemap,
+		RecordOrigStatus:    r.RecordOrigStatus,
+		Allowlist:           r.Allowlist,
+		Subsets:             r.Subsets,
+		StreamingUpload:     r.StreamingUpload,
+		FlushInterval:       util.ConfigDuration{Duration: r.FlushInterval},
+		Retries:             r.Retries,
+		RetryMethods:        r.RetryMethods,
+		Compression:         r.Compression,
+		CompressionTypes:    r.CompressionTypes,
+		MaxRequestBodyBytes: r.MaxRequestBodyBytes,
+		RateLimit:           r.RateLimit,
+		CORS:                r.CORS,
+		Mirror:              r.Mirror,
+		CanaryRule:          r.CanaryRule,
+		RequestHeaders:      r.RequestHeaders,
+		ResponseHeaders:     r.ResponseHeaders,
+		UpstreamHost:        r.UpstreamHost,
+		TrustForwarded:      r.TrustForwarded,
+		Redirects:           r.Redirects,
+		MaxRedirects:        r.MaxRedirects,
+		AccessLog:           r.AccessLog,
+		ErrorPages:          r.ErrorPages,
+		JSONErrors:          r.JSONErrors,
+		Fallback:            r.Fallback,
+		RequestIDHeader:     r.RequestIDHeader,
+	}
+	if r.OutlierDetection != nil {
+		inputRoute.OutlierDetection = &InputOutlier{
+			Threshold: r.OutlierDetection.Threshold,
+			Interval:  util.ConfigDuration{Duration: r.OutlierDetection.Interval},
+			Cooldown:  util.ConfigDuration{Duration: r.OutlierDetection.Cooldown},
+		}
+	}
+	if r.AdaptiveWeights != nil {
+		inputRoute.AdaptiveWeights = &InputAdaptiveWeights{
+			Aggressiveness: r.AdaptiveWeights.Aggressiveness,
+			MinShare:       r.AdaptiveWeights.MinShare,
+			Interval:       util.ConfigDuration{Duration: r.AdaptiveWeights.Interval},
+		}
+	}
+	if r.AdaptiveTimeout != nil {
+		inputRoute.AdaptiveTimeout = &InputAdaptiveTimeout{
+			Multiplier: r.AdaptiveTimeout.Multiplier,
+			Floor:      util.ConfigDuration{Duration: r.AdaptiveTimeout.Floor},
+			Ceiling:    util.ConfigDuration{Duration: r.AdaptiveTimeout.Ceiling},
+			MinSamples: r.AdaptiveTimeout.MinSamples,
+		}
 	}
 	inputRoute.Backends = make([]*InputBackend, len(r.Backends))
 	i := 0
@@ -173,8 +372,8 @@ func ConvertRouteToInputRoute(r *route.Route) *InputRoute {
 		inputRoute.Backends[i] = ConvertBackendToInputBackend(backend)
 		i++
 	}
-	if r.Switchover != nil {
-		inputRoute.Switchover = ConvertSwitchoverToInputSwitchover(r.Switchover)
+	if switchover := r.CurrentSwitchover(); switchover != nil {
+		inputRoute.Switchover = ConvertSwitchoverToInputSwitchover(switchover)
 	}
 
 	return inputRoute
@@ -203,6 +402,128 @@ func ConvertInputRouteToRoute(r *InputRoute) (*route.Route, error) {
 		r.CookieTTL.Duration,
 		hs,
 	)
+	if err != nil {
+		return nil, err
+	}
+	newRoute.Timeout = r.Timeout.Duration
+	newRoute.StripPrefix = r.StripPrefix
+	newRoute.Query = r.Query
+	if err = newRoute.Validate(); err != nil {
+		return nil, err
+	}
+	if err = newRoute.SetSessionCookie(r.CookieName, r.SessionKeyEnv); err != nil {
+		return nil, err
+	}
+	if r.HealthyThreshold < 0 || r.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("Healthcheck thresholds cannot be negative")
+	}
+	newRoute.HealthyThreshold = r.HealthyThreshold
+	newRoute.UnhealthyThreshold = r.UnhealthyThreshold
+	if r.HealthCheckJitter < 0 || r.HealthCheckJitter > 1 {
+		return nil, fmt.Errorf("Healthcheck jitter must be in [0, 1]")
+	}
+	newRoute.HealthCheckJitter = r.HealthCheckJitter
+	// the upstream client depends on the flush interval
+	newRoute.FlushInterval = r.FlushInterval.Duration
+	if err = newRoute.SetConnectionPool(r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost); err != nil {
+		return nil, err
+	}
+	for upstream, returned := range r.StatusRemap {
+		if upstream < 100 || upstream > 599 || returned < 100 || returned > 599 {
+			return nil, fmt.Errorf("Status codes of statusRemap must be in [100, 599], got %d: %d", upstream, returned)
+		}
+	}
+	newRoute.StatusRemap = r.StatusRemap
+	newRoute.RecordOrigStatus = r.RecordOrigStatus
+	newRoute.StreamingUpload = r.StreamingUpload
+	if r.Retries < 0 {
+		return nil, fmt.Errorf("Retries cannot be negative")
+	}
+	newRoute.Retries = r.Retries
+	newRoute.RetryMethods = r.RetryMethods
+	newRoute.Compression = r.Compression
+	newRoute.CompressionTypes = r.CompressionTypes
+	newRoute.MaxRequestBodyBytes = r.MaxRequestBodyBytes
+	if r.AdaptiveTimeout != nil {
+		defaults.Set(r.AdaptiveTimeout)
+		if r.AdaptiveTimeout.Multiplier <= 0 {
+			return nil, fmt.Errorf("Multiplier of adaptiveTimeout must be larger than 0")
+		}
+		newRoute.AdaptiveTimeout = &route.AdaptiveTimeout{
+			Multiplier: r.AdaptiveTimeout.Multiplier,
+			Floor:      r.AdaptiveTimeout.Floor.Duration,
+			Ceiling:    r.AdaptiveTimeout.Ceiling.Duration,
+			MinSamples: r.AdaptiveTimeout.MinSamples,
+		}
+	}
+	if r.RateLimit != nil {
+		if err = r.RateLimit.Validate(); err != nil {
+			return nil, err
+		}
+		newRoute.RateLimit = r.RateLimit
+	}
+	if r.CORS != nil {
+		if err = r.CORS.Validate(); err != nil {
+			return nil, err
+		}
+		newRoute.CORS = r.CORS
+	}
+	if err = r.RequestHeaders.Validate(); err != nil {
+		return nil, err
+	}
+	if err = r.ResponseHeaders.Validate(); err != nil {
+		return nil, err
+	}
+	newRoute.RequestHeaders = r.RequestHeaders
+	newRoute.ResponseHeaders = r.ResponseHeaders
+	newRoute.UpstreamHost = r.UpstreamHost
+	newRoute.TrustForwarded = r.TrustForwarded
+	switch r.Redirects {
+	case "", route.RedirectRewrite, route.RedirectFollow:
+		newRoute.Redirects = r.Redirects
+	default:
+		return nil, fmt.Errorf("Unknown redirects %s", r.Redirects)
+	}
+	if r.MaxRedirects < 0 {
+		return nil, fmt.Errorf("MaxRedirects must not be negative")
+	}
+	newRoute.MaxRedirects = r.MaxRedirects
+	if r.AccessLog != nil {
+		defaults.Set(r.AccessLog)
+		if err = r.AccessLog.Validate(); err != nil {
+			return nil, err
+		}
+		newRoute.AccessLog = r.AccessLog
+	}
+	if err = r.ErrorPages.Validate(); err != nil {
+		return nil, err
+	}
+	newRoute.ErrorPages = r.ErrorPages
+	newRoute.JSONErrors = r.JSONErrors
+	if r.Fallback != nil {
+		defaults.Set(r.Fallback)
+		if err = r.Fallback.Validate(); err != nil {
+			return nil, err
+		}
+		newRoute.Fallback = r.Fallback
+	}
+	newRoute.RequestIDHeader = r.RequestIDHeader
+	if r.CanaryRule != nil {
+		defaults.Set(r.CanaryRule)
+		if err = r.CanaryRule.Validate(); err != nil {
+			return nil, err
+		}
+		newRoute.CanaryRule = r.CanaryRule
+	}
+	if r.Allowlist != nil {
+		if err = r.Allowlist.Compile(); err != nil {
+			return nil, err
+		}
+		newRoute.Allowlist = r.Allowlist
+	}
+	if err = newRoute.SetSubsets(r.Subsets); err != nil {
+		return nil, err
+	}
 
 	for _, backend := range r.Backends {
 		if backend.ID == uuid.Nil {
@@ -222,16 +543,53 @@ func ConvertInputRouteToRoute(r *InputRoute) (*route.Route, error) {
 			return nil, err
 		}
 	}
+	if err = newRoute.SetMirror(r.Mirror); err != nil {
+		return nil, err
+	}
+	if r.OutlierDetection != nil {
+		defaults.Set(r.OutlierDetection)
+		err = newRoute.SetOutlierDetection(&route.OutlierDetection{
+			Threshold: r.OutlierDetection.Threshold,
+			Interval:  r.OutlierDetection.Interval.Duration,
+			Cooldown:  r.OutlierDetection.Cooldown.Duration,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.AdaptiveWeights != nil {
+		defaults.Set(r.AdaptiveWeights)
+		err = newRoute.SetAdaptiveWeights(&route.AdaptiveWeights{
+			Aggressiveness: r.AdaptiveWeights.Aggressiveness,
+			MinShare:       r.AdaptiveWeights.MinShare,
+			Interval:       r.AdaptiveWeights.Interval.Duration,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 	return newRoute, err
 }
 
 // Gateway
 
+// NewStorage returns the configured storage of the metrics
+func NewStorage() metrics.Storage {
+	if InfluxDBURL != "" {
+		return storage.NewInfluxStorage(
+			InfluxDBURL, InfluxDBToken, InfluxDBOrg, InfluxDBBucket, Granulartiy, RetentionPeriod, Granulartiy)
+	}
+	return storage.NewLocalStorage(RetentionPeriod, Granulartiy, MaxBuckets)
+}
+
 func ConvertInputGatewayToGateway(g *InputGateway) *gateway.Gateway {
 	_, newMetricsRepo := metrics.NewMetricsRepository(
-		storage.NewLocalStorage(RetentionPeriod, Granulartiy),
+		NewStorage(),
 		Granulartiy, MetricsChannelPuffersize, ScrapeMetricsChannelPuffersize,
 	)
+	newMetricsRepo.ScrapeTimeout = ScrapeTimeout
+	newMetricsRepo.ScrapeErrorThreshold = ScrapeErrorThreshold
+	newMetricsRepo.ChannelPolicy = MetricsChannelPolicy
 	newGateway := gateway.NewGateway(
 		g.Addr,
 		newMetricsRepo,
@@ -239,15 +597,25 @@ func ConvertInputGatewayToGateway(g *InputGateway) *gateway.Gateway {
 		g.WriteTimeout.Duration,
 		g.IdleTimeout.Duration,
 	)
+	newGateway.MaxRequestsPerConn = g.MaxRequestsPerConn
+	newGateway.MaxConnsPerIP = g.MaxConnsPerIP
+	newGateway.MaxHeaderBytes = g.MaxHeaderBytes
+	newGateway.DisableKeepalive = g.DisableKeepalive
+	newGateway.JSONErrors = g.JSONErrors
 	return newGateway
 }
 func ConvertGatewayToInputGateway(g *gateway.Gateway) *InputGateway {
 	inputGateway := &InputGateway{
-		Addr:         g.Addr,
-		ReadTimeout:  util.ConfigDuration{g.ReadTimeout},
-		WriteTimeout: util.ConfigDuration{g.WriteTimeout},
-		IdleTimeout:  util.ConfigDuration{g.IdleTimeout},
-		Routes:       []*InputRoute{},
+		Addr:               g.Addr,
+		ReadTimeout:        util.ConfigDuration{g.ReadTimeout},
+		WriteTimeout:       util.ConfigDuration{g.WriteTimeout},
+		IdleTimeout:        util.ConfigDuration{g.IdleTimeout},
+		MaxRequestsPerConn: g.MaxRequestsPerConn,
+		MaxConnsPerIP:      g.MaxConnsPerIP,
+		MaxHeaderBytes:     g.MaxHeaderBytes,
+		DisableKeepalive:   g.DisableKeepalive,
+		JSONErrors:         g.JSONErrors,
+		Routes:             []*InputRoute{},
 	}
 	inputGateway.Routes = make([]*InputRoute, len(g.Routes))
 	i := 0
@@ -255,23 +623,90 @@ func ConvertGatewayToInputGateway(g *gateway.Gateway) *InputGateway {
 		inputGateway.Routes[i] = ConvertRouteToInputRoute(r)
 		i++
 	}
+	if sink := g.MetricsRepo.StatsD(); sink != nil {
+		inputGateway.StatsD = ConvertStatsDSinkToInputStatsD(sink)
+	}
+	for _, n := range g.MetricsRepo.Notifiers() {
+		if inputNotifier := ConvertNotifierToInputNotifier(n); inputNotifier != nil {
+			inputGateway.Notifiers = append(inputGateway.Notifiers, inputNotifier)
+		}
+	}
 	return inputGateway
 }
 
+// Notifier
+
+func ConvertInputNotifierToNotifier(n *InputNotifier) (metrics.Notifier, error) {
+	defaults.Set(n)
+	switch n.Type {
+	case "webhook":
+		return metrics.NewWebhookNotifier(n.URL, n.Template, n.Retries, n.Backoff.Duration)
+	case "slack":
+		return metrics.NewSlackNotifier(n.URL, n.Debounce.Duration, n.Retries, n.Backoff.Duration)
+	}
+	return nil, fmt.Errorf("Unknown notifier type %s", n.Type)
+}
+
+func ConvertNotifierToInputNotifier(n metrics.Notifier) *InputNotifier {
+	switch notifier := n.(type) {
+	case *metrics.WebhookNotifier:
+		return &InputNotifier{
+			Type:     "webhook",
+			URL:      notifier.URL,
+			Template: notifier.Template,
+			Retries:  notifier.Retries,
+			Backoff:  util.ConfigDuration{Duration: notifier.Backoff},
+		}
+	case *metrics.SlackNotifier:
+		return &InputNotifier{
+			Type:     "slack",
+			URL:      notifier.URL,
+			Retries:  notifier.Retries,
+			Backoff:  util.ConfigDuration{Duration: notifier.Backoff},
+			Debounce: util.ConfigDuration{Duration: notifier.Debounce},
+		}
+	}
+	return nil
+}
+
+// StatsD
+
+func ConvertInputStatsDToStatsDSink(s *InputStatsD) (*metrics.StatsDSink, error) {
+	defaults.Set(s)
+	return metrics.NewStatsDSink(s.Addr, s.Prefix, s.SampleRate)
+}
+
+func ConvertStatsDSinkToInputStatsD(s *metrics.StatsDSink) *InputStatsD {
+	return &InputStatsD{
+		Addr:       s.Addr,
+		Prefix:     s.Prefix,
+		SampleRate: s.SampleRate,
+	}
+}
+
 // Switchover
 
 func ConvertSwitchoverToInputSwitchover(s *route.Switchover) *InputSwitchover {
 	inputRoute := &InputSwitchover{
+		ID:              s.ID,
 		Route:           s.Route.Name,
-		Status:          s.Status,
+		Status:          s.GetStatus(),
 		From:            s.From.Name,
 		To:              s.To.Name,
-		FailureCounter:  s.FailureCounter,
 		AllowedFailures: s.AllowedFailures,
 		WeightChange:    s.WeightChange,
+		Steps:           s.Steps,
+		AbortOn:         s.AbortOn,
 		Timeout:         util.ConfigDuration{s.Timeout},
+		MaxDuration:     util.ConfigDuration{Duration: s.MaxDuration},
 		Conditions:      s.Conditions,
 		Rollback:        s.Rollback,
+		RemoveOnSuccess: s.RemoveOnSuccess,
+		Linger:          util.ConfigDuration{Duration: s.Linger},
+		StartAt:         s.StartAt,
 	}
+	progress := s.Progress()
+	inputRoute.Progress = &progress
+	inputRoute.FailureCounter = progress.FailureCounter
 	return inputRoute
 }
@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+func Test_ConvertInputRouteToRoute_StatusRemap(t *testing.T) {
+	tests := map[string]struct {
+		remap map[int]int
+		valid bool
+	}{
+		"valid":             {remap: map[int]int{598: 504, 202: 204}, valid: true},
+		"upstream too low":  {remap: map[int]int{99: 200}},
+		"upstream too high": {remap: map[int]int{600: 502}},
+		"returned too low":  {remap: map[int]int{502: 0}},
+		"returned too high": {remap: map[int]int{502: 1000}},
+	}
+	for name, tt := range tests {
+		inputRoute := parseTestConfig(t, map[string][]string{"a:/a/": {"v1=100"}}).Routes[0]
+		inputRoute.StatusRemap = tt.remap
+		newRoute, err := ConvertInputRouteToRoute(inputRoute)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected the remap to be accepted, got %v", name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected the remap to be rejected", name)
+		}
+		if newRoute != nil {
+			newRoute.Delete()
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp/reuseport"
@@ -26,14 +29,25 @@ type Gateway struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
-	Routes       map[string]*route.Route
-	Router       map[string]*router.Router
-	MetricsRepo  *metrics.Repository
-	server       *fasthttp.Server
-	mux          sync.Mutex
+	// downstream connection options
+	MaxRequestsPerConn int  // maximal number of requests served per client connection (0 = unlimited)
+	MaxConnsPerIP      int  // maximal number of concurrent connections per client IP (0 = unlimited)
+	MaxHeaderBytes     int  // maximal size of the request header (0 = default of 4096 bytes)
+	DisableKeepalive   bool // close client connections after each response
+	JSONErrors         bool // unknown paths and methods are answered with the JSON error envelope
+	Routes             map[string]*route.Route
+	Router             map[string]*router.Router
+	MetricsRepo        *metrics.Repository
+	server             *fasthttp.Server
+	mux                sync.Mutex
+	inFlight           int64 // number of requests that are currently served
+	draining           int32 // if set to 1, new requests are rejected
+	switchoverChanged  chan struct{}
+	persistKill        chan struct{} // stops PersistSwitchovers
+	persistDone        chan struct{}
 }
 
-//NewGateway returns a new instance of Gateway
+// NewGateway returns a new instance of Gateway
 func NewGateway(
 	addr string, metricsRepo *metrics.Repository,
 	readTimeout, writeTimeout, idleTimeout time.Duration) *Gateway {
@@ -51,7 +65,9 @@ func NewGateway(
 	g.Router = make(map[string]*router.Router)
 
 	// any HOST router
-	g.Router["*"] = router.NewRouter()
+	g.Router["*"] = g.newRouter()
+
+	g.switchoverChanged = make(chan struct{}, 1)
 
 	// set timeouts
 	g.ReadTimeout = readTimeout
@@ -67,19 +83,29 @@ func NewGateway(
 // a pointer to the new Router
 func (g *Gateway) Reload() {
 	log.Info("Reloading Gateway")
-	newRouter := make(map[string]*router.Router)
-	// any host router
-	newRouter["*"] = router.NewRouter()
+	// the request ID headers of the routes of each host
+	requestIDHeaders := map[string]map[string]bool{"*": {}}
 	for _, routeItem := range g.Routes {
-		// Each host has its own router
-		if _, found := newRouter[routeItem.Host]; !found {
-			// host does not exist, create its router
-			newRouter[routeItem.Host] = router.NewRouter()
+		if _, found := requestIDHeaders[routeItem.Host]; !found {
+			requestIDHeaders[routeItem.Host] = make(map[string]bool)
+		}
+		requestIDHeaders[routeItem.Host][routeItem.GetRequestIDHeader()] = true
+	}
+	newRouter := make(map[string]*router.Router)
+	// Each host has its own router, including the any host router
+	for host, headers := range requestIDHeaders {
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		newRouter[host] = g.newRouter(names...)
+	}
+	for _, routeItem := range g.Routes {
 		// add all routes to the router
 		for _, method := range routeItem.Methods {
 			// for each http-method add a handler to the router
-			newRouter[routeItem.Host].Handle(method, routeItem.Prefix,
+			newRouter[routeItem.Host].HandleQuery(method, routeItem.Prefix, routeItem.Query,
 				middleware.LogRequest(routeItem.GetHandler()),
 			)
 		}
@@ -88,18 +114,32 @@ func (g *Gateway) Reload() {
 	g.Router = newRouter
 }
 
+// newRouter returns a new router with the error handlers of the Gateway. The request ID
+// of their responses is read from the request ID headers of the routes of the router
+func (g *Gateway) newRouter(requestIDHeaders ...string) *router.Router {
+	r := router.NewRouter()
+	if g.JSONErrors {
+		if len(requestIDHeaders) == 0 {
+			requestIDHeaders = []string{route.DefaultRequestIDHeader}
+		}
+		r.UseJSONErrors(requestIDHeaders...)
+	}
+	return r
+}
+
 // Run starts the HTTP-Server of the Gateway
 func (g *Gateway) Run() {
 	g.server = &fasthttp.Server{
 		Handler:                       g.ServeHTTP,
 		Name:                          ServerName,
 		Concurrency:                   256 * 1024,
-		DisableKeepalive:              false,
+		DisableKeepalive:              g.DisableKeepalive,
 		ReadTimeout:                   g.ReadTimeout,
 		WriteTimeout:                  g.WriteTimeout,
 		IdleTimeout:                   g.IdleTimeout,
-		MaxConnsPerIP:                 0,
-		MaxRequestsPerConn:            0,
+		MaxConnsPerIP:                 g.MaxConnsPerIP,
+		MaxRequestsPerConn:            g.MaxRequestsPerConn,
+		ReadBufferSize:                g.MaxHeaderBytes,
 		TCPKeepalive:                  false,
 		DisableHeaderNamesNormalizing: false,
 		NoDefaultServerHeader:         false,
@@ -129,11 +169,13 @@ func (g *Gateway) checkIfExists(newRoute *route.Route) error {
 		}
 
 		// if name is not taken, check if other configs are taken
-		// if combination of prefix/host is already taken, return error
-		if route.Prefix == newRoute.Prefix && route.Host == newRoute.Host {
+		// if combination of prefix/host/query is already taken, return error.
+		// Routes with the same prefix are selected by their query
+		if route.Prefix == newRoute.Prefix && route.Host == newRoute.Host &&
+			router.CanonicalQuery(route.Query) == router.CanonicalQuery(newRoute.Query) {
 			return fmt.Errorf(
-				"Route with combination of prefix (%s) and host (%s) already exist. Existing Route: %s",
-				route.Prefix, route.Host, routeName)
+				"Route with combination of prefix (%s), host (%s) and query (%s) already exist. Existing Route: %s",
+				route.Prefix, route.Host, router.CanonicalQuery(route.Query), routeName)
 		}
 	}
 	// no error
@@ -169,6 +211,7 @@ func (g *Gateway) RegisterRoute(newRoute *route.Route) error {
 	}
 	log.Debugf("Setting up MetricsRepo for %s", newRoute.Name)
 	newRoute.MetricsRepo = g.MetricsRepo
+	newRoute.OnSwitchoverChange(g.notifySwitchoverChanged)
 
 	g.Routes[newRoute.Name] = newRoute
 	log.Infof("Successfully registered new route %s", newRoute.Name)
@@ -201,6 +244,14 @@ func (g *Gateway) RemoveRoute(name string) *route.Route {
 // ServeHTTP is the required interface to quality as http.Handler
 // so the Gateway can be executed as a http.Server
 func (g *Gateway) ServeHTTP(ctx *fasthttp.RequestCtx) {
+	if atomic.LoadInt32(&g.draining) == 1 {
+		ctx.SetConnectionClose()
+		ctx.Error("Gateway is shutting down", 503)
+		return
+	}
+	atomic.AddInt64(&g.inFlight, 1)
+	defer atomic.AddInt64(&g.inFlight, -1)
+
 	// error handling is done in router
 	if router, found := g.Router[string(ctx.Host())]; found {
 		router.ServeHTTP(ctx)
@@ -214,9 +265,77 @@ func (g *Gateway) GetRoutes() map[string]*route.Route {
 	return g.Routes
 }
 
+// Drain stops the Gateway from accepting new requests (503) and waits until
+// all in-flight requests are finished or ctx is done
+func (g *Gateway) Drain(ctx context.Context) error {
+	log.Warnf("Draining Gateway with %d requests in-flight", atomic.LoadInt64(&g.inFlight))
+	atomic.StoreInt32(&g.draining, 1)
+	for {
+		if atomic.LoadInt64(&g.inFlight) == 0 {
+			log.Warn("Successfully drained Gateway")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Shutdown gracefully stops the Gateway. The server stops accepting new
+// connections, the in-flight requests of the Gateway and of all routes are
+// drained and afterwards the routes and the MetricsRepo are stopped.
+// If ctx is done before the Gateway is quiesced, the routes and the MetricsRepo
+// are stopped anyway and the error of ctx is returned
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.stopPersisting()
+	atomic.StoreInt32(&g.draining, 1)
+	serverDone := make(chan error, 1)
+	go func() {
+		if g.server == nil {
+			serverDone <- nil
+			return
+		}
+		// closes the listener and waits for all connections to be closed
+		serverDone <- g.server.Shutdown()
+	}()
+
+	// the routes and the MetricsRepo are stopped even if the drain times out
+	drainErr := g.Drain(ctx)
+	if drainErr != nil {
+		log.Warnf("Unable to drain Gateway: %v", drainErr)
+	}
+	for _, route := range g.GetRoutes() {
+		if err := route.Drain(ctx); err != nil {
+			log.Warnf("Unable to drain %s: %v", route.Name, err)
+			drainErr = ctx.Err()
+		}
+	}
+	for routeName := range g.Routes {
+		g.RemoveRoute(routeName)
+	}
+	g.MetricsRepo.Stop()
+	if drainErr != nil {
+		return drainErr
+	}
+
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			return fmt.Errorf("Gateway server shutdown failed: %v", err)
+		}
+		log.Warn("Successfully shutdown Gateway")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Stop executes a shutdown of the Gateway server and removes all
 // routes of the Gateway
 func (g *Gateway) Stop() {
+	g.stopPersisting()
 	for routeName := range g.Routes {
 		g.RemoveRoute(routeName)
 	}
@@ -1 +1,353 @@
 package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/route"
+	"github.com/rgumi/depoy/router"
+	"github.com/rgumi/depoy/storage"
+	"github.com/valyala/fasthttp"
+)
+
+// freeAddr returns a local address which is not in use
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// newTestGateway returns a running Gateway with a route to the upstream
+func newTestGateway(t *testing.T, upstream string) *Gateway {
+	return newTestGatewayWith(t, upstream, storage.NewLocalStorage(time.Minute, time.Second, 0))
+}
+
+// newTestGatewayWith returns a running Gateway with a route to the upstream
+// which stores its metrics in st
+func newTestGatewayWith(t *testing.T, upstream string, st metrics.Storage) *Gateway {
+	_, repo := metrics.NewMetricsRepository(st, time.Second, 10, 10)
+	g := NewGateway(freeAddr(t), repo, 5*time.Second, 5*time.Second, 5*time.Second)
+
+	r, err := route.New("test", "/", "/", "*", "", []string{"GET"},
+		5*time.Second, 5*time.Second, 5*time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.RegisterRoute(r); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := url.Parse(upstream)
+	if _, err = r.AddBackend("upstream", addr, &url.URL{}, &url.URL{}, nil, nil, 100); err != nil {
+		t.Fatal(err)
+	}
+	strategy, err := route.NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+	r.Reload()
+	g.Reload()
+	g.Run()
+
+	// wait for the listener
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp4", g.Addr); err == nil {
+			conn.Close()
+			return g
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the Gateway to listen")
+	return nil
+}
+
+func Test_Shutdown_DrainsInFlightRequests(t *testing.T) {
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+	g := newTestGateway(t, upstream.URL)
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + g.Addr + "/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		results <- result{status: resp.StatusCode, body: string(body)}
+	}()
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the Gateway to shutdown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the shutdown to return once the request is done, took %v", elapsed)
+	}
+
+	res := <-results
+	if res.err != nil || res.status != 200 || res.body != "done" {
+		t.Errorf("Expected the in-flight request to complete, got %+v", res)
+	}
+	if len(g.Routes) != 0 {
+		t.Errorf("Expected all routes to be removed, got %d", len(g.Routes))
+	}
+	if _, err := net.DialTimeout("tcp4", g.Addr, time.Second); err == nil {
+		t.Error("Expected the Gateway to not accept new connections")
+	}
+}
+
+func Test_Shutdown_Timeout(t *testing.T) {
+	// the routes are stopped after the timeout without waiting for the request
+	defer func(timeout time.Duration) { route.DefaultDrainTimeout = timeout }(route.DefaultDrainTimeout)
+	route.DefaultDrainTimeout = 100 * time.Millisecond
+	received := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+	g := newTestGateway(t, upstream.URL)
+
+	go http.Get("http://" + g.Addr + "/")
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the shutdown to time out, got %v", err)
+	}
+}
+
+// stopCounter counts the stops of the storage to check the teardown of the Gateway
+type stopCounter struct {
+	metrics.Storage
+	stops int32
+}
+
+func (s *stopCounter) Stop() {
+	atomic.AddInt32(&s.stops, 1)
+	s.Storage.Stop()
+}
+
+func Test_Shutdown_GracePeriod(t *testing.T) {
+	defer func(timeout time.Duration) { route.DefaultDrainTimeout = timeout }(route.DefaultDrainTimeout)
+	route.DefaultDrainTimeout = 100 * time.Millisecond
+
+	// the in-flight request is either finished or still running at the deadline
+	for name, finish := range map[string]bool{"finished": true, "deadline": false} {
+		received := make(chan struct{})
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(received)
+			<-release
+			w.Write([]byte("done"))
+		}))
+		st := &stopCounter{Storage: storage.NewLocalStorage(time.Minute, time.Second, 0)}
+		g := newTestGatewayWith(t, upstream.URL, st)
+
+		results := make(chan int, 1)
+		go func() {
+			resp, err := http.Get("http://" + g.Addr + "/")
+			if err != nil {
+				results <- 0
+				return
+			}
+			resp.Body.Close()
+			results <- resp.StatusCode
+		}()
+		<-received
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- g.Shutdown(ctx) }()
+		for atomic.LoadInt32(&g.draining) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// a new request is rejected while the in-flight request is served
+		newRequest := &fasthttp.RequestCtx{}
+		g.ServeHTTP(newRequest)
+		if status := newRequest.Response.StatusCode(); status != 503 {
+			t.Errorf("%s: expected a new request to be rejected, got %d", name, status)
+		}
+		if stops := atomic.LoadInt32(&st.stops); stops != 0 {
+			t.Errorf("%s: expected the teardown to wait for the in-flight request", name)
+		}
+
+		if finish {
+			close(release)
+		}
+		err := <-shutdown
+		if finish && err != nil {
+			t.Errorf("%s: expected the Gateway to shutdown, got %v", name, err)
+		}
+		if !finish && err != context.DeadlineExceeded {
+			t.Errorf("%s: expected the shutdown to time out, got %v", name, err)
+		}
+		if stops := atomic.LoadInt32(&st.stops); stops != 1 || len(g.Routes) != 0 {
+			t.Errorf("%s: expected the routes and the MetricsRepo to be stopped once, got %d stops and %d routes",
+				name, stops, len(g.Routes))
+		}
+		if finish {
+			if status := <-results; status != 200 {
+				t.Errorf("%s: expected the in-flight request to complete, got %d", name, status)
+			}
+		} else {
+			close(release)
+		}
+		cancel()
+		upstream.Close()
+	}
+}
+
+func Test_RegisterRoute_Query(t *testing.T) {
+	_, repo := metrics.NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	g := NewGateway(freeAddr(t), repo, 5*time.Second, 5*time.Second, 5*time.Second)
+
+	newRoute := func(name string, query map[string]string) *route.Route {
+		r, err := route.New(name, "/search", "/", "*", "", []string{"GET"},
+			5*time.Second, 5*time.Second, 5*time.Second, time.Second, time.Second, time.Second, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Query = query
+		return r
+	}
+	if err := g.RegisterRoute(newRoute("default", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterRoute(newRoute("beta", map[string]string{"version": "beta"})); err != nil {
+		t.Errorf("Expected a route with a different query to be registered, got %v", err)
+	}
+	if err := g.RegisterRoute(newRoute("beta2", map[string]string{"version": "beta"})); err == nil {
+		t.Error("Expected a route with the same prefix and query to be rejected")
+	}
+}
+
+func Test_PersistSwitchovers_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "switchovers.json")
+
+	// newCanaryGateway returns a gateway whose route has the backends upstream and canary
+	newCanaryGateway := func() (*Gateway, *route.Route) {
+		g := newTestGateway(t, "http://127.0.0.1:1")
+		r := g.GetRoute("test")
+		addr, _ := url.Parse("http://127.0.0.1:2")
+		if _, err := r.AddBackend("canary", addr, &url.URL{}, &url.URL{}, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		return g, r
+	}
+	g, r := newCanaryGateway()
+	go g.PersistSwitchovers(file, time.Hour)
+	if _, err = r.StartSwitchOver("upstream", "canary", nil, time.Hour, 0, 0, 30, nil, nil,
+		true, true, false, 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// the start of the switchover is saved as change
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(file)
+		if strings.Contains(string(b), `"Running"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the running switchover to be saved, got %s", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	g, r = newCanaryGateway()
+	defer g.Shutdown(context.Background())
+	if err = g.RestoreSwitchovers(file); err != nil {
+		t.Fatal(err)
+	}
+	if r.Switchover == nil {
+		t.Fatal("Expected the switchover to be restored")
+	}
+	progress := r.Switchover.Progress()
+	if progress.Status != "Running" || progress.FromWeight != 70 || progress.ToWeight != 30 {
+		t.Errorf("Expected the switchover to resume at 70/30, got %+v", progress)
+	}
+}
+
+func Test_JSONErrors_RequestIDHeader(t *testing.T) {
+	_, repo := metrics.NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	g := NewGateway(freeAddr(t), repo, 5*time.Second, 5*time.Second, 5*time.Second)
+	g.JSONErrors = true
+
+	r, err := route.New("api", "/api/", "/", "*", "", []string{"GET"},
+		5*time.Second, 5*time.Second, 5*time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestIDHeader = "X-Correlation-Id"
+	strategy, err := route.NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+	if err = g.RegisterRoute(r); err != nil {
+		t.Fatal(err)
+	}
+	g.Reload()
+
+	for method, status := range map[string]int{"GET": 404, "POST": 405} {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI("/api/")
+		if method == "GET" {
+			ctx.Request.SetRequestURI("/unknown")
+		}
+		ctx.Request.Header.Set("X-Correlation-Id", "req-1")
+		g.ServeHTTP(ctx)
+
+		envelope := router.ErrorResponse{}
+		if err = json.Unmarshal(ctx.Response.Body(), &envelope); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if ctx.Response.StatusCode() != status || envelope.Error.RequestID != "req-1" {
+			t.Errorf("%s: expected %d with the request ID of the header of the route, got %d %s",
+				method, status, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+}
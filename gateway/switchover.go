@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rgumi/depoy/route"
+	log "github.com/sirupsen/logrus"
+)
+
+// SwitchoverStates returns the states of the active switchovers of all routes
+func (g *Gateway) SwitchoverStates() []route.SwitchoverState {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	states := []route.SwitchoverState{}
+	for _, r := range g.Routes {
+		if switchover := r.CurrentSwitchover(); switchover != nil && switchover.IsActive() {
+			states = append(states, switchover.State())
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Route < states[j].Route })
+	return states
+}
+
+// SaveSwitchovers writes the states of the active switchovers to the file.
+// The file is replaced atomically so that a crash does not leave a partial state
+func (g *Gateway) SaveSwitchovers(file string) error {
+	b, err := json.MarshalIndent(g.SwitchoverStates(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// RestoreSwitchovers reads the states of the switchovers from the file and resumes
+// them on their routes. A missing file is not an error. Switchovers which cannot
+// be restored are skipped
+func (g *Gateway) RestoreSwitchovers(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	states := []route.SwitchoverState{}
+	if err = json.Unmarshal(b, &states); err != nil {
+		return err
+	}
+	for _, state := range states {
+		r := g.GetRoute(state.Route)
+		if r == nil {
+			log.Warnf("Unable to restore Switchover %d as route %s does not exist", state.ID, state.Route)
+			continue
+		}
+		if _, err = r.RestoreSwitchover(state); err != nil {
+			log.Warnf("Unable to restore Switchover %d of %s: %v", state.ID, state.Route, err)
+		}
+	}
+	return nil
+}
+
+// PersistSwitchovers saves the states of the switchovers to the file every interval
+// and whenever a switchover changes until the Gateway is stopped
+func (g *Gateway) PersistSwitchovers(file string, interval time.Duration) {
+	g.mux.Lock()
+	if g.persistKill != nil {
+		g.mux.Unlock()
+		return
+	}
+	kill, done := make(chan struct{}), make(chan struct{})
+	g.persistKill, g.persistDone = kill, done
+	g.mux.Unlock()
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	save := func() {
+		if err := g.SaveSwitchovers(file); err != nil {
+			log.Errorf("Unable to persist switchovers to %s: %v", file, err)
+		}
+	}
+	save()
+	for {
+		select {
+		case <-kill:
+			save()
+			return
+		case <-ticker.C:
+			save()
+		case <-g.switchoverChanged:
+			save()
+		}
+	}
+}
+
+// stopPersisting stops PersistSwitchovers after a last save. It is called
+// before the routes are removed so that their switchovers are resumed on restart
+func (g *Gateway) stopPersisting() {
+	g.mux.Lock()
+	kill, done := g.persistKill, g.persistDone
+	g.persistKill, g.persistDone = nil, nil
+	g.mux.Unlock()
+	if kill == nil {
+		return
+	}
+	close(kill)
+	<-done
+}
+
+// notifySwitchoverChanged triggers a save of the switchovers without blocking
+func (g *Gateway) notifySwitchoverChanged() {
+	select {
+	case g.switchoverChanged <- struct{}{}:
+	default:
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -11,7 +12,6 @@ import (
 	"github.com/rgumi/depoy/gateway"
 	"github.com/rgumi/depoy/metrics"
 	"github.com/rgumi/depoy/statemgt"
-	"github.com/rgumi/depoy/storage"
 	log "github.com/sirupsen/logrus"
 
 	"net/http"
@@ -38,8 +38,21 @@ func main() {
 	}()
 	// set global config
 	flag.Parse()
+	// the token is not the default of the flag so that it is not printed by -h
+	if config.InfluxDBToken == "" {
+		config.InfluxDBToken = os.Getenv("INFLUXDB_TOKEN")
+	}
 	// log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.Level(config.LogLevel))
+	if config.ResponseTimeBuckets != "" {
+		buckets, err := config.ParseBuckets(config.ResponseTimeBuckets)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = metrics.SetResponseTimeBuckets(buckets); err != nil {
+			log.Fatal(err)
+		}
+	}
 	// read config from file if configured
 	if config.ConfigFile != "" {
 		gw = config.LoadFromFile(config.ConfigFile)
@@ -50,12 +63,25 @@ func main() {
 	} else {
 		// if no config file is configured, a new instance will be started
 		_, newMetricsRepo := metrics.NewMetricsRepository(
-			storage.NewLocalStorage(config.RetentionPeriod, config.Granulartiy),
+			config.NewStorage(),
 			config.Granulartiy, config.MetricsChannelPuffersize, config.ScrapeMetricsChannelPuffersize,
 		)
+		newMetricsRepo.ScrapeTimeout = config.ScrapeTimeout
+		newMetricsRepo.ScrapeErrorThreshold = config.ScrapeErrorThreshold
+		newMetricsRepo.ChannelPolicy = config.MetricsChannelPolicy
 		gw = gateway.NewGateway(config.GatewayAddr, newMetricsRepo,
 			config.ReadTimeout, config.WriteTimeout, config.IdleTimeout,
 		)
+		gw.MaxRequestsPerConn = config.MaxRequestsPerConn
+		gw.MaxConnsPerIP = config.MaxConnsPerIP
+		gw.MaxHeaderBytes = config.MaxHeaderBytes
+		gw.DisableKeepalive = config.DisableKeepalive
+	}
+	if config.SwitchoverStateFile != "" {
+		if err := gw.RestoreSwitchovers(config.SwitchoverStateFile); err != nil {
+			log.Errorf("Unable to restore switchovers from %s: %v", config.SwitchoverStateFile, err)
+		}
+		go gw.PersistSwitchovers(config.SwitchoverStateFile, config.SwitchoverStateInterval)
 	}
 	go gw.Run()
 	log.Warnf("Gateway listening on Addr %s", config.GatewayAddr)
@@ -72,20 +98,22 @@ func main() {
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 	sig := <-signalChannel
-	switch sig {
-	case os.Interrupt:
-		log.Warnf(signalMsg, sig)
-
-	case syscall.SIGTERM:
-		log.Warnf(signalMsg, sig)
-
-	case syscall.SIGKILL:
-		log.Warnf(signalMsg, sig)
-	}
+	log.Warnf(signalMsg, sig)
 
+	// the config is persisted before the routes are removed from the Gateway
 	if config.PersistConfigOnExit && config.ConfigFile != "" {
 		config.WriteToFile(st.Gateway, config.ConfigFile)
 	}
 	st.Stop()
+
+	if sig == syscall.SIGTERM {
+		// stop accepting new connections and let in-flight requests finish
+		ctx, cancel := context.WithTimeout(context.Background(), config.DrainGracePeriod)
+		defer cancel()
+		if err := st.Gateway.Shutdown(ctx); err != nil {
+			log.Warnf("Unable to shutdown Gateway within %v (%v)", config.DrainGracePeriod, err)
+		}
+		return
+	}
 	st.Gateway.Stop()
 }
@@ -2,7 +2,7 @@ package metrics
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -41,8 +41,29 @@ var (
 	}
 )
 
+// DefaultScrapeTimeout is the time after which a scrape is cancelled
+const DefaultScrapeTimeout = 5 * time.Second
+
+// DefaultScrapeInterval is the interval of backends which do not configure their own
+const DefaultScrapeInterval = 5 * time.Second
+
+// DefaultScrapeErrorThreshold is the number of consecutive failed scrapes
+// which are tolerated before a ScrapeError alert is sent
+const DefaultScrapeErrorThreshold = 3
+
+// ScrapeErrorMetric is the metric of the alert which is sent if the
+// scrapes of a backend fail repeatedly
+const ScrapeErrorMetric = "ScrapeError"
+
+const (
+	// ChannelPolicyBlock waits until the metrics channel has space
+	ChannelPolicyBlock = "block"
+	// ChannelPolicyDrop drops the metrics of a request if the metrics channel is full
+	ChannelPolicyDrop = "drop"
+)
+
 type Storage interface {
-	Write(string, uuid.UUID, map[string]float64, int64, int64, int)
+	Write(string, uuid.UUID, map[string]float64, int64, int64, int, string)
 	ReadData() map[string]map[uuid.UUID]map[time.Time]storage.Metric
 	ReadBackend(backend uuid.UUID, start, end time.Time) (storage.Metric, error)
 	ReadRoute(route string, start, end time.Time) (storage.Metric, error)
@@ -70,6 +91,7 @@ type Metrics struct {
 	UpstreamResponseTime int64
 	UpstreamRequestTime  int64
 	DownstreamAddr       string
+	RequestID            string
 }
 
 type ScrapeMetrics struct {
@@ -85,23 +107,55 @@ type MonitoredBackend struct {
 	nextTimeout        time.Duration
 	MetricThreshholds  []*conditional.Condition
 	AlertChannel       chan Alert
-	stopMonitoring     chan int // Channel to kill Monitor-Loop
-	stopScraping       chan int
+	ctx                context.Context // cancelled once the backend is removed or the repository is stopped
+	cancel             context.CancelFunc
 	activeAlerts       map[string]*Alert
+	alertsMux          sync.Mutex // guards activeAlerts
 	ScrapeMetrics      []string
+	ScrapeParser       ScrapeParser
+	ScrapeAuth         *ScrapeAuth `yaml:"-" json:"-"`
 	ScrapeInterval     time.Duration
+	MonitoringWindow   time.Duration // timeframe of the rates which are evaluated
+	windowMux          sync.RWMutex  // guards MonitoringWindow
 	ScrapeMetricPuffer map[string]float64
+	pufferMux          sync.RWMutex // guards ScrapeMetricPuffer
+}
+
+// context returns the context of the backend which ends its Monitor- and Scrape-Loop
+func (b *MonitoredBackend) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// puffer returns the metrics of the last scrape
+func (b *MonitoredBackend) puffer() map[string]float64 {
+	b.pufferMux.RLock()
+	defer b.pufferMux.RUnlock()
+	return b.ScrapeMetricPuffer
 }
 
 type Repository struct {
 	Storage              Storage                         `yaml:"-" json:"-"`
 	PromMetrics          *PromMetrics                    `yaml:"-" json:"-"`
 	InChannel            chan (*Metrics)                 `yaml:"-" json:"-"`
+	ChannelPolicy        string                          `yaml:"-" json:"-"` // ChannelPolicyBlock (default) or ChannelPolicyDrop
 	Backends             map[uuid.UUID]*MonitoredBackend `yaml:"backends" json:"backends"`
+	backendsMux          sync.RWMutex                    // guards Backends
 	Granularity          time.Duration
+	ScrapeTimeout        time.Duration // a slow scrape counts as an error
+	ScrapeInterval       time.Duration // interval of backends which are registered without one
+	ScrapeErrorThreshold int           // consecutive failed scrapes before a ScrapeError alert. 0 disables the alert
 	client               *http.Client
 	scrapeMetricsChannel chan (ScrapeMetrics)
-	shutdown             chan int
+	ctx                  context.Context // cancelled once the repository is stopped
+	cancel               context.CancelFunc
+	stopOnce             sync.Once
+	notifiers            []*notifierQueue
+	notifiersMux         sync.RWMutex // guards notifiers
+	statsD               *StatsDSink
+	statsDMux            sync.RWMutex // guards statsD
 }
 
 // NewMetricsRepository creates a new instance of NewMetricsRepository
@@ -113,14 +167,19 @@ func NewMetricsRepository(
 	channel := make(chan *Metrics, metricChannelPuffersize)
 	scrapeMetricsChannel := make(chan ScrapeMetrics, scrapeMetricChannelPuffersize)
 	log.Info("Created new MetricsRepo")
+	ctx, cancel := context.WithCancel(context.Background())
 	repo := &Repository{
 		Storage:              st,
 		PromMetrics:          NewPromMetrics(),
-		client:               http.DefaultClient,
+		client:               &http.Client{},
 		Granularity:          granularity,
+		ScrapeTimeout:        DefaultScrapeTimeout,
+		ScrapeInterval:       DefaultScrapeInterval,
+		ScrapeErrorThreshold: DefaultScrapeErrorThreshold,
 		InChannel:            channel,
 		Backends:             make(map[uuid.UUID]*MonitoredBackend),
-		shutdown:             make(chan int, 1), // Channel to kill Listen-Loop
+		ctx:                  ctx,
+		cancel:               cancel,
 		scrapeMetricsChannel: scrapeMetricsChannel,
 	}
 	go repo.Listen()
@@ -128,20 +187,79 @@ func NewMetricsRepository(
 	return channel, repo
 }
 
+// done returns a channel which is closed once the repository is stopped
+func (m *Repository) done() <-chan struct{} {
+	if m.ctx == nil {
+		return nil
+	}
+	return m.ctx.Done()
+}
+
+// backend returns the monitored backend with the given id
+func (m *Repository) backend(backendID uuid.UUID) (*MonitoredBackend, bool) {
+	m.backendsMux.RLock()
+	defer m.backendsMux.RUnlock()
+	backend, found := m.Backends[backendID]
+	return backend, found
+}
+
+// MonitoringWindow returns the largest monitoring window of the backends which
+// match the route and, if it is not uuid.Nil, the backend ID. If none of them is
+// monitored, 0 is returned
+func (m *Repository) MonitoringWindow(route string, backendID uuid.UUID) time.Duration {
+	var window time.Duration
+	for _, backend := range m.backends() {
+		if (route != "" && backend.Route != route) || (backendID != uuid.Nil && backend.ID != backendID) {
+			continue
+		}
+		backend.windowMux.RLock()
+		if backend.MonitoringWindow > window {
+			window = backend.MonitoringWindow
+		}
+		backend.windowMux.RUnlock()
+	}
+	return window
+}
+
+// backends returns a snapshot of all monitored backends
+func (m *Repository) backends() []*MonitoredBackend {
+	m.backendsMux.RLock()
+	defer m.backendsMux.RUnlock()
+	backends := make([]*MonitoredBackend, 0, len(m.Backends))
+	for _, backend := range m.Backends {
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
 // RegisterBackend adds a new instance to the ScrapingJob
 func (m *Repository) RegisterBackend(
 	routeName string,
 	backendID uuid.UUID,
 	scrapeURL *url.URL,
 	scrapeMetrics []string,
+	scrapeFormat string,
+	scrapeAuth *ScrapeAuth,
 	scrapeInterval time.Duration,
 	metricsTresholds []*conditional.Condition) (<-chan Alert, error) {
 
+	parser, err := NewScrapeParser(scrapeFormat)
+	if err != nil {
+		return nil, err
+	}
+	if err := scrapeAuth.Validate(); err != nil {
+		return nil, err
+	}
+	if scrapeInterval <= 0 {
+		scrapeInterval = m.ScrapeInterval
+	}
+
+	m.backendsMux.Lock()
+	defer m.backendsMux.Unlock()
+
 	// check if backendID is already configured
-	for key := range m.Backends {
-		if key == backendID {
-			return nil, fmt.Errorf("instance with ID %v already exists", key)
-		}
+	if _, found := m.Backends[backendID]; found {
+		return nil, fmt.Errorf("instance with ID %v already exists", backendID)
 	}
 	log.Infof("Registering new Backend %v of %s in MetricsRepo", backendID, routeName)
 	newBackend := &MonitoredBackend{
@@ -153,13 +271,19 @@ func (m *Repository) RegisterBackend(
 		MetricThreshholds:  metricsTresholds,
 		ScrapeInterval:     scrapeInterval,
 		ScrapeMetrics:      scrapeMetrics,
+		ScrapeParser:       parser,
+		ScrapeAuth:         scrapeAuth,
 		ScrapeMetricPuffer: make(map[string]float64),
 		AlertChannel:       make(chan Alert),
-		stopMonitoring:     make(chan int, 1),
-		stopScraping:       make(chan int, 1),
 		activeAlerts:       make(map[string]*Alert),
 	}
 
+	parent := m.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	newBackend.ctx, newBackend.cancel = context.WithCancel(parent)
+
 	// add to PromMetrics
 	log.Infof("Registering new PromMetric %v of %s in MetricsRepo", backendID, routeName)
 	m.PromMetrics.RegisterRouteBackend(routeName, backendID)
@@ -178,33 +302,34 @@ func (m *Repository) RegisterBackend(
 func (m *Repository) RemoveBackend(backendID uuid.UUID) error {
 
 	log.Warnf("Removing MontioringBackend for BackendID: %v", backendID)
+	m.backendsMux.Lock()
+	defer m.backendsMux.Unlock()
 
 	// check if backendID is exists and delete
-	for key := range m.Backends {
-		if key == backendID {
-			// stop monitoring job of backend
-			m.Backends[key].stopMonitoring <- 1
-			m.Backends[key].stopScraping <- 1
-			// Unregister backend
-			delete(m.Backends, key)
-
-			return nil
-		}
-	}
-
-	return fmt.Errorf("Could not find instance with ID %v", backendID)
+	backend, found := m.Backends[backendID]
+	if !found {
+		return fmt.Errorf("Could not find instance with ID %v", backendID)
+	}
+	// stop monitoring and scraping of backend
+	backend.cancel()
+	// Unregister backend
+	delete(m.Backends, backendID)
+	return nil
 }
 
-// Stop cancels the Listen()-Loop and channels are no longer read
+// Stop cancels the Listen()-Loop and the Monitor- and Scrape-Loops of all backends.
+// Alerts which are not yet received are discarded. Stop never blocks and can be
+// called more than once
 func (m *Repository) Stop() {
-	log.Debug("Shutting down listening loop")
-	m.shutdown <- 1
-
-	for _, b := range m.Backends {
-		b.stopMonitoring <- 1
-		b.stopScraping <- 1
-	}
-	m.Storage.Stop()
+	m.stopOnce.Do(func() {
+		log.Debug("Shutting down listening loop")
+		if m.cancel != nil {
+			m.cancel() // the contexts of all backends are derived from it
+		}
+		m.stopNotifiers()
+		m.SetStatsD(nil)
+		m.Storage.Stop()
+	})
 }
 
 // RegisterAlert adds an Alert to the backend for the provided metric
@@ -219,27 +344,71 @@ func (m *Repository) RegisterAlert(backendID uuid.UUID, alertType, metric string
 		SendTime:   time.Time{},
 		EndTime:    time.Time{},
 	}
-	if backend, found := m.Backends[backendID]; found {
+	if backend, found := m.backend(backendID); found {
+		backend.alertsMux.Lock()
 		backend.activeAlerts[metric] = alert
-		backend.AlertChannel <- *alert
+		backend.alertsMux.Unlock()
+		m.sendAlert(backend, *alert)
 	}
 }
 
+// ClearAlert removes the active alert of the backend for the provided metric
+// and sends a resolved alert. This can be used to manually acknowledge an alert
+// which is stuck (e.g. the resolved alert could not be sent)
+func (m *Repository) ClearAlert(backendID uuid.UUID, metric string) error {
+	backend, found := m.backend(backendID)
+	if !found {
+		return fmt.Errorf("Could not find backend with id %v", backendID)
+	}
+
+	backend.alertsMux.Lock()
+	alert, found := backend.activeAlerts[metric]
+	if !found {
+		backend.alertsMux.Unlock()
+		return fmt.Errorf("Backend %v has no active alert for %s", backendID, metric)
+	}
+	delete(backend.activeAlerts, metric)
+	ActiveAlerts.With(
+		prometheus.Labels{
+			"route":   backend.Route,
+			"backend": backend.ID.String(),
+		},
+	).Set(float64(len(backend.activeAlerts)))
+	backend.alertsMux.Unlock()
+
+	log.Warnf("Clearing Alert for %s of %v", metric, backendID)
+	alert.Type = "Resolved"
+	alert.EndTime = time.Now()
+	m.sendAlert(backend, *alert)
+	return nil
+}
+
 // Monitor starts the monitoring-loop of a Backend which checks every interval
 // if an alert needs to be sent
 // activeFor defines for how long a threshhold needs to be reached to
 // send an alert
 // resolveFor defines for how long a alert has to be inactive before resolving it
-func (m *Repository) Monitor(backendID uuid.UUID, interval time.Duration) error {
-	if backend, ok := m.Backends[backendID]; ok {
-		log.Debugf("Starting monitoring of backend %v", backend.ID)
+// window defines the timeframe of the evaluated rates. If it is 0, twice the interval is used
+func (m *Repository) Monitor(backendID uuid.UUID, interval, window time.Duration) error {
+	if backend, ok := m.backend(backendID); ok {
+		if window <= 0 {
+			window = 2 * interval
+		}
+		backend.windowMux.Lock()
+		backend.MonitoringWindow = window
+		backend.windowMux.Unlock()
+		log.Debugf("Starting monitoring of backend %v with a window of %v", backend.ID, window)
 		for {
 			select {
-			case _ = <-backend.stopMonitoring:
+			case _ = <-backend.context().Done():
 				return nil
 			case now := <-time.After(interval):
-				collected, _ := m.ReadRatesOfBackend(backendID, now.Add(-2*interval), now)
+				collected, _ := m.ReadRatesOfBackend(backendID, now.Add(-window), now)
 				log.Tracef("Rates of Backend %v: %v", backendID, collected)
+				// the alerts are sent after the lock is released as sending
+				// blocks until the alert is received (see ClearAlert)
+				alerts := []Alert{}
+				backend.alertsMux.Lock()
 				// loop over every metric that was collected
 				for _, condition := range backend.MetricThreshholds {
 					// get the treshhold for this metric
@@ -266,7 +435,7 @@ func (m *Repository) Monitor(backendID uuid.UUID, interval time.Duration) error
 							if now.After(alert.StartTime.Add(condition.GetActiveFor())) && alert.SendTime.IsZero() {
 								alert.Type = "Alarming"
 								alert.SendTime = now
-								backend.AlertChannel <- *alert
+								alerts = append(alerts, *alert)
 							}
 							// goto next metric
 							continue
@@ -283,7 +452,7 @@ func (m *Repository) Monitor(backendID uuid.UUID, interval time.Duration) error
 						if now.After(alert.EndTime.Add(condition.GetResolveIn())) {
 							alert.Type = "Resolved"
 							alert.Value = currentValue
-							backend.AlertChannel <- *alert
+							alerts = append(alerts, *alert)
 							delete(backend.activeAlerts, condition.Metric)
 							log.Debugf("Resolved Alert for %v", alert)
 						}
@@ -302,22 +471,42 @@ func (m *Repository) Monitor(backendID uuid.UUID, interval time.Duration) error
 						}
 						backend.activeAlerts[condition.Metric] = alert
 						// sending pending alarming to backend
-						backend.AlertChannel <- *alert
+						alerts = append(alerts, *alert)
 						log.Debugf("New alert registered: %v", alert)
 					}
 				}
+				backend.alertsMux.Unlock()
+				for _, alert := range alerts {
+					m.sendAlert(backend, alert)
+				}
 			}
 		}
 	}
 	return fmt.Errorf("Could not find backend with id %v", backendID)
 }
 
+// Send passes the metrics of a request to the Listen-Loop. If the channel is full,
+// Send blocks unless the ChannelPolicy is ChannelPolicyDrop. Then the metrics are
+// dropped and counted by DroppedMetrics
+func (m *Repository) Send(metrics *Metrics) {
+	if m.ChannelPolicy != ChannelPolicyDrop {
+		m.InChannel <- metrics
+		return
+	}
+	select {
+	case m.InChannel <- metrics:
+	default:
+		DroppedMetrics.With(prometheus.Labels{"route": metrics.Route}).Inc()
+		ReleaseMetrics(metrics)
+	}
+}
+
 // Listen listens on all channels and adds Metrics to the storage
 // alarms when a treshhold is reached
 func (m *Repository) Listen() {
 	for {
 		select {
-		case _ = <-m.shutdown:
+		case _ = <-m.done():
 			return // stop listening
 		case metrics := <-m.InChannel:
 			log.Trace(metrics)
@@ -325,30 +514,36 @@ func (m *Repository) Listen() {
 			m.PromMetrics.Update(
 				float64(metrics.UpstreamResponseTime), float64(metrics.ContentLength),
 				metrics.ResponseStatus, metrics.RequestMethod, metrics.Route, metrics.BackendID)
+			if sink := m.StatsD(); sink != nil {
+				sink.Record(metrics)
+			}
 
-			backend, found := m.Backends[metrics.BackendID]
+			backend, found := m.backend(metrics.BackendID)
 			if !found { // check if backend exists (to avoid nil pointer exc)
 				continue
 			}
-			scrapeMetrics := backend.ScrapeMetricPuffer // Get Scrape Metrics for last interval
+			scrapeMetrics := backend.puffer() // Get Scrape Metrics for last interval
 			if scrapeMetrics == nil {
 				m.Storage.Write(
 					metrics.Route, metrics.BackendID, nil, metrics.UpstreamResponseTime,
-					metrics.ContentLength, metrics.ResponseStatus)
+					metrics.ContentLength, metrics.ResponseStatus, metrics.RequestMethod)
 			} else {
 				m.Storage.Write(
 					metrics.Route, metrics.BackendID, scrapeMetrics, metrics.UpstreamResponseTime,
-					metrics.ContentLength, metrics.ResponseStatus)
+					metrics.ContentLength, metrics.ResponseStatus, metrics.RequestMethod)
 			}
 			ReleaseMetrics(metrics) // return obj to obj-pool
 
 		case scrapeMetrics := <-m.scrapeMetricsChannel:
 			log.Trace(scrapeMetrics)
-			backend, found := m.Backends[scrapeMetrics.BackendID]
+			backend, found := m.backend(scrapeMetrics.BackendID)
 			if !found { // check if backend exists (to avoid nil pointer exc)
 				continue
 			}
+			// the puffer is replaced and never modified as it is passed to the storage
+			backend.pufferMux.Lock()
 			backend.ScrapeMetricPuffer = scrapeMetrics.Metrics
+			backend.pufferMux.Unlock()
 		}
 	}
 }
@@ -357,63 +552,159 @@ func (m *Repository) Listen() {
 // and pushes them into the scrapeMetricsChannel
 func (m *Repository) scrapeJob(instance *MonitoredBackend) {
 	// timeout if last scrape was an error
-	time.Sleep(instance.nextTimeout)
-	req, err := http.NewRequest("GET", instance.ScrapeURL.String(), nil)
+	select {
+	case _ = <-instance.context().Done():
+		return
+	case _ = <-time.After(instance.nextTimeout):
+	}
+	ctx, cancel := context.WithTimeout(instance.context(), m.ScrapeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", instance.ScrapeURL.String(), nil)
 	if err != nil {
 		panic(err)
 	}
+	instance.ScrapeAuth.apply(req)
 	log.Tracef("Scraping instance %v", instance.ID)
 	resp, err := m.client.Do(req)
 	if err != nil {
-		instance.Errors++
-		instance.nextTimeout = time.Duration(instance.Errors) * time.Second
+		m.scrapeFailed(instance, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		m.scrapeFailed(instance, fmt.Errorf("Scrape responded with status %d", resp.StatusCode))
 		return
 	}
-	// reset errors counter
-	instance.Errors = 0
-	instance.nextTimeout = 0
 	// got response therefore extract metricValues
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error(err)
+		// the deadline may be exceeded while reading the body
+		m.scrapeFailed(instance, err)
+		return
 	}
-	defer resp.Body.Close()
+	m.scrapeSucceeded(instance)
 	metrics := ScrapeMetrics{
 		BackendID: instance.ID,
 		Metrics:   map[string]float64{},
 	}
+	// all metrics are extracted in a single pass over the body
+	values, err := instance.ScrapeParser.ParseAll(body, instance.ScrapeMetrics)
+	if err != nil {
+		log.Error(err)
+	}
 	for _, name := range instance.ScrapeMetrics {
-		bodyReader := bytes.NewReader(body)
-		value, err := getRowFromBody(bodyReader, name)
-		if err != nil {
-			log.Error(err)
+		value, found := values[name]
+		if !found {
+			value = -1
 		}
 		metrics.Metrics[name] = value
 	}
 	// finished extracting metric values from scrape
-	m.scrapeMetricsChannel <- metrics
+	select {
+	case m.scrapeMetricsChannel <- metrics:
+	case _ = <-instance.context().Done():
+	}
 }
 
-// jobLoop is a loop which executes all ScrapeInstances and waits ScrapeInterval
-// for each ScrapeInstance a goroutine scrapeJob is started
+// scrapeFailed backs off the next scrape of the instance. Once more than
+// ScrapeErrorThreshold consecutive scrapes failed, a ScrapeError alert is sent
+// as the thresholds of the backend can no longer be evaluated
+func (m *Repository) scrapeFailed(instance *MonitoredBackend, err error) {
+	log.Debugf("Failed to scrape instance %v: %v", instance.ID, err)
+	instance.Errors++
+	instance.nextTimeout = time.Duration(instance.Errors) * time.Second
+	if m.ScrapeErrorThreshold <= 0 || instance.Errors <= m.ScrapeErrorThreshold {
+		return
+	}
+
+	instance.alertsMux.Lock()
+	if _, found := instance.activeAlerts[ScrapeErrorMetric]; found {
+		instance.alertsMux.Unlock()
+		return
+	}
+	now := time.Now()
+	alert := &Alert{
+		Type:       "Alarming",
+		BackendID:  instance.ID,
+		Metric:     ScrapeErrorMetric,
+		Threshhold: float64(m.ScrapeErrorThreshold),
+		Value:      float64(instance.Errors),
+		StartTime:  now,
+		SendTime:   now,
+	}
+	instance.activeAlerts[ScrapeErrorMetric] = alert
+	ActiveAlerts.With(
+		prometheus.Labels{
+			"route":   instance.Route,
+			"backend": instance.ID.String(),
+		},
+	).Set(float64(len(instance.activeAlerts)))
+	instance.alertsMux.Unlock()
+
+	log.Warnf("Scraping of %v failed %d times in a row: %v", instance.ID, instance.Errors, err)
+	m.sendAlert(instance, *alert)
+}
+
+// scrapeSucceeded resets the errors of the instance and resolves its ScrapeError alert
+func (m *Repository) scrapeSucceeded(instance *MonitoredBackend) {
+	instance.Errors = 0
+	instance.nextTimeout = 0
+
+	instance.alertsMux.Lock()
+	alert, found := instance.activeAlerts[ScrapeErrorMetric]
+	if !found {
+		instance.alertsMux.Unlock()
+		return
+	}
+	delete(instance.activeAlerts, ScrapeErrorMetric)
+	ActiveAlerts.With(
+		prometheus.Labels{
+			"route":   instance.Route,
+			"backend": instance.ID.String(),
+		},
+	).Set(float64(len(instance.activeAlerts)))
+	instance.alertsMux.Unlock()
+
+	log.Infof("Scraping of %v recovered", instance.ID)
+	alert.Type = "Resolved"
+	alert.Value = 0
+	alert.EndTime = time.Now()
+	m.sendAlert(instance, *alert)
+}
+
+// jobLoop scrapes the backend every ScrapeInterval of the backend. Each
+// backend is scheduled on its own ticker so that a slow scrape does not
+// delay the scrapes of other backends
 func (m *Repository) jobLoop(b *MonitoredBackend) {
+	ticker := time.NewTicker(b.ScrapeInterval)
+	defer ticker.Stop()
 
-	// loop over all scrapeInstances, get metrics and then sleep
 	for {
 		select {
-		case _ = <-b.stopScraping:
+		case _ = <-b.context().Done():
 			return
-		case _ = <-time.After(b.ScrapeInterval):
+		case _ = <-ticker.C:
 			m.scrapeJob(b)
 		}
 	}
-
 }
 
 // ReadRatesOfBackend makes rates (average) of all metrics of the backend within the given timeframe
 func (m *Repository) ReadRatesOfBackend(backend uuid.UUID, start, end time.Time) (map[string]float64, error) {
-	metricRates := make(map[string]float64)
 	current, err := m.Storage.ReadBackend(backend, start, end)
+	return rates(current), err
+}
+
+// ReadRatesOfRoute makes rates (average) of all metrics of the route within the given timeframe.
+// In contrast to the metrics of a backend, these include the errors of all backends of the route
+// as observed by the clients
+func (m *Repository) ReadRatesOfRoute(routeName string, start, end time.Time) (map[string]float64, error) {
+	current, err := m.Storage.ReadRoute(routeName, start, end)
+	return rates(current), err
+}
+
+func rates(current storage.Metric) map[string]float64 {
+	metricRates := make(map[string]float64)
 
 	// there were no responses yet => avoid divison by 0
 	if current.TotalResponses == 0 {
@@ -424,18 +715,41 @@ func (m *Repository) ReadRatesOfBackend(backend uuid.UUID, start, end time.Time)
 	metricRates["4xxRate"] = float64(current.ResponseStatus400) / float64(current.TotalResponses)
 	metricRates["5xxRate"] = float64(current.ResponseStatus500) / float64(current.TotalResponses)
 	metricRates["6xxRate"] = float64(current.ResponseStatus600) / float64(current.TotalResponses)
+	// ErrorRate are all responses which result in a server error for the client
+	metricRates["ErrorRate"] = float64(current.ResponseStatus500+current.ResponseStatus600) / float64(current.TotalResponses)
 	metricRates["ResponseTime"] = current.ResponseTime
 	metricRates["ContentLength"] = float64(current.ContentLength)
 	for customScrapeMetricName, customScrapeMetricValue := range current.CustomMetrics {
 		metricRates[customScrapeMetricName] = customScrapeMetricValue
 	}
-	return metricRates, err
+	// the rates by request method are prefixed with the method, e.g. POST.5xxRate
+	for method, methodMetric := range current.Methods {
+		if methodMetric.TotalResponses == 0 {
+			continue
+		}
+		total := float64(methodMetric.TotalResponses)
+		metricRates[method+".Requests"] = total
+		metricRates[method+".2xxRate"] = float64(methodMetric.ResponseStatus200) / total
+		metricRates[method+".3xxRate"] = float64(methodMetric.ResponseStatus300) / total
+		metricRates[method+".4xxRate"] = float64(methodMetric.ResponseStatus400) / total
+		metricRates[method+".5xxRate"] = float64(methodMetric.ResponseStatus500) / total
+		metricRates[method+".6xxRate"] = float64(methodMetric.ResponseStatus600) / total
+		metricRates[method+".ErrorRate"] = float64(methodMetric.ResponseStatus500+methodMetric.ResponseStatus600) / total
+	}
+	return metricRates
 }
 
 func (m *Repository) GetActiveAlerts() map[uuid.UUID]map[string]*Alert {
 	alertMap := make(map[uuid.UUID]map[string]*Alert)
-	for id, backend := range m.Backends {
-		alertMap[id] = backend.activeAlerts
+	for _, backend := range m.backends() {
+		id := backend.ID
+		backend.alertsMux.Lock()
+		alertMap[id] = make(map[string]*Alert, len(backend.activeAlerts))
+		for metric, alert := range backend.activeAlerts {
+			alertCopy := *alert
+			alertMap[id][metric] = &alertCopy
+		}
+		backend.alertsMux.Unlock()
 	}
 	return alertMap
 }
@@ -444,8 +758,8 @@ func (m *Repository) GetActiveAlerts() map[uuid.UUID]map[string]*Alert {
 func (m *Repository) ReadAllBackends(start, end time.Time, granularity time.Duration) (map[string]map[uuid.UUID]map[time.Time]storage.Metric, error) {
 
 	metricsByBackends := make(map[string]map[uuid.UUID]map[time.Time]storage.Metric)
-	for backendID, backend := range m.Backends {
-
+	for _, backend := range m.backends() {
+		backendID := backend.ID
 		if _, found := metricsByBackends[backend.Route]; !found {
 			metricsByBackends[backend.Route] = make(map[uuid.UUID]map[time.Time]storage.Metric)
 		}
@@ -467,7 +781,7 @@ func (m *Repository) ReadAllRoutes(start, end time.Time, granularity time.Durati
 
 	metricsByRoute := make(map[string]map[time.Time]storage.Metric)
 
-	for _, backend := range m.Backends {
+	for _, backend := range m.backends() {
 		if _, found := metricsByRoute[backend.Route]; !found {
 			metricsByRoute[backend.Route], err = m.ReadRoute(backend.Route, start, end, granularity)
 		}
@@ -475,73 +789,102 @@ func (m *Repository) ReadAllRoutes(start, end time.Time, granularity time.Durati
 	return metricsByRoute, err
 }
 
-func (m *Repository) ReadBackend(backendID uuid.UUID, start, end time.Time, granularity time.Duration) (map[time.Time]storage.Metric, error) {
-	var err error
-	if _, found := m.Backends[backendID]; !found {
-		return nil, fmt.Errorf("Could not find backend with ID %v", backendID)
-	}
+// TimeSeriesPoint is the metric of the granularity which ends at Timestamp
+type TimeSeriesPoint struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Metric    storage.Metric `json:"metric"`
+}
+
+// readTimeSeries splits the timeframe into steps of the granularity and reads
+// the metric of each step in chronological order. The granularity must divide
+// the timeframe. If it is 0, the granularity of the repository is used
+func (m *Repository) readTimeSeries(
+	start, end time.Time, granularity time.Duration,
+	read func(start, end time.Time) (storage.Metric, error)) ([]TimeSeriesPoint, error) {
+
 	if granularity == 0 {
 		granularity = m.Granularity
 	}
+	if granularity <= 0 {
+		return nil, fmt.Errorf("Granularity must be greater than 0")
+	}
 	timeframe := end.Sub(start)
-	// granualrity < MonitoringGranularity is ignored
 	if timeframe < granularity {
-		return nil, fmt.Errorf("Timeframe must be greater than granulartiy (%v > %v)", timeframe, granularity)
+		return nil, fmt.Errorf("Timeframe must be greater than granulartiy (%v must be larger than %v)", timeframe, granularity)
 	}
+	if timeframe%granularity != 0 {
+		return nil, fmt.Errorf("Timeframe %v is not a multiple of the granularity %v", timeframe, granularity)
+	}
+	// only return avg over the timeframe
 	if timeframe == granularity {
-		// only return avg over the timeframe
-		data := make(map[time.Time]storage.Metric, 1)
-		data[time.Now()], err = m.Storage.ReadBackend(backendID, start, end)
-		return data, err
+		metric, err := read(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return []TimeSeriesPoint{{Timestamp: end, Metric: metric}}, nil
 	}
 	// number of timestamped entries
 	steps := int(timeframe / granularity)
-	data := make(map[time.Time]storage.Metric, steps)
-
-	maxTime := start
-	for i := 0; i < steps; i++ {
-		maxTime = maxTime.Add(granularity)
-		data[maxTime], err = m.Storage.ReadBackend(backendID, start, maxTime)
+	series := make([]TimeSeriesPoint, steps)
+	for i := range series {
+		maxTime := start.Add(granularity)
+		metric, err := read(start, maxTime)
 		if err != nil {
 			// errors are ignored and just empty metrics are returned instead
-			data[maxTime] = storage.Metric{}
+			metric = storage.Metric{}
 		}
+		series[i] = TimeSeriesPoint{Timestamp: maxTime, Metric: metric}
 		start = maxTime
 	}
-	return data, nil
+	return series, nil
 }
 
-func (m *Repository) ReadRoute(routeName string, start, end time.Time, granularity time.Duration) (map[time.Time]storage.Metric, error) {
-	var err error
-	if granularity == 0 {
-		granularity = m.Granularity
+// seriesToMap keys the metrics of the time series by their timestamp
+func seriesToMap(series []TimeSeriesPoint) map[time.Time]storage.Metric {
+	data := make(map[time.Time]storage.Metric, len(series))
+	for _, point := range series {
+		data[point.Timestamp] = point.Metric
 	}
-	timeframe := end.Sub(start)
-	// granualrity < MonitoringGranularity is ignored
-	if timeframe < granularity {
-		return nil, fmt.Errorf("Timeframe must be greater than granulartiy (%v must be larger than %v)", timeframe, granularity)
+	return data
+}
+
+// ReadBackendTimeSeries returns the metrics of the backend within the timeframe in
+// steps of the granularity, ordered by time
+func (m *Repository) ReadBackendTimeSeries(backendID uuid.UUID, start, end time.Time, granularity time.Duration) ([]TimeSeriesPoint, error) {
+	if _, found := m.backend(backendID); !found {
+		return nil, fmt.Errorf("Could not find backend with ID %v", backendID)
 	}
-	// only return avg over the timeframe
-	if timeframe == granularity {
-		data := make(map[time.Time]storage.Metric, 1)
-		data[end], err = m.Storage.ReadRoute(routeName, start, end)
-		return data, err
+	return m.readTimeSeries(start, end, granularity, func(start, end time.Time) (storage.Metric, error) {
+		return m.Storage.ReadBackend(backendID, start, end)
+	})
+}
+
+// ReadRouteTimeSeries returns the metrics of the route within the timeframe in
+// steps of the granularity, ordered by time
+func (m *Repository) ReadRouteTimeSeries(routeName string, start, end time.Time, granularity time.Duration) ([]TimeSeriesPoint, error) {
+	return m.readTimeSeries(start, end, granularity, func(start, end time.Time) (storage.Metric, error) {
+		return m.Storage.ReadRoute(routeName, start, end)
+	})
+}
+
+// ReadBackend returns the metrics of the backend within the timeframe in steps
+// of the granularity, keyed by the end of each step
+func (m *Repository) ReadBackend(backendID uuid.UUID, start, end time.Time, granularity time.Duration) (map[time.Time]storage.Metric, error) {
+	series, err := m.ReadBackendTimeSeries(backendID, start, end, granularity)
+	if err != nil {
+		return nil, err
 	}
-	// number of timestamped entries
-	steps := int(timeframe / granularity)
-	data := make(map[time.Time]storage.Metric, steps)
+	return seriesToMap(series), nil
+}
 
-	maxTime := start
-	for i := 0; i < steps; i++ {
-		maxTime = maxTime.Add(granularity)
-		data[maxTime], err = m.Storage.ReadRoute(routeName, start, maxTime)
-		if err != nil {
-			// errors are ignored and just empty metrics are returned instead
-			data[maxTime] = storage.Metric{}
-		}
-		start = maxTime
+// ReadRoute returns the metrics of the route within the timeframe in steps
+// of the granularity, keyed by the end of each step
+func (m *Repository) ReadRoute(routeName string, start, end time.Time, granularity time.Duration) (map[time.Time]storage.Metric, error) {
+	series, err := m.ReadRouteTimeSeries(routeName, start, end, granularity)
+	if err != nil {
+		return nil, err
 	}
-	return data, nil
+	return seriesToMap(series), nil
 }
 
 /*
@@ -584,28 +927,53 @@ func parseFloat(str string) (float64, error) {
 	return baseVal * math.Pow10(int(expVal)), nil
 }
 
-// getRowFromBody reads the body line by line (sep=\n) and checks if the given pattern
-// exists. Returns the value that indeicated by the pattern
+// getRowsFromBody reads the body line by line (sep=\n) once and returns the values
+// of all given patterns. If a pattern exists multiple times, the first row is used.
 // Prometheus format: pattern *space* value
-func getRowFromBody(body io.Reader, pattern string) (float64, error) {
+func getRowsFromBody(body io.Reader, patterns []string) (map[string]float64, error) {
+	values := make(map[string]float64, len(patterns))
+	pending := pendingMetrics(patterns)
+	errs := []string{}
 	scanner := bufio.NewScanner(body)
-	for scanner.Scan() {
+	for len(pending) > 0 && scanner.Scan() {
 		// Prometheus scrape format is metricName space metricValue
 		substrings := strings.Split(scanner.Text(), " ")
 		// Comment rows start with #
-		if substrings[0] == "#" {
+		if substrings[0] == "#" || !pending[substrings[0]] || len(substrings) < 2 {
 			continue
 		}
-		if substrings[0] == pattern {
-			i, err := parseFloat(substrings[1])
-			if err != nil {
-				return -1, err
-			}
-			return i, nil
+		delete(pending, substrings[0])
+		value, err := parseFloat(substrings[1])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
 		}
+		values[substrings[0]] = value
+	}
+	return values, scrapeError(errs, patterns, pending)
+}
 
+// pendingMetrics returns the set of metrics which are not yet found in a scrape
+func pendingMetrics(metrics []string) map[string]bool {
+	pending := make(map[string]bool, len(metrics))
+	for _, metric := range metrics {
+		pending[metric] = true
+	}
+	return pending
+}
+
+// scrapeError combines the errors of a scrape with the metrics which were not found.
+// If there are none, nil is returned
+func scrapeError(errs, metrics []string, pending map[string]bool) error {
+	for _, metric := range metrics {
+		if pending[metric] {
+			errs = append(errs, fmt.Sprintf("Could not find value for given pattern %s", metric))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
 	}
-	return -1, fmt.Errorf("Could not find value for given pattern %s", pattern)
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
 }
 
 func appendToMap(puffer map[string][]float64, input map[string]float64) {
@@ -627,5 +995,6 @@ func AcquireMetrics() *Metrics {
 	return MetricsPool.Get().(*Metrics)
 }
 func ReleaseMetrics(m *Metrics) {
+	*m = Metrics{}
 	MetricsPool.Put(m)
 }
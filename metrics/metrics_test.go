@@ -0,0 +1,377 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/conditional"
+	"github.com/rgumi/depoy/storage"
+)
+
+func Test_Repository_ConcurrentAccess(t *testing.T) {
+	st := storage.NewLocalStorage(time.Minute, time.Second, 0)
+	_, repo := NewMetricsRepository(st, time.Second, 100, 100)
+	defer repo.Stop()
+
+	ids := make([]uuid.UUID, 20)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for _, id := range ids {
+			if _, err := repo.RegisterBackend("test", id, nil, nil, "", nil, time.Second, nil); err != nil {
+				t.Error(err)
+			}
+		}
+		for _, id := range ids {
+			if err := repo.RemoveBackend(id); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, id := range ids {
+			m := AcquireMetrics()
+			m.Route = "test"
+			m.BackendID = id
+			m.ResponseStatus = 200
+			repo.InChannel <- m
+			repo.scrapeMetricsChannel <- ScrapeMetrics{BackendID: id, Metrics: map[string]float64{"cpu": 1}}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, id := range ids {
+			repo.ReadBackend(id, time.Now().Add(-time.Minute), time.Now(), time.Second)
+			repo.GetActiveAlerts()
+			repo.ReadAllBackends(time.Now().Add(-time.Minute), time.Now(), time.Second)
+		}
+	}()
+	wg.Wait()
+
+	if backends := repo.backends(); len(backends) != 0 {
+		t.Errorf("Expected all backends to be removed, got %d", len(backends))
+	}
+}
+
+func Test_ScrapeJob_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	repo.ScrapeTimeout = 100 * time.Millisecond
+
+	scrapeURL, _ := url.Parse(server.URL)
+	instance := &MonitoredBackend{ID: uuid.New(), ScrapeURL: scrapeURL, ScrapeMetrics: []string{"cpu"}}
+
+	start := time.Now()
+	repo.scrapeJob(instance)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the scrape to be cancelled after the timeout, took %v", elapsed)
+	}
+	if instance.Errors != 1 || instance.nextTimeout != time.Second {
+		t.Errorf("Expected the timeout to count as error, got %d errors", instance.Errors)
+	}
+}
+
+// rangeStorage records the timeframes which are read by backend
+type rangeStorage struct {
+	mux    sync.Mutex
+	ranges map[uuid.UUID]time.Duration
+}
+
+func (s *rangeStorage) Write(string, uuid.UUID, map[string]float64, int64, int64, int, string) {}
+func (s *rangeStorage) ReadData() map[string]map[uuid.UUID]map[time.Time]storage.Metric {
+	return nil
+}
+func (s *rangeStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (storage.Metric, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.ranges[backend] = end.Sub(start)
+	return storage.Metric{}, nil
+}
+func (s *rangeStorage) ReadRoute(route string, start, end time.Time) (storage.Metric, error) {
+	return storage.Metric{}, nil
+}
+func (s *rangeStorage) Stop() {}
+
+func Test_Monitor_Window(t *testing.T) {
+	st := &rangeStorage{ranges: make(map[uuid.UUID]time.Duration)}
+	_, repo := NewMetricsRepository(st, time.Second, 10, 10)
+	defer repo.Stop()
+
+	windows := map[uuid.UUID]time.Duration{uuid.New(): 2 * time.Second, uuid.New(): time.Minute, uuid.New(): 0}
+	for id, window := range windows {
+		repo.RegisterBackend("test", id, nil, nil, "", nil, time.Second, nil)
+		go repo.Monitor(id, 10*time.Millisecond, window)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	for id, window := range windows {
+		if window == 0 {
+			window = 20 * time.Millisecond // defaults to twice the interval
+		}
+		if st.ranges[id] != window {
+			t.Errorf("Expected the rates of %v to be read over %v, got %v", id, window, st.ranges[id])
+		}
+	}
+}
+
+// clockStorage returns the seconds between the start of the storage and the
+// end of the read timeframe as TotalResponses
+type clockStorage struct {
+	rangeStorage
+	start time.Time
+}
+
+func (s *clockStorage) ReadRoute(route string, start, end time.Time) (storage.Metric, error) {
+	return storage.Metric{TotalResponses: int(end.Sub(s.start) / time.Second)}, nil
+}
+
+func Test_ReadTimeSeries_ExactFit(t *testing.T) {
+	start := time.Now()
+	st := &clockStorage{start: start}
+	_, repo := NewMetricsRepository(st, time.Second, 10, 10)
+	defer repo.Stop()
+
+	series, err := repo.ReadRouteTimeSeries("test", start, start.Add(10*time.Second), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 5 {
+		t.Fatalf("Expected 5 points, got %d", len(series))
+	}
+	for i, point := range series {
+		seconds := 2 * (i + 1)
+		if !point.Timestamp.Equal(start.Add(time.Duration(seconds)*time.Second)) || point.Metric.TotalResponses != seconds {
+			t.Errorf("Expected point %d to end after %ds, got %+v", i, seconds, point)
+		}
+	}
+
+	series, err = repo.ReadRouteTimeSeries("test", start, start.Add(10*time.Second), 10*time.Second)
+	if err != nil || len(series) != 1 || series[0].Metric.TotalResponses != 10 {
+		t.Errorf("Expected a single point over the timeframe, got %+v (%v)", series, err)
+	}
+}
+
+func Test_ReadTimeSeries_NotDivisible(t *testing.T) {
+	start := time.Now()
+	_, repo := NewMetricsRepository(&clockStorage{start: start}, time.Second, 10, 10)
+	defer repo.Stop()
+
+	if _, err := repo.ReadRouteTimeSeries("test", start, start.Add(10*time.Second), 3*time.Second); err == nil {
+		t.Error("Expected a granularity which does not divide the timeframe to be rejected")
+	}
+	if _, err := repo.ReadRoute("test", start, start.Add(10*time.Second), 3*time.Second); err == nil {
+		t.Error("Expected the timeframe of ReadRoute to be validated")
+	}
+	if _, err := repo.ReadRouteTimeSeries("test", start, start.Add(time.Second), 2*time.Second); err == nil {
+		t.Error("Expected a granularity larger than the timeframe to be rejected")
+	}
+}
+
+func Test_Rates_StatusClasses(t *testing.T) {
+	tests := []struct {
+		current  storage.Metric
+		expected map[string]float64
+	}{
+		{
+			storage.Metric{},
+			map[string]float64{"2xxRate": 0, "5xxRate": 0, "ErrorRate": 0},
+		},
+		{
+			storage.Metric{TotalResponses: 10, ResponseStatus200: 10},
+			map[string]float64{"2xxRate": 1, "4xxRate": 0, "5xxRate": 0},
+		},
+		{
+			storage.Metric{TotalResponses: 10, ResponseStatus200: 7, ResponseStatus400: 2, ResponseStatus500: 1},
+			map[string]float64{"2xxRate": 0.7, "3xxRate": 0, "4xxRate": 0.2, "5xxRate": 0.1, "ErrorRate": 0.1},
+		},
+		{
+			storage.Metric{TotalResponses: 3, ResponseStatus300: 1, ResponseStatus500: 1, ResponseStatus600: 1},
+			map[string]float64{"3xxRate": 1.0 / 3, "5xxRate": 1.0 / 3, "6xxRate": 1.0 / 3, "ErrorRate": 2.0 / 3},
+		},
+	}
+	for i, test := range tests {
+		metricRates := rates(test.current)
+		for key, value := range test.expected {
+			if actual := metricRates[key]; actual != value {
+				t.Errorf("Test %d: expected %s to be %v, got %v", i, key, value, actual)
+			}
+		}
+	}
+}
+
+func Test_Rates_Methods(t *testing.T) {
+	current := storage.Metric{
+		TotalResponses:    4,
+		ResponseStatus200: 3,
+		ResponseStatus500: 1,
+		Methods: map[string]storage.MethodMetric{
+			"GET":  {TotalResponses: 2, ResponseStatus200: 2},
+			"POST": {TotalResponses: 2, ResponseStatus200: 1, ResponseStatus500: 1},
+		},
+	}
+	metricRates := rates(current)
+	expected := map[string]float64{
+		"5xxRate":        0.25,
+		"ErrorRate":      0.25,
+		"GET.Requests":   2,
+		"GET.2xxRate":    1,
+		"GET.5xxRate":    0,
+		"POST.Requests":  2,
+		"POST.5xxRate":   0.5,
+		"POST.ErrorRate": 0.5,
+	}
+	for key, value := range expected {
+		if actual, found := metricRates[key]; !found || actual != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, actual)
+		}
+	}
+	if _, found := metricRates["PUT.5xxRate"]; found {
+		t.Error("Expected no rates of methods without requests")
+	}
+}
+
+// stopsPromptly fails the test if fn does not return within a second
+func stopsPromptly(t *testing.T, name string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %s to return promptly", name)
+	}
+}
+
+func Test_Repository_Stop(t *testing.T) {
+	newRepo := func() *Repository {
+		_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+		return repo
+	}
+
+	t.Run("without backends", func(t *testing.T) {
+		repo := newRepo()
+		stopsPromptly(t, "Stop", repo.Stop)
+		stopsPromptly(t, "a second Stop", repo.Stop)
+	})
+
+	t.Run("monitoring not started", func(t *testing.T) {
+		repo := newRepo()
+		for i := 0; i < 3; i++ {
+			repo.RegisterBackend("test", uuid.New(), nil, nil, "", nil, time.Second, nil)
+		}
+		stopsPromptly(t, "Stop", repo.Stop)
+	})
+
+	t.Run("monitoring and scraping", func(t *testing.T) {
+		// the scrape hangs until the repository is stopped
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+		repo := newRepo()
+		id := uuid.New()
+		scrapeURL, _ := url.Parse(server.URL)
+		repo.RegisterBackend("test", id, scrapeURL, []string{"up"}, "", nil, 10*time.Millisecond, nil)
+		monitoring := make(chan struct{})
+		go func() {
+			repo.Monitor(id, 10*time.Millisecond, 0)
+			close(monitoring)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		stopsPromptly(t, "Stop", repo.Stop)
+		stopsPromptly(t, "Monitor", func() { <-monitoring })
+	})
+
+	t.Run("alert not received", func(t *testing.T) {
+		repo := newRepo()
+		id := uuid.New()
+		repo.RegisterBackend("test", id, nil, nil, "", nil, time.Second, nil)
+		// nobody reads the alert channel of the backend
+		alerting := make(chan struct{})
+		go func() {
+			repo.RegisterAlert(id, "Alarming", "5xxRate", 0.1, 0.5)
+			close(alerting)
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		stopsPromptly(t, "Stop", repo.Stop)
+		stopsPromptly(t, "RegisterAlert", func() { <-alerting })
+	})
+
+	t.Run("backend removed", func(t *testing.T) {
+		repo := newRepo()
+		defer repo.Stop()
+		id := uuid.New()
+		repo.RegisterBackend("test", id, nil, nil, "", nil, time.Second, nil)
+		monitoring := make(chan struct{})
+		go func() {
+			repo.Monitor(id, 10*time.Millisecond, 0)
+			close(monitoring)
+		}()
+		repo.RemoveBackend(id)
+		stopsPromptly(t, "Monitor", func() { <-monitoring })
+	})
+}
+
+func Test_Monitor_ClearAlertConcurrently(t *testing.T) {
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	id := uuid.New()
+	// both thresholds are reached in every cycle as there are no responses
+	conditions := []*conditional.Condition{
+		conditional.NewCondition("5xxRate", "<", 1, time.Nanosecond, time.Nanosecond),
+		conditional.NewCondition("4xxRate", "<", 1, time.Nanosecond, time.Nanosecond),
+	}
+	alerts, err := repo.RegisterBackend("test", id, nil, nil, "", nil, time.Second, conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go repo.Monitor(id, time.Millisecond, 0)
+
+	// the receiver of the alerts reads the active alerts for every alert
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-alerts:
+				repo.GetActiveAlerts()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stopsPromptly(t, "ClearAlert", func() {
+		for cleared := 0; cleared < 10; {
+			if repo.ClearAlert(id, "5xxRate") == nil {
+				cleared++
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// notifierBuffer is the number of alerts which are queued for each notifier.
+	// If the queue is full, alerts are dropped so that the monitoring is never blocked
+	notifierBuffer = 100
+	// DefaultWebhookRetries is the number of retries of a failed webhook
+	DefaultWebhookRetries = 3
+	// DefaultWebhookBackoff is the time before the first retry. It doubles after every retry
+	DefaultWebhookBackoff = time.Second
+)
+
+// Notification is the alert which is passed to notifiers
+type Notification struct {
+	Type      string    `json:"type"`
+	Route     string    `json:"route"`
+	BackendID uuid.UUID `json:"backend_id"`
+	Metric    string    `json:"metric"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// Notifier delivers alerts to an external system
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+type notifierQueue struct {
+	notifier Notifier
+	queue    chan Notification
+}
+
+// AddNotifier registers a notifier which receives every alert of all backends.
+// The notifier is called sequentially in the order the alerts were sent
+func (m *Repository) AddNotifier(n Notifier) {
+	q := &notifierQueue{notifier: n, queue: make(chan Notification, notifierBuffer)}
+	m.notifiersMux.Lock()
+	m.notifiers = append(m.notifiers, q)
+	m.notifiersMux.Unlock()
+
+	go func() {
+		for notification := range q.queue {
+			if err := n.Notify(notification); err != nil {
+				log.Errorf("Failed to send %s alert of %v: %v", notification.Type, notification.BackendID, err)
+			}
+		}
+	}()
+}
+
+// stopNotifiers stops the delivery of alerts to all notifiers
+func (m *Repository) stopNotifiers() {
+	m.notifiersMux.Lock()
+	defer m.notifiersMux.Unlock()
+	for _, q := range m.notifiers {
+		close(q.queue)
+	}
+	m.notifiers = nil
+}
+
+// Notifiers returns all registered notifiers
+func (m *Repository) Notifiers() []Notifier {
+	m.notifiersMux.RLock()
+	defer m.notifiersMux.RUnlock()
+	notifiers := make([]Notifier, len(m.notifiers))
+	for i, q := range m.notifiers {
+		notifiers[i] = q.notifier
+	}
+	return notifiers
+}
+
+// sendAlert passes the alert to the backend and queues it for all notifiers
+func (m *Repository) sendAlert(backend *MonitoredBackend, alert Alert) {
+	select {
+	case backend.AlertChannel <- alert:
+	case _ = <-backend.context().Done():
+		log.Debugf("Discarded %s alert of %v as monitoring is stopped", alert.Type, alert.BackendID)
+		return
+	}
+
+	notification := Notification{
+		Type:      alert.Type,
+		Route:     backend.Route,
+		BackendID: alert.BackendID,
+		Metric:    alert.Metric,
+		Threshold: alert.Threshhold,
+		Value:     alert.Value,
+		StartTime: alert.StartTime,
+		EndTime:   alert.EndTime,
+	}
+	m.notifiersMux.RLock()
+	defer m.notifiersMux.RUnlock()
+	for _, q := range m.notifiers {
+		select {
+		case q.queue <- notification:
+		default:
+			log.Warnf("Dropped %s alert of %v as the notifier is busy", alert.Type, alert.BackendID)
+		}
+	}
+}
+
+// WebhookNotifier posts every alert as JSON to the URL. If a template is set,
+// the body is rendered from the template with the Notification as data
+type WebhookNotifier struct {
+	URL      string
+	Template string
+	Retries  int
+	Backoff  time.Duration // doubles after every failed attempt
+	client   *http.Client
+	tmpl     *template.Template
+}
+
+// NewWebhookNotifier returns a new WebhookNotifier. The template can use the
+// function json to encode values, e.g. {"text": {{json .Metric}}}
+func NewWebhookNotifier(url, tmpl string, retries int, backoff time.Duration) (*WebhookNotifier, error) {
+	if url == "" {
+		return nil, fmt.Errorf("Webhook URL cannot be empty")
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("Webhook retries cannot be negative")
+	}
+	w := &WebhookNotifier{
+		URL:      url,
+		Template: tmpl,
+		Retries:  retries,
+		Backoff:  backoff,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if tmpl != "" {
+		var err error
+		w.tmpl, err = template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid webhook template: %v", err)
+		}
+	}
+	return w, nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Notify posts the notification. Failed requests are retried with backoff
+func (w *WebhookNotifier) Notify(n Notification) error {
+	var body []byte
+	var err error
+	if w.tmpl != nil {
+		buf := new(bytes.Buffer)
+		err = w.tmpl.Execute(buf, n)
+		body = buf.Bytes()
+	} else {
+		body, err = json.Marshal(n)
+	}
+	if err != nil {
+		return err
+	}
+	return postWithRetries(w.client, w.URL, body, w.Retries, w.Backoff)
+}
+
+// postWithRetries posts the JSON body to the url until it is accepted
+func postWithRetries(client *http.Client, url string, body []byte, retries int, backoff time.Duration) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var resp *http.Response
+		resp, err = client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return err
+}
+
+// colors of the Slack attachments by alert type
+var slackColors = map[string]string{
+	"Pending":  "#daa038",
+	"Alarming": "#d00000",
+	"Resolved": "#2eb886",
+}
+
+// SlackNotifier posts every alert as message to a Slack incoming webhook.
+// A Resolved alert which arrives within Debounce of its Alarming is not posted
+type SlackNotifier struct {
+	URL      string
+	Debounce time.Duration
+	Retries  int
+	Backoff  time.Duration // doubles after every failed attempt
+	client   *http.Client
+	now      func() time.Time
+	alarming map[string]time.Time // time of the posted Alarming by backend and metric
+}
+
+// NewSlackNotifier returns a new SlackNotifier which posts to the incoming webhook url
+func NewSlackNotifier(url string, debounce time.Duration, retries int, backoff time.Duration) (*SlackNotifier, error) {
+	if url == "" {
+		return nil, fmt.Errorf("Slack webhook URL cannot be empty")
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("Slack webhook retries cannot be negative")
+	}
+	return &SlackNotifier{
+		URL:      url,
+		Debounce: debounce,
+		Retries:  retries,
+		Backoff:  backoff,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+		alarming: make(map[string]time.Time),
+	}, nil
+}
+
+// Notify posts the notification as Slack message. It is not safe for concurrent
+// use which is ensured by the repository
+func (s *SlackNotifier) Notify(n Notification) error {
+	key := n.BackendID.String() + "/" + n.Metric
+	switch n.Type {
+	case "Alarming":
+		s.alarming[key] = s.now()
+	case "Resolved":
+		alarmed, found := s.alarming[key]
+		delete(s.alarming, key)
+		if found && s.now().Sub(alarmed) < s.Debounce {
+			log.Debugf("Suppressed flapping alert of %s", key)
+			return nil
+		}
+	}
+	body, err := json.Marshal(slackMessage(n))
+	if err != nil {
+		return err
+	}
+	return postWithRetries(s.client, s.URL, body, s.Retries, s.Backoff)
+}
+
+func slackMessage(n Notification) map[string]interface{} {
+	mrkdwn := func(text string) map[string]string {
+		return map[string]string{"type": "mrkdwn", "text": text}
+	}
+	summary := fmt.Sprintf("*%s*: %s of backend %v of route %s", n.Type, n.Metric, n.BackendID, n.Route)
+	return map[string]interface{}{
+		"text": summary, // fallback of notifications
+		"attachments": []map[string]interface{}{{
+			"color": slackColors[n.Type],
+			"blocks": []map[string]interface{}{
+				{"type": "section", "text": mrkdwn(summary)},
+				{"type": "section", "fields": []map[string]string{
+					mrkdwn(fmt.Sprintf("*Threshold*\n%v", n.Threshold)),
+					mrkdwn(fmt.Sprintf("*Value*\n%v", n.Value)),
+				}},
+			},
+		}},
+	}
+}
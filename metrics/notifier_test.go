@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/storage"
+)
+
+// webhookServer passes every accepted body to the channel. The given number
+// of requests is answered with 500 before any request is accepted
+func webhookServer(failures int32) (*httptest.Server, chan []byte) {
+	bodies := make(chan []byte, 10)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	return server, bodies
+}
+
+func newAlertingRepository(t *testing.T, backendID uuid.UUID) *Repository {
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	alerts, err := repo.RegisterBackend("test", backendID, nil, nil, "", nil, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range alerts {
+		}
+	}()
+	return repo
+}
+
+func receiveNotification(t *testing.T, bodies chan []byte) Notification {
+	var n Notification
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Fatalf("Expected a JSON notification, got %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the webhook to receive a notification")
+	}
+	return n
+}
+
+func Test_WebhookNotifier_Lifecycle(t *testing.T) {
+	server, bodies := webhookServer(1)
+	defer server.Close()
+
+	backendID := uuid.New()
+	repo := newAlertingRepository(t, backendID)
+	defer repo.Stop()
+	notifier, err := NewWebhookNotifier(server.URL, "", 2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.AddNotifier(notifier)
+
+	repo.RegisterAlert(backendID, "Alarming", "5xxRate", 0.1, 0.5)
+	repo.ClearAlert(backendID, "5xxRate")
+
+	alarming := receiveNotification(t, bodies)
+	if alarming.Type != "Alarming" || alarming.Route != "test" || alarming.BackendID != backendID ||
+		alarming.Metric != "5xxRate" || alarming.Threshold != 0.1 || alarming.Value != 0.5 {
+		t.Errorf("Unexpected alarming notification %+v", alarming)
+	}
+	resolved := receiveNotification(t, bodies)
+	if resolved.Type != "Resolved" || resolved.EndTime.IsZero() {
+		t.Errorf("Unexpected resolved notification %+v", resolved)
+	}
+}
+
+func Test_WebhookNotifier_Template(t *testing.T) {
+	server, bodies := webhookServer(0)
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL, `{"text": {{json (printf "%s of %s" .Type .Metric)}}}`, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(Notification{Type: "Pending", Metric: `"ResponseTime"`}); err != nil {
+		t.Fatal(err)
+	}
+	if body := string(<-bodies); body != `{"text": "Pending of \"ResponseTime\""}` {
+		t.Errorf("Expected the rendered template, got %s", body)
+	}
+}
+
+func Test_WebhookNotifier_GivesUp(t *testing.T) {
+	server, _ := webhookServer(10)
+	defer server.Close()
+
+	notifier, _ := NewWebhookNotifier(server.URL, "", 1, time.Millisecond)
+	if err := notifier.Notify(Notification{Type: "Alarming"}); err == nil {
+		t.Error("Expected an error once all retries failed")
+	}
+}
+
+func Test_SlackNotifier_Payload(t *testing.T) {
+	server, bodies := webhookServer(0)
+	defer server.Close()
+
+	backendID := uuid.New()
+	notifier, _ := NewSlackNotifier(server.URL, 0, 0, 0)
+	for _, alertType := range []string{"Alarming", "Resolved"} {
+		n := Notification{Type: alertType, Route: "test", BackendID: backendID, Metric: "5xxRate", Threshold: 0.1, Value: 0.5}
+		if err := notifier.Notify(n); err != nil {
+			t.Fatal(err)
+		}
+
+		var message struct {
+			Text        string
+			Attachments []struct {
+				Color  string
+				Blocks []struct {
+					Type   string
+					Text   struct{ Type, Text string }
+					Fields []struct{ Type, Text string }
+				}
+			}
+		}
+		if err := json.Unmarshal(<-bodies, &message); err != nil {
+			t.Fatal(err)
+		}
+		if len(message.Attachments) != 1 || len(message.Attachments[0].Blocks) != 2 {
+			t.Fatalf("Expected one attachment with two blocks, got %+v", message)
+		}
+		attachment := message.Attachments[0]
+		if attachment.Color != slackColors[alertType] {
+			t.Errorf("Expected %s to be colored %s, got %s", alertType, slackColors[alertType], attachment.Color)
+		}
+		summary := attachment.Blocks[0].Text
+		expected := "*" + alertType + "*: 5xxRate of backend " + backendID.String() + " of route test"
+		if summary.Type != "mrkdwn" || summary.Text != expected || message.Text != expected {
+			t.Errorf("Expected the summary %s, got %+v", expected, summary)
+		}
+		if fields := attachment.Blocks[1].Fields; len(fields) != 2 || fields[0].Text != "*Threshold*\n0.1" || fields[1].Text != "*Value*\n0.5" {
+			t.Errorf("Expected threshold and value fields, got %+v", fields)
+		}
+	}
+	if slackColors["Alarming"] != "#d00000" || slackColors["Resolved"] != "#2eb886" {
+		t.Error("Expected Alarming to be red and Resolved to be green")
+	}
+}
+
+func Test_SlackNotifier_Debounce(t *testing.T) {
+	server, bodies := webhookServer(0)
+	defer server.Close()
+
+	now := time.Now()
+	notifier, _ := NewSlackNotifier(server.URL, time.Minute, 0, 0)
+	notifier.now = func() time.Time { return now }
+	backendID := uuid.New()
+	alarming := Notification{Type: "Alarming", BackendID: backendID, Metric: "5xxRate"}
+	resolved := Notification{Type: "Resolved", BackendID: backendID, Metric: "5xxRate"}
+
+	// flapping alert, the resolved is suppressed
+	notifier.Notify(alarming)
+	now = now.Add(30 * time.Second)
+	notifier.Notify(resolved)
+	// the alert stays active for longer than the debounce
+	notifier.Notify(alarming)
+	now = now.Add(2 * time.Minute)
+	notifier.Notify(resolved)
+
+	var types []string
+	for len(bodies) > 0 {
+		var message struct{ Text string }
+		json.Unmarshal(<-bodies, &message)
+		types = append(types, message.Text[:strings.Index(message.Text, ":")])
+	}
+	if strings.Join(types, ",") != "*Alarming*,*Alarming*,*Resolved*" {
+		t.Errorf("Expected the first resolved to be suppressed, got %v", types)
+	}
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"fmt"
 	"strconv"
 	"sync"
 
@@ -28,6 +29,10 @@ type PromMetric struct {
 	PatchRequest      int64
 }
 
+// DefaultResponseTimeBuckets are the upper bounds of the buckets of the
+// response time histogram in milliseconds
+var DefaultResponseTimeBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
 type PromMetrics struct {
 	mux     sync.RWMutex
 	Metrics map[string]map[uuid.UUID]*PromMetric
@@ -61,6 +66,11 @@ var (
 		[]string{"route", "backend", "code", "method"},
 	)
 
+	// ResponseTimeHistogram is the distribution of the upstream response times of the backend
+	// in milliseconds. The buckets can be changed with SetResponseTimeBuckets
+	ResponseTimeHistogram = newResponseTimeHistogram(DefaultResponseTimeBuckets)
+	responseTimeMux       sync.RWMutex // guards ResponseTimeHistogram
+
 	// ActiveAlerts is the amount of alerts that are curretnly active by route & backend
 	ActiveAlerts = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -69,13 +79,133 @@ var (
 		},
 		[]string{"route", "backend"},
 	)
+
+	// AllowlistedRequests is the total amount of requests of allowlisted users
+	AllowlistedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingress_depoy_allowlisted_http_requests",
+			Help: "the total amount of http requests of allowlisted users",
+		},
+		[]string{"route", "backend", "code"},
+	)
+
+	// LingeringRequests is the total amount of requests of sessions which are
+	// pinned to a backend that lingers after a successful switchover
+	LingeringRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingress_depoy_lingering_http_requests",
+			Help: "the total amount of http requests of sessions pinned to a lingering backend",
+		},
+		[]string{"route", "backend"},
+	)
+
+	// RetriedRequests is the total amount of upstream requests which
+	// failed and were retried on another backend
+	RetriedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingress_depoy_retried_http_requests",
+			Help: "the total amount of failed http requests which were retried on another backend",
+		},
+		[]string{"route", "backend"},
+	)
+
+	// FallbackRequests is the total amount of requests which were answered with
+	// the fallback of the route as no backend was active
+	FallbackRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingress_depoy_fallback_http_requests",
+			Help: "the total amount of http requests which were answered with the fallback as no backend was active",
+		},
+		[]string{"route"},
+	)
+
+	// DroppedMetrics is the total amount of metrics of requests which were
+	// dropped as the metrics channel was full
+	DroppedMetrics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingress_depoy_dropped_metrics",
+			Help: "the total amount of request metrics which were dropped as the metrics channel was full",
+		},
+		[]string{"route"},
+	)
+
+	// InFlightRequests is the amount of requests which are currently sent to the backend
+	InFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ingress_depoy_in_flight_http_requests",
+			Help: "the amount of http requests which are currently sent to the backend",
+		},
+		[]string{"route", "backend"},
+	)
+
+	// UpstreamConnections is the amount of open connections to an upstream address
+	UpstreamConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ingress_depoy_upstream_connections",
+			Help: "the amount of open connections to the upstream",
+		},
+		[]string{"upstream"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(TotalHTTPRequests)
 	prometheus.MustRegister(AvgResponseTime)
 	prometheus.MustRegister(AvgContentLength)
+	prometheus.MustRegister(ResponseTimeHistogram)
 	prometheus.MustRegister(ActiveAlerts)
+	prometheus.MustRegister(AllowlistedRequests)
+	prometheus.MustRegister(LingeringRequests)
+	prometheus.MustRegister(RetriedRequests)
+	prometheus.MustRegister(FallbackRequests)
+	prometheus.MustRegister(InFlightRequests)
+	prometheus.MustRegister(DroppedMetrics)
+	prometheus.MustRegister(UpstreamConnections)
+}
+
+func newResponseTimeHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ingress_depoy_response_time",
+			Help:    "the distribution of the upstream response times of the backend in milliseconds",
+			Buckets: buckets,
+		},
+		[]string{"route", "backend"},
+	)
+}
+
+// SetResponseTimeBuckets replaces the response time histogram with one of the
+// given buckets. The observations of the current histogram are dropped
+func SetResponseTimeBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("At least one bucket of the response time histogram is required")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("Buckets of the response time histogram must be strictly increasing")
+		}
+	}
+	histogram := newResponseTimeHistogram(buckets)
+
+	responseTimeMux.Lock()
+	defer responseTimeMux.Unlock()
+	prometheus.Unregister(ResponseTimeHistogram)
+	if err := prometheus.Register(histogram); err != nil {
+		prometheus.MustRegister(ResponseTimeHistogram)
+		return err
+	}
+	ResponseTimeHistogram = histogram
+	return nil
+}
+
+func observeResponseTime(routeName string, backend uuid.UUID, responseTime float64) {
+	responseTimeMux.RLock()
+	defer responseTimeMux.RUnlock()
+	ResponseTimeHistogram.With(
+		prometheus.Labels{
+			"route":   routeName,
+			"backend": backend.String()},
+	).Observe(responseTime)
 }
 
 func (p *PromMetrics) GetCurrentMetrics() map[string]map[uuid.UUID]*PromMetric {
@@ -117,7 +247,9 @@ func (p *PromMetrics) Update(
 	responseTime, contentLength float64,
 	responseStatus int, requestMethod string, routeName string, backend uuid.UUID) {
 
+	p.mux.RLock()
 	promMetric, found := p.Metrics[routeName][backend]
+	p.mux.RUnlock()
 	if !found {
 		return // not registered
 	}
@@ -146,6 +278,8 @@ func (p *PromMetrics) Update(
 			"method":  requestMethod},
 	).Set(p.GetAvgContentLength(routeName, backend))
 
+	observeResponseTime(routeName, backend, responseTime)
+
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramBuckets scrapes the cumulative counts of the response time
+// histogram of the backend from the default registry
+func histogramBuckets(t *testing.T, routeName string, backend uuid.UUID) map[float64]uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "ingress_depoy_response_time" {
+			continue
+		}
+		labels := map[string]string{"route": routeName, "backend": backend.String()}
+	outer:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue outer
+				}
+			}
+			buckets := make(map[float64]uint64)
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+			}
+			return buckets
+		}
+	}
+	return nil
+}
+
+func Test_PromMetrics_ResponseTimeHistogram(t *testing.T) {
+	p := NewPromMetrics()
+	backend := uuid.New()
+	p.RegisterRouteBackend("histogram", backend)
+	for _, responseTime := range []float64{3, 20, 20, 700, 20000} {
+		p.Update(responseTime, 0, 200, "GET", "histogram", backend)
+	}
+
+	expected := map[float64]uint64{5: 1, 10: 1, 25: 3, 50: 3, 100: 3, 250: 3, 500: 3, 1000: 4, 2500: 4, 5000: 4, 10000: 4}
+	buckets := histogramBuckets(t, "histogram", backend)
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected the buckets %v, got %v", expected, buckets)
+	}
+	for bound, count := range expected {
+		if buckets[bound] != count {
+			t.Errorf("Expected %d observations up to %vms, got %d", count, bound, buckets[bound])
+		}
+	}
+
+	// unregistered backends are not observed
+	p.Update(3, 0, 200, "GET", "histogram", uuid.New())
+	if buckets := histogramBuckets(t, "histogram", backend); buckets[5] != 1 {
+		t.Errorf("Expected only the registered backend to be observed, got %v", buckets)
+	}
+}
+
+func Test_SetResponseTimeBuckets(t *testing.T) {
+	defer SetResponseTimeBuckets(DefaultResponseTimeBuckets)
+
+	for _, buckets := range [][]float64{{}, {10, 10}, {100, 50}} {
+		if err := SetResponseTimeBuckets(buckets); err == nil {
+			t.Errorf("Expected the buckets %v to be rejected", buckets)
+		}
+	}
+	if err := SetResponseTimeBuckets([]float64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewPromMetrics()
+	backend := uuid.New()
+	p.RegisterRouteBackend("buckets", backend)
+	p.Update(2, 0, 200, "GET", "buckets", backend)
+
+	buckets := histogramBuckets(t, "buckets", backend)
+	if len(buckets) != 2 || buckets[1] != 0 || buckets[2] != 1 {
+		t.Errorf("Expected the configured buckets, got %v", buckets)
+	}
+}
@@ -0,0 +1,310 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// formats of scraped metric endpoints
+const (
+	ScrapeFormatLine       = "line"       // metricName space metricValue
+	ScrapeFormatPrometheus = "prometheus" // Prometheus text format including labels
+	ScrapeFormatJSON       = "json"       // JSON document, metrics are selected by a dotted path
+)
+
+// ScrapeParser extracts the values of metrics from the body of a scrape
+type ScrapeParser interface {
+	Parse(body []byte, metric string) (float64, error)
+	// ParseAll extracts all metrics in a single pass over the body. Metrics which
+	// cannot be found or parsed are missing in the result and reported in the error
+	ParseAll(body []byte, metrics []string) (map[string]float64, error)
+}
+
+// parseOne extracts a single metric with ParseAll
+func parseOne(p ScrapeParser, body []byte, metric string) (float64, error) {
+	values, err := p.ParseAll(body, []string{metric})
+	if err != nil {
+		return -1, err
+	}
+	return values[metric], nil
+}
+
+// NewScrapeParser returns the parser of the format. If format is empty,
+// the line format is used
+func NewScrapeParser(format string) (ScrapeParser, error) {
+	switch format {
+	case "", ScrapeFormatLine:
+		return lineParser{}, nil
+	case ScrapeFormatPrometheus:
+		return prometheusParser{}, nil
+	case ScrapeFormatJSON:
+		return jsonParser{}, nil
+	}
+	return nil, fmt.Errorf("Unknown scrape format %s", format)
+}
+
+type lineParser struct{}
+
+func (p lineParser) Parse(body []byte, metric string) (float64, error) {
+	return parseOne(p, body, metric)
+}
+
+func (lineParser) ParseAll(body []byte, metrics []string) (map[string]float64, error) {
+	return getRowsFromBody(bytes.NewReader(body), metrics)
+}
+
+// prometheusParser selects a series by its name and an optional label matcher,
+// e.g. http_requests_total{code="200"}. The series must have all labels of
+// the matcher. If multiple series match, the first one is used
+type prometheusParser struct{}
+
+func (p prometheusParser) Parse(body []byte, metric string) (float64, error) {
+	return parseOne(p, body, metric)
+}
+
+// seriesMatcher is a requested metric and its label matcher
+type seriesMatcher struct {
+	metric string
+	labels map[string]string
+}
+
+func (prometheusParser) ParseAll(body []byte, metrics []string) (map[string]float64, error) {
+	values := make(map[string]float64, len(metrics))
+	pending := pendingMetrics(metrics)
+	errs := []string{}
+	// the matchers are grouped by name so that each sample is only parsed once
+	matchers := make(map[string][]seriesMatcher)
+	for _, metric := range metrics {
+		name, labels, err := parseSeries(metric)
+		if err != nil {
+			delete(pending, metric)
+			errs = append(errs, err.Error())
+			continue
+		}
+		matchers[name] = append(matchers[name], seriesMatcher{metric, labels})
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for len(pending) > 0 && scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Comment rows start with #
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, err := splitSample(line)
+		if err != nil {
+			continue
+		}
+		seriesName, labels, err := parseSeries(series)
+		if err != nil {
+			continue
+		}
+		for _, matcher := range matchers[seriesName] {
+			if !pending[matcher.metric] || !matchLabels(labels, matcher.labels) {
+				continue
+			}
+			// if multiple series match, the first one is used
+			delete(pending, matcher.metric)
+			parsed, err := parseFloat(value)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			values[matcher.metric] = parsed
+		}
+	}
+	return values, scrapeError(errs, metrics, pending)
+}
+
+// splitSample splits a sample into the series and its value. An optional
+// timestamp after the value is ignored
+func splitSample(line string) (series, value string, err error) {
+	end := strings.LastIndex(line, "}")
+	if end < 0 {
+		end = strings.IndexAny(line, " \t")
+	} else {
+		end++
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("Invalid sample %s", line)
+	}
+	fields := strings.Fields(line[end:])
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("Invalid sample %s", line)
+	}
+	return line[:end], fields[0], nil
+}
+
+// parseSeries splits name{label="value",...} into the name and its labels
+func parseSeries(series string) (string, map[string]string, error) {
+	start := strings.Index(series, "{")
+	if start < 0 {
+		return strings.TrimSpace(series), nil, nil
+	}
+	if !strings.HasSuffix(series, "}") {
+		return "", nil, fmt.Errorf("Invalid series %s", series)
+	}
+	labels := make(map[string]string)
+	rest := series[start+1 : len(series)-1]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			break
+		}
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return "", nil, fmt.Errorf("Invalid labels of series %s", series)
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimSpace(rest[eq+1:])
+		value, n, err := unquoteLabel(rest)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid labels of series %s", series)
+		}
+		labels[key] = value
+		rest = rest[n:]
+	}
+	return strings.TrimSpace(series[:start]), labels, nil
+}
+
+// unquoteLabel unquotes the label value at the start of s and returns
+// the number of bytes it spans. Label values may contain escaped quotes
+func unquoteLabel(s string) (string, int, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", 0, fmt.Errorf("Label value is not quoted")
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			return value, i + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("Label value is not terminated")
+}
+
+func matchLabels(labels, matcher map[string]string) bool {
+	for key, value := range matcher {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonParser selects a value by a dotted path, e.g. jvm.memory.used.
+// Elements of arrays are selected by their index
+type jsonParser struct{}
+
+func (p jsonParser) Parse(body []byte, metric string) (float64, error) {
+	return parseOne(p, body, metric)
+}
+
+func (jsonParser) ParseAll(body []byte, metrics []string) (map[string]float64, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Invalid JSON scrape: %v", err)
+	}
+	values := make(map[string]float64, len(metrics))
+	errs := []string{}
+	for _, metric := range metrics {
+		value, err := jsonValue(doc, metric)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		values[metric] = value
+	}
+	return values, scrapeError(errs, nil, nil)
+}
+
+// jsonValue selects the value of the dotted path in the decoded document
+func jsonValue(doc interface{}, metric string) (float64, error) {
+	for _, key := range strings.Split(metric, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			doc = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return -1, fmt.Errorf("Could not find value for given pattern %s", metric)
+			}
+			doc = node[i]
+		default:
+			return -1, fmt.Errorf("Could not find value for given pattern %s", metric)
+		}
+	}
+	switch value := doc.(type) {
+	case json.Number:
+		return value.Float64()
+	case string:
+		return parseFloat(value)
+	case bool:
+		if value {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return -1, fmt.Errorf("Could not find value for given pattern %s", metric)
+}
+
+// ScrapeAuth are the credentials which are sent with every scrape. Either basic auth
+// or a token can be used. Values of the form ${NAME} are read from the environment
+// variable NAME, so that secrets do not need to be stored in the config
+type ScrapeAuth struct {
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	Token    string `json:"token,omitempty" yaml:"token,omitempty"`
+	Header   string `json:"header,omitempty" yaml:"header,omitempty"` // default Authorization with a Bearer token
+}
+
+// Validate checks that only one kind of credentials is configured
+func (a *ScrapeAuth) Validate() error {
+	if a == nil {
+		return nil
+	}
+	if a.Token != "" && (a.Username != "" || a.Password != "") {
+		return fmt.Errorf("Scrape auth cannot use a token and basic auth")
+	}
+	if a.Header != "" && a.Token == "" {
+		return fmt.Errorf("Scrape auth header %s requires a token", a.Header)
+	}
+	return nil
+}
+
+// apply adds the credentials to the scrape request
+func (a *ScrapeAuth) apply(req *http.Request) {
+	if a == nil {
+		return
+	}
+	if a.Username != "" || a.Password != "" {
+		req.SetBasicAuth(resolveEnv(a.Username), resolveEnv(a.Password))
+	}
+	if a.Token == "" {
+		return
+	}
+	if a.Header == "" {
+		req.Header.Set("Authorization", "Bearer "+resolveEnv(a.Token))
+		return
+	}
+	req.Header.Set(a.Header, resolveEnv(a.Token))
+}
+
+// resolveEnv returns the value of the environment variable if value is a reference
+// of the form ${NAME}. Otherwise value is returned
+func resolveEnv(value string) string {
+	if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") {
+		return os.Getenv(value[2 : len(value)-1])
+	}
+	return value
+}
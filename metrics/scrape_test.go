@@ -0,0 +1,323 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/storage"
+)
+
+const prometheusBody = `# HELP http_requests_total The total number of requests
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027 1395066363000
+http_requests_total{code="400",method="post"} 3
+http_requests_total{code="500",path="/a \"b\""} 7
+process_cpu_seconds_total 12.47
+`
+
+func Test_PrometheusParser_Labels(t *testing.T) {
+	tests := map[string]float64{
+		`http_requests_total{code="200"}`:               1027,
+		`http_requests_total{code="400",method="post"}`: 3,
+		`http_requests_total{path="/a \"b\""}`:          7,
+		`http_requests_total`:                           1027,
+		`process_cpu_seconds_total`:                     12.47,
+	}
+	parser, _ := NewScrapeParser(ScrapeFormatPrometheus)
+	for metric, expected := range tests {
+		value, err := parser.Parse([]byte(prometheusBody), metric)
+		if err != nil {
+			t.Errorf("Expected %s to be found: %v", metric, err)
+			continue
+		}
+		if value != expected {
+			t.Errorf("Expected %s to be %v, got %v", metric, expected, value)
+		}
+	}
+	if _, err := parser.Parse([]byte(prometheusBody), `http_requests_total{code="404"}`); err == nil {
+		t.Error("Expected an error if no series matches")
+	}
+}
+
+// countingReader counts the bytes which are read from the body
+type countingReader struct {
+	body *bytes.Reader
+	read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += n
+	return n, err
+}
+
+func Test_GetRowsFromBody_OnePass(t *testing.T) {
+	body := []byte("# HELP up\nup 1\nrequests 42\nlatency 0.25\nrequests 7\ninvalid abc\n")
+	reader := &countingReader{body: bytes.NewReader(body)}
+	values, err := getRowsFromBody(reader, []string{"latency", "up", "requests", "invalid", "missing"})
+	if reader.read > len(body) {
+		t.Errorf("Expected the body to be read once, read %d of %d bytes", reader.read, len(body))
+	}
+	expected := map[string]float64{"up": 1, "requests": 42, "latency": 0.25}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected the values %v, got %v", expected, values)
+	}
+	if err == nil || !strings.Contains(err.Error(), "missing") || !strings.Contains(err.Error(), "abc") {
+		t.Errorf("Expected the invalid and missing metrics to be reported, got %v", err)
+	}
+}
+
+func Test_PrometheusParser_ParseAll(t *testing.T) {
+	parser, _ := NewScrapeParser(ScrapeFormatPrometheus)
+	metrics := []string{
+		`http_requests_total{code="400"}`, `http_requests_total`, `process_cpu_seconds_total`,
+		`http_requests_total{code="404"}`, `http_requests_total{code`,
+	}
+	values, err := parser.ParseAll([]byte(prometheusBody), metrics)
+	expected := map[string]float64{
+		`http_requests_total{code="400"}`: 3, `http_requests_total`: 1027, `process_cpu_seconds_total`: 12.47,
+	}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected the values %v, got %v", expected, values)
+	}
+	if err == nil || !strings.Contains(err.Error(), `code="404"`) || !strings.Contains(err.Error(), "Invalid series") {
+		t.Errorf("Expected the missing and invalid series to be reported, got %v", err)
+	}
+}
+
+func Test_ScrapeParser_Unknown(t *testing.T) {
+	if _, err := NewScrapeParser("xml"); err == nil {
+		t.Error("Expected unknown formats to be rejected")
+	}
+	if parser, _ := NewScrapeParser(""); parser != (lineParser{}) {
+		t.Errorf("Expected the line format as default, got %T", parser)
+	}
+}
+
+func Test_ScrapeJob_JSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jvm": {"memory": {"used": 512.5}}, "pools": [{"active": 4}], "healthy": true}`))
+	}))
+	defer server.Close()
+
+	scrapes := make(chan ScrapeMetrics, 1)
+	repo := &Repository{client: &http.Client{}, ScrapeTimeout: time.Second, scrapeMetricsChannel: scrapes}
+
+	scrapeURL, _ := url.Parse(server.URL)
+	parser, _ := NewScrapeParser(ScrapeFormatJSON)
+	instance := &MonitoredBackend{
+		ID:            uuid.New(),
+		ScrapeURL:     scrapeURL,
+		ScrapeMetrics: []string{"jvm.memory.used", "pools.0.active", "healthy"},
+		ScrapeParser:  parser,
+	}
+	repo.scrapeJob(instance)
+
+	scrape := <-scrapes
+	expected := map[string]float64{"jvm.memory.used": 512.5, "pools.0.active": 4, "healthy": 1}
+	for metric, value := range expected {
+		if scrape.Metrics[metric] != value {
+			t.Errorf("Expected %s to be %v, got %v", metric, value, scrape.Metrics[metric])
+		}
+	}
+}
+
+func scrapeWithAuth(t *testing.T, auth *ScrapeAuth, check func(r *http.Request) bool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !check(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	scrapes := make(chan ScrapeMetrics, 1)
+	repo := &Repository{client: &http.Client{}, ScrapeTimeout: time.Second, scrapeMetricsChannel: scrapes}
+	scrapeURL, _ := url.Parse(server.URL)
+	instance := &MonitoredBackend{
+		ID:            uuid.New(),
+		ScrapeURL:     scrapeURL,
+		ScrapeMetrics: []string{"up"},
+		ScrapeParser:  lineParser{},
+		ScrapeAuth:    auth,
+	}
+	repo.scrapeJob(instance)
+
+	scrape := <-scrapes
+	if scrape.Metrics["up"] != 1 {
+		t.Errorf("Expected the authenticated scrape to succeed, got %v", scrape.Metrics)
+	}
+}
+
+func Test_ScrapeAuth_Basic(t *testing.T) {
+	scrapeWithAuth(t, &ScrapeAuth{Username: "depoy", Password: "secret"}, func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "depoy" && password == "secret"
+	})
+}
+
+func Test_ScrapeAuth_TokenFromEnv(t *testing.T) {
+	os.Setenv("DEPOY_TEST_SCRAPE_TOKEN", "abc")
+	defer os.Unsetenv("DEPOY_TEST_SCRAPE_TOKEN")
+
+	scrapeWithAuth(t, &ScrapeAuth{Token: "${DEPOY_TEST_SCRAPE_TOKEN}"}, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer abc"
+	})
+	scrapeWithAuth(t, &ScrapeAuth{Token: "${DEPOY_TEST_SCRAPE_TOKEN}", Header: "X-Api-Key"}, func(r *http.Request) bool {
+		return r.Header.Get("X-Api-Key") == "abc" && r.Header.Get("Authorization") == ""
+	})
+}
+
+func Test_ScrapeAuth_Invalid(t *testing.T) {
+	if err := (&ScrapeAuth{Username: "depoy", Token: "abc"}).Validate(); err == nil {
+		t.Error("Expected basic auth and a token to be rejected")
+	}
+	if err := (&ScrapeAuth{Header: "X-Api-Key"}).Validate(); err == nil {
+		t.Error("Expected a header without token to be rejected")
+	}
+}
+
+func Test_ScrapeJob_ScrapeErrorAlert(t *testing.T) {
+	var scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first 3 scrapes fail
+		if atomic.AddInt32(&scrapes, 1) <= 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	repo.ScrapeErrorThreshold = 2
+	id := uuid.New()
+	alerts, err := repo.RegisterBackend("test", id, nil, []string{"up"}, "", nil, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, _ := repo.backend(id)
+	instance.ScrapeURL, _ = url.Parse(server.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			instance.nextTimeout = 0 // skip the backoff
+			repo.scrapeJob(instance)
+		}
+	}()
+
+	alert := <-alerts
+	if alert.Type != "Alarming" || alert.Metric != ScrapeErrorMetric || alert.Value != 3 {
+		t.Errorf("Expected an alert after the third failed scrape, got %+v", alert)
+	}
+	if n := atomic.LoadInt32(&scrapes); n != 3 {
+		t.Errorf("Expected the alert to be sent after 3 scrapes, got %d", n)
+	}
+	if _, found := repo.GetActiveAlerts()[id][ScrapeErrorMetric]; !found {
+		t.Error("Expected the alert to be active")
+	}
+	alert = <-alerts
+	if alert.Type != "Resolved" || alert.Metric != ScrapeErrorMetric || alert.EndTime.IsZero() {
+		t.Errorf("Expected the alert to be resolved once scraping recovers, got %+v", alert)
+	}
+	<-done
+	if len(repo.GetActiveAlerts()[id]) != 0 {
+		t.Errorf("Expected no active alert, got %v", repo.GetActiveAlerts()[id])
+	}
+}
+
+func Test_JobLoop_Intervals(t *testing.T) {
+	var fast, slow int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			atomic.AddInt32(&fast, 1)
+		} else {
+			atomic.AddInt32(&slow, 1)
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	fastURL, _ := url.Parse(server.URL + "/fast")
+	slowURL, _ := url.Parse(server.URL + "/slow")
+	for _, backend := range []struct {
+		url      *url.URL
+		interval time.Duration
+	}{{fastURL, 20 * time.Millisecond}, {slowURL, 100 * time.Millisecond}} {
+		if _, err := repo.RegisterBackend("test", uuid.New(), backend.url, []string{"up"}, "", nil, backend.interval, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(450 * time.Millisecond)
+
+	// the fast backend is scraped about 22 times, the slow one 4 times
+	fastScrapes, slowScrapes := atomic.LoadInt32(&fast), atomic.LoadInt32(&slow)
+	if slowScrapes < 3 || slowScrapes > 5 {
+		t.Errorf("Expected the slow backend to be scraped 4 times, got %d", slowScrapes)
+	}
+	if fastScrapes < 3*slowScrapes {
+		t.Errorf("Expected the fast backend to be scraped 5 times as often, got %d and %d", fastScrapes, slowScrapes)
+	}
+}
+
+func Test_RegisterBackend_DefaultInterval(t *testing.T) {
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	repo.ScrapeInterval = time.Minute
+	id := uuid.New()
+	repo.RegisterBackend("test", id, nil, nil, "", nil, 0, nil)
+	if backend, _ := repo.backend(id); backend.ScrapeInterval != time.Minute {
+		t.Errorf("Expected the default interval of the repository, got %v", backend.ScrapeInterval)
+	}
+}
+
+// largeScrape returns a Prometheus page of many series and some of its metrics
+func largeScrape() ([]byte, []string) {
+	var body bytes.Buffer
+	metrics := []string{}
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&body, "# TYPE metric_%d gauge\nmetric_%d{instance=\"a\"} %d\n", i, i, i)
+		if i%20 == 19 {
+			metrics = append(metrics, fmt.Sprintf(`metric_%d{instance="a"}`, i))
+		}
+	}
+	return body.Bytes(), metrics
+}
+
+func Benchmark_Scrape_PerMetric(b *testing.B) {
+	body, metrics := largeScrape()
+	parser := prometheusParser{}
+	for i := 0; i < b.N; i++ {
+		for _, metric := range metrics {
+			if _, err := parser.Parse(body, metric); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func Benchmark_Scrape_OnePass(b *testing.B) {
+	body, metrics := largeScrape()
+	parser := prometheusParser{}
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.ParseAll(body, metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statsDBuffer is the number of lines which are queued. If the queue is full,
+// lines are dropped so that the Listen-Loop is never blocked
+const statsDBuffer = 1000
+
+// StatsDSink sends the metrics of every request to a StatsD server via UDP.
+// The lines are tagged in the DogStatsD format
+type StatsDSink struct {
+	Addr       string
+	Prefix     string
+	SampleRate float64 // share of requests which are sent
+	conn       net.Conn
+	queue      chan string
+	kill       chan int
+	closeOnce  sync.Once
+}
+
+// NewStatsDSink returns a new StatsDSink which sends to the udp addr
+func NewStatsDSink(addr, prefix string, sampleRate float64) (*StatsDSink, error) {
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("Sample rate of StatsD must be in (0, 1]")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsDSink{
+		Addr:       addr,
+		Prefix:     prefix,
+		SampleRate: sampleRate,
+		conn:       conn,
+		queue:      make(chan string, statsDBuffer),
+		kill:       make(chan int),
+	}
+	go s.send()
+	return s, nil
+}
+
+func (s *StatsDSink) send() {
+	for {
+		select {
+		case <-s.kill:
+			return
+		case line := <-s.queue:
+			if _, err := s.conn.Write([]byte(line)); err != nil {
+				log.Debugf("Failed to send StatsD metric: %v", err)
+			}
+		}
+	}
+}
+
+// Record queues the request count, response time and content length of the request
+func (s *StatsDSink) Record(m *Metrics) {
+	if s.SampleRate < 1 && rand.Float64() >= s.SampleRate {
+		return
+	}
+	rate := ""
+	if s.SampleRate < 1 {
+		rate = "|@" + strconv.FormatFloat(s.SampleRate, 'f', -1, 64)
+	}
+	tags := fmt.Sprintf("|#route:%s,backend:%v,status:%d", m.Route, m.BackendID, m.ResponseStatus)
+	lines := []string{
+		s.metric("requests") + ":1|c" + rate + tags,
+		s.metric("response_time") + ":" + strconv.FormatInt(m.UpstreamResponseTime, 10) + "|ms" + rate + tags,
+		s.metric("content_length") + ":" + strconv.FormatInt(m.ContentLength, 10) + "|g" + tags,
+	}
+	select {
+	case s.queue <- strings.Join(lines, "\n"):
+	default:
+		log.Debugf("Dropped StatsD metrics of %s", m.Route)
+	}
+}
+
+func (s *StatsDSink) metric(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return s.Prefix + "." + name
+}
+
+// Close stops sending metrics
+func (s *StatsDSink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.kill)
+		s.conn.Close()
+	})
+}
+
+// SetStatsD sets the sink which receives the metrics of every request.
+// The previous sink is closed. If sink is nil, no metrics are sent
+func (m *Repository) SetStatsD(sink *StatsDSink) {
+	m.statsDMux.Lock()
+	defer m.statsDMux.Unlock()
+	if m.statsD != nil {
+		m.statsD.Close()
+	}
+	m.statsD = sink
+}
+
+// StatsD returns the configured StatsDSink or nil
+func (m *Repository) StatsD() *StatsDSink {
+	m.statsDMux.RLock()
+	defer m.statsDMux.RUnlock()
+	return m.statsD
+}
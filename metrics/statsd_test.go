@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/storage"
+)
+
+func Test_StatsDSink_Lines(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, repo := NewMetricsRepository(storage.NewLocalStorage(time.Minute, time.Second, 0), time.Second, 10, 10)
+	defer repo.Stop()
+	sink, err := NewStatsDSink(conn.LocalAddr().String(), "depoy", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.SetStatsD(sink)
+
+	backendID := uuid.New()
+	m := AcquireMetrics()
+	m.Route = "test"
+	m.BackendID = backendID
+	m.ResponseStatus = 502
+	m.UpstreamResponseTime = 42
+	m.ContentLength = 11
+	repo.InChannel <- m
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := "|#route:test,backend:" + backendID.String() + ",status:502"
+	expected := []string{
+		"depoy.requests:1|c" + tags,
+		"depoy.response_time:42|ms" + tags,
+		"depoy.content_length:11|g" + tags,
+	}
+	if lines := string(buf[:n]); lines != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %s", expected, lines)
+	}
+}
+
+func Test_StatsDSink_SampleRate(t *testing.T) {
+	if _, err := NewStatsDSink("127.0.0.1:8125", "", 0); err == nil {
+		t.Error("Expected a sample rate of 0 to be rejected")
+	}
+	sink, err := NewStatsDSink("127.0.0.1:8125", "", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	// the closed sink does not send, all sampled lines stay in the queue
+	for i := 0; i < 1000; i++ {
+		sink.Record(&Metrics{Route: "test"})
+	}
+	if sampled := len(sink.queue); sampled < 400 || sampled > 600 {
+		t.Errorf("Expected about half of the requests to be sampled, got %d", sampled)
+	}
+	if line := <-sink.queue; !strings.HasPrefix(line, "requests:1|c|@0.5|#route:test") {
+		t.Errorf("Expected the sample rate in %s", line)
+	}
+}
@@ -0,0 +1,104 @@
+package route
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// AccessLogLogfmt writes access logs as key=value pairs
+	AccessLogLogfmt = "logfmt"
+	// AccessLogJSON writes access logs as JSON objects
+	AccessLogJSON = "json"
+)
+
+// accessLogBuffer is the number of access log entries which are queued.
+// If the queue is full, entries are dropped so that responses are never blocked
+const accessLogBuffer = 1024
+
+type accessLogEntry struct {
+	logger *log.Logger
+	fields log.Fields
+}
+
+var (
+	accessLogQueue = make(chan accessLogEntry, accessLogBuffer)
+	accessLogOnce  sync.Once
+)
+
+// AccessLog writes a line for every response which is returned to a client
+type AccessLog struct {
+	Format   string    `json:"format" yaml:"format" default:"logfmt"`
+	Disabled bool      `json:"disabled" yaml:"disabled"`
+	Out      io.Writer `json:"-" yaml:"-"` // default os.Stdout
+	once     sync.Once
+	logger   *log.Logger
+}
+
+// Validate checks the format of the access log
+func (a *AccessLog) Validate() error {
+	if a == nil {
+		return nil
+	}
+	switch a.Format {
+	case "", AccessLogLogfmt, AccessLogJSON:
+		return nil
+	}
+	return fmt.Errorf("Unknown access log format %s", a.Format)
+}
+
+func (a *AccessLog) init() {
+	a.logger = log.New()
+	a.logger.SetOutput(os.Stdout)
+	if a.Out != nil {
+		a.logger.SetOutput(a.Out)
+	}
+	if a.Format == AccessLogJSON {
+		a.logger.SetFormatter(&log.JSONFormatter{})
+	} else {
+		a.logger.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	}
+
+	accessLogOnce.Do(func() {
+		go func() {
+			for entry := range accessLogQueue {
+				entry.logger.WithFields(entry.fields).Info("access")
+			}
+		}()
+	})
+}
+
+// log queues an entry of the request. The fields are copied from the metrics
+// as these are released once they are recorded
+func (a *AccessLog) log(m *metrics.Metrics, uri *fasthttp.URI) {
+	if a == nil || a.Disabled {
+		return
+	}
+	a.once.Do(a.init)
+
+	entry := accessLogEntry{
+		logger: a.logger,
+		fields: log.Fields{
+			"route":            m.Route,
+			"method":           m.RequestMethod,
+			"path":             string(uri.Path()),
+			"backend":          m.BackendID.String(),
+			"status":           m.ResponseStatus,
+			"bytes":            m.ContentLength,
+			"upstream_time_ms": m.UpstreamResponseTime,
+			"client":           m.DownstreamAddr,
+			"request_id":       m.RequestID,
+		},
+	}
+	select {
+	case accessLogQueue <- entry:
+	default:
+		log.Debugf("Dropped access log entry of %s", m.Route)
+	}
+}
@@ -0,0 +1,96 @@
+package route
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// lineWriter passes every written line to the channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func accessLogRequest(t *testing.T, accessLog *AccessLog) string {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.Client = &staticClient{contentType: "text/plain", body: "hello"}
+	r.AccessLog = accessLog
+	out := make(lineWriter, 1)
+	accessLog.Out = out
+
+	req := new(fasthttp.Request)
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("/orders")
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}, nil)
+	r.forward(ctx, backendByName(r, "a"), nil)
+
+	select {
+	case line := <-out:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("Expected an access log line")
+	}
+	return ""
+}
+
+func Test_AccessLog_JSON(t *testing.T) {
+	line := accessLogRequest(t, &AccessLog{Format: AccessLogJSON})
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatalf("Expected a JSON line, got %s", line)
+	}
+	expected := map[string]interface{}{
+		"route":  "test",
+		"method": "POST",
+		"path":   "/orders",
+		"status": float64(200),
+		"bytes":  float64(5),
+		"client": "10.1.2.3",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, fields[key])
+		}
+	}
+	for _, key := range []string{"backend", "upstream_time_ms"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("Expected %s to be logged", key)
+		}
+	}
+}
+
+func Test_AccessLog_Logfmt(t *testing.T) {
+	line := accessLogRequest(t, &AccessLog{Format: AccessLogLogfmt})
+
+	for _, field := range []string{"method=POST", "path=/orders", "status=200", "client=10.1.2.3"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Expected %s in %s", field, line)
+		}
+	}
+}
+
+func Test_AccessLog_Disabled(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.Client = &staticClient{contentType: "text/plain", body: "hello"}
+	out := make(lineWriter, 1)
+	r.AccessLog = &AccessLog{Disabled: true, Out: out}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.forward(ctx, backendByName(r, "a"), nil)
+
+	select {
+	case line := <-out:
+		t.Errorf("Expected no access log, got %s", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
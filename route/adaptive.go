@@ -0,0 +1,219 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	latencyWindowSize = 512 // number of recent response times per backend
+	latencyRecompute  = 32  // the percentile is recomputed every n samples
+)
+
+// AdaptiveTimeout sets the timeout of upstream requests to a multiple of the
+// recent p99 response time of the backend, bounded by Floor and Ceiling.
+// If less than MinSamples response times are known, the static timeout is used
+type AdaptiveTimeout struct {
+	Multiplier float64
+	Floor      time.Duration
+	Ceiling    time.Duration
+	MinSamples int
+}
+
+// timeout returns the adaptive timeout based on the latencies of the backend
+func (a *AdaptiveTimeout) timeout(l *latencyWindow) (time.Duration, bool) {
+	p99, ok := l.p99(a.MinSamples)
+	if !ok {
+		return 0, false
+	}
+	timeout := time.Duration(float64(p99) * a.Multiplier)
+	if timeout < a.Floor {
+		timeout = a.Floor
+	}
+	if a.Ceiling > 0 && timeout > a.Ceiling {
+		timeout = a.Ceiling
+	}
+	return timeout, true
+}
+
+// latencyWindow stores the recent response times of a backend
+type latencyWindow struct {
+	mux     sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	next    int
+	count   int
+	cached  time.Duration
+}
+
+func (l *latencyWindow) record(d time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindowSize
+	if l.count < latencyWindowSize {
+		l.count++
+	}
+	if l.count < latencyRecompute || l.next%latencyRecompute == 0 {
+		sorted := make([]time.Duration, l.count)
+		copy(sorted, l.samples[:l.count])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		l.cached = sorted[(len(sorted)*99)/100]
+	}
+}
+
+// p99 returns the 99th percentile of the recent response times. If less than
+// minSamples are recorded, false is returned
+func (l *latencyWindow) p99(minSamples int) (time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.count == 0 || l.count < minSamples {
+		return 0, false
+	}
+	return l.cached, true
+}
+
+// AdaptiveWeights periodically scales the weights of the backends by their response
+// time within Interval. A backend receives its configured weight scaled by
+// (fastest response time / its response time)^Aggressiveness, but at least MinShare
+// of its configured weight and never less than 1. Hence, slower backends receive
+// less traffic but only inactive backends are starved. Backends without responses
+// within Interval keep their configured weight
+type AdaptiveWeights struct {
+	Aggressiveness float64       // how much the response time shifts the weight (0 = configured weights)
+	MinShare       float64       // lower bound of the scale of the configured weight [0, 1]
+	Interval       time.Duration // window of the response times and interval of the recompute (default MonitoringInterval)
+	kill           chan int
+}
+
+// Validate checks the config of the adaptive weights
+func (a *AdaptiveWeights) Validate() error {
+	if a.Aggressiveness < 0 {
+		return fmt.Errorf("Aggressiveness of adaptiveWeights cannot be negative")
+	}
+	if a.MinShare < 0 || a.MinShare > 1 {
+		return fmt.Errorf("MinShare of adaptiveWeights must be within [0, 1]")
+	}
+	if a.Interval < 0 {
+		return fmt.Errorf("Interval of adaptiveWeights cannot be negative")
+	}
+	return nil
+}
+
+// scale returns the scale of the weight of a backend with the response time
+func (a *AdaptiveWeights) scale(fastest, responseTime float64) float64 {
+	scale := math.Pow(fastest/responseTime, a.Aggressiveness)
+	if scale < a.MinShare {
+		return a.MinShare
+	}
+	return scale
+}
+
+// SetAdaptiveWeights starts the adaptive weights of the route. Running adaptive
+// weights are stopped. If a is nil, the configured weights are restored
+func (r *Route) SetAdaptiveWeights(a *AdaptiveWeights) error {
+	if a != nil {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+		if a.Interval == 0 {
+			a.Interval = r.MonitoringInterval
+		}
+	}
+	if r.AdaptiveWeights != nil && r.AdaptiveWeights.kill != nil {
+		r.AdaptiveWeights.kill <- 1
+	}
+	// the configured weights are used until the first recompute
+	r.mux.Lock()
+	r.AdaptiveWeights = a
+	r.weightScales = nil
+	r.mux.Unlock()
+	r.updateWeights()
+	if a != nil {
+		a.kill = make(chan int, 1)
+		go r.runAdaptiveWeights(a)
+	}
+	return nil
+}
+
+func (r *Route) runAdaptiveWeights(a *AdaptiveWeights) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.kill:
+			log.Warnf("Stopping adaptive weights of %s", r.Name)
+			return
+		case now := <-ticker.C:
+			r.adaptWeights(a, now)
+		}
+	}
+}
+
+// adaptWeights recomputes the scales of the weights from the response times
+// of the active backends and updates the distribution
+func (r *Route) adaptWeights(a *AdaptiveWeights, now time.Time) {
+	if r.MetricsRepo == nil || r.MetricsRepo.Storage == nil {
+		return
+	}
+	r.mux.RLock()
+	backends := make([]*Backend, 0, len(r.Backends))
+	for _, backend := range r.Backends {
+		backends = append(backends, backend)
+	}
+	r.mux.RUnlock()
+
+	responseTimes := make(map[uuid.UUID]float64)
+	fastest := 0.0
+	for _, backend := range backends {
+		if !backend.isActive() {
+			continue
+		}
+		rates, err := r.MetricsRepo.ReadRatesOfBackend(backend.ID, now.Add(-a.Interval), now)
+		if err != nil || rates["ResponseTime"] <= 0 {
+			continue
+		}
+		responseTimes[backend.ID] = rates["ResponseTime"]
+		if fastest == 0 || rates["ResponseTime"] < fastest {
+			fastest = rates["ResponseTime"]
+		}
+	}
+	scales := make(map[uuid.UUID]float64, len(responseTimes))
+	for id, responseTime := range responseTimes {
+		scales[id] = a.scale(fastest, responseTime)
+	}
+	log.Debugf("Adapting weights of %s to %v", r.Name, scales)
+
+	r.mux.Lock()
+	if r.AdaptiveWeights != a {
+		// replaced while the response times were read
+		r.mux.Unlock()
+		return
+	}
+	r.weightScales = scales
+	r.mux.Unlock()
+	r.updateWeights()
+}
+
+// effectiveWeight returns the weight of the backend in the distribution which is
+// its configured weight scaled by the adaptive weights. The caller must hold the
+// lock of the route
+func (r *Route) effectiveWeight(backend *Backend) uint8 {
+	scale, found := r.weightScales[backend.ID]
+	if !found || backend.Weigth == 0 {
+		return backend.Weigth
+	}
+	weight := math.Round(float64(backend.Weigth) * scale)
+	if weight < 1 {
+		return 1
+	}
+	return uint8(weight)
+}
@@ -0,0 +1,234 @@
+package route
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/storage"
+)
+
+// latencyStorage returns the injected response time of each backend
+type latencyStorage struct {
+	fakeStorage
+	responseTimes map[uuid.UUID]float64
+}
+
+func (s *latencyStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (storage.Metric, error) {
+	return storage.Metric{TotalResponses: 100, ResponseTime: s.responseTimes[backend]}, nil
+}
+
+func newLatencyRoute(t *testing.T, responseTimes map[string]float64) *Route {
+	r := newTestRoute(t, map[string]uint8{"fast": 50, "slow": 50})
+	st := &latencyStorage{responseTimes: make(map[uuid.UUID]float64)}
+	for name, responseTime := range responseTimes {
+		st.responseTimes[backendByName(r, name).ID] = responseTime
+	}
+	r.MetricsRepo = &metrics.Repository{Storage: st, InChannel: make(chan *metrics.Metrics, 100)}
+	return r
+}
+
+// shareOf returns the share of the backend in the distribution of the route
+func shareOf(r *Route, name string) float64 {
+	for _, entry := range r.Distribution() {
+		if entry.Name == name {
+			return entry.Share
+		}
+	}
+	return 0
+}
+
+func Test_AdaptiveWeights_FasterGainsShare(t *testing.T) {
+	r := newLatencyRoute(t, map[string]float64{"fast": 20, "slow": 80})
+	if share := shareOf(r, "fast"); share != 0.5 {
+		t.Fatalf("Expected the configured share of 0.5, got %v", share)
+	}
+
+	now := time.Now()
+	adapt := func(r *Route, a *AdaptiveWeights) {
+		r.AdaptiveWeights = a
+		r.adaptWeights(a, now)
+	}
+	adapt(r, &AdaptiveWeights{Aggressiveness: 1, Interval: time.Second})
+	proportional := shareOf(r, "fast")
+	// 50 : 50*20/80
+	if proportional < 0.79 || proportional > 0.8 {
+		t.Errorf("Expected the faster backend to gain share, got %v", proportional)
+	}
+	if backendByName(r, "slow").Weigth != 50 {
+		t.Error("Expected the configured weight to be kept")
+	}
+
+	adapt(r, &AdaptiveWeights{Aggressiveness: 0.5, Interval: time.Second})
+	if share := shareOf(r, "fast"); share <= 0.5 || share >= proportional {
+		t.Errorf("Expected a lower aggressiveness to shift less share, got %v", share)
+	}
+
+	// a very slow backend is not starved
+	r = newLatencyRoute(t, map[string]float64{"fast": 1, "slow": 10000})
+	adapt(r, &AdaptiveWeights{Aggressiveness: 1, MinShare: 0.1, Interval: time.Second})
+	if share := shareOf(r, "slow"); share < 0.09 {
+		t.Errorf("Expected the slow backend to keep the minimal share, got %v", share)
+	}
+	adapt(r, &AdaptiveWeights{Aggressiveness: 1, Interval: time.Second})
+	if share := shareOf(r, "slow"); share == 0 {
+		t.Error("Expected the slow backend to keep a weight of at least 1")
+	}
+}
+
+func Test_AdaptiveWeights_MonitoringInterval(t *testing.T) {
+	r := newLatencyRoute(t, map[string]float64{"fast": 20, "slow": 80})
+	r.MonitoringInterval = 20 * time.Millisecond
+	a := &AdaptiveWeights{Aggressiveness: 1}
+	if err := r.SetAdaptiveWeights(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Interval != r.MonitoringInterval {
+		t.Errorf("Expected the monitoring interval by default, got %v", a.Interval)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for shareOf(r, "fast") == 0.5 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the weights to be recomputed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := r.SetAdaptiveWeights(nil); err != nil {
+		t.Fatal(err)
+	}
+	if share := shareOf(r, "fast"); share != 0.5 {
+		t.Errorf("Expected the configured weights to be restored, got %v", share)
+	}
+}
+
+func Test_AdaptiveWeights_Validate(t *testing.T) {
+	if err := (&AdaptiveWeights{Aggressiveness: -1}).Validate(); err == nil {
+		t.Error("Expected a negative aggressiveness to be rejected")
+	}
+	if err := (&AdaptiveWeights{Aggressiveness: 1, MinShare: 1.5}).Validate(); err == nil {
+		t.Error("Expected a minimal share larger than 1 to be rejected")
+	}
+}
+
+func Test_LatencyWindow_P99(t *testing.T) {
+	l := new(latencyWindow)
+	if _, ok := l.p99(0); ok {
+		t.Error("Expected no percentile without samples")
+	}
+	// the percentile is recomputed every latencyRecompute samples
+	for i := 1; i <= 4*latencyRecompute; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := l.p99(4*latencyRecompute + 1); ok {
+		t.Error("Expected no percentile with less than minSamples samples")
+	}
+	if p99, ok := l.p99(4 * latencyRecompute); !ok || p99 != 127*time.Millisecond {
+		t.Errorf("Expected a p99 of 127ms, got %v %t", p99, ok)
+	}
+
+	// only the recent response times are kept
+	for i := 0; i < latencyWindowSize; i++ {
+		l.record(time.Millisecond)
+	}
+	if p99, _ := l.p99(0); p99 != time.Millisecond {
+		t.Errorf("Expected the old response times to be dropped, got %v", p99)
+	}
+}
+
+func Test_AdaptiveTimeout_Bounds(t *testing.T) {
+	l := new(latencyWindow)
+	for i := 0; i < 100; i++ {
+		l.record(100 * time.Millisecond)
+	}
+	tests := []struct {
+		adaptive *AdaptiveTimeout
+		expected time.Duration
+	}{
+		{&AdaptiveTimeout{Multiplier: 3}, 300 * time.Millisecond},
+		{&AdaptiveTimeout{Multiplier: 3, Floor: time.Second}, time.Second},
+		{&AdaptiveTimeout{Multiplier: 3, Ceiling: 200 * time.Millisecond}, 200 * time.Millisecond},
+		{&AdaptiveTimeout{Multiplier: 1.5, Floor: 10 * time.Millisecond, Ceiling: time.Second}, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if timeout, ok := tt.adaptive.timeout(l); !ok || timeout != tt.expected {
+			t.Errorf("Expected a timeout of %v for %+v, got %v", tt.expected, tt.adaptive, timeout)
+		}
+	}
+}
+
+func Test_AdaptiveTimeout_MinSamples(t *testing.T) {
+	addr, _ := url.Parse("http://a:8080")
+	a, err := NewBackend("a", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Timeout = 5 * time.Second
+	r := &Route{
+		Timeout:         time.Second,
+		AdaptiveTimeout: &AdaptiveTimeout{Multiplier: 2, Floor: 20 * time.Millisecond, MinSamples: 10},
+	}
+
+	// too few samples => the static timeout of the backend is used
+	for i := 0; i < 9; i++ {
+		a.latency.record(100 * time.Millisecond)
+	}
+	if timeout := r.requestTimeout(a); timeout != 5*time.Second {
+		t.Errorf("Expected the static timeout before MinSamples, got %v", timeout)
+	}
+	a.latency.record(100 * time.Millisecond)
+	if timeout := r.requestTimeout(a); timeout != 200*time.Millisecond {
+		t.Errorf("Expected twice the p99 as timeout, got %v", timeout)
+	}
+
+	a.latency = new(latencyWindow)
+	for i := 0; i < 10; i++ {
+		a.latency.record(time.Millisecond)
+	}
+	if timeout := r.requestTimeout(a); timeout != 20*time.Millisecond {
+		t.Errorf("Expected the floor as timeout, got %v", timeout)
+	}
+}
+
+func Test_AdaptiveTimeout_Request(t *testing.T) {
+	r, stop := newDelayedRoute(t, 150*time.Millisecond)
+	defer stop()
+	r.AdaptiveTimeout = &AdaptiveTimeout{Multiplier: 2, Floor: 20 * time.Millisecond, MinSamples: 10}
+	a := backendByName(r, "a")
+	a.Timeout = 5 * time.Second
+
+	// too few samples => the static timeout of the backend is used
+	for i := 0; i < 9; i++ {
+		a.latency.record(10 * time.Millisecond)
+	}
+	if timeout := r.requestTimeout(a); timeout != 5*time.Second {
+		t.Fatalf("Expected the static timeout before MinSamples, got %v", timeout)
+	}
+	ctx, err := doRequest(r, "GET", "", a)
+	if err != nil || string(ctx.Response.Body()) != "done" {
+		t.Fatalf("Expected the request to succeed with the static timeout, got %v", err)
+	}
+
+	// the slow request is now a sample as well: p99 = 150ms => 300ms
+	if timeout := r.requestTimeout(a); timeout < 300*time.Millisecond || timeout > 400*time.Millisecond {
+		t.Fatalf("Expected twice the p99 as timeout, got %v", timeout)
+	}
+
+	a.latency = new(latencyWindow)
+	for i := 0; i < 10; i++ {
+		a.latency.record(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if _, err := doRequest(r, "GET", "", a); err == nil {
+		t.Error("Expected the request to time out after the adaptive timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 120*time.Millisecond {
+		t.Errorf("Expected the request to time out after 20ms, took %v", elapsed)
+	}
+	// timeouts are recorded so that the timeout can grow again
+	if p99, _ := a.latency.p99(0); p99 != 20*time.Millisecond {
+		t.Errorf("Expected the timeout to be recorded, got %v", p99)
+	}
+}
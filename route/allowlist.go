@@ -0,0 +1,210 @@
+package route
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Allowlist is used to route requests of specific users to a backend
+// regardless of its weight (e.g. for a beta program). The user is either
+// identified by a claim of a HS256-signed JWT (Authorization: Bearer <token>)
+// or by a header which is only trusted if the request is received from one of
+// the trusted proxies. Unauthenticated requests are never matched
+type Allowlist struct {
+	Claim          string   `json:"claim,omitempty" yaml:"claim,omitempty"`
+	SecretEnv      string   `json:"secret_env,omitempty" yaml:"secretEnv,omitempty"` // env variable which contains the key of the JWT
+	Header         string   `json:"header,omitempty" yaml:"header,omitempty"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty" yaml:"trustedProxies,omitempty"`
+	Users          []string `json:"users" yaml:"users"`
+	Target         string   `json:"target_backend,omitempty" yaml:"targetBackend,omitempty"` // if empty, the target of the active switchover is used
+	secret         []byte
+	trusted        []*net.IPNet
+	users          map[string]struct{}
+}
+
+// Compile validates the allowlist and prepares it for matching
+func (a *Allowlist) Compile() error {
+	if (a.Claim == "") == (a.Header == "") {
+		return fmt.Errorf("Allowlist requires either a claim or a header")
+	}
+
+	if a.Claim != "" {
+		if a.SecretEnv == "" {
+			return fmt.Errorf("Allowlist with a claim requires secretEnv")
+		}
+		secret := os.Getenv(a.SecretEnv)
+		if secret == "" {
+			return fmt.Errorf("Environment variable %s is not set", a.SecretEnv)
+		}
+		a.secret = []byte(secret)
+	}
+
+	if a.Header != "" {
+		if len(a.TrustedProxies) == 0 {
+			return fmt.Errorf("Allowlist with a header requires trustedProxies")
+		}
+		a.trusted = make([]*net.IPNet, 0, len(a.TrustedProxies))
+		for _, proxy := range a.TrustedProxies {
+			if !strings.Contains(proxy, "/") {
+				if strings.Contains(proxy, ":") {
+					proxy += "/128"
+				} else {
+					proxy += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return err
+			}
+			a.trusted = append(a.trusted, ipNet)
+		}
+	}
+
+	a.users = make(map[string]struct{}, len(a.Users))
+	for _, user := range a.Users {
+		a.users[user] = struct{}{}
+	}
+	return nil
+}
+
+// Match returns true if the user of the request is on the allowlist
+func (a *Allowlist) Match(ctx *fasthttp.RequestCtx) bool {
+	user, found := a.User(ctx)
+	if !found {
+		return false
+	}
+	_, found = a.users[user]
+	return found
+}
+
+// User returns the authenticated user of the request. If the user cannot
+// be authenticated, false is returned
+func (a *Allowlist) User(ctx *fasthttp.RequestCtx) (string, bool) {
+	if a.Header != "" {
+		if !a.isTrusted(ctx.RemoteIP()) {
+			return "", false
+		}
+		user := strings.TrimSpace(string(ctx.Request.Header.Peek(a.Header)))
+		return user, user != ""
+	}
+
+	auth := ctx.Request.Header.Peek("Authorization")
+	if len(auth) < 7 || !bytes.EqualFold(auth[:7], []byte("Bearer ")) {
+		return "", false
+	}
+	claims, err := a.verifyToken(string(bytes.TrimSpace(auth[7:])))
+	if err != nil {
+		log.Debugf("Unable to verify token: %v", err)
+		return "", false
+	}
+	user, ok := claims[a.Claim].(string)
+	return user, ok && user != ""
+}
+
+func (a *Allowlist) isTrusted(ip net.IP) bool {
+	for _, ipNet := range a.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyToken validates the signature and expiry of a HS256-signed JWT
+// and returns its claims
+func (a *Allowlist) verifyToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err = json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("Unsupported signing algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("Invalid signature")
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, err
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, found := claims["exp"].(float64); found && now >= exp {
+		return nil, fmt.Errorf("Token is expired")
+	}
+	if nbf, found := claims["nbf"].(float64); found && now < nbf {
+		return nil, fmt.Errorf("Token is not valid yet")
+	}
+	return claims, nil
+}
+
+// allowlistTarget returns the backend to which the request is forced if
+// its user is on the allowlist of the route. Otherwise nil is returned
+func (r *Route) allowlistTarget(ctx *fasthttp.RequestCtx) *Backend {
+	if r.Allowlist == nil || !r.Allowlist.Match(ctx) {
+		return nil
+	}
+
+	if r.Allowlist.Target == "" {
+		if switchover := r.CurrentSwitchover(); switchover != nil && switchover.To.isActive() {
+			return switchover.To
+		}
+		return nil
+	}
+
+	if backend := r.namedBackend(r.Allowlist.Target); backend != nil && backend.isActive() {
+		return backend
+	}
+	return nil
+}
+
+// forwardAllowlisted forwards the request of an allowlisted user to the target.
+// No session cookie is set as the user is matched on every request
+func (r *Route) forwardAllowlisted(ctx *fasthttp.RequestCtx, target *Backend) {
+	log.Debugf("Forwarding allowlisted request to %v", target.ID)
+
+	r.forward(ctx, target, nil)
+	metrics.AllowlistedRequests.With(
+		prometheus.Labels{
+			"route":   r.Name,
+			"backend": target.ID.String(),
+			"code":    strconv.Itoa(ctx.Response.StatusCode())},
+	).Inc()
+}
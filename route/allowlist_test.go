@@ -0,0 +1,257 @@
+package route
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testAllowlistSecret = "DEPOY_TEST_ALLOWLIST_SECRET"
+
+// signToken returns a JWT with the given header and claims signed with HS256
+func signToken(secret string, header, claims map[string]interface{}) string {
+	rawHeader, _ := json.Marshal(header)
+	rawClaims, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(rawHeader) + "." +
+		base64.RawURLEncoding.EncodeToString(rawClaims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func allowlistRequest(remoteIP string, headers map[string]string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 4711}, nil)
+	ctx.Request.SetRequestURI("/")
+	for key, value := range headers {
+		ctx.Request.Header.Set(key, value)
+	}
+	return ctx
+}
+
+func newClaimAllowlist(t *testing.T) *Allowlist {
+	os.Setenv(testAllowlistSecret, "secret")
+	defer os.Unsetenv(testAllowlistSecret)
+
+	a := &Allowlist{Claim: "sub", SecretEnv: testAllowlistSecret, Users: []string{"alice"}, Target: "b"}
+	if err := a.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func Test_Allowlist_Compile(t *testing.T) {
+	os.Setenv(testAllowlistSecret, "secret")
+	defer os.Unsetenv(testAllowlistSecret)
+
+	tests := map[string]struct {
+		allowlist *Allowlist
+		valid     bool
+	}{
+		"claim":                    {&Allowlist{Claim: "sub", SecretEnv: testAllowlistSecret}, true},
+		"header":                   {&Allowlist{Header: "X-User", TrustedProxies: []string{"10.0.0.0/8", "127.0.0.1", "::1"}}, true},
+		"neither claim nor header": {&Allowlist{}, false},
+		"claim and header":         {&Allowlist{Claim: "sub", SecretEnv: testAllowlistSecret, Header: "X-User"}, false},
+		"claim without secret":     {&Allowlist{Claim: "sub"}, false},
+		"unset secret":             {&Allowlist{Claim: "sub", SecretEnv: "DEPOY_TEST_UNSET"}, false},
+		"header without proxies":   {&Allowlist{Header: "X-User"}, false},
+		"invalid proxy":            {&Allowlist{Header: "X-User", TrustedProxies: []string{"10.0.0.0/33"}}, false},
+	}
+	for name, tt := range tests {
+		if err := tt.allowlist.Compile(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", name, tt.valid, err)
+		}
+	}
+}
+
+func Test_Allowlist_Token(t *testing.T) {
+	a := newClaimAllowlist(t)
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+
+	tests := map[string]struct {
+		auth  string
+		user  string
+		match bool
+	}{
+		"valid": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice", "exp": now + 60}),
+			user: "alice", match: true,
+		},
+		"lower case scheme": {
+			auth: "bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice"}),
+			user: "alice", match: true,
+		},
+		"not allowlisted": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "bob"}),
+			user: "bob",
+		},
+		"bad signature": {
+			auth: "Bearer " + signToken("guessed", hs256, map[string]interface{}{"sub": "alice"}),
+		},
+		"alg none": {
+			auth: "Bearer " + signToken("secret", map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "alice"}),
+		},
+		"other algorithm": {
+			auth: "Bearer " + signToken("secret", map[string]interface{}{"alg": "HS512"}, map[string]interface{}{"sub": "alice"}),
+		},
+		"expired": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice", "exp": now - 1}),
+		},
+		"not valid yet": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice", "nbf": now + 60}),
+		},
+		"missing claim": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"name": "alice"}),
+		},
+		"claim is no string": {
+			auth: "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": 42}),
+		},
+		"malformed":       {auth: "Bearer not-a-token"},
+		"malformed parts": {auth: "Bearer a.b.c"},
+		"no bearer":       {auth: "Basic YWxpY2U6c2VjcmV0"},
+		"no header":       {},
+	}
+	for name, tt := range tests {
+		headers := map[string]string{}
+		if tt.auth != "" {
+			headers["Authorization"] = tt.auth
+		}
+		ctx := allowlistRequest("192.0.2.1", headers)
+		if user, _ := a.User(ctx); user != tt.user {
+			t.Errorf("%s: expected user %q, got %q", name, tt.user, user)
+		}
+		if match := a.Match(ctx); match != tt.match {
+			t.Errorf("%s: expected match to be %t, got %t", name, tt.match, match)
+		}
+	}
+}
+
+func Test_Allowlist_Header(t *testing.T) {
+	a := &Allowlist{
+		Header:         "X-Forwarded-User",
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+		Users:          []string{"alice"},
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		remoteIP string
+		user     string
+		match    bool
+	}{
+		"trusted network": {remoteIP: "10.1.2.3", user: "alice", match: true},
+		"trusted proxy":   {remoteIP: "192.0.2.1", user: "alice", match: true},
+		"untrusted peer":  {remoteIP: "192.0.2.2"},
+		"cidr miss":       {remoteIP: "11.0.0.1"},
+	}
+	for name, tt := range tests {
+		ctx := allowlistRequest(tt.remoteIP, map[string]string{"X-Forwarded-User": "alice"})
+		if user, _ := a.User(ctx); user != tt.user {
+			t.Errorf("%s: expected user %q, got %q", name, tt.user, user)
+		}
+		if match := a.Match(ctx); match != tt.match {
+			t.Errorf("%s: expected match to be %t, got %t", name, tt.match, match)
+		}
+	}
+
+	ctx := allowlistRequest("10.1.2.3", map[string]string{"X-Forwarded-User": "  "})
+	if _, found := a.User(ctx); found {
+		t.Error("Expected an empty header of a trusted proxy not to identify a user")
+	}
+}
+
+func Test_Allowlist_Target(t *testing.T) {
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make(map[string]*Backend)
+	for _, name := range []string{"a", "b"} {
+		addr, _ := url.Parse("http://" + name + ":8080")
+		id, err := r.AddBackend(name, addr, &url.URL{}, &url.URL{}, nil, nil, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[name] = r.Backends[id]
+	}
+	r.Allowlist = newClaimAllowlist(t)
+	hs256 := map[string]interface{}{"alg": "HS256"}
+	alice := allowlistRequest("192.0.2.1", map[string]string{
+		"Authorization": "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice"}),
+	})
+	forged := allowlistRequest("192.0.2.1", map[string]string{
+		"Authorization": "Bearer " + signToken("guessed", hs256, map[string]interface{}{"sub": "alice"}),
+	})
+
+	if target := r.allowlistTarget(alice); target != backends["b"] {
+		t.Errorf("Expected the allowlisted user to be forced to b, got %v", target)
+	}
+	if target := r.allowlistTarget(forged); target != nil {
+		t.Errorf("Expected a forged token not to be forced to b, got %v", target.Name)
+	}
+
+	backends["b"].Active = false
+	if target := r.allowlistTarget(alice); target != nil {
+		t.Errorf("Expected an inactive target not to be used, got %v", target.Name)
+	}
+
+	// without a target, the new backend of the active switchover is used
+	r.Allowlist.Target = ""
+	backends["b"].Active = true
+	if target := r.allowlistTarget(alice); target != nil {
+		t.Errorf("Expected no target without a switchover, got %v", target.Name)
+	}
+}
+
+func Test_Allowlist_GetHandler(t *testing.T) {
+	r, client := newLimitedRoute(t, 0)
+	backendAddr := *backendByName(r, "a").Addr
+	backendAddr.Host = "b:8080"
+	if _, err := r.AddBackend("b", &backendAddr, &url.URL{}, &url.URL{}, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	client.status["b:8080"] = 200
+	r.updateWeights()
+	r.Allowlist = newClaimAllowlist(t)
+	r.CORS = &CORS{AllowedOrigins: []string{"https://example.com"}}
+	if err := r.CORS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	handler := r.GetHandler()
+	hs256 := map[string]interface{}{"alg": "HS256"}
+	alice := "Bearer " + signToken("secret", hs256, map[string]interface{}{"sub": "alice"})
+	forged := "Bearer " + signToken("guessed", hs256, map[string]interface{}{"sub": "alice"})
+
+	handler(allowlistRequest("192.0.2.1", map[string]string{"Authorization": alice}))
+	handler(allowlistRequest("192.0.2.1", map[string]string{"Authorization": forged}))
+	if len(client.hosts) != 2 || client.hosts[0] != "b:8080" || client.hosts[1] != "a:8080" {
+		t.Errorf("Expected only the allowlisted user to be forced to b, got %v", client.hosts)
+	}
+
+	// rejected requests are never forwarded, even for allowlisted users
+	ctx := allowlistRequest("192.0.2.1", map[string]string{
+		"Authorization":                 alice,
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "GET",
+	})
+	ctx.Request.Header.SetMethod("OPTIONS")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected the preflight of a disallowed origin to be rejected, got %d", ctx.Response.StatusCode())
+	}
+	if len(client.hosts) != 2 {
+		t.Errorf("Expected the rejected request not to be forwarded, got %v", client.hosts)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/dealancer/validate.v2"
 
@@ -15,20 +17,36 @@ import (
 )
 
 type Backend struct {
-	ID               uuid.UUID                `json:"id" yaml:"id" validate:"empty=false"`
-	Name             string                   `json:"name" yaml:"name" validate:"empty=false"`
-	Addr             *url.URL                 `json:"addr" yaml:"addr"`
-	Weigth           uint8                    `json:"weight" yaml:"weight"`
-	Active           bool                     `json:"active" yaml:"active"`
-	Scrapeurl        *url.URL                 `json:"scrape_url" yaml:"scrapeUrl"`
-	Scrapemetrics    []string                 `json:"scrape_metrics" yaml:"scrapeMetrics"`
-	Metricthresholds []*conditional.Condition `json:"metric_thresholds" yaml:"metricThresholds"`
-	Healthcheckurl   *url.URL                 `json:"healthcheck_url" yaml:"healthcheckUrl"`
-	ActiveAlerts     map[string]metrics.Alert `json:"active_alerts" yaml:"-"`
-	AlertChan        <-chan metrics.Alert     `json:"-" yaml:"-"`
-	updateWeigth     func()
-	mux              sync.Mutex
-	killChan         chan int
+	ID                 uuid.UUID                `json:"id" yaml:"id" validate:"empty=false"`
+	Name               string                   `json:"name" yaml:"name" validate:"empty=false"`
+	Addr               *url.URL                 `json:"addr" yaml:"addr"`
+	Weigth             uint8                    `json:"weight" yaml:"weight"`
+	Active             bool                     `json:"active" yaml:"active"`
+	Scrapeurl          *url.URL                 `json:"scrape_url" yaml:"scrapeUrl"`
+	Scrapemetrics      []string                 `json:"scrape_metrics" yaml:"scrapeMetrics"`
+	ScrapeFormat       string                   `json:"scrape_format,omitempty" yaml:"scrapeFormat,omitempty"` // default line
+	ScrapeAuth         *metrics.ScrapeAuth      `json:"scrape_auth,omitempty" yaml:"scrapeAuth,omitempty"`
+	ScrapeInterval     time.Duration            `json:"scrape_interval" yaml:"scrapeInterval"` // default the scrape interval of the route
+	Metricthresholds   []*conditional.Condition `json:"metric_thresholds" yaml:"metricThresholds"`
+	Healthcheckurl     *url.URL                 `json:"healthcheck_url" yaml:"healthcheckUrl"`
+	Timeout            time.Duration            `json:"timeout" yaml:"timeout"`
+	HealthCheckTimeout time.Duration            `json:"healthcheck_timeout" yaml:"healthcheckTimeout"`
+	HealthCheckProbe   *Probe                   `json:"healthcheck_probe,omitempty" yaml:"healthcheckProbe,omitempty"` // default GET which accepts every response
+	MonitoringWindow   time.Duration            `json:"monitoring_window" yaml:"monitoringWindow"`                     // default twice the monitoring interval
+	Transport          *Transport               `json:"transport,omitempty" yaml:"transport,omitempty"`
+	ActiveAlerts       map[string]metrics.Alert `json:"active_alerts" yaml:"-"`
+	AlertChan          <-chan metrics.Alert     `json:"-" yaml:"-"`
+	updateWeigth       func()
+	mux                sync.Mutex
+	killChan           chan int
+	lingering          int32 // set to 1 while the backend only serves pinned sessions
+	latency            *latencyWindow
+	inFlight           int64                           // number of requests which are currently dispatched to the backend
+	draining           bool                            // set once the backend is removed. It cannot be activated again
+	ejectedUntil       time.Time                       // set while the backend is ejected by the outlier detection
+	alertSubs          map[chan metrics.Alert]struct{} // receive a copy of every alert, e.g. of a switchover
+	health             HealthStatus                    // outcome of the recent healthchecks
+	passing            bool                            // set once the healthchecks reached the healthy threshold until they reach the unhealthy threshold
 }
 
 // NewBackend returns a new base Target
@@ -66,6 +84,7 @@ func NewBackend(
 		Healthcheckurl:   healthCheckAddr,
 		ActiveAlerts:     make(map[string]metrics.Alert),
 		killChan:         make(chan int, 1),
+		latency:          new(latencyWindow),
 	}
 
 	if err := validate.Validate(backend); err != nil {
@@ -74,6 +93,9 @@ func NewBackend(
 
 	// compile conditions to prevent nil-pointers
 	for _, cond := range backend.Metricthresholds {
+		if err := cond.Validate(); err != nil {
+			return nil, err
+		}
 		cond.Compile()
 	}
 
@@ -92,7 +114,7 @@ func (b *Backend) UpdateStatus(status bool) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	if b.Active == status {
+	if b.Active == status || (status && (b.draining || !b.ejectedUntil.IsZero())) {
 		return
 	}
 	b.Active = status
@@ -104,6 +126,70 @@ func (b *Backend) UpdateStatus(status bool) {
 	}
 }
 
+func (b *Backend) isActive() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.Active
+}
+
+// eject deactivates the backend until the given time. Healthchecks cannot
+// activate it in the meantime. Returns false if the backend is not active
+func (b *Backend) eject(until time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.Active || b.draining {
+		return false
+	}
+	b.Active = false
+	b.ejectedUntil = until
+	b.updateWeigth()
+	return true
+}
+
+// readmit activates the ejected backend once its ejection expired
+func (b *Backend) readmit(now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.ejectedUntil.IsZero() || now.Before(b.ejectedUntil) {
+		return false
+	}
+	b.ejectedUntil = time.Time{}
+	if b.draining {
+		return false
+	}
+	b.Active = true
+	b.updateWeigth()
+	return true
+}
+
+// drain deactivates the backend so that it does not receive new requests.
+// Alerts and healthchecks cannot activate it again
+func (b *Backend) drain() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.draining = true
+	b.Active = false
+	if b.updateWeigth != nil {
+		b.updateWeigth()
+	}
+}
+
+// waitForDrain waits until the backend has no in-flight requests or the timeout
+// is reached. Returns false if requests are still in flight
+func (b *Backend) waitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&b.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
 func (b *Backend) Monitor() {
 	if b.AlertChan == nil {
 		panic(fmt.Errorf("Backend %v has no AlertChan set", b.ID))
@@ -115,6 +201,7 @@ func (b *Backend) Monitor() {
 			return
 		case alert := <-b.AlertChan:
 			log.Debugf("Backend %v received %v", b.ID, alert.Type)
+			b.publishAlert(alert)
 			if alert.Type == "Alarming" {
 				// Alarm condition was active for long enought => alarming
 				b.ActiveAlerts[alert.Metric] = alert
@@ -134,6 +221,38 @@ func (b *Backend) Monitor() {
 	}
 }
 
+// subscribeAlerts returns a channel which receives every alert of the backend
+// until the returned func is called
+func (b *Backend) subscribeAlerts() (<-chan metrics.Alert, func()) {
+	ch := make(chan metrics.Alert, 10)
+	b.mux.Lock()
+	if b.alertSubs == nil {
+		b.alertSubs = make(map[chan metrics.Alert]struct{})
+	}
+	b.alertSubs[ch] = struct{}{}
+	b.mux.Unlock()
+
+	return ch, func() {
+		b.mux.Lock()
+		delete(b.alertSubs, ch)
+		b.mux.Unlock()
+	}
+}
+
+// publishAlert passes the alert to all subscribers. If a subscriber is busy,
+// the alert is dropped for it so that the backend is never blocked
+func (b *Backend) publishAlert(alert metrics.Alert) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for ch := range b.alertSubs {
+		select {
+		case ch <- alert:
+		default:
+			log.Warnf("Dropped %s alert of %v as the subscriber is busy", alert.Type, b.ID)
+		}
+	}
+}
+
 func (b *Backend) Stop() {
 	b.killChan <- 1
 	log.Debugf("Killed Backend %v", b.ID)
@@ -0,0 +1,82 @@
+package route
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newDelayedRoute returns a route whose backends a and b forward to an
+// upstream which answers after the delay
+func newDelayedRoute(t *testing.T, delay time.Duration) (*Route, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(delay)
+		ctx.SetBodyString("done")
+	})
+	r := newTestRouteTo(t, ln.Addr().String(), map[string]uint8{"a": 50, "b": 50})
+	r.Timeout = time.Second
+	return r, func() { ln.Close() }
+}
+
+func Test_BackendTimeout(t *testing.T) {
+	r, stop := newDelayedRoute(t, 150*time.Millisecond)
+	defer stop()
+	backendByName(r, "a").Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := doRequest(r, "GET", "", backendByName(r, "a")); err == nil {
+		t.Error("Expected the request to a to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 120*time.Millisecond {
+		t.Errorf("Expected a to time out after its own timeout, took %v", elapsed)
+	}
+
+	ctx, err := doRequest(r, "GET", "", backendByName(r, "b"))
+	if err != nil || string(ctx.Response.Body()) != "done" {
+		t.Errorf("Expected b to use the timeout of the route, got %v %s", err, ctx.Response.Body())
+	}
+}
+
+func Test_HealthCheckTimeout(t *testing.T) {
+	r, stop := newDelayedRoute(t, 150*time.Millisecond)
+	defer stop()
+	backendByName(r, "a").HealthCheckTimeout = 50 * time.Millisecond
+
+	if r.healthCheck(backendByName(r, "a")) {
+		t.Error("Expected the healthcheck of a to time out")
+	}
+	if !r.healthCheck(backendByName(r, "b")) {
+		t.Errorf("Expected the healthcheck of b to use the timeout of the route, got %+v", backendByName(r, "b").Health())
+	}
+}
+
+func Test_AddExistingBackend_Timeouts(t *testing.T) {
+	src := newTestRoute(t, map[string]uint8{"a": 50})
+	backend := backendByName(src, "a")
+	backend.Timeout = 50 * time.Millisecond
+	backend.HealthCheckTimeout = 20 * time.Millisecond
+
+	r := newTestRoute(t, nil)
+	r.Timeout = time.Second
+	if _, err := r.AddExistingBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	added := backendByName(r, "a")
+	if timeout := r.requestTimeout(added); timeout != 50*time.Millisecond {
+		t.Errorf("Expected the request timeout of the backend to be kept, got %v", timeout)
+	}
+	if timeout := r.healthCheckTimeout(added); timeout != 20*time.Millisecond {
+		t.Errorf("Expected the healthcheck timeout of the backend to be kept, got %v", timeout)
+	}
+
+	added.Timeout, added.HealthCheckTimeout = 0, 0
+	if r.requestTimeout(added) != time.Second || r.healthCheckTimeout(added) != time.Second {
+		t.Error("Expected backends without timeouts to use the timeout of the route")
+	}
+}
@@ -0,0 +1,82 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
+)
+
+// droppedMetrics scrapes the dropped metrics of the route from the default registry
+func droppedMetrics(t *testing.T, route string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "ingress_depoy_dropped_metrics" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == route {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func Test_MetricsChannel_Drop(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.MetricsRepo = &metrics.Repository{
+		InChannel:     make(chan *metrics.Metrics, 1),
+		ChannelPolicy: metrics.ChannelPolicyDrop,
+	}
+	r.Client = &staticClient{contentType: "text/plain", body: "hello"}
+	before := droppedMetrics(t, r.Name)
+
+	// nothing reads the channel, so all but the first metrics are dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			ctx, err := doRequest(r, "GET", "", backendByName(r, "a"))
+			if err != nil || string(ctx.Response.Body()) != "hello" {
+				t.Errorf("Expected the response to be returned, got %v", err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the requests not to block on the full metrics channel")
+	}
+	if dropped := droppedMetrics(t, r.Name) - before; dropped != 4 {
+		t.Errorf("Expected 4 dropped metrics, got %v", dropped)
+	}
+}
+
+func Test_MetricsChannel_Block(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.MetricsRepo = &metrics.Repository{
+		InChannel:     make(chan *metrics.Metrics, 1),
+		ChannelPolicy: metrics.ChannelPolicyBlock,
+	}
+	r.Client = &staticClient{contentType: "text/plain", body: "hello"}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			doRequest(r, "GET", "", backendByName(r, "a"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the second request to wait for the metrics channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-r.MetricsRepo.InChannel
+	<-done
+}
@@ -0,0 +1,63 @@
+package route
+
+import (
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// BalancedHandler forwards each request to the backend which is selected by next.
+// Unlike the CanaryHandler, no session cookie is set
+func BalancedHandler(r *Route, next func(ctx *fasthttp.RequestCtx) (*Backend, error)) func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		target := r.allowlistTarget(ctx)
+		if target != nil {
+			r.forwardAllowlisted(ctx, target)
+			return
+		}
+		if target = r.canaryTarget(ctx); target != nil {
+			r.forward(ctx, target, nil)
+			return
+		}
+
+		target, err := next(ctx)
+		if err != nil {
+			r.handleError(ctx, err)
+			return
+		}
+		r.forward(ctx, target, nil)
+	}
+}
+
+// getNextBackendRoundRobin walks the distribution of the pool that serves
+// the request in order. A backend with weight w is selected w/ggt times per cycle
+func (r *Route) getNextBackendRoundRobin(ctx *fasthttp.RequestCtx) (*Backend, error) {
+	distr, counter := r.distributionFor(ctx)
+	if len(distr) == 0 {
+		return nil, ErrNoBackend
+	}
+	n := atomic.AddUint64(counter, 1) - 1
+	return distr[n%uint64(len(distr))], nil
+}
+
+// getNextBackendLeastConn selects the backend of the pool that serves the request
+// which has the fewest in-flight requests. Ties are broken by the higher weight
+func (r *Route) getNextBackendLeastConn(ctx *fasthttp.RequestCtx) (*Backend, error) {
+	distr, _ := r.distributionFor(ctx)
+	if len(distr) == 0 {
+		return nil, ErrNoBackend
+	}
+
+	var target *Backend
+	var min int64
+	for _, backend := range distr {
+		if backend == target {
+			continue
+		}
+		n := atomic.LoadInt64(&backend.inFlight)
+		if target == nil || n < min || (n == min && backend.Weigth > target.Weigth) {
+			target, min = backend, n
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,214 @@
+package route
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+func newTestRoute(t *testing.T, weights map[string]uint8) *Route {
+	return newTestRouteTo(t, "", weights)
+}
+
+// newTestRouteTo returns a route whose backends all forward to addr
+func newTestRouteTo(t *testing.T, addr string, weights map[string]uint8) *Route {
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MetricsRepo = &metrics.Repository{InChannel: make(chan *metrics.Metrics, 100)}
+	for name, weight := range weights {
+		host := addr
+		if host == "" {
+			host = name + ":8080"
+		}
+		backendAddr, _ := url.Parse("http://" + host)
+		if _, err = r.AddBackend(name, backendAddr, &url.URL{}, &url.URL{}, nil, nil, weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.updateWeights()
+	return r
+}
+
+func nextNames(t *testing.T, r *Route, n int) []string {
+	ctx := new(fasthttp.RequestCtx)
+	names := make([]string, n)
+	for i := range names {
+		backend, err := r.getNextBackendRoundRobin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[i] = backend.Name
+	}
+	return names
+}
+
+func Test_RoundRobin_Sequence(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50})
+
+	got := nextNames(t, r, 6)
+	want := []string{"a", "b", "a", "b", "a", "b"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected sequence %v, got %v", want, got)
+		}
+	}
+}
+
+func Test_RoundRobin_Weighted(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 10, "b": 90})
+
+	got := nextNames(t, r, 30)
+	count := 0
+	for i, name := range got {
+		if name != got[i%10] {
+			t.Fatalf("Expected a cycle of 10 backends, got %v", got)
+		}
+		if i < 10 && name == "a" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected a to be selected once per cycle, got %d", count)
+	}
+}
+
+func Test_RoundRobin_Interleaved(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 40, "b": 60})
+
+	got := nextNames(t, r, 5)
+	want := []string{"b", "a", "b", "a", "b"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected sequence %v, got %v", want, got)
+		}
+	}
+}
+
+func Test_RoundRobin_NoBackend(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{})
+
+	if _, err := r.getNextBackendRoundRobin(new(fasthttp.RequestCtx)); err == nil {
+		t.Error("Expected an error if no backend is active")
+	}
+}
+
+func Test_Distribution_Proportional(t *testing.T) {
+	for _, c := range []struct {
+		weights map[string]uint8
+		shares  map[string]float64
+	}{
+		{map[string]uint8{"a": 37}, map[string]float64{"a": 1}},
+		{map[string]uint8{"a": 100, "b": 5, "c": 0}, map[string]float64{"a": 100.0 / 105, "b": 5.0 / 105}},
+		// the sum of the weights exceeds the range of uint8
+		{map[string]uint8{"a": 100, "b": 99, "c": 98}, map[string]float64{"a": 100.0 / 297, "b": 99.0 / 297, "c": 98.0 / 297}},
+	} {
+		r := newTestRoute(t, c.weights)
+		entries := r.Distribution()
+		if len(entries) != len(c.shares) {
+			t.Fatalf("Expected the shares %v, got %+v", c.shares, entries)
+		}
+		for _, entry := range entries {
+			if share := c.shares[entry.Name]; share-entry.Share > 1e-9 || entry.Share-share > 1e-9 {
+				t.Errorf("Expected %s to have share %f, got %f", entry.Name, share, entry.Share)
+			}
+		}
+	}
+
+	r := newTestRoute(t, map[string]uint8{"a": 0, "b": 0})
+	if entries := r.Distribution(); len(entries) != 0 {
+		t.Errorf("Expected backends with weight 0 to receive no traffic, got %+v", entries)
+	}
+	if err := r.UpdateBackendWeight(backendByName(r, "a").ID, 101); err == nil {
+		t.Error("Expected a weight above 100 to be rejected")
+	}
+}
+
+func inFlight(r *Route) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, backend := range r.Backends {
+		counts[backend.Name] = atomic.LoadInt64(&backend.inFlight)
+	}
+	return counts
+}
+
+func Test_LeastConn_ConcurrentDispatch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		arrived <- struct{}{}
+		<-release
+	})
+
+	r := newTestRouteTo(t, ln.Addr().String(), map[string]uint8{"a": 60, "b": 40})
+	strat, err := NewLeastConnStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every request is held by the upstream until all are dispatched
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := new(fasthttp.RequestCtx)
+			ctx.Request.SetRequestURI("/")
+			strat.Handler(ctx)
+		}()
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Request was not dispatched")
+		}
+	}
+
+	if counts := inFlight(r); counts["a"] != 2 || counts["b"] != 2 {
+		t.Errorf("Expected 2 in-flight requests per backend, got %v", counts)
+	}
+
+	close(release)
+	wg.Wait()
+	if counts := inFlight(r); counts["a"] != 0 || counts["b"] != 0 {
+		t.Errorf("Expected no in-flight requests, got %v", counts)
+	}
+}
+
+func Test_LeastConn_UpstreamError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	r := newTestRouteTo(t, addr, map[string]uint8{"a": 50})
+	strat, err := NewLeastConnStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	strat.Handler(ctx)
+	if ctx.Response.StatusCode() != 502 {
+		t.Errorf("Expected status 502, got %d", ctx.Response.StatusCode())
+	}
+	if counts := inFlight(r); counts["a"] != 0 {
+		t.Errorf("Expected no in-flight requests after an error, got %v", counts)
+	}
+}
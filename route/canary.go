@@ -0,0 +1,52 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CanaryRule forwards requests which contain the header with the given value
+// to the target backend regardless of its weight. If the target is not active,
+// the backend is selected as usual
+type CanaryRule struct {
+	HeaderName  string `json:"header_name" yaml:"headerName" default:"X-Canary"`
+	HeaderValue string `json:"header_value" yaml:"headerValue" default:"true"`
+	Target      string `json:"target_backend" yaml:"targetBackend"`
+}
+
+// Validate checks if all required parameters of the rule are set
+func (c *CanaryRule) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.HeaderName == "" || c.HeaderValue == "" || c.Target == "" {
+		return fmt.Errorf("Required parameter of canaryRule are missing")
+	}
+	return nil
+}
+
+func (c *CanaryRule) match(ctx *fasthttp.RequestCtx) bool {
+	return string(ctx.Request.Header.Peek(c.HeaderName)) == c.HeaderValue
+}
+
+// canaryTarget returns the active target of the canary rule of the route
+// if the request matches it. Otherwise nil is returned
+func (r *Route) canaryTarget(ctx *fasthttp.RequestCtx) *Backend {
+	if r.CanaryRule == nil || !r.CanaryRule.match(ctx) {
+		return nil
+	}
+	if backend := r.namedBackend(r.CanaryRule.Target); backend != nil && backend.isActive() {
+		return backend
+	}
+	return nil
+}
+
+// forward forwards the request to the target and sets the cookie (if not nil)
+func (r *Route) forward(ctx *fasthttp.RequestCtx, target *Backend, c *fasthttp.Cookie) {
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	if err := r.HTTPDo(req, target, HTTPReturn(ctx, c, r.FlushInterval)); err != nil {
+		r.handleError(ctx, err)
+	}
+}
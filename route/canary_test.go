@@ -0,0 +1,82 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newCanaryRuleRoute(t *testing.T) (fasthttp.RequestHandler, *Route) {
+	r, _ := newRetryRoute(t, 0, map[string]int{"stable": 200, "canary": 200})
+	backendByName(r, "canary").Weigth = 0
+	r.updateWeights()
+	r.CanaryRule = &CanaryRule{HeaderName: "X-Canary", HeaderValue: "true", Target: "canary"}
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	return r.GetHandler(), r
+}
+
+func canaryRequest(handler fasthttp.RequestHandler, value string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	if value != "" {
+		ctx.Request.Header.Set("X-Canary", value)
+	}
+	handler(ctx)
+	return ctx
+}
+
+func Test_CanaryRule_Match(t *testing.T) {
+	handler, _ := newCanaryRuleRoute(t)
+
+	ctx := canaryRequest(handler, "true")
+	if body := string(ctx.Response.Body()); body != "canary:8080" {
+		t.Errorf("Expected the request to be forwarded to canary, got %s", body)
+	}
+	if cookie := ctx.Response.Header.Peek("Set-Cookie"); len(cookie) > 0 {
+		t.Errorf("Expected no session cookie, got %s", cookie)
+	}
+}
+
+func Test_CanaryRule_NoMatch(t *testing.T) {
+	handler, _ := newCanaryRuleRoute(t)
+
+	for _, value := range []string{"", "false"} {
+		ctx := canaryRequest(handler, value)
+		if body := string(ctx.Response.Body()); body != "stable:8080" {
+			t.Errorf("Expected the request with %q to be forwarded to stable, got %s", value, body)
+		}
+	}
+}
+
+func Test_CanaryRule_InactiveTarget(t *testing.T) {
+	handler, r := newCanaryRuleRoute(t)
+	backendByName(r, "canary").Active = false
+
+	ctx := canaryRequest(handler, "true")
+	if body := string(ctx.Response.Body()); body != "stable:8080" {
+		t.Errorf("Expected a fallback to stable, got %s", body)
+	}
+}
+
+func Test_HeaderStrategy_Target(t *testing.T) {
+	r, _ := newRetryRoute(t, 0, map[string]int{"stable": 200, "canary": 200})
+	strat, err := NewHeaderStrategy(r, "X-Canary", "true", "canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.updateWeights()
+	r.SetStrategy(strat)
+	handler := r.GetHandler()
+
+	// a request without the header must not change the target of the strategy
+	canaryRequest(handler, "")
+	for i := 0; i < 5; i++ {
+		if body := string(canaryRequest(handler, "true").Response.Body()); body != "canary:8080" {
+			t.Fatalf("Expected the request to be forwarded to canary, got %s", body)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package route
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultCompressionTypes are the content types which are compressed if
+// no types are configured. Already compressed types (e.g. images, video)
+// are not contained as compressing them again only costs time
+var DefaultCompressionTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// compressible checks if the content type starts with one of the
+// allowed content types of the route
+func (r *Route) compressible(contentType string) bool {
+	types := r.CompressionTypes
+	if len(types) == 0 {
+		types = DefaultCompressionTypes
+	}
+	contentType = strings.ToLower(contentType)
+	for _, t := range types {
+		if strings.HasPrefix(contentType, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress gzips the body of the upstream response if compression is enabled,
+// the client accepts gzip and the response is neither encoded nor streamed.
+// The Content-Length of the response is set to the compressed size
+func (r *Route) compress(req *fasthttp.Request, resp *fasthttp.Response) {
+	if !r.Compression || !req.Header.HasAcceptEncoding("gzip") || req.Header.IsHead() {
+		return
+	}
+	if resp.IsBodyStream() || len(resp.Header.Peek(fasthttp.HeaderContentEncoding)) > 0 {
+		return
+	}
+	if code := resp.StatusCode(); code < 200 || code == 204 || code == 304 {
+		return
+	}
+	body := resp.Body()
+	if len(body) == 0 || !r.compressible(string(resp.Header.ContentType())) {
+		return
+	}
+
+	compressed := fasthttp.AppendGzipBytes(nil, body)
+	resp.SetBodyRaw(compressed)
+	resp.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+	resp.Header.SetContentLength(len(compressed))
+	if vary := resp.Header.Peek(fasthttp.HeaderVary); len(vary) == 0 {
+		resp.Header.Set(fasthttp.HeaderVary, "Accept-Encoding")
+	} else if !bytes.Contains(bytes.ToLower(vary), []byte("accept-encoding")) {
+		resp.Header.Set(fasthttp.HeaderVary, string(vary)+", Accept-Encoding")
+	}
+}
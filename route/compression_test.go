@@ -0,0 +1,70 @@
+package route
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// staticClient answers every request with the same body and content type
+type staticClient struct {
+	contentType string
+	body        string
+}
+
+func (c *staticClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	resp := fasthttp.AcquireResponse()
+	resp.Header.SetContentType(c.contentType)
+	resp.SetBodyString(c.body)
+	resp.Header.SetContentLength(len(c.body))
+	return resp, nil
+}
+
+func compressedRequest(t *testing.T, contentType string) (*fasthttp.RequestCtx, *metrics.Metrics, string) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.Compression = true
+	body := strings.Repeat("depoy compresses text responses. ", 100)
+	r.Client = &staticClient{contentType: contentType, body: body}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("Accept-Encoding", "gzip, deflate")
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, <-r.MetricsRepo.InChannel, body
+}
+
+func Test_Compression_Gzip(t *testing.T) {
+	ctx, m, body := compressedRequest(t, "text/plain; charset=utf-8")
+
+	if encoding := string(ctx.Response.Header.Peek("Content-Encoding")); encoding != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip, got %q", encoding)
+	}
+	uncompressed, err := ctx.Response.BodyGunzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(uncompressed) != body {
+		t.Error("Uncompressed body does not match the upstream body")
+	}
+	if m.ContentLength != int64(len(ctx.Response.Body())) || m.ContentLength >= int64(len(body)) {
+		t.Errorf("Expected the compressed size %d to be recorded, got %d", len(ctx.Response.Body()), m.ContentLength)
+	}
+}
+
+func Test_Compression_SkipContentType(t *testing.T) {
+	ctx, m, body := compressedRequest(t, "image/png")
+
+	if encoding := ctx.Response.Header.Peek("Content-Encoding"); len(encoding) > 0 {
+		t.Errorf("Expected image/png not to be compressed, got %q", encoding)
+	}
+	if m.ContentLength != int64(len(body)) {
+		t.Errorf("Expected the size %d to be recorded, got %d", len(body), m.ContentLength)
+	}
+}
@@ -0,0 +1,146 @@
+package route
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultCORSMethods are the methods which are allowed if no methods are configured
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+// CORS answers preflight requests of the route and adds the Access-Control
+// headers to its responses. An origin of "*" allows all origins. If credentials
+// are allowed, the origin of the request is returned instead of the wildcard
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty" yaml:"allowedMethods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty" yaml:"allowedHeaders,omitempty"` // "*" allows all requested headers
+	ExposedHeaders   []string `json:"exposed_headers,omitempty" yaml:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials" yaml:"allowCredentials"`
+	MaxAge           int      `json:"max_age,omitempty" yaml:"maxAge,omitempty"` // seconds the preflight may be cached
+}
+
+// Validate checks if all required parameters of the CORS config are set
+func (c *CORS) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("CORS requires at least one allowed origin")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("MaxAge of CORS cannot be negative")
+	}
+	return nil
+}
+
+func (c *CORS) originAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return DefaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *CORS) methodAllowed(method string) bool {
+	for _, allowed := range c.methods() {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed checks if all headers of the comma-separated list are allowed
+func (c *CORS) headersAllowed(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range c.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets the allowed origin of the response. The wildcard is only
+// returned if credentials are not allowed
+func (c *CORS) setOrigin(ctx *fasthttp.RequestCtx, origin string) {
+	wildcard := false
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			wildcard = true
+		}
+	}
+	if wildcard && !c.AllowCredentials {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+		ctx.Response.Header.Add(fasthttp.HeaderVary, "Origin")
+	}
+	if c.AllowCredentials {
+		ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handlePreflight answers the request if it is a preflight request. Preflight
+// requests of disallowed origins, methods or headers are rejected with 403.
+// Returns false if the request is not a preflight request
+func (c *CORS) handlePreflight(ctx *fasthttp.RequestCtx) bool {
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	method := string(ctx.Request.Header.Peek("Access-Control-Request-Method"))
+	if !ctx.IsOptions() || origin == "" || method == "" {
+		return false
+	}
+
+	requested := string(ctx.Request.Header.Peek("Access-Control-Request-Headers"))
+	if !c.originAllowed(origin) || !c.methodAllowed(method) || !c.headersAllowed(requested) {
+		ctx.Error("CORS request is not allowed", fasthttp.StatusForbidden)
+		return true
+	}
+
+	ctx.Response.Reset()
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+	c.setOrigin(ctx, origin)
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+	if requested != "" {
+		ctx.Response.Header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.MaxAge > 0 {
+		ctx.Response.Header.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	return true
+}
+
+// setHeaders adds the Access-Control headers to the response
+// of an actual request if its origin is allowed
+func (c *CORS) setHeaders(ctx *fasthttp.RequestCtx) {
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if origin == "" || !c.originAllowed(origin) {
+		return
+	}
+	c.setOrigin(ctx, origin)
+	if len(c.ExposedHeaders) > 0 {
+		ctx.Response.Header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
@@ -0,0 +1,118 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newCORSRoute(t *testing.T, cors *CORS) (fasthttp.RequestHandler, *flakyClient) {
+	r, client := newLimitedRoute(t, 0)
+	if err := cors.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r.CORS = cors
+	return r.GetHandler(), client
+}
+
+func corsRequest(handler fasthttp.RequestHandler, method, origin string, headers map[string]string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("Origin", origin)
+	for key, value := range headers {
+		ctx.Request.Header.Set(key, value)
+	}
+	handler(ctx)
+	return ctx
+}
+
+func Test_CORS_Preflight(t *testing.T) {
+	handler, client := newCORSRoute(t, &CORS{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type"},
+		MaxAge:         600,
+	})
+
+	ctx := corsRequest(handler, "OPTIONS", "https://example.com", map[string]string{
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "content-type",
+	})
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", ctx.Response.StatusCode())
+	}
+	if origin := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); origin != "https://example.com" {
+		t.Errorf("Expected the origin to be allowed, got %q", origin)
+	}
+	if methods := string(ctx.Response.Header.Peek("Access-Control-Allow-Methods")); methods != "GET, PUT" {
+		t.Errorf("Unexpected allowed methods %q", methods)
+	}
+	if maxAge := string(ctx.Response.Header.Peek("Access-Control-Max-Age")); maxAge != "600" {
+		t.Errorf("Unexpected max age %q", maxAge)
+	}
+	if len(client.hosts) != 0 {
+		t.Errorf("Expected the preflight not to be forwarded, got %v", client.hosts)
+	}
+
+	ctx = corsRequest(handler, "OPTIONS", "https://example.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected a disallowed method to be rejected, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func Test_CORS_SimpleRequest(t *testing.T) {
+	handler, client := newCORSRoute(t, &CORS{
+		AllowedOrigins: []string{"*"},
+		ExposedHeaders: []string{"X-Request-Id"},
+	})
+
+	ctx := corsRequest(handler, "GET", "https://example.com", nil)
+	if ctx.Response.StatusCode() != 200 {
+		t.Errorf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+	if origin := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); origin != "*" {
+		t.Errorf("Expected the wildcard origin, got %q", origin)
+	}
+	if exposed := string(ctx.Response.Header.Peek("Access-Control-Expose-Headers")); exposed != "X-Request-Id" {
+		t.Errorf("Unexpected exposed headers %q", exposed)
+	}
+	if len(client.hosts) != 1 {
+		t.Errorf("Expected the request to be forwarded, got %v", client.hosts)
+	}
+}
+
+func Test_CORS_Credentials(t *testing.T) {
+	handler, _ := newCORSRoute(t, &CORS{
+		AllowedOrigins:   []string{"*"},
+		AllowCredentials: true,
+	})
+
+	ctx := corsRequest(handler, "GET", "https://example.com", nil)
+	if origin := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); origin != "https://example.com" {
+		t.Errorf("Expected the origin instead of the wildcard, got %q", origin)
+	}
+	if credentials := string(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")); credentials != "true" {
+		t.Errorf("Expected credentials to be allowed, got %q", credentials)
+	}
+}
+
+func Test_CORS_DisallowedOrigin(t *testing.T) {
+	handler, _ := newCORSRoute(t, &CORS{
+		AllowedOrigins: []string{"https://example.com"},
+	})
+
+	ctx := corsRequest(handler, "GET", "https://evil.com", nil)
+	if origin := ctx.Response.Header.Peek("Access-Control-Allow-Origin"); len(origin) > 0 {
+		t.Errorf("Expected no CORS headers for a disallowed origin, got %q", origin)
+	}
+
+	ctx = corsRequest(handler, "OPTIONS", "https://evil.com", map[string]string{
+		"Access-Control-Request-Method": "GET",
+	})
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("Expected the preflight to be rejected, got %d", ctx.Response.StatusCode())
+	}
+}
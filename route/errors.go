@@ -0,0 +1,166 @@
+package route
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/rgumi/depoy/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// classes of gateway errors
+const (
+	ErrorTimeout           = "timeout"
+	ErrorConnectionRefused = "connection_refused"
+	ErrorNoBackend         = "no_backend"
+	ErrorUpstream          = "upstream" // any other error of the upstream request
+)
+
+// codes of the requests which are rejected by the route before they are forwarded
+const (
+	ErrorBodyTooLarge = "body_too_large"
+	ErrorRateLimited  = "rate_limited"
+)
+
+// ErrNoBackend is returned if no active backend is available for a request
+var ErrNoBackend = errors.New("No backend is active")
+
+// GatewayError is the error of a request which could not be answered by the upstream
+type GatewayError struct {
+	Class string
+	Err   error
+}
+
+func (e *GatewayError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Err
+}
+
+// NewGatewayError classifies the error of an upstream request
+func NewGatewayError(err error) *GatewayError {
+	var gatewayErr *GatewayError
+	if errors.As(err, &gatewayErr) {
+		return gatewayErr
+	}
+	class := ErrorUpstream
+	// fasthttp.ErrTimeout only implements the Timeout function of net.Error
+	var timeoutErr interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, ErrNoBackend):
+		class = ErrorNoBackend
+	case errors.As(err, &timeoutErr) && timeoutErr.Timeout(), errors.Is(err, fasthttp.ErrDialTimeout):
+		class = ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		class = ErrorConnectionRefused
+	}
+	return &GatewayError{Class: class, Err: err}
+}
+
+// ErrorResponse is returned to the client if a request fails with a GatewayError.
+// The body is a template which can access the .Path of the request and the .Class of the error
+type ErrorResponse struct {
+	StatusCode  int    `json:"status_code" yaml:"statusCode"`
+	Body        string `json:"body" yaml:"body"`
+	ContentType string `json:"content_type,omitempty" yaml:"contentType,omitempty"` // html content types are escaped
+	tmpl        interface {
+		Execute(io.Writer, interface{}) error
+	}
+}
+
+// DefaultErrorResponses are returned if no ErrorResponse of the class is configured
+var DefaultErrorResponses = map[string]*ErrorResponse{
+	ErrorTimeout:           {StatusCode: fasthttp.StatusGatewayTimeout, Body: "Gateway Timeout"},
+	ErrorConnectionRefused: {StatusCode: fasthttp.StatusBadGateway, Body: "Bad Gateway"},
+	ErrorNoBackend:         {StatusCode: fasthttp.StatusServiceUnavailable, Body: "No Upstream Host Available"},
+	ErrorUpstream:          {StatusCode: fasthttp.StatusBadGateway, Body: "Bad Gateway"},
+}
+
+// Compile validates the error response and parses its body
+func (e *ErrorResponse) Compile() (err error) {
+	if e.StatusCode < 100 || e.StatusCode > 599 {
+		return fmt.Errorf("Invalid status code %d of error response", e.StatusCode)
+	}
+	if strings.Contains(e.ContentType, "html") {
+		e.tmpl, err = htmltemplate.New("error").Parse(e.Body)
+	} else {
+		e.tmpl, err = template.New("error").Parse(e.Body)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid body of error response: %v", err)
+	}
+	return nil
+}
+
+// ErrorPages maps classes of gateway errors to the response which is returned
+type ErrorPages map[string]*ErrorResponse
+
+// Validate checks the classes and compiles the error responses
+func (p ErrorPages) Validate() error {
+	for class, resp := range p {
+		if _, ok := DefaultErrorResponses[class]; !ok {
+			return fmt.Errorf("Unknown error class %s", class)
+		}
+		if err := resp.Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject responds to a request which is not forwarded with the status. With
+// JSONErrors, the JSON error envelope with the code is returned
+func (r *Route) reject(ctx *fasthttp.RequestCtx, status int, code string) {
+	message := fasthttp.StatusMessage(status)
+	if r.JSONErrors {
+		router.WriteJSONError(ctx, status, code, message, string(ctx.Request.Header.Peek(r.GetRequestIDHeader())))
+		return
+	}
+	ctx.Error(message, status)
+}
+
+// handleError translates the error of a request into the response of the client.
+// If no backend is active, the fallback of the route is served if configured
+func (r *Route) handleError(ctx *fasthttp.RequestCtx, err error) {
+	gatewayErr := NewGatewayError(err)
+	log.Debugf("Request of %s failed (%s): %v", r.Name, gatewayErr.Class, gatewayErr.Err)
+	if gatewayErr.Class == ErrorNoBackend && r.Fallback != nil {
+		r.serveFallback(ctx)
+		return
+	}
+
+	resp, ok := r.ErrorPages[gatewayErr.Class]
+	if !ok {
+		resp = DefaultErrorResponses[gatewayErr.Class]
+	}
+	if r.JSONErrors {
+		// the status of a configured error page is kept but the body is the envelope
+		ctx.Response.Reset()
+		router.WriteJSONError(ctx, resp.StatusCode, gatewayErr.Class,
+			DefaultErrorResponses[gatewayErr.Class].Body, string(ctx.Request.Header.Peek(r.GetRequestIDHeader())))
+		return
+	}
+	body := resp.Body
+	if resp.tmpl != nil {
+		buf := new(bytes.Buffer)
+		data := map[string]string{"Path": string(ctx.Path()), "Class": gatewayErr.Class}
+		if err := resp.tmpl.Execute(buf, data); err != nil {
+			log.Errorf("Could not render error response of %s: %v", r.Name, err)
+		} else {
+			body = buf.String()
+		}
+	}
+	ctx.Error(body, resp.StatusCode)
+	if resp.ContentType != "" {
+		ctx.SetContentType(resp.ContentType)
+	}
+}
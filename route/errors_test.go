@@ -0,0 +1,203 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/router"
+	"github.com/valyala/fasthttp"
+)
+
+// errorClient fails every request with the error
+type errorClient struct {
+	err error
+}
+
+func (c *errorClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	return nil, c.err
+}
+
+var refusedErr = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+func Test_GatewayError_Classes(t *testing.T) {
+	tests := map[string]error{
+		ErrorTimeout:           fasthttp.ErrTimeout,
+		ErrorConnectionRefused: refusedErr,
+		ErrorNoBackend:         ErrNoBackend,
+		ErrorUpstream:          errors.New("connection reset"),
+	}
+	for class, err := range tests {
+		if got := NewGatewayError(err).Class; got != class {
+			t.Errorf("Expected %v to be of class %s, got %s", err, class, got)
+		}
+	}
+}
+
+func Test_ErrorPages_Defaults(t *testing.T) {
+	tests := map[error]int{
+		fasthttp.ErrTimeout:                         504,
+		refusedErr:                                  502,
+		errors.New("connection reset"):              502,
+		&GatewayError{ErrorNoBackend, ErrNoBackend}: 503,
+	}
+	for err, status := range tests {
+		r := newTestRoute(t, map[string]uint8{"a": 50})
+		r.Client = &errorClient{err: err}
+
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/")
+		r.forward(ctx, backendByName(r, "a"), nil)
+		if ctx.Response.StatusCode() != status {
+			t.Errorf("Expected %v to be answered with %d, got %d", err, status, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func Test_ErrorPages_NoBackend(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	backendByName(r, "a").UpdateStatus(false)
+	r.updateWeights()
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	BalancedHandler(r, r.getNextBackendRoundRobin)(ctx)
+	if ctx.Response.StatusCode() != 503 {
+		t.Errorf("Expected 503 if no backend is active, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func Test_ErrorPages_Custom(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.Client = &errorClient{err: fasthttp.ErrTimeout}
+	r.ErrorPages = ErrorPages{
+		ErrorTimeout: {
+			StatusCode:  503,
+			Body:        "<p>{{.Path}} timed out ({{.Class}})</p>",
+			ContentType: "text/html",
+		},
+	}
+	if err := r.ErrorPages.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/<script>")
+	r.forward(ctx, backendByName(r, "a"), nil)
+	if ctx.Response.StatusCode() != 503 {
+		t.Errorf("Expected the custom status, got %d", ctx.Response.StatusCode())
+	}
+	if body := string(ctx.Response.Body()); body != "<p>/&lt;script&gt; timed out (timeout)</p>" {
+		t.Errorf("Expected the rendered body, got %s", body)
+	}
+	if contentType := string(ctx.Response.Header.ContentType()); contentType != "text/html" {
+		t.Errorf("Expected the custom content type, got %s", contentType)
+	}
+}
+
+func Test_ErrorPages_Invalid(t *testing.T) {
+	if err := (ErrorPages{"unknown": {StatusCode: 500}}).Validate(); err == nil {
+		t.Error("Expected unknown classes to be rejected")
+	}
+	if err := (ErrorPages{ErrorTimeout: {StatusCode: 504, Body: "{{.Path"}}).Validate(); err == nil {
+		t.Error("Expected invalid templates to be rejected")
+	}
+}
+
+func Test_JSONErrors_Timeout(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.Client = &errorClient{err: fasthttp.ErrTimeout}
+	r.JSONErrors = true
+	strategy, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.GetHandler()(ctx)
+	if ctx.Response.StatusCode() != 504 || string(ctx.Response.Header.ContentType()) != "application/json" {
+		t.Fatalf("Expected a JSON 504, got %d (%s)", ctx.Response.StatusCode(), ctx.Response.Header.ContentType())
+	}
+	envelope := router.ErrorResponse{}
+	if err = json.Unmarshal(ctx.Response.Body(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	expected := router.ErrorDetail{
+		Code:      ErrorTimeout,
+		Message:   "Gateway Timeout",
+		RequestID: string(ctx.Response.Header.Peek(DefaultRequestIDHeader)),
+	}
+	if envelope.Error != expected || expected.RequestID == "" {
+		t.Errorf("Expected the envelope %+v, got %s", expected, ctx.Response.Body())
+	}
+
+	// the status of a configured error page is kept
+	r.ErrorPages = ErrorPages{ErrorTimeout: {StatusCode: 503, Body: "busy"}}
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set(DefaultRequestIDHeader, "client-id")
+	r.GetHandler()(ctx)
+	if err = json.Unmarshal(ctx.Response.Body(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != 503 || envelope.Error.RequestID != "client-id" {
+		t.Errorf("Expected a 503 with the request ID of the client, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func Test_JSONErrors_Rejected(t *testing.T) {
+	r, client := newLimitedRoute(t, 8)
+	r.JSONErrors = true
+	r.RequestIDHeader = "X-Correlation-Id"
+	r.RateLimit, _ = newRateLimit(t, 1, 1, false)
+	handler := r.GetHandler()
+
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{"more than eight bytes", fasthttp.StatusRequestEntityTooLarge, ErrorBodyTooLarge},
+		{"", fasthttp.StatusOK, ""},
+		{"", fasthttp.StatusTooManyRequests, ErrorRateLimited},
+	}
+	for _, tt := range tests {
+		ctx := clientCtx("10.0.0.1")
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/")
+		ctx.Request.Header.Set("X-Correlation-Id", "client-id")
+		ctx.Request.SetBodyString(tt.body)
+		handler(ctx)
+		if ctx.Response.StatusCode() != tt.status {
+			t.Fatalf("Expected status %d, got %d", tt.status, ctx.Response.StatusCode())
+		}
+		if tt.code == "" {
+			continue
+		}
+		envelope := router.ErrorResponse{}
+		if err := json.Unmarshal(ctx.Response.Body(), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		expected := router.ErrorDetail{
+			Code:      tt.code,
+			Message:   fasthttp.StatusMessage(tt.status),
+			RequestID: "client-id",
+		}
+		if envelope.Error != expected {
+			t.Errorf("Expected the envelope %+v, got %s", expected, ctx.Response.Body())
+		}
+		if id := string(ctx.Response.Header.Peek("X-Correlation-Id")); id != "client-id" {
+			t.Errorf("Expected the request ID header in the rejection, got %q", id)
+		}
+	}
+	if len(client.hosts) != 1 {
+		t.Errorf("Expected only the allowed request to be forwarded, got %v", client.hosts)
+	}
+}
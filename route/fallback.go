@@ -0,0 +1,45 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Fallback is the static response of a route if no backend is active,
+// e.g. a maintenance page during a planned downtime
+type Fallback struct {
+	StatusCode  int               `json:"status_code" yaml:"statusCode" default:"503"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body        string            `json:"body" yaml:"body"`
+	ContentType string            `json:"content_type,omitempty" yaml:"contentType,omitempty"`
+}
+
+// Validate checks the status code of the fallback
+func (f *Fallback) Validate() error {
+	if f == nil {
+		return nil
+	}
+	if f.StatusCode < 100 || f.StatusCode > 599 {
+		return fmt.Errorf("Invalid status code %d of fallback", f.StatusCode)
+	}
+	return nil
+}
+
+// serveFallback answers the request with the fallback of the route
+func (r *Route) serveFallback(ctx *fasthttp.RequestCtx) {
+	log.Debugf("No backend of %s is active. Serving fallback", r.Name)
+	ctx.Response.Reset()
+	ctx.SetStatusCode(r.Fallback.StatusCode)
+	for key, value := range r.Fallback.Headers {
+		ctx.Response.Header.Set(key, value)
+	}
+	if r.Fallback.ContentType != "" {
+		ctx.SetContentType(r.Fallback.ContentType)
+	}
+	ctx.SetBodyString(r.Fallback.Body)
+	metrics.FallbackRequests.With(prometheus.Labels{"route": r.Name}).Inc()
+}
@@ -0,0 +1,72 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// newInactiveRoute returns a route of which no backend is active
+func newInactiveRoute(t *testing.T) *Route {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	backendByName(r, "a").UpdateStatus(false)
+	r.updateWeights()
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	return r
+}
+
+func Test_Fallback(t *testing.T) {
+	r := newInactiveRoute(t)
+	r.Name = "fallback"
+	r.Fallback = &Fallback{
+		StatusCode:  503,
+		Headers:     map[string]string{"Retry-After": "3600"},
+		Body:        "<h1>Down for maintenance</h1>",
+		ContentType: "text/html",
+	}
+	if err := r.Fallback.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.GetHandler()(ctx)
+	if ctx.Response.StatusCode() != 503 || string(ctx.Response.Body()) != "<h1>Down for maintenance</h1>" {
+		t.Errorf("Expected the fallback, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if string(ctx.Response.Header.Peek("Retry-After")) != "3600" || string(ctx.Response.Header.ContentType()) != "text/html" {
+		t.Errorf("Expected the headers of the fallback, got %s", ctx.Response.Header.String())
+	}
+	hits := testutil.ToFloat64(metrics.FallbackRequests.With(prometheus.Labels{"route": "fallback"}))
+	if hits != 1 {
+		t.Errorf("Expected the fallback to be recorded, got %v", hits)
+	}
+}
+
+func Test_Fallback_Default(t *testing.T) {
+	r := newInactiveRoute(t)
+	r.Name = "nofallback"
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.GetHandler()(ctx)
+	if ctx.Response.StatusCode() != 503 || string(ctx.Response.Body()) != "No Upstream Host Available" {
+		t.Errorf("Expected the gateway error, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if hits := testutil.ToFloat64(metrics.FallbackRequests.With(prometheus.Labels{"route": "nofallback"})); hits != 0 {
+		t.Errorf("Expected no fallback to be recorded, got %v", hits)
+	}
+}
+
+func Test_Fallback_Validate(t *testing.T) {
+	if err := (&Fallback{StatusCode: 0}).Validate(); err == nil {
+		t.Error("Expected an invalid status to be rejected")
+	}
+}
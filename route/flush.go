@@ -0,0 +1,68 @@
+package route
+
+import (
+	"bufio"
+	"sync"
+	"time"
+)
+
+// flushWriter flushes the body of a streamed response to the client. With a
+// negative interval every write is flushed. Otherwise the writes are flushed
+// once the interval has passed since the first write which was not flushed
+type flushWriter struct {
+	mux      sync.Mutex
+	w        *bufio.Writer
+	interval time.Duration
+	timer    *time.Timer
+	pending  bool // a flush is scheduled
+}
+
+func newFlushWriter(w *bufio.Writer, interval time.Duration) *flushWriter {
+	return &flushWriter{w: w, interval: interval}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval < 0 {
+		return n, fw.w.Flush()
+	}
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.flush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) flush() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	if !fw.pending {
+		return
+	}
+	fw.pending = false
+	// errors of the client are returned by the next write
+	fw.w.Flush()
+}
+
+// stop cancels the scheduled flush. The remaining writes are flushed
+// by the owner of the writer
+func (fw *flushWriter) stop() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
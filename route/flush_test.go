@@ -0,0 +1,102 @@
+package route
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// serveRoute serves the requests of the route with its backend a
+func serveRoute(t *testing.T, r *Route) (string, func()) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := backendByName(r, "a")
+	server := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		req, release := r.prepareRequest(ctx)
+		defer release()
+		if err := r.HTTPDo(req, a, HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+			t.Error(err)
+		}
+	}}
+	go server.Serve(ln)
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// streamEvents serves the route and returns the events of a request to it.
+// The upstream sends the second event only after the first one was received
+func streamEvents(t *testing.T, flushInterval time.Duration) []string {
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer upstream.Close()
+
+	r := newTestRouteTo(t, strings.TrimPrefix(upstream.URL, "http://"), map[string]uint8{"a": 100})
+	r.FlushInterval = flushInterval
+	if err := r.SetConnectionPool(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.releaseClients()
+
+	addr, stop := serveRoute(t, r)
+	defer stop()
+
+	resp, err := http.Get("http://" + addr + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := []string{}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				lines <- strings.TrimSpace(line)
+			}
+		}
+	}()
+	for {
+		select {
+		case event, ok := <-lines:
+			if !ok {
+				return events
+			}
+			if len(events) == 0 {
+				close(received)
+			}
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the events to arrive while the upstream streams, got %v", events)
+		}
+	}
+}
+
+func Test_FlushInterval_StreamsEvents(t *testing.T) {
+	for _, interval := range []time.Duration{-1, 50 * time.Millisecond} {
+		if events := streamEvents(t, interval); len(events) != 2 || events[0] != "data: 1" || events[1] != "data: 2" {
+			t.Errorf("Flush interval %v: expected both events, got %v", interval, events)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package route
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// hashPointsPerWeight is the number of points a backend is placed
+// on the hash ring per unit of its weight
+const hashPointsPerWeight = 4
+
+// hashRing maps keys onto backends. Each backend is placed on the ring
+// proportionally to its weight. The points of a backend only depend on its
+// name and weight, hence if a backend is removed only its keys are remapped
+type hashRing struct {
+	points   []uint32
+	backends []*Backend // backend of the point with the same index
+}
+
+// hashKey returns the FNV-1a hash of the key. As FNV-1a spreads similar keys
+// poorly, the hash is finalized like murmur3
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
+
+// newHashRing returns a ring of the given active backends. If no
+// backend has a weight, nil is returned
+func newHashRing(activeBackends []*Backend, weightOf func(*Backend) uint8) *hashRing {
+	type point struct {
+		hash    uint32
+		backend *Backend
+	}
+	points := []point{}
+	for _, backend := range activeBackends {
+		for i := 0; i < int(weightOf(backend))*hashPointsPerWeight; i++ {
+			points = append(points, point{hashKey(backend.Name + "-" + strconv.Itoa(i)), backend})
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].backend.Name < points[j].backend.Name
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &hashRing{
+		points:   make([]uint32, len(points)),
+		backends: make([]*Backend, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.backends[i] = p.backend
+	}
+	return ring
+}
+
+// get returns the backend of the first point at or after the hash of the key
+func (h *hashRing) get(key string) *Backend {
+	hash := hashKey(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= hash })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.backends[i]
+}
+
+// ringFor returns the hash ring of the subset that matches the request.
+// If no subset matches or the subset has no active backend, the ring of
+// the default pool is returned
+func (r *Route) ringFor(ctx *fasthttp.RequestCtx) *hashRing {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if subset := r.subsetFor(ctx); subset != nil {
+		if subset.ring != nil {
+			return subset.ring
+		}
+		log.Debugf("Subset %s of %s has no active backend. Using default", subset.Name, r.Name)
+	}
+	return r.ring
+}
+
+// hashKeyOf returns the key of the request which is hashed onto the ring.
+// If keySource is "header", the value of the header is used. Otherwise
+// the IP of the client is used
+func hashKeyOf(ctx *fasthttp.RequestCtx, keySource, headerName string) string {
+	if strings.ToLower(keySource) == "header" {
+		return string(ctx.Request.Header.Peek(headerName))
+	}
+	return ctx.RemoteIP().String()
+}
+
+// getNextBackendHash returns a function which selects the backend
+// by hashing the key of the request onto the ring of the pool
+func (r *Route) getNextBackendHash(keySource, headerName string) func(ctx *fasthttp.RequestCtx) (*Backend, error) {
+	return func(ctx *fasthttp.RequestCtx) (*Backend, error) {
+		ring := r.ringFor(ctx)
+		if ring == nil {
+			return nil, ErrNoBackend
+		}
+		return ring.get(hashKeyOf(ctx, keySource, headerName)), nil
+	}
+}
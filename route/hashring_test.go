@@ -0,0 +1,113 @@
+package route
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func hashAssignments(t *testing.T, r *Route, keys int) map[string]string {
+	next := r.getNextBackendHash("header", "X-User")
+	assigned := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		ctx := new(fasthttp.RequestCtx)
+		key := "user-" + strconv.Itoa(i)
+		ctx.Request.Header.Set("X-User", key)
+		backend, err := next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned[key] = backend.Name
+	}
+	return assigned
+}
+
+func backendByName(r *Route, name string) *Backend {
+	for _, backend := range r.Backends {
+		if backend.Name == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+func Test_ConsistentHash_Stable(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50, "c": 50})
+
+	first := hashAssignments(t, r, 1000)
+	r.updateWeights()
+	second := hashAssignments(t, r, 1000)
+	for key, name := range first {
+		if second[key] != name {
+			t.Fatalf("Expected %s to stay on %s after a rebuild, got %s", key, name, second[key])
+		}
+	}
+}
+
+func Test_ConsistentHash_Weights(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 20, "b": 80})
+
+	counts := make(map[string]int)
+	for _, name := range hashAssignments(t, r, 10000) {
+		counts[name]++
+	}
+	if counts["a"] < 1000 || counts["a"] > 3000 {
+		t.Errorf("Expected about 20%% of the keys on a, got %v", counts)
+	}
+}
+
+func Test_ConsistentHash_InactiveBackend(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50, "c": 50})
+
+	before := hashAssignments(t, r, 1000)
+	backendByName(r, "c").Active = false
+	r.updateWeights()
+	after := hashAssignments(t, r, 1000)
+
+	moved := 0
+	for key, name := range before {
+		if after[key] == "c" {
+			t.Fatalf("Key %s is still mapped to the inactive backend", key)
+		}
+		if name != "c" && after[key] != name {
+			t.Fatalf("Expected %s to stay on %s, got %s", key, name, after[key])
+		}
+		if name == "c" {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected some keys to be mapped to c before it became inactive")
+	}
+}
+
+func Test_ConsistentHash_RemoteAddr(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50})
+	next := r.getNextBackendHash("", "")
+
+	ctx := new(fasthttp.RequestCtx)
+	first, err := next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if backend, _ := next(ctx); backend != first {
+			t.Fatal("Expected the same client to be forwarded to the same backend")
+		}
+	}
+}
+
+func Test_ConsistentHash_Validate(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+
+	if _, err := NewConsistentHashStrategy(r, "header", ""); err == nil {
+		t.Error("Expected an error if the header of the hash key is missing")
+	}
+	if _, err := NewConsistentHashStrategy(r, "cookie", ""); err == nil {
+		t.Error("Expected an error for an unsupported hash key")
+	}
+	if _, err := NewConsistentHashStrategy(r, "RemoteAddr", ""); err != nil {
+		t.Error(err)
+	}
+}
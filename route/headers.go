@@ -0,0 +1,46 @@
+package route
+
+import (
+	"fmt"
+	"net/textproto"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Headers are set on requests to the upstream or on responses to the client.
+// A nil value removes the header
+type Headers map[string]*string
+
+// Validate checks that no hop-by-hop header is configured as these are
+// always removed by the gateway
+func (h Headers) Validate() error {
+	for key := range h {
+		canonical := textproto.CanonicalMIMEHeaderKey(key)
+		for _, hop := range hopHeaders {
+			if canonical == hop {
+				return fmt.Errorf("Hop-by-hop header %s cannot be configured", key)
+			}
+		}
+	}
+	return nil
+}
+
+func (h Headers) applyRequest(header *fasthttp.RequestHeader) {
+	for key, value := range h {
+		if value == nil {
+			header.Del(key)
+		} else {
+			header.Set(key, *value)
+		}
+	}
+}
+
+func (h Headers) applyResponse(header *fasthttp.ResponseHeader) {
+	for key, value := range h {
+		if value == nil {
+			header.Del(key)
+		} else {
+			header.Set(key, *value)
+		}
+	}
+}
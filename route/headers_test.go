@@ -0,0 +1,91 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// echoClient returns the headers of the upstream request and
+// adds the given headers to the response
+type echoClient struct {
+	request  fasthttp.RequestHeader
+	response map[string]string
+}
+
+func (c *echoClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	req.Header.CopyTo(&c.request)
+	resp := fasthttp.AcquireResponse()
+	for key, value := range c.response {
+		resp.Header.Set(key, value)
+	}
+	return resp, nil
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func Test_Headers(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	client := &echoClient{response: map[string]string{
+		"X-Internal": "secret",
+		"Server":     "upstream",
+		"Connection": "keep-alive",
+	}}
+	r.Client = client
+	r.RequestHeaders = Headers{
+		"Authorization": stringPtr("Bearer upstream"), // overwrite
+		"X-Gateway":     stringPtr("depoy"),           // set
+		"Cookie":        nil,                          // delete
+	}
+	r.ResponseHeaders = Headers{
+		"X-Internal": nil,                // delete
+		"Server":     stringPtr("depoy"), // overwrite
+		"X-Frame":    stringPtr("DENY"),  // set
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("Authorization", "Bearer client")
+	ctx.Request.Header.Set("Cookie", "session=1")
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRequest := map[string]string{
+		"Authorization": "Bearer upstream",
+		"X-Gateway":     "depoy",
+		"Cookie":        "",
+	}
+	for key, value := range expectedRequest {
+		if got := string(client.request.Peek(key)); got != value {
+			t.Errorf("Expected request header %s to be %q, got %q", key, value, got)
+		}
+	}
+
+	expectedResponse := map[string]string{
+		"X-Internal": "",
+		"Server":     "depoy",
+		"X-Frame":    "DENY",
+		"Connection": "",
+	}
+	for key, value := range expectedResponse {
+		if got := string(ctx.Response.Header.Peek(key)); got != value {
+			t.Errorf("Expected response header %s to be %q, got %q", key, value, got)
+		}
+	}
+}
+
+func Test_Headers_HopByHop(t *testing.T) {
+	if err := (Headers{"connection": stringPtr("close")}).Validate(); err == nil {
+		t.Error("Expected hop-by-hop headers to be rejected")
+	}
+	if err := (Headers{"X-Gateway": stringPtr("depoy")}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
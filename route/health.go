@@ -0,0 +1,154 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/util"
+	"github.com/valyala/fasthttp"
+)
+
+// Probe configures the request of a healthcheck and the response which is healthy
+type Probe struct {
+	Method         string `json:"method" yaml:"method"` // default GET
+	Body           string `json:"body,omitempty" yaml:"body,omitempty"`
+	ContentType    string `json:"content_type,omitempty" yaml:"contentType,omitempty"`
+	ExpectedStatus []int  `json:"expected_status,omitempty" yaml:"expectedStatus,omitempty"` // default any 2xx
+	ExpectedBody   string `json:"expected_body,omitempty" yaml:"expectedBody,omitempty"`     // substring of the response body
+}
+
+// Validate checks the probe config
+func (p *Probe) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, status := range p.ExpectedStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("Expected status %d of healthcheck is invalid", status)
+		}
+	}
+	if p.Body != "" && (p.Method == "" || p.Method == "GET" || p.Method == "HEAD") {
+		return fmt.Errorf("Healthcheck with a body requires a method like POST")
+	}
+	return nil
+}
+
+// prepare sets the method and body of the healthcheck request
+func (p *Probe) prepare(req *fasthttp.Request) {
+	if p == nil || p.Method == "" {
+		req.Header.SetMethod("GET")
+		return
+	}
+	req.Header.SetMethod(p.Method)
+	if p.Body != "" {
+		req.SetBodyString(p.Body)
+		if p.ContentType != "" {
+			req.Header.SetContentType(p.ContentType)
+		}
+	}
+}
+
+// check returns an error if the response does not match the expectations of the
+// probe. Without a probe, every response is healthy
+func (p *Probe) check(resp *fasthttp.Response) error {
+	if p == nil {
+		return nil
+	}
+	status := resp.StatusCode()
+	if len(p.ExpectedStatus) == 0 {
+		if status < 200 || status > 299 {
+			return fmt.Errorf("Healthcheck responded with status %d", status)
+		}
+	} else if !containsStatus(p.ExpectedStatus, status) {
+		return fmt.Errorf("Healthcheck responded with status %d instead of %v", status, p.ExpectedStatus)
+	}
+	if p.ExpectedBody != "" && !bytes.Contains(resp.Body(), []byte(p.ExpectedBody)) {
+		return fmt.Errorf("Healthcheck response does not contain %q", p.ExpectedBody)
+	}
+	return nil
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthStatus is the outcome of the recent healthchecks of a backend
+type HealthStatus struct {
+	LastCheck            time.Time           `json:"last_check"` // zero if the backend was never checked
+	Healthy              bool                `json:"healthy"`    // result of the last healthcheck
+	Latency              util.ConfigDuration `json:"latency"`
+	Error                string              `json:"error,omitempty"` // reason of the last failed healthcheck
+	ConsecutiveSuccesses int                 `json:"consecutive_successes"`
+	ConsecutiveFailures  int                 `json:"consecutive_failures"`
+}
+
+// recordHealthCheck updates the health of the backend with the outcome of a healthcheck
+func (b *Backend) recordHealthCheck(healthy bool, latency time.Duration, err error) HealthStatus {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.health.LastCheck = time.Now()
+	b.health.Healthy = healthy
+	b.health.Latency = util.ConfigDuration{Duration: latency}
+	b.health.Error = ""
+	if healthy {
+		b.health.ConsecutiveSuccesses++
+		b.health.ConsecutiveFailures = 0
+	} else {
+		b.health.ConsecutiveFailures++
+		b.health.ConsecutiveSuccesses = 0
+		if err != nil {
+			b.health.Error = err.Error()
+		}
+	}
+	return b.health
+}
+
+// setPassing activates the backend once its healthchecks pass and deactivates it
+// once they fail. The status is only updated if the outcome changed so that
+// a backend which is deactivated by an alert is not activated by every healthcheck
+func (b *Backend) setPassing(passing bool) {
+	b.mux.Lock()
+	changed := b.passing != passing
+	b.passing = passing
+	b.mux.Unlock()
+
+	if changed || !passing {
+		b.UpdateStatus(passing)
+	}
+}
+
+// threshold returns the number of consecutive healthchecks which change the
+// status of a backend. At least one healthcheck is required
+func threshold(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Health returns the outcome of the recent healthchecks of the backend
+func (b *Backend) Health() HealthStatus {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.health
+}
+
+// BackendHealth returns the health of all backends of the route
+func (r *Route) BackendHealth() map[uuid.UUID]HealthStatus {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	health := make(map[uuid.UUID]HealthStatus, len(r.Backends))
+	for id, backend := range r.Backends {
+		health[id] = backend.Health()
+	}
+	return health
+}
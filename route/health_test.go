@@ -0,0 +1,229 @@
+package route
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// probeClient answers healthchecks with the given outcomes in order.
+// true is a 200 response, false a transport error
+type probeClient struct {
+	outcomes []bool
+	next     int
+}
+
+func (c *probeClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	healthy := c.outcomes[c.next%len(c.outcomes)]
+	c.next++
+	if !healthy {
+		return nil, fmt.Errorf("connection refused")
+	}
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	return resp, nil
+}
+
+func Test_HealthCheck_RecordsOutcomes(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	a := backendByName(r, "a")
+	if health := a.Health(); !health.LastCheck.IsZero() {
+		t.Errorf("Expected the backend to be unchecked, got %+v", health)
+	}
+	r.Client = &probeClient{outcomes: []bool{true, true, false, false, false, true}}
+
+	expected := []struct {
+		healthy             bool
+		successes, failures int
+	}{
+		{true, 1, 0}, {true, 2, 0}, {false, 0, 1}, {false, 0, 2}, {false, 0, 3}, {true, 1, 0},
+	}
+	for i, e := range expected {
+		before := time.Now()
+		if healthy := r.healthCheck(a); healthy != e.healthy {
+			t.Errorf("Check %d: expected %t, got %t", i, e.healthy, healthy)
+		}
+		health := a.Health()
+		if health.Healthy != e.healthy || health.ConsecutiveSuccesses != e.successes || health.ConsecutiveFailures != e.failures {
+			t.Errorf("Check %d: expected %+v, got %+v", i, e, health)
+		}
+		if health.LastCheck.Before(before) || health.Latency.Duration < 0 {
+			t.Errorf("Check %d: expected the time and latency of the check, got %+v", i, health)
+		}
+		if e.healthy != (health.Error == "") {
+			t.Errorf("Check %d: expected only failures to have an error, got %q", i, health.Error)
+		}
+	}
+	if health := r.BackendHealth()[a.ID]; !health.Healthy || health.ConsecutiveSuccesses != 1 {
+		t.Errorf("Expected the health of the route to contain the backend, got %+v", health)
+	}
+}
+
+func Test_HealthCheck_Thresholds(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.HealthyThreshold = 2
+	r.UnhealthyThreshold = 3
+	a := backendByName(r, "a")
+	a.UpdateStatus(false)
+	outcomes := []bool{true, true, false, true, true, false, false, false, true, true}
+	r.Client = &probeClient{outcomes: outcomes}
+
+	// status after each healthcheck
+	expected := []bool{false, true, true, true, true, true, true, false, false, true}
+	for i := range outcomes {
+		r.healthCheck(a)
+		a.mux.Lock()
+		active := a.Active
+		a.mux.Unlock()
+		if active != expected[i] {
+			t.Errorf("Check %d: expected the backend to be active %t, got %t", i, expected[i], active)
+		}
+	}
+	if len(r.MetricsRepo.InChannel) != 7 {
+		t.Errorf("Expected the tolerated failures to not be recorded, got %d metrics", len(r.MetricsRepo.InChannel))
+	}
+}
+
+func Test_HealthCheck_DefaultThreshold(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	a := backendByName(r, "a")
+	r.Client = &probeClient{outcomes: []bool{true, false}}
+	r.healthCheck(a)
+	r.healthCheck(a)
+	if a.Active {
+		t.Error("Expected a single failure to deactivate the backend by default")
+	}
+}
+
+func Test_HealthCheck_PostProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method != "POST" || string(body) != `{"deep": true}` || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"status": "ready"}`))
+	}))
+	defer server.Close()
+
+	r := newTestRouteTo(t, strings.TrimPrefix(server.URL, "http://"), map[string]uint8{"a": 100})
+	a := backendByName(r, "a")
+	a.HealthCheckProbe = &Probe{Method: "POST", Body: `{"deep": true}`, ContentType: "application/json"}
+	if !r.healthCheck(a) {
+		t.Errorf("Expected the POST probe to succeed, got %+v", a.Health())
+	}
+
+	a.HealthCheckProbe.ExpectedBody = `"ready"`
+	if !r.healthCheck(a) {
+		t.Errorf("Expected the body to contain the substring, got %+v", a.Health())
+	}
+	a.HealthCheckProbe.ExpectedBody = `"starting"`
+	if r.healthCheck(a) || !strings.Contains(a.Health().Error, "starting") {
+		t.Errorf("Expected the probe to fail without the substring, got %+v", a.Health())
+	}
+	a.HealthCheckProbe = &Probe{Method: "POST"}
+	if r.healthCheck(a) {
+		t.Error("Expected the 400 of the upstream to fail the probe")
+	}
+}
+
+func Test_HealthCheck_ExpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	r := newTestRouteTo(t, strings.TrimPrefix(server.URL, "http://"), map[string]uint8{"a": 100})
+	a := backendByName(r, "a")
+	if !r.healthCheck(a) {
+		t.Error("Expected every response to be healthy without a probe")
+	}
+	a.HealthCheckProbe = &Probe{}
+	if r.healthCheck(a) {
+		t.Error("Expected only 2xx to be healthy by default")
+	}
+	a.HealthCheckProbe = &Probe{ExpectedStatus: []int{200, 401}}
+	if !r.healthCheck(a) {
+		t.Errorf("Expected the 401 to be healthy, got %+v", a.Health())
+	}
+}
+
+func Test_Probe_Validate(t *testing.T) {
+	if err := (&Probe{ExpectedStatus: []int{700}}).Validate(); err == nil {
+		t.Error("Expected an invalid status to be rejected")
+	}
+	if err := (&Probe{Body: "{}"}).Validate(); err == nil {
+		t.Error("Expected a GET with body to be rejected")
+	}
+	if err := (&Probe{Method: "POST", Body: "{}", ExpectedStatus: []int{204}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// recordingClient records the time of every healthcheck
+type recordingClient struct {
+	mux   sync.Mutex
+	times []time.Time
+}
+
+func (c *recordingClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	c.mux.Lock()
+	c.times = append(c.times, time.Now())
+	c.mux.Unlock()
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	return resp, nil
+}
+
+// probeSpread runs one cycle of healthchecks of 10 backends and returns the
+// time between the first and the last probe
+func probeSpread(t *testing.T, jitter float64) time.Duration {
+	weights := make(map[string]uint8)
+	for i := 0; i < 10; i++ {
+		weights[fmt.Sprintf("b%d", i)] = 10
+	}
+	r := newTestRoute(t, weights)
+	r.HealthCheckInterval = 300 * time.Millisecond
+	r.HealthCheckJitter = jitter
+	client := &recordingClient{}
+	r.Client = client
+
+	go r.RunHealthCheckOnBackends()
+	// the first cycle is done after 450ms, the second one starts after 600ms
+	time.Sleep(520 * time.Millisecond)
+	r.killHealthCheck <- 1
+
+	client.mux.Lock()
+	defer client.mux.Unlock()
+	if len(client.times) != 10 {
+		t.Fatalf("Expected one probe per backend, got %d", len(client.times))
+	}
+	first, last := client.times[0], client.times[0]
+	for _, probe := range client.times {
+		if probe.Before(first) {
+			first = probe
+		}
+		if probe.After(last) {
+			last = probe
+		}
+	}
+	return last.Sub(first)
+}
+
+func Test_HealthCheck_Jitter(t *testing.T) {
+	// the chance that 10 probes with a jitter of 150ms are within 20ms is negligible
+	if spread := probeSpread(t, 0.5); spread < 20*time.Millisecond {
+		t.Errorf("Expected the probes to be spread out, got %v", spread)
+	}
+	if spread := probeSpread(t, 0); spread > 20*time.Millisecond {
+		t.Errorf("Expected the probes to be simultaneous without jitter, got %v", spread)
+	}
+}
@@ -0,0 +1,75 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// blockingClient answers requests once release is closed
+type blockingClient struct {
+	received chan struct{}
+	release  chan struct{}
+}
+
+func (c *blockingClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	c.received <- struct{}{}
+	<-c.release
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	return resp, nil
+}
+
+// gaugeValue scrapes the value of the gauge with the labels from the default registry
+func gaugeValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	outer:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue outer
+				}
+			}
+			return metric.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+func Test_InFlightRequests_Gauge(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.MetricsRepo = &metrics.Repository{InChannel: make(chan *metrics.Metrics, 100)}
+	client := &blockingClient{received: make(chan struct{}), release: make(chan struct{})}
+	r.Client = client
+	a := backendByName(r, "a")
+	labels := map[string]string{"route": r.Name, "backend": a.ID.String()}
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			doRequest(r, "GET", "", a)
+			done <- struct{}{}
+		}()
+		<-client.received
+	}
+	if value := gaugeValue(t, "ingress_depoy_in_flight_http_requests", labels); value != 2 {
+		t.Errorf("Expected 2 requests in flight, got %v", value)
+	}
+
+	close(client.release)
+	<-done
+	<-done
+	if value := gaugeValue(t, "ingress_depoy_in_flight_http_requests", labels); value != 0 {
+		t.Errorf("Expected no requests in flight, got %v", value)
+	}
+}
@@ -0,0 +1,88 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// maxMirrorRequests is the maximum number of concurrent requests to the
+// mirror (or shadow) backend of a route. Further copies are dropped
+const maxMirrorRequests = 256
+
+// SetMirror designates the backend with the given name as mirror of the route.
+// A copy of each request is sent to the mirror and its response is discarded.
+// The mirror does not receive regular traffic, hence its weight is set to 0.
+// If the name is empty, mirroring is disabled
+func (r *Route) SetMirror(name string) error {
+	if name == "" {
+		r.Mirror = ""
+		return nil
+	}
+	if r.StreamingUpload {
+		return fmt.Errorf("Mirror requires buffering and cannot be used with streamingUpload")
+	}
+	for _, backend := range r.Backends {
+		if backend.Name == name {
+			backend.Weigth = 0
+			r.Mirror = name
+			r.updateWeights()
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to find the mirror backend %s", name)
+}
+
+// mirrorBackend returns the active mirror backend of the route or nil
+func (r *Route) mirrorBackend() *Backend {
+	if r.Mirror == "" {
+		return nil
+	}
+	if backend := r.namedBackend(r.Mirror); backend != nil && backend.isActive() {
+		return backend
+	}
+	return nil
+}
+
+// copyRequest returns a copy of the downstream request which is owned by the caller
+func (r *Route) copyRequest(ctx *fasthttp.RequestCtx) *fasthttp.Request {
+	req := fasthttp.AcquireRequest()
+	ctx.Request.CopyTo(req)
+	delRequestHopHeader(req)
+	setForwardedHeaders(req, ctx, r.TrustForwarded)
+	r.RequestHeaders.applyRequest(&req.Header)
+	return req
+}
+
+// sendAsync sends the copy of a request to the backend without blocking and
+// releases it afterwards. The response is discarded but the metrics are recorded.
+// If too many copies are in flight, the copy is dropped
+func (r *Route) sendAsync(req *fasthttp.Request, backend *Backend) {
+	select {
+	case r.mirrorSem <- struct{}{}:
+	default:
+		log.Debugf("Dropping copy of request to %v of %s", backend.ID, r.Name)
+		fasthttp.ReleaseRequest(req)
+		return
+	}
+
+	go func() {
+		defer func() { <-r.mirrorSem }()
+		defer fasthttp.ReleaseRequest(req)
+
+		// the copy must never be retried on another backend
+		if err := r.httpDo(req, backend, discardResponse, 0); err != nil {
+			log.Infof("Request to %v of %s failed with %s", backend.ID, r.Name, err.Error())
+		}
+	}()
+}
+
+// discardResponse drops the response of a copy of a request. A streamed
+// response is owned by the return-function and released without being read
+func discardResponse(resp *fasthttp.Response, m *metrics.Metrics) {
+	if resp.IsBodyStream() {
+		fasthttp.ReleaseResponse(resp)
+	}
+}
@@ -0,0 +1,72 @@
+package route
+
+import (
+	"testing"
+	"time"
+)
+
+func (c *flakyClient) calls() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return append([]string{}, c.hosts...)
+}
+
+func Test_Mirror_Error(t *testing.T) {
+	r, client := newRetryRoute(t, 0, map[string]int{"a": 200, "m": 0})
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	if err = r.SetMirror("m"); err != nil {
+		t.Fatal(err)
+	}
+	handler := r.GetHandler()
+
+	for i := 0; i < 5; i++ {
+		ctx := clientCtx("10.0.0.1")
+		ctx.Request.SetRequestURI("/")
+		ctx.Request.SetBodyString("payload")
+		handler(ctx)
+		if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "a:8080" {
+			t.Fatalf("Expected the response of a, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	// every request records its metrics once it is done
+	for len(r.MetricsRepo.InChannel) < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	primary, mirrored := 0, 0
+	for _, host := range client.calls() {
+		switch host {
+		case "a:8080":
+			primary++
+		case "m:8080":
+			mirrored++
+		}
+	}
+	if primary != 5 || mirrored != 5 {
+		t.Errorf("Expected 5 primary and 5 mirrored requests, got %d and %d", primary, mirrored)
+	}
+
+	// the failed requests of the mirror are recorded
+	failed := 0
+	for len(r.MetricsRepo.InChannel) > 0 {
+		if m := <-r.MetricsRepo.InChannel; m.BackendID == backendByName(r, "m").ID && m.ResponseStatus == 600 {
+			failed++
+		}
+	}
+	if failed != 5 {
+		t.Errorf("Expected 5 failed requests of the mirror to be recorded, got %d", failed)
+	}
+}
+
+func Test_Mirror_Unknown(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+
+	if err := r.SetMirror("unknown"); err == nil {
+		t.Error("Expected an error for an unknown mirror backend")
+	}
+}
@@ -0,0 +1,112 @@
+package route
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OutlierDetection passively ejects backends whose 5xx rate within Interval
+// exceeds Threshold. Ejected backends are re-admitted after Cooldown.
+// The last active backend of a route is never ejected
+type OutlierDetection struct {
+	Threshold float64       // 5xx rate (0, 1] which ejects a backend
+	Interval  time.Duration // window of the rate and interval of the detection (default MonitoringInterval)
+	Cooldown  time.Duration // duration of an ejection
+	kill      chan int
+}
+
+// Validate checks the config of the outlier detection
+func (o *OutlierDetection) Validate() error {
+	if o.Threshold <= 0 || o.Threshold > 1 {
+		return fmt.Errorf("Threshold of outlierDetection must be within (0, 1]")
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("Interval of outlierDetection cannot be negative")
+	}
+	if o.Cooldown <= 0 {
+		return fmt.Errorf("Cooldown of outlierDetection must be larger than 0")
+	}
+	return nil
+}
+
+// SetOutlierDetection starts the outlier detection of the route.
+// A running outlier detection is stopped. If o is nil, it is disabled
+func (r *Route) SetOutlierDetection(o *OutlierDetection) error {
+	if o != nil {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		if o.Interval == 0 {
+			o.Interval = r.MonitoringInterval
+		}
+	}
+	if r.OutlierDetection != nil && r.OutlierDetection.kill != nil {
+		r.OutlierDetection.kill <- 1
+	}
+	r.OutlierDetection = o
+	if o != nil {
+		o.kill = make(chan int, 1)
+		go r.runOutlierDetection(o)
+	}
+	return nil
+}
+
+func (r *Route) runOutlierDetection(o *OutlierDetection) {
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.kill:
+			log.Warnf("Stopping outlier detection of %s", r.Name)
+			return
+		case now := <-ticker.C:
+			r.detectOutliers(o, now)
+		}
+	}
+}
+
+// detectOutliers re-admits backends whose cooldown expired and ejects
+// backends whose 5xx rate exceeds the threshold
+func (r *Route) detectOutliers(o *OutlierDetection, now time.Time) {
+	if r.MetricsRepo == nil || r.MetricsRepo.Storage == nil {
+		return
+	}
+	r.mux.RLock()
+	backends := make([]*Backend, 0, len(r.Backends))
+	for _, backend := range r.Backends {
+		backends = append(backends, backend)
+	}
+	r.mux.RUnlock()
+
+	active := 0
+	for _, backend := range backends {
+		if backend.isActive() {
+			active++
+		}
+	}
+	for _, backend := range backends {
+		if backend.readmit(now) {
+			log.Warnf("Re-admitting backend %v of %s after its ejection", backend.ID, r.Name)
+			active++
+			continue
+		}
+		if !backend.isActive() {
+			continue
+		}
+		rates, err := r.MetricsRepo.ReadRatesOfBackend(backend.ID, now.Add(-o.Interval), now)
+		if err != nil || rates["5xxRate"] < o.Threshold {
+			continue
+		}
+		if active <= 1 {
+			log.Warnf("Not ejecting backend %v as it is the last active backend of %s", backend.ID, r.Name)
+			continue
+		}
+		if backend.eject(now.Add(o.Cooldown)) {
+			log.Warnf("Ejecting backend %v of %s for %v (5xxRate %.2f)", backend.ID, r.Name, o.Cooldown, rates["5xxRate"])
+			active--
+		}
+	}
+}
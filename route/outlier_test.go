@@ -0,0 +1,92 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/storage"
+)
+
+// fakeStorage returns the given 5xx responses (of 100) of each backend
+// and of the route
+type fakeStorage struct {
+	errors      map[uuid.UUID]int
+	routeErrors int
+}
+
+func (s *fakeStorage) Write(string, uuid.UUID, map[string]float64, int64, int64, int, string) {}
+
+func (s *fakeStorage) ReadData() map[string]map[uuid.UUID]map[time.Time]storage.Metric {
+	return nil
+}
+
+func (s *fakeStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (storage.Metric, error) {
+	return storage.Metric{TotalResponses: 100, ResponseStatus500: s.errors[backend]}, nil
+}
+
+func (s *fakeStorage) ReadRoute(route string, start, end time.Time) (storage.Metric, error) {
+	return storage.Metric{TotalResponses: 100, ResponseStatus500: s.routeErrors}, nil
+}
+
+func (s *fakeStorage) Stop() {}
+
+func newOutlierRoute(t *testing.T, errors map[string]int) (*Route, *OutlierDetection) {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50})
+	st := &fakeStorage{errors: make(map[uuid.UUID]int)}
+	for name, n := range errors {
+		st.errors[backendByName(r, name).ID] = n
+	}
+	r.MetricsRepo = &metrics.Repository{Storage: st, InChannel: make(chan *metrics.Metrics, 100)}
+	o := &OutlierDetection{Threshold: 0.5, Interval: time.Second, Cooldown: time.Minute}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return r, o
+}
+
+func Test_OutlierDetection_Eject(t *testing.T) {
+	r, o := newOutlierRoute(t, map[string]int{"a": 80, "b": 1})
+	a := backendByName(r, "a")
+	now := time.Now()
+
+	r.detectOutliers(o, now)
+	if a.isActive() {
+		t.Fatal("Expected a to be ejected")
+	}
+	for _, backend := range r.NextTargetDistr {
+		if backend == a {
+			t.Fatal("Expected a to be removed from the distribution")
+		}
+	}
+
+	// healthchecks do not re-admit an ejected backend
+	a.UpdateStatus(true)
+	if a.isActive() {
+		t.Error("Expected a to stay ejected until the cooldown expired")
+	}
+
+	r.detectOutliers(o, now.Add(o.Cooldown))
+	if !a.isActive() || !containsBackend(r.NextTargetDistr, a) {
+		t.Error("Expected a to be re-admitted after the cooldown")
+	}
+}
+
+func Test_OutlierDetection_LastBackend(t *testing.T) {
+	r, o := newOutlierRoute(t, map[string]int{"a": 80, "b": 90})
+
+	r.detectOutliers(o, time.Now())
+	if r.lenNextTargetDistr == 0 {
+		t.Error("Expected the last active backend not to be ejected")
+	}
+}
+
+func Test_OutlierDetection_Validate(t *testing.T) {
+	if err := (&OutlierDetection{Threshold: 1.5, Cooldown: time.Second}).Validate(); err == nil {
+		t.Error("Expected a threshold larger than 1 to be rejected")
+	}
+	if err := (&OutlierDetection{Threshold: 0.5}).Validate(); err == nil {
+		t.Error("Expected a missing cooldown to be rejected")
+	}
+}
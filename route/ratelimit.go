@@ -0,0 +1,124 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// rateLimitSweep is the number of client buckets after which
+// idle buckets are removed
+const rateLimitSweep = 1024
+
+// RateLimit limits the requests of a route with a token bucket. Each request
+// takes a token, the bucket is refilled with RequestsPerSecond tokens and holds
+// at most Burst tokens. If PerClient is set, every client IP has its own bucket
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second" yaml:"requestsPerSecond"`
+	Burst             int     `json:"burst" yaml:"burst"`
+	PerClient         bool    `json:"per_client" yaml:"perClient"`
+	mux               sync.Mutex
+	global            *tokenBucket
+	clients           map[string]*tokenBucket
+	now               func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Validate checks the parameters of the rate limit. If no burst is
+// set, the bucket holds the tokens of one second
+func (l *RateLimit) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.RequestsPerSecond <= 0 {
+		return fmt.Errorf("RequestsPerSecond of rateLimit must be larger than 0")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("Burst of rateLimit cannot be negative")
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.RequestsPerSecond))
+	}
+	return nil
+}
+
+// Allow takes a token of the bucket of the request. If the bucket is empty,
+// false and the duration until the next token is available are returned
+func (l *RateLimit) Allow(ctx *fasthttp.RequestCtx) (bool, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+
+	bucket := l.bucketFor(ctx, now)
+	bucket.refill(now, l.RequestsPerSecond, float64(l.Burst))
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.RequestsPerSecond * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// bucketFor returns the bucket of the client of the request or the
+// bucket of the route. New buckets are full
+func (l *RateLimit) bucketFor(ctx *fasthttp.RequestCtx, now time.Time) *tokenBucket {
+	if !l.PerClient {
+		if l.global == nil {
+			l.global = &tokenBucket{tokens: float64(l.Burst), last: now}
+		}
+		return l.global
+	}
+
+	if l.clients == nil {
+		l.clients = make(map[string]*tokenBucket)
+	}
+	ip := ctx.RemoteIP().String()
+	bucket, found := l.clients[ip]
+	if !found {
+		if len(l.clients) >= rateLimitSweep {
+			l.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.clients[ip] = bucket
+	}
+	return bucket
+}
+
+// sweep removes the buckets which are full again as they
+// are equivalent to new buckets
+func (l *RateLimit) sweep(now time.Time) {
+	for ip, bucket := range l.clients {
+		bucket.refill(now, l.RequestsPerSecond, float64(l.Burst))
+		if bucket.tokens >= float64(l.Burst) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
+
+// retryAfter formats the duration as seconds for the Retry-After header (at least 1)
+func retryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
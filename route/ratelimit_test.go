@@ -0,0 +1,123 @@
+package route
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newRateLimit(t *testing.T, rate float64, burst int, perClient bool) (*RateLimit, *time.Time) {
+	now := time.Unix(0, 0)
+	l := &RateLimit{RequestsPerSecond: rate, Burst: burst, PerClient: perClient}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func clientCtx(ip string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}, nil)
+	return ctx
+}
+
+func Test_RateLimit_Boundary(t *testing.T) {
+	l, now := newRateLimit(t, 2, 3, false)
+	ctx := clientCtx("10.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(ctx); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := l.Allow(ctx)
+	if ok {
+		t.Fatal("Expected the request after the burst to be denied")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for the next token, got %v", wait)
+	}
+
+	*now = now.Add(499 * time.Millisecond)
+	if ok, _ = l.Allow(ctx); ok {
+		t.Error("Expected the request to be denied before a token is refilled")
+	}
+	*now = now.Add(time.Millisecond)
+	if ok, _ = l.Allow(ctx); !ok {
+		t.Error("Expected the request to be allowed once a token is refilled")
+	}
+	if ok, _ = l.Allow(ctx); ok {
+		t.Error("Expected the bucket to be empty again")
+	}
+}
+
+func Test_RateLimit_PerClient(t *testing.T) {
+	l, _ := newRateLimit(t, 1, 1, true)
+
+	if ok, _ := l.Allow(clientCtx("10.0.0.1")); !ok {
+		t.Fatal("Expected the first request of the client to be allowed")
+	}
+	if ok, _ := l.Allow(clientCtx("10.0.0.1")); ok {
+		t.Error("Expected the second request of the client to be denied")
+	}
+	if ok, _ := l.Allow(clientCtx("10.0.0.2")); !ok {
+		t.Error("Expected another client to have its own bucket")
+	}
+}
+
+func Test_RateLimit_Concurrent(t *testing.T) {
+	l, _ := newRateLimit(t, 1, 50, false)
+
+	allowed := make(chan bool, 100)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, _ := l.Allow(clientCtx("10.0.0.1"))
+			allowed <- ok
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+
+	count := 0
+	for ok := range allowed {
+		if ok {
+			count++
+		}
+	}
+	if count != 50 {
+		t.Errorf("Expected 50 allowed requests, got %d", count)
+	}
+}
+
+func Test_RateLimit_Handler(t *testing.T) {
+	r, client := newLimitedRoute(t, 0)
+	r.RateLimit, _ = newRateLimit(t, 1, 1, false)
+	handler := r.GetHandler()
+
+	ctx := clientCtx("10.0.0.1")
+	ctx.Request.SetRequestURI("/")
+	handler(ctx)
+	if ctx.Response.StatusCode() != 200 {
+		t.Fatalf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+
+	ctx = clientCtx("10.0.0.1")
+	ctx.Request.SetRequestURI("/")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", ctx.Response.StatusCode())
+	}
+	if retry := string(ctx.Response.Header.Peek("Retry-After")); retry != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", retry)
+	}
+	if len(client.hosts) != 1 {
+		t.Errorf("Expected 1 upstream request, got %v", client.hosts)
+	}
+}
@@ -0,0 +1,130 @@
+package route
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// RedirectRewrite rewrites the Location header of redirects of the
+	// backend so that it points at the route
+	RedirectRewrite = "rewrite"
+	// RedirectFollow follows redirects of the backend to the backend
+	// server-side up to MaxRedirects times
+	RedirectFollow = "follow"
+)
+
+// DefaultMaxRedirects is the number of redirects which are followed if MaxRedirects is not set
+const DefaultMaxRedirects = 5
+
+func isRedirect(code int) bool {
+	switch code {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// reversePath reverses the rewrite of the path (Rewrite or stripped prefix => Prefix)
+func (r *Route) reversePath(path string) string {
+	upstreamPrefix := r.upstreamPrefix()
+	if upstreamPrefix == "" || !strings.HasPrefix(path, upstreamPrefix) {
+		return path
+	}
+	return r.Prefix + path[len(upstreamPrefix):]
+}
+
+// upstreamLocation resolves the Location header of the response against the
+// upstream request. If it does not point at the backend, nil is returned.
+// The returned uri must be released by the caller
+func (r *Route) upstreamLocation(req *fasthttp.Request, resp *fasthttp.Response, target *Backend) *fasthttp.URI {
+	location := resp.Header.Peek(fasthttp.HeaderLocation)
+	if len(location) == 0 {
+		return nil
+	}
+	uri := fasthttp.AcquireURI()
+	req.URI().CopyTo(uri)
+	uri.UpdateBytes(location)
+	if !bytes.EqualFold(uri.Host(), req.URI().Host()) && !strings.EqualFold(string(uri.Host()), target.Addr.Host) {
+		fasthttp.ReleaseURI(uri)
+		return nil
+	}
+	return uri
+}
+
+// rewriteLocation replaces the backend address and the rewritten path of the
+// Location header with the host of the client and the prefix of the route.
+// Path-absolute locations stay relative. Document-relative locations are
+// already resolved correctly by the client and are not modified
+func (r *Route) rewriteLocation(req *fasthttp.Request, orig *fasthttp.URI, resp *fasthttp.Response, target *Backend) {
+	if !isRedirect(resp.StatusCode()) {
+		return
+	}
+	header := resp.Header.Peek(fasthttp.HeaderLocation)
+	pathAbsolute := bytes.HasPrefix(header, []byte("/")) && !bytes.HasPrefix(header, []byte("//"))
+	if !pathAbsolute && !bytes.Contains(header, []byte("//")) {
+		return
+	}
+	uri := r.upstreamLocation(req, resp, target)
+	if uri == nil {
+		return
+	}
+	defer fasthttp.ReleaseURI(uri)
+
+	location := r.reversePath(string(uri.RequestURI()))
+	if !pathAbsolute {
+		location = string(orig.Scheme()) + "://" + string(orig.Host()) + location
+	}
+	resp.Header.Set(fasthttp.HeaderLocation, location)
+}
+
+// followRedirects follows redirects of GET and HEAD requests which point at
+// the backend. The metrics of every redirect are recorded. Redirects to other
+// hosts and redirects of streamed requests are returned to the client
+func (r *Route) followRedirects(
+	req *fasthttp.Request,
+	orig *fasthttp.URI,
+	target *Backend,
+	resp *fasthttp.Response,
+	m *metrics.Metrics,
+	timeout time.Duration) (*fasthttp.Response, *metrics.Metrics, error) {
+
+	if !req.Header.IsGet() && !req.Header.IsHead() || r.StreamingUpload && req.Header.ContentLength() > 0 {
+		return resp, m, nil
+	}
+	max := r.MaxRedirects
+	if max <= 0 {
+		max = DefaultMaxRedirects
+	}
+
+	for hops := 0; hops < max && isRedirect(resp.StatusCode()); hops++ {
+		uri := r.upstreamLocation(req, resp, target)
+		if uri == nil {
+			break
+		}
+		// the location is converted back so that it is rewritten like the original uri
+		next := fasthttp.AcquireURI()
+		orig.CopyTo(next)
+		next.Update(r.reversePath(string(uri.RequestURI())))
+		fasthttp.ReleaseURI(uri)
+
+		log.Debugf("Following redirect of %v to %s", target.ID, next.String())
+		m.ResponseStatus = resp.StatusCode()
+		m.ContentLength = int64(resp.Header.ContentLength())
+		r.MetricsRepo.Send(m)
+		fasthttp.ReleaseResponse(resp)
+
+		var err error
+		resp, m, err = r.send(req, next, target, timeout)
+		fasthttp.ReleaseURI(next)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return resp, m, nil
+}
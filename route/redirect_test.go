@@ -0,0 +1,131 @@
+package route
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// redirectClient redirects requests of the configured paths to the location.
+// Other paths are answered with 200
+type redirectClient struct {
+	mux       sync.Mutex
+	locations map[string]string
+	paths     []string
+}
+
+func (c *redirectClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	path := string(req.URI().RequestURI())
+	c.paths = append(c.paths, path)
+	resp := fasthttp.AcquireResponse()
+	if location, ok := c.locations[path]; ok {
+		resp.SetStatusCode(fasthttp.StatusFound)
+		resp.Header.Set(fasthttp.HeaderLocation, location)
+		return resp, nil
+	}
+	resp.SetBodyString(path)
+	return resp, nil
+}
+
+func newRedirectRoute(t *testing.T, mode string, locations map[string]string) (*Route, *redirectClient) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.Prefix = "/app/"
+	r.Rewrite = "/"
+	r.Redirects = mode
+	client := &redirectClient{locations: locations}
+	r.Client = client
+	return r, client
+}
+
+func redirectRequest(t *testing.T, r *Route, path string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetHost("public.example.com")
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func Test_Redirects_Rewrite(t *testing.T) {
+	r, _ := newRedirectRoute(t, RedirectRewrite, map[string]string{
+		"/absolute": "http://a:8080/login?next=1",
+		"/relative": "/login",
+		"/external": "https://sso.example.com/login",
+		"/document": "login",
+	})
+
+	expected := map[string]string{
+		"/app/absolute": "http://public.example.com/app/login?next=1",
+		"/app/relative": "/app/login",
+		"/app/external": "https://sso.example.com/login",
+		"/app/document": "login",
+	}
+	for path, location := range expected {
+		ctx := redirectRequest(t, r, path)
+		if got := string(ctx.Response.Header.Peek(fasthttp.HeaderLocation)); got != location {
+			t.Errorf("Expected Location of %s to be %s, got %s", path, location, got)
+		}
+	}
+}
+
+func Test_Redirects_PassThrough(t *testing.T) {
+	r, _ := newRedirectRoute(t, "", map[string]string{"/absolute": "http://a:8080/login"})
+
+	ctx := redirectRequest(t, r, "/app/absolute")
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderLocation)); got != "http://a:8080/login" {
+		t.Errorf("Expected Location not to be modified, got %s", got)
+	}
+}
+
+func Test_Redirects_Follow(t *testing.T) {
+	r, client := newRedirectRoute(t, RedirectFollow, map[string]string{
+		"/start":  "/middle",
+		"/middle": "http://a:8080/end?done=1",
+	})
+
+	ctx := redirectRequest(t, r, "/app/start")
+	if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "/end?done=1" {
+		t.Errorf("Expected the final response, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if len(client.paths) != 3 {
+		t.Errorf("Expected 3 upstream requests, got %v", client.paths)
+	}
+	// every hop is recorded
+	if n := len(r.MetricsRepo.InChannel); n != 3 {
+		t.Errorf("Expected 3 metrics, got %d", n)
+	}
+}
+
+func Test_Redirects_FollowMaxHops(t *testing.T) {
+	r, client := newRedirectRoute(t, RedirectFollow, map[string]string{"/loop": "/loop"})
+	r.MaxRedirects = 2
+
+	ctx := redirectRequest(t, r, "/app/loop")
+	if ctx.Response.StatusCode() != fasthttp.StatusFound {
+		t.Errorf("Expected the redirect to be returned after the max hops, got %d", ctx.Response.StatusCode())
+	}
+	if len(client.paths) != 3 {
+		t.Errorf("Expected 3 upstream requests, got %v", client.paths)
+	}
+}
+
+func Test_Redirects_FollowExternal(t *testing.T) {
+	r, client := newRedirectRoute(t, RedirectFollow, map[string]string{"/external": "https://sso.example.com/login"})
+
+	ctx := redirectRequest(t, r, "/app/external")
+	if got := string(ctx.Response.Header.Peek(fasthttp.HeaderLocation)); got != "https://sso.example.com/login" {
+		t.Errorf("Expected redirects to other hosts to be returned, got %s", got)
+	}
+	if len(client.paths) != 1 {
+		t.Errorf("Expected 1 upstream request, got %v", client.paths)
+	}
+}
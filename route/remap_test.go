@@ -0,0 +1,41 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_RemapStatus(t *testing.T) {
+	tests := map[string]struct {
+		upstream, returned, recorded int
+		recordOrig                   bool
+		body                         string
+	}{
+		"unmapped":             {upstream: 500, returned: 500, recorded: 500, body: "upstream"},
+		"remapped":             {upstream: 598, returned: 504, recorded: 504, body: "upstream"},
+		"record original":      {upstream: 598, returned: 504, recorded: 598, recordOrig: true, body: "upstream"},
+		"no content":           {upstream: 202, returned: 204, recorded: 204},
+		"not modified":         {upstream: 299, returned: 304, recorded: 304},
+		"no content, original": {upstream: 202, returned: 204, recorded: 202, recordOrig: true},
+	}
+	for name, tt := range tests {
+		r := &Route{
+			StatusRemap:      map[int]int{598: 504, 202: 204, 299: 304},
+			RecordOrigStatus: tt.recordOrig,
+		}
+		resp := new(fasthttp.Response)
+		resp.SetStatusCode(tt.upstream)
+		resp.SetBodyString("upstream")
+
+		if recorded := r.remapStatus(resp); recorded != tt.recorded {
+			t.Errorf("%s: expected status %d to be recorded, got %d", name, tt.recorded, recorded)
+		}
+		if status := resp.StatusCode(); status != tt.returned {
+			t.Errorf("%s: expected status %d to be returned, got %d", name, tt.returned, status)
+		}
+		if body := string(resp.Body()); body != tt.body {
+			t.Errorf("%s: expected body %q, got %q", name, tt.body, body)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package route
+
+import (
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultRequestIDHeader is the header of the request ID if RequestIDHeader is not set
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// GetRequestIDHeader returns the header of the request ID of the route
+func (r *Route) GetRequestIDHeader() string {
+	if r.RequestIDHeader == "" {
+		return DefaultRequestIDHeader
+	}
+	return r.RequestIDHeader
+}
+
+// setRequestID ensures that the request carries a request ID so that it is
+// forwarded upstream. The ID of the client is preserved, otherwise a new one is generated
+func (r *Route) setRequestID(ctx *fasthttp.RequestCtx) string {
+	header := r.GetRequestIDHeader()
+	if id := ctx.Request.Header.Peek(header); len(id) > 0 {
+		return string(id)
+	}
+	id := uuid.New().String()
+	ctx.Request.Header.Set(header, id)
+	return id
+}
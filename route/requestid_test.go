@@ -0,0 +1,54 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+func requestIDRequest(t *testing.T, header, id string) (*fasthttp.RequestCtx, *echoClient, *Route) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	r.RequestIDHeader = header
+	client := &echoClient{response: map[string]string{header: "upstream"}}
+	r.Client = client
+	strategy, err := NewRoundRobinStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	if id != "" {
+		ctx.Request.Header.Set(r.GetRequestIDHeader(), id)
+	}
+	r.GetHandler()(ctx)
+	return ctx, client, r
+}
+
+func Test_RequestID_Absent(t *testing.T) {
+	ctx, client, r := requestIDRequest(t, "", "")
+
+	id := string(client.request.Peek(DefaultRequestIDHeader))
+	if _, err := uuid.Parse(id); err != nil {
+		t.Fatalf("Expected a generated UUID upstream, got %q", id)
+	}
+	if got := string(ctx.Response.Header.Peek(DefaultRequestIDHeader)); got != id {
+		t.Errorf("Expected %s to be returned to the client, got %s", id, got)
+	}
+	if m := <-r.MetricsRepo.InChannel; m.RequestID != id {
+		t.Errorf("Expected %s to be recorded, got %s", id, m.RequestID)
+	}
+}
+
+func Test_RequestID_Present(t *testing.T) {
+	ctx, client, _ := requestIDRequest(t, "X-Correlation-Id", "client-id")
+
+	if got := string(client.request.Peek("X-Correlation-Id")); got != "client-id" {
+		t.Errorf("Expected the ID of the client to be forwarded, got %s", got)
+	}
+	if got := string(ctx.Response.Header.Peek("X-Correlation-Id")); got != "client-id" {
+		t.Errorf("Expected the ID of the client to be returned, got %s", got)
+	}
+}
@@ -0,0 +1,146 @@
+package route
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// flakyClient answers with the status of the address of the request.
+// A status of 0 fails with a transport error
+type flakyClient struct {
+	mux    sync.Mutex
+	status map[string]int
+	hosts  []string
+	bodies []string
+}
+
+func (c *flakyClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	host := addr
+	c.hosts = append(c.hosts, host)
+	c.bodies = append(c.bodies, string(req.Body()))
+	if c.status[host] == 0 {
+		return nil, errors.New("connection refused")
+	}
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(c.status[host])
+	resp.SetBodyString(host)
+	return resp, nil
+}
+
+func newRetryRoute(t *testing.T, retries int, status map[string]int) (*Route, *flakyClient) {
+	weights := make(map[string]uint8)
+	for name := range status {
+		weights[name] = 50
+	}
+	r := newTestRoute(t, weights)
+	r.Retries = retries
+	client := &flakyClient{status: make(map[string]int)}
+	for name, code := range status {
+		client.status[name+":8080"] = code
+	}
+	r.Client = client
+	return r, client
+}
+
+func doRequest(r *Route, method, body string, target *Backend) (*fasthttp.RequestCtx, error) {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("/hello")
+	ctx.Request.SetBodyString(body)
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	return ctx, r.HTTPDo(req, target, HTTPReturn(ctx, nil, r.FlushInterval))
+}
+
+func Test_Retry_TransportError(t *testing.T) {
+	r, client := newRetryRoute(t, 1, map[string]int{"a": 0, "b": 200})
+
+	ctx, err := doRequest(r, "PUT", "payload", backendByName(r, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ctx.Response.Body()) != "b:8080" {
+		t.Errorf("Expected the response of b, got %s", ctx.Response.Body())
+	}
+	if len(client.hosts) != 2 || client.hosts[0] != "a:8080" || client.hosts[1] != "b:8080" {
+		t.Errorf("Expected an attempt on a and b, got %v", client.hosts)
+	}
+	if client.bodies[1] != "payload" {
+		t.Errorf("Expected the body to be resent, got %q", client.bodies[1])
+	}
+}
+
+func Test_Retry_ServerError(t *testing.T) {
+	r, client := newRetryRoute(t, 2, map[string]int{"a": 503, "b": 200})
+
+	ctx, err := doRequest(r, "GET", "", backendByName(r, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != 200 {
+		t.Errorf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+	if len(client.hosts) != 2 {
+		t.Errorf("Expected 2 attempts, got %v", client.hosts)
+	}
+}
+
+func Test_Retry_Exhausted(t *testing.T) {
+	r, client := newRetryRoute(t, 5, map[string]int{"a": 0, "b": 0, "c": 0})
+
+	if _, err := doRequest(r, "GET", "", backendByName(r, "a")); err == nil {
+		t.Error("Expected an error if all backends fail")
+	}
+	// every backend is only tried once
+	if len(client.hosts) != 3 {
+		t.Errorf("Expected 3 attempts, got %v", client.hosts)
+	}
+}
+
+func Test_Retry_LastServerError(t *testing.T) {
+	r, _ := newRetryRoute(t, 1, map[string]int{"a": 0, "b": 502})
+
+	ctx, err := doRequest(r, "GET", "", backendByName(r, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != 502 {
+		t.Errorf("Expected the last response to be returned, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func Test_Retry_NonIdempotent(t *testing.T) {
+	r, client := newRetryRoute(t, 1, map[string]int{"a": 0, "b": 200})
+
+	if _, err := doRequest(r, "POST", "payload", backendByName(r, "a")); err == nil {
+		t.Error("Expected POST not to be retried")
+	}
+	if len(client.hosts) != 1 {
+		t.Errorf("Expected 1 attempt, got %v", client.hosts)
+	}
+
+	r.RetryMethods = []string{"post"}
+	if _, err := doRequest(r, "POST", "payload", backendByName(r, "a")); err != nil {
+		t.Errorf("Expected POST to be retried if configured: %v", err)
+	}
+}
+
+func Test_Retry_StreamingUpload(t *testing.T) {
+	r, client := newRetryRoute(t, 1, map[string]int{"a": 0, "b": 200})
+	r.StreamingUpload = true
+
+	if _, err := doRequest(r, "GET", "", backendByName(r, "a")); err == nil {
+		t.Error("Expected streamed requests not to be retried")
+	}
+	if len(client.hosts) != 1 {
+		t.Errorf("Expected 1 attempt, got %v", client.hosts)
+	}
+}
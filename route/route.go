@@ -1,18 +1,20 @@
 package route
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"math/rand"
-	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
 
-	"github.com/rgumi/depoy/upstreamclient"
-
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rgumi/depoy/conditional"
 	"github.com/rgumi/depoy/metrics"
 
@@ -20,29 +22,98 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultDrainTimeout is the maximum duration to wait for the
+// in-flight requests of a backend when it is removed
+var DefaultDrainTimeout = 30 * time.Second
+
+// UpstreamHostBackend is the value of UpstreamHost which sets the Host
+// header of upstream requests to the host of the backend address
+const UpstreamHostBackend = "$backend"
+
+// DefaultRetryMethods are the idempotent methods which are retried
+// if no methods are configured
+var DefaultRetryMethods = []string{"GET", "HEAD", "PUT", "DELETE"}
+
+// UpstreamClient sends requests to the upstream
+type UpstreamClient interface {
+	// Send sends the request to addr. The Host header is set to the host of the request uri
+	Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error)
+}
+
 type Route struct {
 	Name                string
 	Prefix              string
 	Methods             []string
 	Host                string
 	Rewrite             string
+	StripPrefix         bool              // removes the prefix from the upstream path. The rest of the path is appended to Rewrite if set
+	Query               map[string]string // query parameters which requests of the route must have (an empty value matches any)
 	CookieTTL           time.Duration
 	Strategy            *Strategy
 	HealthCheck         bool
 	HealthCheckInterval time.Duration
+	HealthyThreshold    int     // consecutive successful healthchecks which activate a backend (0 = 1)
+	UnhealthyThreshold  int     // consecutive failed healthchecks which deactivate a backend (0 = 1)
+	HealthCheckJitter   float64 // share of the interval by which each healthcheck is randomly delayed (0 = none)
 	MonitoringInterval  time.Duration
 	ReadTimeout         time.Duration
 	WriteTimeout        time.Duration
 	IdleTimeout         time.Duration
+	MaxIdleConns        int              // idle upstream connections of all hosts (0 = upstreamclient.MaxIdleConns)
+	MaxIdleConnsPerHost int              // idle upstream connections of a host (0 = upstreamclient.MaxIdleConnsPerHost)
+	MaxConnsPerHost     int              // open upstream connections of a host (0 = MaxIdleConnsPerHost)
+	Timeout             time.Duration    // overall timeout of an upstream request (0 = unlimited)
+	AdaptiveTimeout     *AdaptiveTimeout // if set, overrides Timeout based on the recent response times
 	ScrapeInterval      time.Duration
 	Proxy               string
-	cookieName          string
+	StatusRemap         map[int]int   // maps upstream status codes to the code returned to the client
+	RecordOrigStatus    bool          // record the original upstream status instead of the remapped one
+	Allowlist           *Allowlist    // forces requests of allowlisted users to a backend
+	Subsets             []*Subset     // pools of backends which are selected by a header
+	StreamingUpload     bool          // stream the downstream body to the upstream without copying it (disables features that replay the body)
+	FlushInterval       time.Duration // flush interval of streaming responses (0 = buffered, negative = every write). Has to be set before SetConnectionPool. Responses with trailers require streaming
+	Retries             int           // number of retries of failed idempotent requests on other backends
+	RetryMethods        []string      // methods which are retried (default DefaultRetryMethods)
+	Compression         bool          // gzip responses if the client accepts it
+	CompressionTypes    []string      // content types which are compressed (default DefaultCompressionTypes)
+	MaxRequestBodyBytes int64         // requests with a larger body are rejected with 413 (0 = unlimited)
+	RateLimit           *RateLimit    // requests exceeding the limit are rejected with 429
+	CORS                *CORS         // answers preflight requests and adds the Access-Control headers
+	Mirror              string        // name of the backend which receives a copy of each request
+	CanaryRule          *CanaryRule   // forwards requests with a matching header to a backend
+	RequestHeaders      Headers       // headers which are set on (or removed from) upstream requests
+	ResponseHeaders     Headers       // headers which are set on (or removed from) responses
+	TrustForwarded      bool          // keep the X-Forwarded-Proto and X-Forwarded-Host headers set by the client (trusted proxy)
+	UpstreamHost        string        // Host header of upstream requests (empty = host of the client, UpstreamHostBackend = host of the backend)
+	Redirects           string        // handling of redirects of the backend ("" = pass through, RedirectRewrite, RedirectFollow)
+	MaxRedirects        int           // number of redirects which are followed (default DefaultMaxRedirects)
+	AccessLog           *AccessLog    // writes a line for every response (nil = disabled)
+	ErrorPages          ErrorPages    // responses of gateway errors by class (default DefaultErrorResponses)
+	JSONErrors          bool          // gateway errors and rejected requests are returned as JSON envelope (see router.WriteJSONError) with the status of ErrorPages
+	Fallback            *Fallback     // response if no backend is active (nil = ErrorPages)
+	RequestIDHeader     string        // header of the request ID which is forwarded and returned (default DefaultRequestIDHeader)
+	mirrorSem           chan struct{}
+	CookieName          string // name of the session cookie of sticky sessions
+	SessionKeyEnv       string // env variable which contains the key that signs the session cookie (empty = random key)
+	sessionKey          []byte
 	Backends            map[uuid.UUID]*Backend
 	Switchover          *Switchover
-	Client              *upstreamclient.Upstreamclient
+	switchoverHistory   []SwitchoverRecord // outcomes of the last MaxSwitchoverHistory switchovers
+	switchoverChanged   func()             // called whenever the state of the switchover changes
+	historyMux          sync.RWMutex
+	OutlierDetection    *OutlierDetection
+	AdaptiveWeights     *AdaptiveWeights      // scales the weights of the backends by their response time
+	weightScales        map[uuid.UUID]float64 // scales of the weights by the adaptive weights
+	Client              UpstreamClient
+	clients             map[string]UpstreamClient // clients of backends with their own transport
+	clientKey           string                    // key of Client in the upstreamclient.DefaultPool
+	poolKeys            []string                  // keys of clients in the upstreamclient.DefaultPool
+	clientsMux          sync.Mutex
 	MetricsRepo         *metrics.Repository
 	NextTargetDistr     []*Backend
 	lenNextTargetDistr  int
+	rrCounter           uint64    // position of the round-robin strategy in NextTargetDistr
+	ring                *hashRing // hash ring of the consistent hash strategy
 	killHealthCheck     chan int
 	mux                 sync.RWMutex
 }
@@ -57,7 +128,7 @@ func New(
 ) (*Route, error) {
 
 	// fix prefix if prefix does not end with /
-	if prefix[len(prefix)-1] != '/' {
+	if prefix != "" && prefix[len(prefix)-1] != '/' {
 		prefix += "/"
 	}
 	route := &Route{
@@ -74,15 +145,19 @@ func New(
 		HealthCheck:         doHealthCheck,
 		HealthCheckInterval: healthcheckInterval,
 		MonitoringInterval:  monitoringInterval,
-		cookieName:          strings.ToUpper(name) + "_SESSIONCOOKIE",
+		CookieName:          DefaultCookieName(name),
+		sessionKey:          newSessionKey(),
 		Strategy:            nil,
 		Backends:            make(map[uuid.UUID]*Backend),
+		clients:             make(map[string]UpstreamClient),
 		killHealthCheck:     make(chan int, 1),
+		mirrorSem:           make(chan struct{}, maxMirrorRequests),
 		CookieTTL:           cookieTTL,
-		Client: upstreamclient.NewUpstreamclient(readTimeout, writeTimeout, idleTimeout,
-			upstreamclient.MaxIdleConnsPerHost, upstreamclient.SkipTLSVerify,
-		),
 	}
+	if err := route.Validate(); err != nil {
+		return nil, err
+	}
+	route.Client = route.acquireDefaultClient()
 
 	if route.HealthCheck {
 		go route.RunHealthCheckOnBackends()
@@ -90,63 +165,269 @@ func New(
 	return route, nil
 }
 
+// Validate checks the config of the route
+func (r *Route) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("Name of route cannot be empty")
+	}
+	if r.Prefix == "" || r.Prefix[0] != '/' || r.Prefix[len(r.Prefix)-1] != '/' {
+		return fmt.Errorf("Prefix %q of %s must start and end with /", r.Prefix, r.Name)
+	}
+	// the rewrite replaces the prefix in the path, hence both have to end with /
+	if r.Rewrite != "" && (r.Rewrite[0] != '/' || r.Rewrite[len(r.Rewrite)-1] != '/') {
+		return fmt.Errorf("Rewrite %q of %s must start and end with / like the prefix %s", r.Rewrite, r.Name, r.Prefix)
+	}
+	for key := range r.Query {
+		if key == "" {
+			return fmt.Errorf("Query parameters of %s cannot be empty", r.Name)
+		}
+	}
+	if len(r.Methods) == 0 {
+		return fmt.Errorf("Methods of %s cannot be empty", r.Name)
+	}
+	for _, method := range r.Methods {
+		if method == "" {
+			return fmt.Errorf("Methods of %s cannot contain an empty method", r.Name)
+		}
+	}
+	if r.ReadTimeout <= 0 || r.WriteTimeout <= 0 || r.IdleTimeout <= 0 {
+		return fmt.Errorf("Read, write and idle timeout of %s must be larger than 0", r.Name)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("Timeout of %s cannot be negative", r.Name)
+	}
+	if r.MonitoringInterval <= 0 {
+		return fmt.Errorf("Monitoring interval of %s must be larger than 0", r.Name)
+	}
+	if r.HealthCheck && r.HealthCheckInterval <= 0 {
+		return fmt.Errorf("Healthcheck interval of %s must be larger than 0", r.Name)
+	}
+	return nil
+}
+
+// SetConnectionPool sizes the connection pools of the upstream clients of the route.
+// Zero values use the defaults of the upstreamclient. It has to be called before
+// backends with their own transport are added
+func (r *Route) SetConnectionPool(maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int) error {
+	if maxIdleConns < 0 || maxIdleConnsPerHost < 0 || maxConnsPerHost < 0 {
+		return fmt.Errorf("Connection pool sizes of %s cannot be negative", r.Name)
+	}
+	r.MaxIdleConns = maxIdleConns
+	r.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	r.MaxConnsPerHost = maxConnsPerHost
+	r.Client = r.acquireDefaultClient()
+	return nil
+}
+
 func (r *Route) SetStrategy(strategy *Strategy) {
 	r.Strategy = strategy
 }
 
+// GetHandler returns the handler of the route. It sets the request ID, answers CORS preflight
+// requests and checks the limits of the route before the request is handed to the current strategy
 func (r *Route) GetHandler() fasthttp.RequestHandler {
 	if r.Strategy == nil {
 		panic(fmt.Errorf("No strategy is set for %s", r.Name))
 	}
 
-	return r.Strategy.Handler
+	return func(ctx *fasthttp.RequestCtx) {
+		id := r.setRequestID(ctx)
+		// set once the response is complete as ctx.Error resets the headers
+		defer ctx.Response.Header.Set(r.GetRequestIDHeader(), id)
+		if r.CORS != nil {
+			if r.CORS.handlePreflight(ctx) {
+				return
+			}
+			defer r.CORS.setHeaders(ctx)
+		}
+		// responses with trailers are written before the handler returns
+		ctx.SetUserValue(responseHeadersKey, func() {
+			ctx.Response.Header.Set(r.GetRequestIDHeader(), id)
+			if r.CORS != nil {
+				r.CORS.setHeaders(ctx)
+			}
+		})
+		if r.exceedsBodyLimit(ctx) {
+			r.reject(ctx, fasthttp.StatusRequestEntityTooLarge, ErrorBodyTooLarge)
+			return
+		}
+		if r.RateLimit != nil {
+			if ok, wait := r.RateLimit.Allow(ctx); !ok {
+				r.reject(ctx, fasthttp.StatusTooManyRequests, ErrorRateLimited)
+				ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, retryAfter(wait))
+				return
+			}
+		}
+		if mirror := r.mirrorBackend(); mirror != nil {
+			// the request is copied before the strategy may modify it
+			req := r.copyRequest(ctx)
+			defer r.sendAsync(req, mirror)
+		}
+		r.Strategy.Handler(ctx)
+	}
+}
+
+// exceedsBodyLimit checks if the declared Content-Length or the received
+// body (e.g. of a chunked request) is larger than MaxRequestBodyBytes
+func (r *Route) exceedsBodyLimit(ctx *fasthttp.RequestCtx) bool {
+	if r.MaxRequestBodyBytes <= 0 {
+		return false
+	}
+	return int64(ctx.Request.Header.ContentLength()) > r.MaxRequestBodyBytes ||
+		int64(len(ctx.Request.Body())) > r.MaxRequestBodyBytes
 }
 
 func (r *Route) updateWeights() {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	var sum uint8
-	k, i := 0, 0
-	listWeights := make([]uint8, len(r.Backends))
-	activeBackends := []*Backend{}
+	defaultPool := []*Backend{}
+	subsetPools := make([][]*Backend, len(r.Subsets))
 
 	for _, backend := range r.Backends {
-		if backend.Active {
-			listWeights[i] = backend.Weigth
-			activeBackends = append(activeBackends, backend)
-			i++
+		if !backend.Active {
+			continue
+		}
+		inSubset := false
+		for i, subset := range r.Subsets {
+			if subset.contains(backend) {
+				subsetPools[i] = append(subsetPools[i], backend)
+				inSubset = true
+			}
 		}
+		if !inSubset {
+			defaultPool = append(defaultPool, backend)
+		}
+	}
+
+	for i, subset := range r.Subsets {
+		subset.distr = distribute(subsetPools[i], r.effectiveWeight)
+		subset.ring = newHashRing(subsetPools[i], r.effectiveWeight)
+		log.Debugf("Current TargetDistribution of subset %s of %s: %v", subset.Name, r.Name, subset.distr)
+	}
+
+	r.NextTargetDistr = distribute(defaultPool, r.effectiveWeight)
+	log.Debugf("Current TargetDistribution of %s: %v", r.Name, r.NextTargetDistr)
+	r.lenNextTargetDistr = len(r.NextTargetDistr)
+	r.ring = newHashRing(defaultPool, r.effectiveWeight)
+}
+
+// distribute returns the weighted distribution of the given active backends.
+// Each backend is contained weight/ggt times
+func distribute(activeBackends []*Backend, weightOf func(*Backend) uint8) []*Backend {
+	// the sum of the weights may exceed the range of uint8
+	sum := 0
+	k := 0
+
+	if len(activeBackends) == 0 {
+		// no active backend
+		return make([]*Backend, 0)
+	}
+
+	listWeights := make([]uint8, len(activeBackends))
+	for i, backend := range activeBackends {
+		listWeights[i] = weightOf(backend)
 	}
 	// find ggt to reduce list length
 	ggt := GGT(listWeights) // if 0, return 0
 	log.Debugf("Current GGT of Weights is %d", ggt)
 
-	if ggt > 0 {
-		for _, weight := range listWeights {
-			sum += weight / ggt
-		}
-		distr := make([]*Backend, sum)
+	if ggt == 0 {
+		// all weights are 0. Backends with weight 0 (e.g. targets of a header
+		// strategy or shadows) must not receive the default traffic
+		return make([]*Backend, 0)
+	}
 
-		for _, backend := range activeBackends {
-			for i := uint8(0); i < backend.Weigth/ggt; i++ {
-				distr[k] = backend
-				k++
+	// the weights are relative, so the distribution is proportional
+	// regardless of their sum
+	for _, weight := range listWeights {
+		sum += int(weight / ggt)
+	}
+	distr := make([]*Backend, sum)
+
+	// interleave the backends (smooth weighted round-robin) so that a backend
+	// is not selected in bursts when the distribution is walked in order.
+	// The backends are sorted to make the order deterministic
+	sort.Slice(activeBackends, func(i, j int) bool {
+		return activeBackends[i].Name < activeBackends[j].Name
+	})
+	// the weights are sorted along with the backends
+	for i, backend := range activeBackends {
+		listWeights[i] = weightOf(backend)
+	}
+	current := make([]int, len(activeBackends))
+	for ; k < len(distr); k++ {
+		best := 0
+		for i := range activeBackends {
+			current[i] += int(listWeights[i] / ggt)
+			if current[i] > current[best] {
+				best = i
 			}
 		}
-		log.Debugf("Current TargetDistribution of %s: %v", r.Name, distr)
-		r.NextTargetDistr = distr
-	} else {
-		// no active backend
-		r.NextTargetDistr = make([]*Backend, 0)
+		current[best] -= sum
+		distr[k] = activeBackends[best]
 	}
-	r.lenNextTargetDistr = len(r.NextTargetDistr)
+	return distr
+}
+
+// DistributionEntry describes the share of a backend in the target distribution
+type DistributionEntry struct {
+	ID              uuid.UUID `json:"id"`
+	Name            string    `json:"name"`
+	Subset          string    `json:"subset,omitempty"` // empty for the default pool
+	Weight          uint8     `json:"weight"`           // configured weight of the backend
+	EffectiveWeight uint8     `json:"effective_weight"` // weight after adaptive scaling
+	Count           int       `json:"count"`            // occurrences in the distribution (after GGT reduction)
+	Share           float64   `json:"share"`            // share of the traffic of its pool (0-1)
+}
+
+// Distribution returns a snapshot of the current target distribution of the
+// default pool followed by the distributions of the subsets of the route.
+// Backends which are not part of a distribution are omitted
+func (r *Route) Distribution() []DistributionEntry {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	entries := r.distributionEntries("", r.NextTargetDistr)
+	for _, subset := range r.Subsets {
+		entries = append(entries, r.distributionEntries(subset.Name, subset.distr)...)
+	}
+	return entries
 }
 
+// distributionEntries counts the occurrences of the backends in the distribution
+func (r *Route) distributionEntries(subset string, distr []*Backend) []DistributionEntry {
+	entries := []DistributionEntry{}
+	index := make(map[uuid.UUID]int)
+	for _, backend := range distr {
+		i, found := index[backend.ID]
+		if !found {
+			i = len(entries)
+			index[backend.ID] = i
+			entries = append(entries, DistributionEntry{
+				ID:              backend.ID,
+				Name:            backend.Name,
+				Subset:          subset,
+				Weight:          backend.Weigth,
+				EffectiveWeight: r.effectiveWeight(backend),
+			})
+		}
+		entries[i].Count++
+	}
+	for i := range entries {
+		entries[i].Share = float64(entries[i].Count) / float64(len(distr))
+	}
+	return entries
+}
+
+// getNextBackend randomly selects the next backend of the default pool.
+// The distribution is replaced by updateWeights, hence it is read under the lock
 func (r *Route) getNextBackend() (*Backend, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
 
 	if r.lenNextTargetDistr == 0 {
-		return nil, fmt.Errorf("No backend is active")
+		return nil, ErrNoBackend
 	}
 
 	backend := r.NextTargetDistr[rand.Intn(r.lenNextTargetDistr)]
@@ -167,21 +448,22 @@ func (r *Route) Reload() {
 	for _, backend := range r.Backends {
 		if backend.AlertChan == nil {
 			if r.HealthCheck {
-				mustHaveCondition := conditional.NewCondition(
-					"6xxRate", ">", 0, 5*time.Second, 2*time.Second)
-				mustHaveCondition.Compile()
-				backend.Metricthresholds = append(backend.Metricthresholds, mustHaveCondition)
+				backend.Metricthresholds = append(backend.Metricthresholds, newHealthCheckCondition())
 			}
 
+			scrapeInterval := backend.ScrapeInterval
+			if scrapeInterval <= 0 {
+				scrapeInterval = r.ScrapeInterval
+			}
 			log.Debugf("Registering %v of %s to MetricsRepository", backend.ID, r.Name)
 			backend.AlertChan, _ = r.MetricsRepo.RegisterBackend(
 				r.Name, backend.ID, backend.Scrapeurl, backend.Scrapemetrics,
-				r.ScrapeInterval, backend.Metricthresholds,
+				backend.ScrapeFormat, backend.ScrapeAuth, scrapeInterval, backend.Metricthresholds,
 			)
 
 			// start monitoring the registered backend
 			log.Debugf("Starting monitoring goroutine of %v of %s", backend.ID, r.Name)
-			go r.MetricsRepo.Monitor(backend.ID, r.MonitoringInterval)
+			go r.MetricsRepo.Monitor(backend.ID, r.MonitoringInterval, backend.MonitoringWindow)
 			// starts listening on alertChan
 			log.Debugf("Starting listening goroutine of %v of %s", backend.ID, r.Name)
 			go backend.Monitor()
@@ -196,11 +478,25 @@ func (r *Route) Reload() {
 	}
 }
 
+// newHealthCheckCondition returns the condition which deactivates a backend
+// once its healthchecks fail
+func newHealthCheckCondition() *conditional.Condition {
+	cond := conditional.NewCondition("6xxRate", ">", 0, 5*time.Second, 2*time.Second)
+	cond.Compile()
+	return cond
+}
+
+// IsHealthCheckCondition returns true if the condition was added to the
+// metric thresholds of a backend by the healthcheck of its route
+func IsHealthCheckCondition(cond *conditional.Condition) bool {
+	return cond.Metric == "6xxRate" && cond.Operator == ">" && cond.Threshold == 0 && cond.Change == "" &&
+		cond.ActiveFor.Duration == 5*time.Second && cond.ResolveIn.Duration == 2*time.Second
+}
+
 func (r *Route) validateStatus(backend *Backend) {
 	log.Debugf("Executing validateStatus on %v", backend.ID)
 	if r.healthCheck(backend) {
 		log.Debugf("Finished healtcheck of %v successfully", backend.ID)
-		backend.UpdateStatus(true)
 		return
 	}
 
@@ -260,6 +556,19 @@ func (r *Route) AddExistingBackend(backend *Backend) (uuid.UUID, error) {
 		return uuid.UUID{}, err
 	}
 
+	newBackend.Timeout = backend.Timeout
+	newBackend.HealthCheckTimeout = backend.HealthCheckTimeout
+	newBackend.HealthCheckProbe = backend.HealthCheckProbe
+	newBackend.latency = backend.latency
+	newBackend.Transport = backend.Transport
+	newBackend.MonitoringWindow = backend.MonitoringWindow
+	newBackend.ScrapeFormat = backend.ScrapeFormat
+	newBackend.ScrapeAuth = backend.ScrapeAuth
+	newBackend.ScrapeInterval = backend.ScrapeInterval
+	if err = r.addClientFor(newBackend); err != nil {
+		return uuid.UUID{}, err
+	}
+
 	if backend.ID != uuid.Nil {
 		newBackend.ID = backend.ID
 	} else {
@@ -290,63 +599,186 @@ func (r *Route) AddExistingBackend(backend *Backend) (uuid.UUID, error) {
 
 func (r *Route) Delete() {
 	r.killHealthCheck <- 1
+	r.SetOutlierDetection(nil)
+	r.SetAdaptiveWeights(nil)
 	r.RemoveSwitchOver()
+
+	// all backends are drained at the same time
+	wg := sync.WaitGroup{}
+	for _, backend := range r.Backends {
+		backend.drain()
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			if !backend.waitForDrain(DefaultDrainTimeout) {
+				log.Warnf("Stopping %v of %s with requests in flight", backend.ID, r.Name)
+			}
+		}(backend)
+	}
+	wg.Wait()
 	for backendID := range r.Backends {
-		r.RemoveBackend(backendID)
+		r.removeBackend(backendID)
 	}
+	r.releaseClients()
 }
+
+// Drain deactivates all backends of the route so that they do not receive new
+// requests and waits until their in-flight requests are done or ctx is done
+func (r *Route) Drain(ctx context.Context) error {
+	r.mux.RLock()
+	backends := make([]*Backend, 0, len(r.Backends))
+	for _, backend := range r.Backends {
+		backends = append(backends, backend)
+	}
+	r.mux.RUnlock()
+
+	for _, backend := range backends {
+		backend.drain()
+	}
+	for _, backend := range backends {
+		for atomic.LoadInt64(&backend.inFlight) > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("Backend %v of %s has %d requests in flight (%v)",
+					backend.ID, r.Name, atomic.LoadInt64(&backend.inFlight), ctx.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveBackend drains the backend and removes it from the route
 func (r *Route) RemoveBackend(backendID uuid.UUID) error {
 	log.Warnf("Removing %s from %s", backendID, r.Name)
 
-	if r.Switchover != nil {
-		if r.Switchover.From.ID == backendID || r.Switchover.To.ID == backendID {
-			return fmt.Errorf("Cannot deleted backend %v with switchover %d associated with it",
-				backendID, r.Switchover.ID,
+	if switchover := r.CurrentSwitchover(); switchover != nil {
+		if switchover.From.ID == backendID || switchover.To.ID == backendID {
+			return fmt.Errorf("Cannot delete backend %v with switchover %d associated with it",
+				backendID, switchover.ID,
 			)
 		}
 	}
+	return r.DrainBackend(backendID, DefaultDrainTimeout)
+}
+
+// DrainBackend deactivates the backend so that it does not receive new requests
+// and waits until its in-flight requests are done (or the timeout is reached).
+// Afterwards, the backend is stopped and removed
+func (r *Route) DrainBackend(backendID uuid.UUID, timeout time.Duration) error {
+	r.mux.RLock()
+	backend, found := r.Backends[backendID]
+	r.mux.RUnlock()
+	if !found {
+		return fmt.Errorf("Backend %v does not exist", backendID)
+	}
+	backend.drain()
+	if !backend.waitForDrain(timeout) {
+		log.Warnf("Stopping %v of %s with %d requests in flight",
+			backendID, r.Name, atomic.LoadInt64(&backend.inFlight))
+	}
+	r.removeBackend(backendID)
+	return nil
+}
+
+func (r *Route) removeBackend(backendID uuid.UUID) {
 	if r.MetricsRepo != nil {
 		r.MetricsRepo.RemoveBackend(backendID)
 	}
-	r.Backends[backendID].Stop()
-	delete(r.Backends, backendID)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if backend, found := r.Backends[backendID]; found {
+		backend.Stop()
+		delete(r.Backends, backendID)
+	}
+}
+
+// namedBackend returns the backend with the name or nil. It is looked up under the
+// lock of the route, so the backend must not be locked by the caller
+func (r *Route) namedBackend(name string) *Backend {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	for _, backend := range r.Backends {
+		if backend.Name == name {
+			return backend
+		}
+	}
 	return nil
 }
 
 func (r *Route) UpdateBackendWeight(id uuid.UUID, newWeigth uint8) error {
-	if backend, found := r.Backends[id]; found {
+	if newWeigth > maxSwitchoverWeight {
+		return fmt.Errorf("Weight cannot be larger than 100")
+	}
+	r.mux.Lock()
+	backend, found := r.Backends[id]
+	if found {
 		backend.Weigth = newWeigth
-		r.updateWeights()
-		return nil
 	}
-	return fmt.Errorf("Backend with ID %v does not exist", id)
+	r.mux.Unlock()
+	if !found {
+		return fmt.Errorf("Backend with ID %v does not exist", id)
+	}
+	r.updateWeights()
+	return nil
+}
+
+// weights returns the weights of the backends. The weights of a route are read and
+// written under the lock of the route as the distribution of the requests is made of them
+func (r *Route) weights(from, to *Backend) (uint8, uint8) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return from.Weigth, to.Weigth
+}
+
+// setWeights sets the weights of the backends (see weights). The distribution
+// has to be updated afterwards
+func (r *Route) setWeights(from, to *Backend, fromWeight, toWeight uint8) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	log.Debugf("Updating Weights of Backends %v and %v to %d/%d", from.ID, to.ID, fromWeight, toWeight)
+	from.Weigth, to.Weigth = fromWeight, toWeight
 }
 
 func (r *Route) healthCheck(backend *Backend) bool {
 	req := fasthttp.AcquireRequest()
 	req.SetRequestURI(backend.Healthcheckurl.String())
-	req.Header.SetMethod("GET")
+	backend.HealthCheckProbe.prepare(req)
 	m := metrics.MetricsPool.Get().(*metrics.Metrics)
 	m.BackendID = backend.ID
 	m.Route = r.Name
 	m.RequestMethod = string(req.Header.Method())
 	m.DownstreamAddr = "depoy-healthcheck"
-	resp, err := r.Client.Send(req, m)
+	start := time.Now()
+	resp, err := r.clientFor(backend).Send("", req, m, r.healthCheckTimeout(backend))
+	latency := time.Since(start)
 	fasthttp.ReleaseRequest(req)
+	if err == nil {
+		m.ResponseStatus = resp.Header.StatusCode()
+		m.ContentLength = int64(resp.Header.ContentLength())
+		err = backend.HealthCheckProbe.check(resp)
+		fasthttp.ReleaseResponse(resp)
+	} else {
+		m.ResponseStatus = 600
+		m.ContentLength = 0
+	}
+	health := backend.recordHealthCheck(err == nil, latency, err)
 	if err != nil {
 		log.Debugf("Healthcheck for %v failed due to %v", backend.ID, err)
-		if backend.Active {
-			backend.UpdateStatus(false)
+		if health.ConsecutiveFailures < threshold(r.UnhealthyThreshold) {
+			// tolerated failures are not recorded as they would raise the 6xxRate
+			metrics.ReleaseMetrics(m)
+			return false
 		}
-		m.ResponseStatus = 600
-		m.ContentLength = 0
-		r.MetricsRepo.InChannel <- m
+		backend.setPassing(false)
+		r.MetricsRepo.Send(m)
 		return false
 	}
-	m.ResponseStatus = resp.Header.StatusCode()
-	m.ContentLength = int64(resp.Header.ContentLength())
-	r.MetricsRepo.InChannel <- m
-	fasthttp.ReleaseResponse(resp)
+	if health.ConsecutiveSuccesses >= threshold(r.HealthyThreshold) {
+		backend.setPassing(true)
+	}
+	r.MetricsRepo.Send(m)
 	return true
 }
 
@@ -361,7 +793,10 @@ func (r *Route) RunHealthCheckOnBackends() {
 				continue
 			}
 			for _, backend := range r.Backends {
-				go r.healthCheck(backend)
+				go func(backend *Backend, delay time.Duration) {
+					time.Sleep(delay)
+					r.healthCheck(backend)
+				}(backend, r.healthCheckDelay())
 			}
 		}
 	}
@@ -372,15 +807,16 @@ func (r *Route) RunHealthCheckOnBackends() {
 func (r *Route) StartSwitchOver(
 	from, to string,
 	conditions []*conditional.Condition,
-	timeout time.Duration, allowedFailures int,
-	weightChange uint8, force, rollback bool) (*Switchover, error) {
+	timeout, maxDuration time.Duration, allowedFailures int,
+	weightChange uint8, steps []int, abortOn []string, force, rollback, removeOnSuccess bool,
+	linger time.Duration, startAt time.Time) (*Switchover, error) {
 
 	var fromBackend, toBackend *Backend
 
 	// check if a switchover is already active
 	// only one switchover is allowed per route at a time
-	if r.Switchover != nil {
-		if r.Switchover.Status == "Running" {
+	if current := r.CurrentSwitchover(); current != nil {
+		if current.IsActive() {
 			return nil, fmt.Errorf("Only one switchover can be active per route")
 		}
 	}
@@ -414,116 +850,450 @@ forward:
 	}
 
 	if force {
-		// Overwrite the current Strategy with CanaryStrategy
-		strategy, err := NewCanaryStrategy(r)
-		if err != nil {
-			return nil, err
+		// Overwrite the current Strategy with CanaryStrategy (sticky) unless
+		// it already supports switchovers
+		if r.Strategy == nil || !supportsSwitchover(r.Strategy) {
+			strategy, err := NewCanaryStrategy(r)
+			if err != nil {
+				return nil, err
+			}
+			r.SetStrategy(strategy)
 		}
-		r.SetStrategy(strategy)
 
 		// set initial weights
-		fromBackend.Weigth = 100 - weightChange
-		toBackend.Weigth = weightChange
+		initial := weightChange
+		if len(steps) > 0 {
+			initial = uint8(steps[0])
+		}
+		toWeight := addWeight(0, initial)
+		r.setWeights(fromBackend, toBackend, maxSwitchoverWeight-toWeight, toWeight)
 
 		r.updateWeights()
 
 	} else {
-		// The Strategy must be canary (sticky or slippery) because otherwise
+		// The Strategy must be canary (sticky) or slippery because otherwise
 		// the traffic cannot be increased/switched-over
-		if strings.ToLower(r.Strategy.Type) != "canary" {
+		if r.Strategy == nil {
+			return nil, fmt.Errorf("Switchover requires Strategy \"canary\" or \"slippery\" but %s has none", r.Name)
+		}
+		if !supportsSwitchover(r.Strategy) {
 			return nil, fmt.Errorf(
-				"Switchover is only supported with Strategy \"canary\" not \"%s\"", r.Strategy.Type)
+				"Switchover is only supported with Strategy \"canary\" or \"slippery\" not \"%s\"", r.Strategy.Type)
 		}
 	}
 
 	switchover, err := NewSwitchover(
-		fromBackend, toBackend, r, conditions, timeout, allowedFailures, weightChange, rollback)
+		fromBackend, toBackend, r, conditions, timeout, maxDuration, allowedFailures,
+		weightChange, steps, abortOn, rollback, removeOnSuccess, linger, startAt)
 
 	if err != nil {
 		return nil, err
 	}
 
-	r.Switchover = switchover
+	r.setSwitchover(switchover)
 	go switchover.Start()
 
 	return switchover, nil
 }
 
+// CurrentSwitchover returns the last switchover of the route or nil if there is none
+func (r *Route) CurrentSwitchover() *Switchover {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.Switchover
+}
+
+func (r *Route) setSwitchover(switchover *Switchover) {
+	r.mux.Lock()
+	r.Switchover = switchover
+	r.mux.Unlock()
+}
+
+// supportsSwitchover returns true if the strategy distributes the requests by the
+// weights of the backends so that the traffic can be switched over
+func supportsSwitchover(strategy *Strategy) bool {
+	if strategy == nil {
+		return false
+	}
+	t := strings.ToLower(strategy.Type)
+	return t == "canary" || t == "slippery"
+}
+
 // RemoveSwitchOver stops the switchover process and leaves the weights as they are last
 func (r *Route) RemoveSwitchOver() {
-	if r.Switchover != nil {
+	r.mux.Lock()
+	switchover := r.Switchover
+	r.Switchover = nil
+	r.mux.Unlock()
+	if switchover != nil {
 		log.Warnf("Stopping Switchover of %s", r.Name)
-		r.Switchover.Stop()
-		r.Switchover = nil
+		switchover.Stop()
+	}
+}
+
+// addSwitchoverRecord adds the outcome of a switchover to the history. Only the
+// last MaxSwitchoverHistory records are kept
+func (r *Route) addSwitchoverRecord(record SwitchoverRecord) {
+	r.historyMux.Lock()
+	defer r.historyMux.Unlock()
+	r.switchoverHistory = append(r.switchoverHistory, record)
+	if len(r.switchoverHistory) > MaxSwitchoverHistory {
+		r.switchoverHistory = r.switchoverHistory[len(r.switchoverHistory)-MaxSwitchoverHistory:]
 	}
 }
 
+// SwitchoverHistory returns the outcomes of the past switchovers, oldest first
+func (r *Route) SwitchoverHistory() []SwitchoverRecord {
+	r.historyMux.RLock()
+	defer r.historyMux.RUnlock()
+	history := make([]SwitchoverRecord, len(r.switchoverHistory))
+	copy(history, r.switchoverHistory)
+	return history
+}
+
 // HTTPDo accepts a request, target and the return-function
 // it sends the request to the target and
-// the response of the target is then handed to the return-function
+// the response of the target is then handed to the return-function.
+// Failed requests are retried if the route is configured to do so.
+// Streamed responses (see FlushInterval) are owned by the return-function
+// which has to release them once their body is copied
 func (r *Route) HTTPDo(
 	req *fasthttp.Request,
 	target *Backend,
-	returnResp func(*fasthttp.Response)) error {
+	returnResp func(*fasthttp.Response, *metrics.Metrics)) error {
+
+	retries := 0
+	if r.canRetry(req) {
+		retries = r.Retries
+	}
+	return r.httpDo(req, target, returnResp, retries)
+}
+
+// httpDo sends the request to the target. If the upstream fails with a transport
+// error or a 5xx, the request is re-dispatched to another active backend of the
+// same pool up to retries times. If a route timeout is set, it limits all attempts
+func (r *Route) httpDo(
+	req *fasthttp.Request,
+	target *Backend,
+	returnResp func(*fasthttp.Response, *metrics.Metrics),
+	retries int) error {
+
+	// every attempt is derived from the original uri
+	orig := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(orig)
+	req.URI().CopyTo(orig)
+
+	var deadline time.Time
+	if retries > 0 && r.Timeout > 0 {
+		deadline = time.Now().Add(r.Timeout)
+	}
+	tried := make([]*Backend, 0, retries+1)
+
+	for attempt := 0; ; attempt++ {
+		timeout := r.requestTimeout(target)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return fasthttp.ErrTimeout
+			}
+			if timeout <= 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		resp, m, err := r.send(req, orig, target, timeout)
+		tried = append(tried, target)
+
+		if attempt < retries && (err != nil || resp.StatusCode() >= 500) {
+			if next := r.retryTarget(target, tried); next != nil {
+				if err == nil {
+					m.ResponseStatus = resp.StatusCode()
+					m.ContentLength = int64(resp.Header.ContentLength())
+					r.MetricsRepo.Send(m)
+					fasthttp.ReleaseResponse(resp)
+				}
+				log.Debugf("Retrying request of %s on %v (attempt %d)", r.Name, next.ID, attempt+2)
+				metrics.RetriedRequests.With(
+					prometheus.Labels{"route": r.Name, "backend": target.ID.String()},
+				).Inc()
+				target = next
+				continue
+			}
+		}
+		if err == nil && r.Redirects == RedirectFollow {
+			resp, m, err = r.followRedirects(req, orig, target, resp, m, timeout)
+		}
+		if err != nil {
+			return err
+		}
+		if r.Redirects == RedirectRewrite {
+			r.rewriteLocation(req, orig, resp, target)
+		}
+
+		streamed := resp.IsBodyStream()
+		m.ResponseStatus = r.remapStatus(resp)
+		if !streamed {
+			r.compress(req, resp)
+		}
+		r.ResponseHeaders.applyResponse(&resp.Header)
+		m.ContentLength = int64(resp.Header.ContentLength())
+		returnResp(resp, m)
+		// mirrored requests are not returned to a client and not logged
+		if m.DownstreamAddr != "" {
+			r.AccessLog.log(m, orig)
+		}
+		r.MetricsRepo.Send(m)
+		if !streamed {
+			fasthttp.ReleaseResponse(resp)
+		}
+		return nil
+	}
+}
+
+// send sends a single attempt of the request to the target. If the upstream
+// fails, the metrics of the attempt are recorded and the error is returned.
+// Otherwise the metrics must be completed and recorded by the caller
+func (r *Route) send(
+	req *fasthttp.Request,
+	orig *fasthttp.URI,
+	target *Backend,
+	timeout time.Duration) (*fasthttp.Response, *metrics.Metrics, error) {
 
 	m := metrics.AcquireMetrics()
 	m.Route = r.Name
 	m.BackendID = target.ID
 	m.RequestMethod = string(req.Header.Method())
 	m.DSContentLength = int64(req.Header.ContentLength())
+	m.RequestID = string(req.Header.Peek(r.GetRequestIDHeader()))
 
 	uri := fasthttp.AcquireURI()
 	defer fasthttp.ReleaseURI(uri)
-	req.URI().CopyTo(uri)
+	orig.CopyTo(uri)
 	r.formateURI(uri, target)
+	uri.SetHost(r.upstreamHost(orig, target))
 	req.SetRequestURI(uri.String())
-	resp, err := r.Client.Send(req, m)
+
+	inFlight := metrics.InFlightRequests.With(prometheus.Labels{"route": r.Name, "backend": target.ID.String()})
+	inFlight.Inc()
+	atomic.AddInt64(&target.inFlight, 1)
+	resp, err := r.clientFor(target).Send(target.Addr.Host, req, m, timeout)
+	atomic.AddInt64(&target.inFlight, -1)
+	inFlight.Dec()
 	if err != nil {
+		if err == fasthttp.ErrTimeout {
+			// record the timeout so that the adaptive timeout can grow again
+			target.latency.record(timeout)
+		}
 		m.ResponseStatus = 600
 		m.ContentLength = -1
-		r.MetricsRepo.InChannel <- m
-		return err
-	}
-	defer fasthttp.ReleaseResponse(resp)
-	returnResp(resp)
-	m.ResponseStatus = resp.StatusCode()
-	m.ContentLength = int64(resp.Header.ContentLength())
-	r.MetricsRepo.InChannel <- m
-	return nil
+		r.MetricsRepo.Send(m)
+		return nil, nil, err
+	}
+	target.latency.record(time.Duration(m.UpstreamResponseTime) * time.Millisecond)
+	return resp, m, nil
+}
+
+// canRetry checks if the request may be sent more than once. Only requests
+// with an idempotent method are retried. Streamed requests cannot be replayed
+func (r *Route) canRetry(req *fasthttp.Request) bool {
+	if r.Retries <= 0 || r.StreamingUpload {
+		return false
+	}
+	methods := r.RetryMethods
+	if len(methods) == 0 {
+		methods = DefaultRetryMethods
+	}
+	method := string(req.Header.Method())
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTarget randomly selects an active backend of the pool of the
+// failed backend which has not been tried yet. If none is left, nil is returned
+func (r *Route) retryTarget(failed *Backend, tried []*Backend) *Backend {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	distr := r.NextTargetDistr
+	for _, subset := range r.Subsets {
+		if subset.contains(failed) && len(subset.distr) > 0 {
+			distr = subset.distr
+			break
+		}
+	}
+
+	candidates := make([]*Backend, 0, len(distr))
+	for _, backend := range distr {
+		if backend.Active && !containsBackend(tried, backend) {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func containsBackend(backends []*Backend, backend *Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
 }
 
 // HTTPReturn takes a ctx and returns a functions that accepts an upstream response
-// which is then copied to the ctx response
+// which is then copied to the ctx response. The address of the client is added to the metrics.
+// The body of streamed responses is copied while it is read and flushed to the client
+// with the flushInterval (see Route.FlushInterval). Trailers of the upstream are
+// forwarded after the body. Only the net/http based clients (streaming routes and
+// HTTP/2 transports) read trailers. The fasthttp client fails on chunked responses
+// with trailers, hence such requests fail unless the route streams responses
 func HTTPReturn(
 	ctx *fasthttp.RequestCtx,
-	c *fasthttp.Cookie) func(resp *fasthttp.Response) {
+	c *fasthttp.Cookie,
+	flushInterval time.Duration) func(resp *fasthttp.Response, m *metrics.Metrics) {
 
-	return func(resp *fasthttp.Response) {
+	return func(resp *fasthttp.Response, m *metrics.Metrics) {
+		m.DownstreamAddr = ctx.RemoteIP().String()
+		delResponseHopHeader(resp)
 		resp.Header.CopyTo(&ctx.Response.Header)
 		if c != nil {
 			ctx.Response.Header.SetCookie(c)
 		}
 		ctx.SetStatusCode(resp.StatusCode())
-		delResponseHopHeader(resp)
+		if len(trailerNames(&resp.Header)) > 0 {
+			returnWithTrailers(ctx, resp, flushInterval)
+			return
+		}
+		if resp.IsBodyStream() {
+			ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+				defer fasthttp.ReleaseResponse(resp)
+				fw := newFlushWriter(w, flushInterval)
+				defer fw.stop()
+				if err := resp.BodyWriteTo(fw); err != nil {
+					log.Debugf("Streaming response to %s aborted: %v", m.DownstreamAddr, err)
+				}
+			})
+			return
+		}
 		ctx.Response.SetBody(resp.Body())
 	}
 }
 
+// prepareRequest returns the request that is forwarded to the upstream and a
+// function which must be called once the request is no longer used.
+// By default the downstream request is copied so that it can be replayed.
+// If StreamingUpload is set, only the headers are copied and the downstream
+// body is passed to the upstream as body stream (see streamRequest)
+func (r *Route) prepareRequest(ctx *fasthttp.RequestCtx) (*fasthttp.Request, func()) {
+	var req *fasthttp.Request
+	var release func()
+
+	if r.StreamingUpload {
+		req, release = streamRequest(ctx)
+	} else {
+		req = fasthttp.AcquireRequest()
+		ctx.Request.CopyTo(req)
+		release = func() { fasthttp.ReleaseRequest(req) }
+	}
+	delRequestHopHeader(req)
+	setForwardedHeaders(req, ctx, r.TrustForwarded)
+	r.RequestHeaders.applyRequest(&req.Header)
+	return req, release
+}
+
+// requestTimeout returns the timeout of requests to the backend. If an adaptive
+// timeout is configured and enough response times of the backend are known, it is
+// used. Otherwise, if the backend has no timeout configured, the timeout of the route is used
+func (r *Route) requestTimeout(backend *Backend) time.Duration {
+	if r.AdaptiveTimeout != nil {
+		if timeout, ok := r.AdaptiveTimeout.timeout(backend.latency); ok {
+			return timeout
+		}
+	}
+	if backend.Timeout > 0 {
+		return backend.Timeout
+	}
+	return r.Timeout
+}
+
+// healthCheckDelay returns a random delay of a healthcheck within the jitter of the
+// interval. The delay of each probe is independent so that the average interval
+// between the probes of a backend remains HealthCheckInterval
+func (r *Route) healthCheckDelay() time.Duration {
+	if r.HealthCheckJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * r.HealthCheckJitter * float64(r.HealthCheckInterval))
+}
+
+// healthCheckTimeout returns the timeout of healthchecks of the backend. If the
+// backend has no healthcheck timeout configured, the timeout of the route is used
+func (r *Route) healthCheckTimeout(backend *Backend) time.Duration {
+	if backend.HealthCheckTimeout > 0 {
+		return backend.HealthCheckTimeout
+	}
+	return r.Timeout
+}
+
+// remapStatus replaces the status code of the upstream response if a mapping
+// is configured for it. Returns the status code that is recorded in the metrics
+func (r *Route) remapStatus(resp *fasthttp.Response) int {
+	original := resp.StatusCode()
+	remapped, found := r.StatusRemap[original]
+	if !found {
+		return original
+	}
+	resp.SetStatusCode(remapped)
+	// responses with these status codes must not contain a body
+	if remapped < 200 || remapped == 204 || remapped == 304 {
+		resp.ResetBody()
+	}
+	if r.RecordOrigStatus {
+		return original
+	}
+	return remapped
+}
+
+// upstreamHost returns the Host header of requests to the backend. By default the
+// host of the downstream request is preserved. If UpstreamHost is UpstreamHostBackend,
+// the host of the backend address is used. Otherwise UpstreamHost is used as is
+func (r *Route) upstreamHost(orig *fasthttp.URI, backend *Backend) string {
+	switch r.UpstreamHost {
+	case "":
+		if host := orig.Host(); len(host) > 0 {
+			return string(host)
+		}
+		return backend.Addr.Host
+	case UpstreamHostBackend:
+		return backend.Addr.Host
+	default:
+		return r.UpstreamHost
+	}
+}
+
 func (r *Route) formateURI(uri *fasthttp.URI, backend *Backend) {
 	uri.SetScheme(backend.Addr.Scheme)
 	uri.SetHost(backend.Addr.Host)
-	if r.Rewrite != "" {
-		uri.SetPath(strings.Replace(string(uri.Path()), r.Prefix, r.Rewrite, 1))
+	if upstreamPrefix := r.upstreamPrefix(); upstreamPrefix != "" {
+		uri.SetPath(replacePrefix(string(uri.Path()), r.Prefix, upstreamPrefix))
 	}
 }
 
-func handleNetError(err error) (string, int) {
-	netErr, ok := err.(net.Error)
-	if !ok {
-		return err.Error(), 500
+// upstreamPrefix returns the path which replaces the prefix in upstream requests.
+// If the path is not rewritten, an empty string is returned
+func (r *Route) upstreamPrefix() string {
+	if r.Rewrite != "" {
+		return r.Rewrite
 	}
-	if netErr.Timeout() {
-		return netErr.Error(), 504
+	if r.StripPrefix {
+		return "/"
 	}
-	return netErr.Error(), 502
+	return ""
 }
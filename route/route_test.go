@@ -0,0 +1,299 @@
+package route
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func newLimitedRoute(t *testing.T, limit int64) (*Route, *flakyClient) {
+	r, client := newRetryRoute(t, 0, map[string]int{"a": 200})
+	r.MaxRequestBodyBytes = limit
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	return r, client
+}
+
+func Test_MaxRequestBodyBytes(t *testing.T) {
+	r, client := newLimitedRoute(t, 8)
+	handler := r.GetHandler()
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.SetBodyString("more than eight bytes")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", ctx.Response.StatusCode())
+	}
+	if len(client.hosts) != 0 {
+		t.Errorf("Expected no upstream request, got %v", client.hosts)
+	}
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.SetBodyString("small")
+	handler(ctx)
+	if ctx.Response.StatusCode() != 200 {
+		t.Errorf("Expected status 200, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func Test_MaxRequestBodyBytes_Chunked(t *testing.T) {
+	r, client := newLimitedRoute(t, 8)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go fasthttp.Serve(ln, r.GetHandler())
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err = resp.Read(bufio.NewReader(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", resp.StatusCode())
+	}
+	if !strings.Contains(string(resp.Body()), "Too Large") {
+		t.Errorf("Unexpected body %q", resp.Body())
+	}
+	if len(client.hosts) != 0 {
+		t.Errorf("Expected no upstream request, got %v", client.hosts)
+	}
+}
+
+func Test_DrainBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		arrived <- struct{}{}
+		<-release
+		ctx.SetBodyString("done")
+	})
+
+	r := newTestRouteTo(t, ln.Addr().String(), map[string]uint8{"a": 50})
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	backend := backendByName(r, "a")
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	served := make(chan struct{})
+	go func() {
+		r.GetHandler()(ctx)
+		close(served)
+	}()
+	<-arrived
+
+	drained := make(chan error)
+	go func() {
+		drained <- r.DrainBackend(backend.ID, 5*time.Second)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("Expected DrainBackend to wait for the in-flight request")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if backend.isActive() {
+		t.Error("Expected the draining backend to be inactive")
+	}
+	backend.UpdateStatus(true)
+	if backend.isActive() {
+		t.Error("Expected the draining backend not to be activated again")
+	}
+
+	close(release)
+	<-served
+	if err = <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "done" {
+		t.Errorf("Expected the in-flight request to complete, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if _, found := r.Backends[backend.ID]; found {
+		t.Error("Expected the backend to be removed")
+	}
+}
+
+func Test_UpstreamHost(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.Host())
+	})
+
+	r := newTestRouteTo(t, ln.Addr().String(), map[string]uint8{"a": 50})
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	handler := r.GetHandler()
+
+	tests := map[string]string{
+		"":                  "public.example.com",
+		"internal.svc":      "internal.svc",
+		UpstreamHostBackend: ln.Addr().String(),
+	}
+	for mode, expected := range tests {
+		r.UpstreamHost = mode
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/")
+		ctx.Request.Header.SetHost("public.example.com")
+		handler(ctx)
+		if host := string(ctx.Response.Body()); host != expected {
+			t.Errorf("Expected Host %q with upstreamHost %q, got %q (%d)", expected, mode, host, ctx.Response.StatusCode())
+		}
+	}
+}
+
+func Test_GetNextBackend_ConcurrentUpdate(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 30, "b": 70})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			r.updateWeights()
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := new(fasthttp.RequestCtx)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := r.getNextBackend(); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := r.getNextBackendFor(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_New_Validate(t *testing.T) {
+	type config struct {
+		prefix, rewrite            string
+		methods                    []string
+		read, healthcheck, monitor time.Duration
+		doHealthCheck              bool
+	}
+	valid := config{"/api", "/", []string{"GET"}, time.Second, time.Second, time.Second, true}
+	tests := map[string]func(c *config){
+		"empty prefix":              func(c *config) { c.prefix = "" },
+		"relative prefix":           func(c *config) { c.prefix = "api/" },
+		"relative rewrite":          func(c *config) { c.rewrite = "v1/" },
+		"rewrite without slash":     func(c *config) { c.rewrite = "/v1" },
+		"empty methods":             func(c *config) { c.methods = nil },
+		"empty method":              func(c *config) { c.methods = []string{""} },
+		"zero read timeout":         func(c *config) { c.read = 0 },
+		"negative read timeout":     func(c *config) { c.read = -time.Second },
+		"zero monitoring interval":  func(c *config) { c.monitor = 0 },
+		"zero healthcheck interval": func(c *config) { c.healthcheck = 0 },
+	}
+	for name, invalidate := range tests {
+		c := valid
+		invalidate(&c)
+		_, err := New("test", c.prefix, c.rewrite, "", "", c.methods,
+			c.read, time.Second, time.Second, time.Second, c.healthcheck, c.monitor, 0, c.doHealthCheck)
+		if err == nil {
+			t.Errorf("Expected the route with %s to be rejected", name)
+		}
+	}
+
+	r, err := New("test", valid.prefix, "", "", "", valid.methods,
+		time.Second, time.Second, time.Second, time.Second, 0, time.Second, 0, false)
+	if err != nil {
+		t.Fatalf("Expected the healthcheck interval to be optional without healthcheck, got %v", err)
+	}
+	if r.Prefix != "/api/" {
+		t.Errorf("Expected the trailing slash to be added to the prefix, got %s", r.Prefix)
+	}
+	r.Timeout = -time.Second
+	if err = r.Validate(); err == nil {
+		t.Error("Expected a negative timeout to be rejected")
+	}
+}
+
+func Test_Distribution(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 60, "b": 30, "c": 0, "d": 40, "e": 20})
+	if err := r.SetSubsets([]*Subset{
+		{Name: "premium", HeaderName: "X-Tenant", HeaderValue: "premium", Backends: []string{"d", "e"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]DistributionEntry{
+		"a": {Weight: 60, EffectiveWeight: 60, Count: 2, Share: 2.0 / 3},
+		"b": {Weight: 30, EffectiveWeight: 30, Count: 1, Share: 1.0 / 3},
+		"d": {Subset: "premium", Weight: 40, EffectiveWeight: 40, Count: 2, Share: 2.0 / 3},
+		"e": {Subset: "premium", Weight: 20, EffectiveWeight: 20, Count: 1, Share: 1.0 / 3},
+	}
+	entries := r.Distribution()
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected the backend with weight 0 to be omitted, got %+v", entries)
+	}
+	for _, entry := range entries {
+		want := expected[entry.Name]
+		want.ID, want.Name = entry.ID, entry.Name
+		if entry != want {
+			t.Errorf("Expected %+v, got %+v", want, entry)
+		}
+	}
+
+	r.weightScales = map[uuid.UUID]float64{backendByName(r, "b").ID: 2}
+	r.updateWeights()
+	for _, entry := range r.Distribution() {
+		if entry.Name == "b" && (entry.EffectiveWeight != 60 || entry.Count != 1 || entry.Share != 0.5) {
+			t.Errorf("Expected the scaled weight of b to be distributed, got %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package route
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// minSessionKeyLength is the minimal length of a configured session key
+	minSessionKeyLength = 16
+	// sessionSlots is the number of positions of slippery sessions in the distribution
+	sessionSlots = 10000
+)
+
+// DefaultCookieName returns the name of the session cookie of the route
+func DefaultCookieName(routeName string) string {
+	return strings.ToUpper(routeName) + "_SESSIONCOOKIE"
+}
+
+// SetSessionCookie sets the name of the session cookie and the environment variable
+// which contains the key that signs it. Empty values keep the current name or key.
+// Without a configured key, the route signs its cookies with a random key, i.e.
+// sessions do not survive a restart
+func (r *Route) SetSessionCookie(name, keyEnv string) error {
+	var key string
+	if keyEnv != "" {
+		key = os.Getenv(keyEnv)
+		if key == "" {
+			return fmt.Errorf("Environment variable %s is not set", keyEnv)
+		}
+		if len(key) < minSessionKeyLength {
+			return fmt.Errorf("Session key of %s must have at least %d characters", r.Name, minSessionKeyLength)
+		}
+	}
+	if name != "" {
+		r.CookieName = name
+	}
+	if keyEnv != "" {
+		r.SessionKeyEnv = keyEnv
+		r.sessionKey = []byte(key)
+	}
+	return nil
+}
+
+// newSessionKey returns a random key to sign session cookies
+func newSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("Failed to create session key: %v", err))
+	}
+	return key
+}
+
+// signSession returns the value of the session cookie which pins the client to the backend
+func (r *Route) signSession(backendID uuid.UUID) string {
+	return r.signSessionValue(backendID.String())
+}
+
+// parseSession returns the backend of the session cookie. Cookies which
+// were not signed by the route are rejected
+func (r *Route) parseSession(value string) (uuid.UUID, bool) {
+	payload, valid := r.parseSessionValue(value)
+	if !valid {
+		return uuid.Nil, false
+	}
+	backendID, err := uuid.Parse(payload)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return backendID, true
+}
+
+// signSessionValue returns the payload with its signature
+func (r *Route) signSessionValue(payload string) string {
+	return payload + "." + base64.RawURLEncoding.EncodeToString(r.sessionMAC(payload))
+}
+
+// parseSessionValue returns the payload of a session cookie if it was signed by the route
+func (r *Route) parseSessionValue(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(mac, r.sessionMAC(value[:i])) {
+		return "", false
+	}
+	return value[:i], true
+}
+
+// parseSlot returns the position of a slippery session cookie
+func (r *Route) parseSlot(value string) (int, bool) {
+	payload, valid := r.parseSessionValue(value)
+	if !valid {
+		return 0, false
+	}
+	slot, err := strconv.Atoi(payload)
+	if err != nil || slot < 0 || slot >= sessionSlots {
+		return 0, false
+	}
+	return slot, true
+}
+
+// slotTarget returns the backend at the position of the slot in the distribution.
+// Each backend covers a range of the slots which is proportional to its weight.
+// The ranges are ordered by the name of the backends so that a change of
+// the weights only moves the slots at the boundaries of the ranges
+func slotTarget(distr []*Backend, slot int) *Backend {
+	if len(distr) == 0 {
+		return nil
+	}
+	counts := make(map[*Backend]int)
+	backends := []*Backend{}
+	for _, backend := range distr {
+		if counts[backend] == 0 {
+			backends = append(backends, backend)
+		}
+		counts[backend]++
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Name < backends[j].Name
+	})
+	position := slot * len(distr) / sessionSlots
+	for _, backend := range backends {
+		if position < counts[backend] {
+			return backend
+		}
+		position -= counts[backend]
+	}
+	return backends[len(backends)-1]
+}
+
+func (r *Route) sessionMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, r.sessionKey)
+	mac.Write([]byte(r.Name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,200 @@
+package route
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+const testSessionKey = "DEPOY_TEST_SESSION_KEY"
+
+func newStickyRoute(t *testing.T) (fasthttp.RequestHandler, *Route) {
+	os.Setenv(testSessionKey, "0123456789abcdef")
+	defer os.Unsetenv(testSessionKey)
+
+	r, _ := newRetryRoute(t, 0, map[string]int{"a": 200, "b": 200})
+	if err := r.SetSessionCookie("SESSION", testSessionKey); err != nil {
+		t.Fatal(err)
+	}
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	return r.GetHandler(), r
+}
+
+// stickyRequest sends a request with the session cookie and returns the name of
+// the backend which served it and the new session cookie (empty if none is set)
+func stickyRequest(handler fasthttp.RequestHandler, session string) (string, string) {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	if session != "" {
+		ctx.Request.Header.SetCookie("SESSION", session)
+	}
+	handler(ctx)
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	c.SetKey("SESSION")
+	if !ctx.Response.Header.Cookie(c) {
+		return strings.TrimSuffix(string(ctx.Response.Body()), ":8080"), ""
+	}
+	return strings.TrimSuffix(string(ctx.Response.Body()), ":8080"), string(c.Value())
+}
+
+func Test_StickySession(t *testing.T) {
+	handler, r := newStickyRoute(t)
+
+	name, session := stickyRequest(handler, "")
+	if session == "" {
+		t.Fatal("Expected a session cookie on the first request")
+	}
+	if backendID, valid := r.parseSession(session); !valid || backendID != backendByName(r, name).ID {
+		t.Errorf("Expected the cookie to be signed for %s, got %s", name, session)
+	}
+	for i := 0; i < 20; i++ {
+		pinned, newSession := stickyRequest(handler, session)
+		if pinned != name || newSession != "" {
+			t.Fatalf("Expected the session to stay on %s, got %s (cookie %q)", name, pinned, newSession)
+		}
+	}
+}
+
+func Test_StickySession_Forged(t *testing.T) {
+	handler, r := newStickyRoute(t)
+	b := backendByName(r, "b")
+	backendByName(r, "a").Weigth = 100
+	b.Weigth = 0
+	r.updateWeights()
+
+	for _, forged := range []string{b.ID.String(), b.ID.String() + ".c2lnbmF0dXJl", "invalid"} {
+		name, session := stickyRequest(handler, forged)
+		if name != "a" || session == "" {
+			t.Errorf("Expected the forged cookie %q to be ignored, got %s (cookie %q)", forged, name, session)
+		}
+	}
+	if name, _ := stickyRequest(handler, r.signSession(b.ID)); name != "b" {
+		t.Errorf("Expected a signed cookie to pin b, got %s", name)
+	}
+}
+
+func Test_StickySession_Failover(t *testing.T) {
+	handler, r := newStickyRoute(t)
+	name, session := stickyRequest(handler, "")
+	backendByName(r, name).UpdateStatus(false)
+	r.updateWeights()
+
+	failover, newSession := stickyRequest(handler, session)
+	if failover == name || failover == "" {
+		t.Fatalf("Expected the session to fail over from %s, got %s", name, failover)
+	}
+	if backendID, valid := r.parseSession(newSession); !valid || backendID != backendByName(r, failover).ID {
+		t.Errorf("Expected a new cookie for %s, got %q", failover, newSession)
+	}
+	if pinned, _ := stickyRequest(handler, newSession); pinned != failover {
+		t.Errorf("Expected the session to stay on %s, got %s", failover, pinned)
+	}
+}
+
+func Test_SetSessionCookie(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	if r.CookieName != "TEST_SESSIONCOOKIE" {
+		t.Errorf("Expected the default cookie name, got %s", r.CookieName)
+	}
+	if err := r.SetSessionCookie("", "DEPOY_TEST_UNSET"); err == nil {
+		t.Error("Expected an unset session key to be rejected")
+	}
+	os.Setenv(testSessionKey, "short")
+	defer os.Unsetenv(testSessionKey)
+	if err := r.SetSessionCookie("", testSessionKey); err == nil {
+		t.Error("Expected a short session key to be rejected")
+	}
+	if r.SessionKeyEnv != "" {
+		t.Errorf("Expected a rejected session key not to be set, got %s", r.SessionKeyEnv)
+	}
+	session := r.signSession(backendByName(r, "a").ID)
+	other := newTestRoute(t, map[string]uint8{"a": 100})
+	if _, valid := other.parseSession(session); valid {
+		t.Error("Expected routes with random keys to reject the cookies of each other")
+	}
+}
+
+// sessionsAfterShift assigns 200 sessions while a has all the weight, moves half
+// of the weight to b and returns the number of sessions which migrated to b
+func sessionsAfterShift(t *testing.T, strategy func(*Route) (*Strategy, error)) int {
+	_, r := newStickyRoute(t)
+	strat, err := strategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	handler := r.GetHandler()
+	r.MetricsRepo = &metrics.Repository{InChannel: make(chan *metrics.Metrics, 1000)}
+	backendByName(r, "a").Weigth = 100
+	backendByName(r, "b").Weigth = 0
+	r.updateWeights()
+
+	sessions := make([]string, 200)
+	for i := range sessions {
+		name, session := stickyRequest(handler, "")
+		if name != "a" || session == "" {
+			t.Fatalf("Expected a new session on a, got %s (cookie %q)", name, session)
+		}
+		sessions[i] = session
+	}
+
+	backendByName(r, "a").Weigth = 50
+	backendByName(r, "b").Weigth = 50
+	r.updateWeights()
+	migrated := 0
+	for _, session := range sessions {
+		name, newSession := stickyRequest(handler, session)
+		if newSession != "" {
+			t.Errorf("Expected the session cookie to be kept, got %q", newSession)
+		}
+		if name == "b" {
+			migrated++
+		}
+		// the session stays on its new backend
+		if again, _ := stickyRequest(handler, session); again != name {
+			t.Errorf("Expected the session to stay on %s, got %s", name, again)
+		}
+	}
+	return migrated
+}
+
+func Test_SlipperySession_Migrates(t *testing.T) {
+	if migrated := sessionsAfterShift(t, NewSlipperyStrategy); migrated < 60 || migrated > 140 {
+		t.Errorf("Expected about half of the slippery sessions to migrate, got %d of 200", migrated)
+	}
+}
+
+func Test_StickySession_DoesNotMigrate(t *testing.T) {
+	if migrated := sessionsAfterShift(t, NewCanaryStrategy); migrated != 0 {
+		t.Errorf("Expected the sticky sessions to stay pinned, got %d of 200 migrated", migrated)
+	}
+	handler, r := newStickyRoute(t)
+	backendByName(r, "a").Weigth = 0
+	backendByName(r, "b").Weigth = 100
+	r.updateWeights()
+	// once the cookie expires, the session is assigned by the new weights
+	if name, _ := stickyRequest(handler, ""); name != "b" {
+		t.Errorf("Expected a new session to be assigned to b, got %s", name)
+	}
+}
+
+func Test_SlotTarget(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 75, "b": 25})
+	if target := slotTarget(r.NextTargetDistr, 7499); target.Name != "a" {
+		t.Errorf("Expected slot 7499 to be on a, got %s", target.Name)
+	}
+	if target := slotTarget(r.NextTargetDistr, 7500); target.Name != "b" {
+		t.Errorf("Expected slot 7500 to be on b, got %s", target.Name)
+	}
+	if target := slotTarget(nil, 0); target != nil {
+		t.Errorf("Expected no target without active backends, got %s", target.Name)
+	}
+}
@@ -2,10 +2,14 @@ package route
 
 import (
 	"fmt"
+	"math/rand"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 )
@@ -15,6 +19,7 @@ type Strategy struct {
 	HeaderName  string                         `json:"header_name,omitempty" yaml:"headerName,omitempty"`
 	HeaderValue string                         `json:"header_value,omitempty" yaml:"headerValue,omitempty"`
 	Target      string                         `json:"target_backend,omitempty" yaml:"targetBackend,omitempty"`
+	HashKey     string                         `json:"hash_key,omitempty" yaml:"hashKey,omitempty"` // RemoteAddr (default) or Header
 	Handler     func(ctx *fasthttp.RequestCtx) `json:"-" yaml:"-"`
 }
 
@@ -22,7 +27,7 @@ func (s *Strategy) Validate(newRoute *Route) (err error) {
 
 	switch t := strings.ToLower(s.Type); t {
 
-	case "canary":
+	case "canary", "slippery", "roundrobin", "leastconn":
 		if newRoute == nil {
 			return fmt.Errorf("Parameter route cannot be nil")
 		}
@@ -31,6 +36,23 @@ func (s *Strategy) Validate(newRoute *Route) (err error) {
 		if newRoute == nil || s.Target == "" {
 			return fmt.Errorf("Required parameter are missing")
 		}
+		if newRoute.StreamingUpload {
+			return fmt.Errorf("Strategy shadow requires buffering and cannot be used with streamingUpload")
+		}
+
+	case "consistenthash":
+		if newRoute == nil {
+			return fmt.Errorf("Parameter route cannot be nil")
+		}
+		switch strings.ToLower(s.HashKey) {
+		case "", "remoteaddr":
+		case "header":
+			if s.HeaderName == "" {
+				return fmt.Errorf("Hash key header requires headerName")
+			}
+		default:
+			return fmt.Errorf("Unsupported hash key (%s)", s.HashKey)
+		}
 
 	case "header":
 		if newRoute == nil || s.HeaderName == "" || s.HeaderValue == "" || s.Target == "" {
@@ -53,6 +75,30 @@ func (s *Strategy) Copy(newRoute *Route) error {
 			return err
 		}
 		newRoute.SetStrategy(strat)
+	case "slippery":
+		strat, err := NewSlipperyStrategy(newRoute)
+		if err != nil {
+			return err
+		}
+		newRoute.SetStrategy(strat)
+	case "roundrobin":
+		strat, err := NewRoundRobinStrategy(newRoute)
+		if err != nil {
+			return err
+		}
+		newRoute.SetStrategy(strat)
+	case "leastconn":
+		strat, err := NewLeastConnStrategy(newRoute)
+		if err != nil {
+			return err
+		}
+		newRoute.SetStrategy(strat)
+	case "consistenthash":
+		strat, err := NewConsistentHashStrategy(newRoute, s.HashKey, s.HeaderName)
+		if err != nil {
+			return err
+		}
+		newRoute.SetStrategy(strat)
 	case "shadow":
 		strat, err := NewShadowStrategy(newRoute, s.Target)
 		if err != nil {
@@ -81,6 +127,58 @@ func NewCanaryStrategy(r *Route) (*Strategy, error) {
 	return st, st.Validate(r)
 }
 
+// NewSlipperyStrategy returns a canary strategy with best-effort sessions
+// which migrate to other backends as the weights change (see SlipperyHandler)
+func NewSlipperyStrategy(r *Route) (*Strategy, error) {
+	st := &Strategy{
+		Type:    "slippery",
+		Handler: SlipperyHandler(r),
+	}
+	return st, st.Validate(r)
+}
+
+// NewRoundRobinStrategy returns a strategy which selects the backends
+// in the order of the weighted distribution instead of randomly
+func NewRoundRobinStrategy(r *Route) (*Strategy, error) {
+	st := &Strategy{
+		Type: "roundrobin",
+	}
+	if err := st.Validate(r); err != nil {
+		return nil, err
+	}
+	st.Handler = BalancedHandler(r, r.getNextBackendRoundRobin)
+	return st, nil
+}
+
+// NewLeastConnStrategy returns a strategy which selects the active
+// backend with the fewest in-flight requests
+func NewLeastConnStrategy(r *Route) (*Strategy, error) {
+	st := &Strategy{
+		Type: "leastconn",
+	}
+	if err := st.Validate(r); err != nil {
+		return nil, err
+	}
+	st.Handler = BalancedHandler(r, r.getNextBackendLeastConn)
+	return st, nil
+}
+
+// NewConsistentHashStrategy returns a strategy which hashes the IP of the client
+// or the value of a header onto a ring of the active backends. Hence, requests
+// with the same key are forwarded to the same backend without a session cookie
+func NewConsistentHashStrategy(r *Route, hashKey, headerName string) (*Strategy, error) {
+	st := &Strategy{
+		Type:       "consistenthash",
+		HashKey:    hashKey,
+		HeaderName: headerName,
+	}
+	if err := st.Validate(r); err != nil {
+		return nil, err
+	}
+	st.Handler = BalancedHandler(r, r.getNextBackendHash(hashKey, headerName))
+	return st, nil
+}
+
 func NewHeaderStrategy(r *Route, headerName, headerValue, targetBackend string) (*Strategy, error) {
 	var target *Backend
 
@@ -136,20 +234,38 @@ func NewShadowStrategy(r *Route, shadowBackend string) (*Strategy, error) {
 
 // CanaryHandler uses a Canary Strategy and selects a backend for forwarding
 // based on its weight. CanaryHandler also sets a session cookie so that all
-// following requests are forwarded to the same backend
+// following requests are forwarded to the same backend (sticky session).
+// The session is pinned for the lifetime of the cookie, even if the weight of
+// the backend is decreased by a switchover. Only if the backend is inactive,
+// a new backend is selected
 func CanaryHandler(r *Route) func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		var err error
 		var target *Backend
+
+		if target = r.allowlistTarget(ctx); target != nil {
+			r.forwardAllowlisted(ctx, target)
+			return
+		}
+		if target = r.canaryTarget(ctx); target != nil {
+			// the rule is evaluated on every request, hence no cookie is set
+			r.forward(ctx, target, nil)
+			return
+		}
 		c := fasthttp.AcquireCookie()
 
-		if value := string(ctx.Request.Header.Cookie(r.cookieName)); value != "" {
-			BackendID, err := uuid.Parse(value)
-			log.Debugf("Found routeCookie for %v", BackendID)
-			if err == nil {
+		if value := string(ctx.Request.Header.Cookie(r.CookieName)); value != "" {
+			BackendID, valid := r.parseSession(value)
+			log.Debugf("Found routeCookie for %v (valid: %t)", BackendID, valid)
+			if valid {
 				if t, found := r.Backends[BackendID]; found {
-					if t.Active {
+					if t.Active && r.inPool(ctx, t) {
 						target = t
+						if atomic.LoadInt32(&t.lingering) == 1 {
+							metrics.LingeringRequests.With(
+								prometheus.Labels{"route": r.Name, "backend": t.ID.String()},
+							).Inc()
+						}
 						fasthttp.ReleaseCookie(c)
 						c = nil
 						goto forward
@@ -157,15 +273,14 @@ func CanaryHandler(r *Route) func(ctx *fasthttp.RequestCtx) {
 				}
 			}
 		}
-		target, err = r.getNextBackend()
+		target, err = r.getNextBackendFor(ctx)
 		if err != nil {
-			log.Debugf("Could not get next backend: %v", err)
-			ctx.Error("No Upstream Host Available", 503)
+			r.handleError(ctx, err)
 			return
 		}
 		log.Debugf("Setting new routeCookie for %v", target.ID)
-		c.SetKey(r.cookieName)
-		c.SetValue(target.ID.String())
+		c.SetKey(r.CookieName)
+		c.SetValue(r.signSession(target.ID))
 		c.SetPath(r.Prefix)
 		if r.CookieTTL > 0 {
 			c.SetExpire(time.Now().Add(r.CookieTTL))
@@ -173,45 +288,68 @@ func CanaryHandler(r *Route) func(ctx *fasthttp.RequestCtx) {
 		defer fasthttp.ReleaseCookie(c)
 
 	forward:
-		req := fasthttp.AcquireRequest()
-		defer fasthttp.ReleaseRequest(req)
-		ctx.Request.CopyTo(req)
-		appendXForwardForHeader(req, ctx.RemoteAddr().String())
-		delRequestHopHeader(req)
-		if err = r.HTTPDo(req, target, HTTPReturn(ctx, c)); err != nil {
-			ctx.Error(handleNetError(err))
+		req, release := r.prepareRequest(ctx)
+		defer release()
+		if err = r.HTTPDo(req, target, HTTPReturn(ctx, c, r.FlushInterval)); err != nil {
+			r.handleError(ctx, err)
 		}
 	}
 }
 
+// SlipperyHandler uses a Canary Strategy with best-effort sessions. The session
+// cookie contains a random position in the weighted distribution instead of
+// a backend. As long as the weights do not change, a session is served by the
+// same backend. If the weights change (e.g. by a switchover), the sessions
+// migrate in proportion to the change without rewriting the cookie
+func SlipperyHandler(r *Route) func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		if target := r.allowlistTarget(ctx); target != nil {
+			r.forwardAllowlisted(ctx, target)
+			return
+		}
+		if target := r.canaryTarget(ctx); target != nil {
+			r.forward(ctx, target, nil)
+			return
+		}
+
+		var c *fasthttp.Cookie
+		slot, valid := r.parseSlot(string(ctx.Request.Header.Cookie(r.CookieName)))
+		if !valid {
+			slot = rand.Intn(sessionSlots)
+			c = fasthttp.AcquireCookie()
+			defer fasthttp.ReleaseCookie(c)
+			c.SetKey(r.CookieName)
+			c.SetValue(r.signSessionValue(strconv.Itoa(slot)))
+			c.SetPath(r.Prefix)
+			if r.CookieTTL > 0 {
+				c.SetExpire(time.Now().Add(r.CookieTTL))
+			}
+		}
+		distr, _ := r.distributionFor(ctx)
+		target := slotTarget(distr, slot)
+		if target == nil {
+			r.handleError(ctx, ErrNoBackend)
+			return
+		}
+		r.forward(ctx, target, c)
+	}
+}
+
 // HeaderHandler is used to check the header of an downstream request
 // if a routing header is found, the request is routed to the specified backend
 func HeaderHandler(r *Route, headerName, headerValue string, target *Backend) func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
-		var err error
-
-		req := fasthttp.AcquireRequest()
-		defer fasthttp.ReleaseRequest(req)
-		ctx.Request.CopyTo(req)
-		delRequestHopHeader(req)
-		appendXForwardForHeader(req, ctx.RemoteAddr().String())
-
-		if len(ctx.Request.Header.Peek(headerName)) > 0 {
-			if err = r.HTTPDo(req, target, HTTPReturn(ctx, nil)); err != nil {
-				ctx.Error(handleNetError(err))
-			}
+		if target.Active && string(ctx.Request.Header.Peek(headerName)) == headerValue {
+			r.forward(ctx, target, nil)
 			return
 		}
 
-		target, err = r.getNextBackend()
+		next, err := r.getNextBackendFor(ctx)
 		if err != nil {
-			log.Debugf("Could not get next backend: %v", err)
-			ctx.Error("No Upstream Host Available", 503)
+			r.handleError(ctx, err)
 			return
 		}
-		if err = r.HTTPDo(req, target, HTTPReturn(ctx, nil)); err != nil {
-			ctx.Error(handleNetError(err))
-		}
+		r.forward(ctx, next, nil)
 	}
 }
 
@@ -220,34 +358,20 @@ func HeaderHandler(r *Route, headerName, headerValue string, target *Backend) fu
 // returned. Both responses can then be compared
 func ShadowHandler(r *Route, shadow *Backend) func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
-		target, err := r.getNextBackend()
+		target, err := r.getNextBackendFor(ctx)
 		if err != nil {
-			log.Debugf("Could not get next backend: %v", err)
-			ctx.Error("No Upstream Host Available", 503)
+			r.handleError(ctx, err)
 			return
 		}
 
-		req1 := fasthttp.AcquireRequest()
-		defer fasthttp.ReleaseRequest(req1)
-		ctx.Request.CopyTo(req1)
-		delRequestHopHeader(req1)
-		appendXForwardForHeader(req1, ctx.RemoteAddr().String())
-
-		req2 := fasthttp.AcquireRequest()
-		defer fasthttp.ReleaseRequest(req2)
-		req2.SetBody(req1.Body())
-		req1.Header.CopyTo(&req2.Header)
+		req, release := r.prepareRequest(ctx)
+		defer release()
+		// the copy is released once the shadow request is done
+		shadowReq := r.copyRequest(ctx)
 
-		if err = r.HTTPDo(req1, target, HTTPReturn(ctx, nil)); err != nil {
-			ctx.Error(handleNetError(err))
+		if err = r.HTTPDo(req, target, HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+			r.handleError(ctx, err)
 		}
-
-		go func() {
-			if err = r.HTTPDo(req2, shadow, func(resp *fasthttp.Response) {
-				return
-			}); err != nil {
-				log.Infof("Shadow Request failed with %s", err.Error())
-			}
-		}()
+		r.sendAsync(shadowReq, shadow)
 	}
 }
@@ -0,0 +1,109 @@
+package route
+
+import (
+	"fmt"
+	"math/rand"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Subset is a pool of backends of a route which is selected if
+// the header of a request matches. Each subset has its own weighted
+// distribution. Backends which are not part of any subset serve
+// all requests that do not match a subset
+type Subset struct {
+	Name        string   `json:"name" yaml:"name"`
+	HeaderName  string   `json:"header_name" yaml:"headerName"`
+	HeaderValue string   `json:"header_value" yaml:"headerValue"`
+	Backends    []string `json:"backends" yaml:"backends"` // names of the backends of the subset
+	distr       []*Backend
+	rrCounter   uint64
+	ring        *hashRing
+}
+
+// Validate checks if all required parameters of the subset are set
+func (s *Subset) Validate() error {
+	if s.Name == "" || s.HeaderName == "" || s.HeaderValue == "" || len(s.Backends) == 0 {
+		return fmt.Errorf("Required parameter of subset are missing")
+	}
+	return nil
+}
+
+func (s *Subset) contains(backend *Backend) bool {
+	for _, name := range s.Backends {
+		if name == backend.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subset) match(ctx *fasthttp.RequestCtx) bool {
+	return string(ctx.Request.Header.Peek(s.HeaderName)) == s.HeaderValue
+}
+
+// SetSubsets validates and sets the subsets of the route
+func (r *Route) SetSubsets(subsets []*Subset) error {
+	for _, subset := range subsets {
+		if err := subset.Validate(); err != nil {
+			return err
+		}
+	}
+	r.Subsets = subsets
+	r.updateWeights()
+	return nil
+}
+
+// subsetFor returns the first subset that matches the request.
+// If no subset matches, nil is returned
+func (r *Route) subsetFor(ctx *fasthttp.RequestCtx) *Subset {
+	for _, subset := range r.Subsets {
+		if subset.match(ctx) {
+			return subset
+		}
+	}
+	return nil
+}
+
+// inPool checks if the backend is part of the pool that serves the request
+func (r *Route) inPool(ctx *fasthttp.RequestCtx, backend *Backend) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if subset := r.subsetFor(ctx); subset != nil && len(subset.distr) > 0 {
+		return subset.contains(backend)
+	}
+	for _, subset := range r.Subsets {
+		if subset.contains(backend) {
+			return false
+		}
+	}
+	return true
+}
+
+// distributionFor returns the distribution of the subset that matches the
+// request and its round-robin counter. If no subset matches or the subset has
+// no active backend, the distribution of the default pool is returned.
+// The returned distribution is never modified as updateWeights replaces it
+func (r *Route) distributionFor(ctx *fasthttp.RequestCtx) ([]*Backend, *uint64) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if subset := r.subsetFor(ctx); subset != nil {
+		if len(subset.distr) > 0 {
+			return subset.distr, &subset.rrCounter
+		}
+		log.Debugf("Subset %s of %s has no active backend. Using default", subset.Name, r.Name)
+	}
+	return r.NextTargetDistr, &r.rrCounter
+}
+
+// getNextBackendFor randomly selects the next backend of the pool that serves the request
+func (r *Route) getNextBackendFor(ctx *fasthttp.RequestCtx) (*Backend, error) {
+	distr, _ := r.distributionFor(ctx)
+	if len(distr) == 0 {
+		return nil, ErrNoBackend
+	}
+	return distr[rand.Intn(len(distr))], nil
+}
@@ -0,0 +1,130 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newSubsetRoute(t *testing.T) *Route {
+	r := newTestRoute(t, map[string]uint8{"a": 50, "b": 50, "p1": 20, "p2": 60})
+	if err := r.SetSubsets([]*Subset{
+		{Name: "premium", HeaderName: "X-Tenant", HeaderValue: "premium", Backends: []string{"p1", "p2"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func tenantRequest(tenant string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	if tenant != "" {
+		ctx.Request.Header.Set("X-Tenant", tenant)
+	}
+	return ctx
+}
+
+// countSelections returns how often each backend is selected by round-robin
+// for n requests of the tenant
+func countSelections(t *testing.T, r *Route, tenant string, n int) map[string]int {
+	ctx := tenantRequest(tenant)
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		backend, err := r.getNextBackendRoundRobin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[backend.Name]++
+	}
+	return counts
+}
+
+func Test_SetSubsets_Validate(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 50})
+	invalid := []*Subset{
+		{HeaderName: "X-Tenant", HeaderValue: "premium", Backends: []string{"a"}},
+		{Name: "premium", HeaderValue: "premium", Backends: []string{"a"}},
+		{Name: "premium", HeaderName: "X-Tenant", Backends: []string{"a"}},
+		{Name: "premium", HeaderName: "X-Tenant", HeaderValue: "premium"},
+	}
+	for _, subset := range invalid {
+		if err := r.SetSubsets([]*Subset{subset}); err == nil {
+			t.Errorf("Expected subset %+v to be rejected", subset)
+		}
+	}
+	if len(r.Subsets) != 0 {
+		t.Errorf("Expected invalid subsets not to be set, got %d", len(r.Subsets))
+	}
+}
+
+func Test_Subset_SelectByHeader(t *testing.T) {
+	r := newSubsetRoute(t)
+
+	tests := map[string]map[string]int{
+		"premium": {"p1": 25, "p2": 75},
+		"":        {"a": 50, "b": 50},
+		"free":    {"a": 50, "b": 50},
+	}
+	for tenant, expected := range tests {
+		counts := countSelections(t, r, tenant, 100)
+		if len(counts) != len(expected) {
+			t.Errorf("%q: expected only %v to be selected, got %v", tenant, expected, counts)
+		}
+		for name, count := range expected {
+			if counts[name] != count {
+				t.Errorf("%q: expected %s to be selected %d times, got %v", tenant, name, count, counts)
+			}
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		backend, err := r.getNextBackendFor(tenantRequest("premium"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.Name != "p1" && backend.Name != "p2" {
+			t.Fatalf("Expected a random backend of the subset, got %s", backend.Name)
+		}
+	}
+}
+
+func Test_Subset_FallbackToDefault(t *testing.T) {
+	r := newSubsetRoute(t)
+	backendByName(r, "p1").Active = false
+	backendByName(r, "p2").Active = false
+	r.updateWeights()
+
+	counts := countSelections(t, r, "premium", 10)
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("Expected the default pool to serve the empty subset, got %v", counts)
+	}
+	if !r.inPool(tenantRequest("premium"), backendByName(r, "a")) {
+		t.Error("Expected the default pool to serve sessions of the empty subset")
+	}
+
+	backendByName(r, "p2").Active = true
+	r.updateWeights()
+	if counts = countSelections(t, r, "premium", 10); counts["p2"] != 10 {
+		t.Errorf("Expected the subset to be used once a backend is active, got %v", counts)
+	}
+}
+
+func Test_Subset_InPool(t *testing.T) {
+	r := newSubsetRoute(t)
+
+	tests := []struct {
+		tenant, backend string
+		inPool          bool
+	}{
+		{"premium", "p1", true},
+		{"premium", "a", false},
+		{"", "a", true},
+		{"", "p1", false},
+		{"free", "p2", false},
+	}
+	for _, tt := range tests {
+		if inPool := r.inPool(tenantRequest(tt.tenant), backendByName(r, tt.backend)); inPool != tt.inPool {
+			t.Errorf("Expected %s to be in the pool of %q: %t, got %t", tt.backend, tt.tenant, tt.inPool, inPool)
+		}
+	}
+}
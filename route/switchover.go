@@ -2,15 +2,22 @@ package route
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rgumi/depoy/conditional"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/util"
 	log "github.com/sirupsen/logrus"
 )
 
 var counter int
 var granularity = 10 * time.Second
 
+// MaxSwitchoverHistory is the number of past switchovers which are kept per route
+const MaxSwitchoverHistory = 10
+
 // Switchover is used to configure a switch-over from
 // one backend to another. This can be used to gradually
 // increase the load to a backend by updating the
@@ -22,7 +29,13 @@ type Switchover struct {
 	Status             string                   `json:"status"`
 	Conditions         []*conditional.Condition `json:"conditions"`    // conditions that all need to be met to change
 	WeightChange       uint8                    `json:"weight_change"` // amount of change to the weights
+	Steps              []int                    `json:"steps"`         // ordered target weights of To which replace WeightChange if set
+	AbortOn            []string                 `json:"abort_on"`      // metrics whose Alarming alert of To aborts the switchover
 	Timeout            time.Duration            `json:"-"`             // duration to wait before changing weights
+	MaxDuration        time.Duration            `json:"-"`             // duration after which an incomplete switchover times out (0 = unlimited)
+	RemoveOnSuccess    bool                     `json:"-"`             // remove the old backend after a successful switchover
+	Linger             time.Duration            `json:"-"`             // duration the old backend serves its pinned sessions before it is removed
+	StartAt            time.Time                `json:"start_at"`      // time at which the switchover begins (zero = immediately)
 	Route              *Route                   `json:"-"`             // route for which the switch is defined
 	Rollback           bool                     `json:"-"`             // If Switchover is cancled or aborted, should the weights of backends be reset?
 	AllowedFailures    int                      `json:"-"`             // amount of failures that are allowed before switchover is aborted
@@ -30,24 +43,76 @@ type Switchover struct {
 	toRollbackWeight   uint8
 	fromRollbackWeight uint8
 	killChan           chan int // chan to stop the switchover process
+	statusMux          sync.RWMutex
+	started            time.Time // time at which the switchover began running
+	cycles             int       // cycles which changed the weights
+	reason             string    // reason of the final status
+	stopped            bool      // set by the first call of Stop
+	recordOnce         sync.Once
+}
+
+// SwitchoverProgress is a snapshot of the ramp of a switchover
+type SwitchoverProgress struct {
+	Status         string              `json:"status"`
+	FromWeight     uint8               `json:"from_weight"`
+	ToWeight       uint8               `json:"to_weight"`
+	Cycles         int                 `json:"cycles"` // cycles which changed the weights
+	FailureCounter int                 `json:"failure_counter"`
+	Elapsed        util.ConfigDuration `json:"elapsed"` // time since the switchover began running
+}
+
+// SwitchoverRecord is the outcome of a switchover which is kept in the history of the route
+type SwitchoverRecord struct {
+	ID         int       `json:"id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason,omitempty"`
+	FromWeight uint8     `json:"from_weight"` // final weights after a possible rollback
+	ToWeight   uint8     `json:"to_weight"`
+	Cycles     int       `json:"cycles"`
 }
 
 func NewSwitchover(
 	from, to *Backend,
 	route *Route,
 	conditions []*conditional.Condition,
-	timeout time.Duration,
+	timeout, maxDuration time.Duration,
 	allowedFailures int,
-	weightChange uint8, rollback bool) (*Switchover, error) {
+	weightChange uint8, steps []int, abortOn []string, rollback, removeOnSuccess bool,
+	linger time.Duration, startAt time.Time) (*Switchover, error) {
+
+	if fromWeight, toWeight := route.weights(from, to); fromWeight < toWeight {
+		return nil, fmt.Errorf("Weight of Switchover.From must be larger then Switchover.To")
+	}
+	return newSwitchover(from, to, route, conditions, timeout, maxDuration, allowedFailures,
+		weightChange, steps, abortOn, rollback, removeOnSuccess, linger, startAt)
+}
+
+// newSwitchover validates and returns the switchover without checking the current
+// weights of the backends (e.g. of a restored switchover which already favors To)
+func newSwitchover(
+	from, to *Backend,
+	route *Route,
+	conditions []*conditional.Condition,
+	timeout, maxDuration time.Duration,
+	allowedFailures int,
+	weightChange uint8, steps []int, abortOn []string, rollback, removeOnSuccess bool,
+	linger time.Duration, startAt time.Time) (*Switchover, error) {
 
 	if from.ID == to.ID {
 		return nil, fmt.Errorf("from and to cannot be the same entity")
 	}
-	if from.Weigth < to.Weigth {
-		return nil, fmt.Errorf("Weight of Switchover.From must be larger then Switchover.To")
+	if err := validateSteps(steps); err != nil {
+		return nil, err
 	}
 
 	for _, cond := range conditions {
+		if err := cond.Validate(); err != nil {
+			return nil, err
+		}
 		cond.Compile()
 	}
 
@@ -59,40 +124,257 @@ func NewSwitchover(
 		Status:          "Registered",
 		Conditions:      conditions,
 		Timeout:         timeout,
+		MaxDuration:     maxDuration,
 		WeightChange:    weightChange,
+		Steps:           steps,
+		AbortOn:         abortOn,
 		AllowedFailures: allowedFailures,
 		Route:           route,
 		Rollback:        rollback,
+		RemoveOnSuccess: removeOnSuccess,
+		Linger:          linger,
+		StartAt:         startAt,
 		killChan:        make(chan int, 1),
 	}, nil
 }
 
-// Stop the switchover process
+// validateSteps checks that the steps are increasing weights which end at 100
+func validateSteps(steps []int) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	for i, step := range steps {
+		if step <= 0 || step > 100 {
+			return fmt.Errorf("Step %d of switchover must be in (0, 100]", step)
+		}
+		if i > 0 && step <= steps[i-1] {
+			return fmt.Errorf("Steps of switchover must be strictly increasing")
+		}
+	}
+	if steps[len(steps)-1] != 100 {
+		return fmt.Errorf("Last step of switchover must be 100")
+	}
+	return nil
+}
+
+// nextChange returns the amount by which the weight of To is increased in the
+// next successful cycle. If steps are configured, it is the difference to the
+// next step. Otherwise it is WeightChange
+func (s *Switchover) nextChange(toWeight uint8) uint8 {
+	if toWeight >= maxSwitchoverWeight {
+		return 0
+	}
+	for _, step := range s.Steps {
+		if step > int(toWeight) {
+			return uint8(step) - toWeight
+		}
+	}
+	if len(s.Steps) > 0 {
+		return maxSwitchoverWeight - toWeight
+	}
+	return s.WeightChange
+}
+
+// shiftWeights moves the next change of weight from From to To and returns it.
+// The weights are clamped to 0 and 100 so that a change which exceeds the
+// remaining weight does not wrap around. They are read and changed under the
+// lock of the route so that a concurrent change (e.g. a rollback) is not lost
+func (s *Switchover) shiftWeights() uint8 {
+	r := s.Route
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	change := s.nextChange(s.To.Weigth)
+	log.Debugf("Shifting Weight %d from Backend %v to %v", change, s.From.ID, s.To.ID)
+	s.From.Weigth = subWeight(s.From.Weigth, change)
+	s.To.Weigth = addWeight(s.To.Weigth, change)
+	return change
+}
+
+// GetStatus returns the current status of the switchover
+func (s *Switchover) GetStatus() string {
+	s.statusMux.RLock()
+	defer s.statusMux.RUnlock()
+	return s.Status
+}
+
+func (s *Switchover) setStatus(status string) {
+	s.statusMux.Lock()
+	s.Status = status
+	s.statusMux.Unlock()
+}
+
+// finish sets the final status and its reason
+func (s *Switchover) finish(status, reason string) {
+	s.statusMux.Lock()
+	s.Status = status
+	s.reason = reason
+	s.statusMux.Unlock()
+}
+
+// Progress returns a snapshot of the current weights and cycles of the switchover
+func (s *Switchover) Progress() SwitchoverProgress {
+	fromWeight, toWeight := s.Route.weights(s.From, s.To)
+
+	s.statusMux.RLock()
+	defer s.statusMux.RUnlock()
+	progress := SwitchoverProgress{
+		Status:         s.Status,
+		FromWeight:     fromWeight,
+		ToWeight:       toWeight,
+		Cycles:         s.cycles,
+		FailureCounter: s.FailureCounter,
+	}
+	if !s.started.IsZero() {
+		progress.Elapsed.Duration = time.Since(s.started)
+	}
+	return progress
+}
+
+// record adds the outcome of the switchover to the history of the route
+func (s *Switchover) record() {
+	s.recordOnce.Do(func() {
+		progress := s.Progress()
+		s.statusMux.RLock()
+		record := SwitchoverRecord{
+			ID:         s.ID,
+			From:       s.From.Name,
+			To:         s.To.Name,
+			Start:      s.started,
+			End:        time.Now(),
+			Result:     s.Status,
+			Reason:     s.reason,
+			FromWeight: progress.FromWeight,
+			ToWeight:   progress.ToWeight,
+			Cycles:     s.cycles,
+		}
+		s.statusMux.RUnlock()
+		s.Route.addSwitchoverRecord(record)
+	})
+}
+
+// IsActive checks if the switchover is running, paused or scheduled to run
+func (s *Switchover) IsActive() bool {
+	status := s.GetStatus()
+	return status == "Running" || status == "Paused" || status == "Scheduled"
+}
+
+// Pause freezes the weights of the backends. The conditions are still evaluated
+// but the weights are not changed until the switchover is resumed
+func (s *Switchover) Pause() error {
+	s.statusMux.Lock()
+	defer s.statusMux.Unlock()
+	if s.Status != "Running" {
+		return fmt.Errorf("Cannot pause switchover with status %s", s.Status)
+	}
+	log.Infof("Pausing Switchover %d of %s", s.ID, s.Route.Name)
+	s.Status = "Paused"
+	s.changed()
+	return nil
+}
+
+// Resume continues a paused switchover from the current weights
+func (s *Switchover) Resume() error {
+	s.statusMux.Lock()
+	defer s.statusMux.Unlock()
+	if s.Status != "Paused" {
+		return fmt.Errorf("Cannot resume switchover with status %s", s.Status)
+	}
+	log.Infof("Resuming Switchover %d of %s", s.ID, s.Route.Name)
+	s.Status = "Running"
+	s.changed()
+	return nil
+}
+
+// Stop the switchover process. Only the first call has an effect, hence a
+// switchover which already stopped itself (e.g. timed out) is not rolled back again
 func (s *Switchover) Stop() {
-	if s.Status == "Running" {
+	s.statusMux.Lock()
+	if s.stopped {
+		s.statusMux.Unlock()
+		return
+	}
+	s.stopped = true
+	if s.Status == "Running" || s.Status == "Paused" || s.Status == "Scheduled" {
 		s.Status = "Stopped"
+		s.reason = "Stopped before completion"
 	}
-	if s.Rollback && s.Status == "Failed" {
-		log.Warnf("Switchover from %v to %v failed", s.From.ID, s.To.ID)
-		s.From.UpdateWeight(s.fromRollbackWeight)
-		s.To.UpdateWeight(s.toRollbackWeight)
+	status := s.Status
+	fromWeight, toWeight := s.fromRollbackWeight, s.toRollbackWeight
+	s.statusMux.Unlock()
+	if s.Rollback && (status == "Failed" || status == "TimedOut") {
+		log.Warnf("Switchover from %v to %v failed (%s)", s.From.ID, s.To.ID, status)
+		s.Route.setWeights(s.From, s.To, fromWeight, toWeight)
 		s.To.updateWeigth()
 	}
+	s.record()
+	s.changed()
 	s.killChan <- 1
 }
 
-// Start the switchover process
+// Start the switchover process. If StartAt is in the future, the
+// switchover is scheduled and waits until then
 func (s *Switchover) Start() {
-	s.toRollbackWeight = s.To.Weigth
-	s.fromRollbackWeight = s.From.Weigth
+	if wait := time.Until(s.StartAt); wait > 0 {
+		s.setStatus("Scheduled")
+		log.Infof("Switchover %d of %s is scheduled to start at %v", s.ID, s.Route.Name, s.StartAt)
+		select {
+		case _ = <-s.killChan:
+			log.Warnf("Killed scheduled SwitchOver %v of Route %v", s.ID, s.Route.Name)
+			return
+		case _ = <-time.After(wait):
+		}
+	}
+	fromWeight, toWeight := s.Route.weights(s.From, s.To)
+	s.statusMux.Lock()
+	s.toRollbackWeight = toWeight
+	s.fromRollbackWeight = fromWeight
 	s.Status = "Running"
-outer:
+	s.started = time.Now()
+	s.statusMux.Unlock()
+	s.changed()
+	s.run()
+}
+
+// run evaluates the conditions every cycle and changes the weights until the
+// switchover is finished or killed
+func (s *Switchover) run() {
+	// if configured, alerts of the new backend abort the switchover
+	var alerts <-chan metrics.Alert
+	if len(s.AbortOn) > 0 {
+		var unsubscribe func()
+		alerts, unsubscribe = s.To.subscribeAlerts()
+		defer unsubscribe()
+	}
+
+	// if configured, the switchover times out after MaxDuration
+	var expired <-chan time.Time
+	if s.MaxDuration > 0 {
+		// a resumed switchover only has the remainder of MaxDuration left
+		timer := time.NewTimer(time.Until(s.started.Add(s.MaxDuration)))
+		defer timer.Stop()
+		expired = timer.C
+	}
 	for {
 		select {
 		case _ = <-s.killChan:
 			log.Warnf("Killed SwitchOver %v of Route %v", s.ID, s.Route.Name)
 			return
 
+		case alert := <-alerts:
+			if alert.Type != "Alarming" || !s.abortsOn(alert.Metric) {
+				continue
+			}
+			log.Warnf("Switchover %d of %s is aborted as %v is alarming on %s",
+				s.ID, s.Route.Name, s.To.ID, alert.Metric)
+			s.finish("Failed", fmt.Sprintf("Backend %s was alarming on %s (%v > %v)",
+				s.To.Name, alert.Metric, alert.Value, alert.Threshhold))
+			s.Stop()
+
+		case _ = <-expired:
+			log.Warnf("Switchover %d of %s timed out after %v", s.ID, s.Route.Name, s.MaxDuration)
+			s.finish("TimedOut", fmt.Sprintf("Did not complete within %v", s.MaxDuration))
+			s.Stop()
+
 		case now := <-time.After(s.Timeout):
 
 			metrics, err := s.Route.MetricsRepo.ReadRatesOfBackend(
@@ -101,69 +383,178 @@ outer:
 				log.Trace(err)
 				continue
 			}
-			// begin cycle => check each condition if true
-			for _, condition := range s.Conditions {
-				if condition.IsTrue(metrics) && s.To.Active {
-					if condition.TriggerTime.IsZero() {
-						// evaluated later by adding activeFor-Duration
-						condition.TriggerTime = now
-					} else {
-						// check if condition was active for long enough
-						if condition.TriggerTime.Add(condition.GetActiveFor()).Before(now) {
-							log.Debugf("Updating status of condition %v %v %v to true",
-								condition.Metric, condition.Operator, condition.Threshold,
-							)
-							condition.Status = true
-
-						}
-					}
-
-					// condition is not true or backend is not active
-				} else {
-					condition.TriggerTime = time.Time{}
-					condition.Status = false
-				}
+			routeMetrics, err := s.readRatesOfRoute(now)
+			if err != nil {
+				log.Trace(err)
+				continue
 			}
+			result, condition := s.evaluate(now, metrics, routeMetrics)
 
-			// end of cycle, check conditions
-			for _, condition := range s.Conditions {
-				// to avoid a failureCounter increment when the trigger is true but the activeFor-duration
-				// is not, check if the triggertime is set
-				if !condition.Status && condition.TriggerTime.IsZero() {
-					// if any condition is not true, cycle is failed
-					log.Debugf("Condition (%s) of Switchover %v (%s) is false",
-						condition.Metric, s.ID, s.Route.Name,
-					)
-					s.FailureCounter++
-					// check if allowed failures have been reached - if configured
-					if s.AllowedFailures > 0 && s.FailureCounter > s.AllowedFailures {
-						// failed too often...
-						s.Status = "Failed"
-						s.Stop()
-					}
-					// continue cycle
-					continue outer
+			if s.GetStatus() == "Paused" {
+				// conditions are kept up to date but neither failures
+				// are counted nor weights changed
+				log.Debugf("Switchover %d of %s is paused", s.ID, s.Route.Name)
+				continue
+			}
+
+			switch result {
+			case cycleFailed:
+				log.Debugf("Condition (%s) of Switchover %v (%s) is false",
+					condition.Metric, s.ID, s.Route.Name,
+				)
+				s.statusMux.Lock()
+				s.FailureCounter++
+				failures := s.FailureCounter
+				s.statusMux.Unlock()
+				s.changed()
+				// check if allowed failures have been reached - if configured
+				if s.AllowedFailures > 0 && failures > s.AllowedFailures {
+					// failed too often...
+					s.finish("Failed", fmt.Sprintf("Condition %s was false in more than %d cycles",
+						condition.Metric, s.AllowedFailures))
+					s.Stop()
 				}
+				continue
+
+			case cyclePending:
+				log.Debugf("Condition (%s) of Switchover %v (%s) is not yet active for %v",
+					condition.Metric, s.ID, s.Route.Name, condition.GetActiveFor(),
+				)
+				continue
 			}
 			// if all conditions are true, increase the weight of the new route
-			s.From.UpdateWeight(s.From.Weigth - s.WeightChange)
-			s.To.UpdateWeight(s.To.Weigth + s.WeightChange)
+			change := s.shiftWeights()
 			// As both routes are part of the same route, both will be updated
 			s.To.updateWeigth()
-			log.Infof("Switchover %d - Updating weights of Backends by %d", s.ID, s.WeightChange)
+			s.statusMux.Lock()
+			s.cycles++
+			s.statusMux.Unlock()
+			s.changed()
+			log.Infof("Switchover %d - Updating weights of Backends by %d", s.ID, change)
 			// reset the conditions
 			for _, condition := range s.Conditions {
 				condition.TriggerTime = time.Time{}
 				condition.Status = false
 			}
-			if s.From.Weigth <= 0 || s.To.Weigth >= 100 {
+			if fromWeight, toWeight := s.Route.weights(s.From, s.To); fromWeight == 0 || toWeight >= maxSwitchoverWeight {
 				// switchover was successful, all traffic is forwarded to new backend
 				log.Infof("Switchover %d -  %s from %v to %v was successful",
 					s.ID, s.Route.Name, s.From.ID, s.To.ID,
 				)
-				s.Status = "Success"
+				s.setStatus("Success")
+				if s.RemoveOnSuccess {
+					go s.removeFrom()
+				}
 				s.Stop()
 			}
 		}
 	}
 }
+
+// results of a cycle of the switchover
+const (
+	cyclePassed  = iota // all conditions are active
+	cyclePending        // all conditions are true but not all for their activeFor-duration yet
+	cycleFailed         // at least one condition is false
+)
+
+// evaluate updates the conditions with the rates of the cycle and returns its result.
+// A cycle only fails if a condition is false. A condition which is true but not yet for
+// its activeFor-duration keeps the cycle pending which neither counts as failure nor
+// changes the weights. The condition which decided the result is returned
+func (s *Switchover) evaluate(now time.Time, rates, routeRates map[string]float64) (int, *conditional.Condition) {
+	result := cyclePassed
+	var decisive *conditional.Condition
+
+	for _, condition := range s.Conditions {
+		conditionRates := rates
+		if condition.IsRouteSource() {
+			conditionRates = routeRates
+		}
+		if condition.IsTrue(conditionRates) && s.To.isActive() {
+			if condition.TriggerTime.IsZero() {
+				// evaluated later by adding activeFor-Duration
+				condition.TriggerTime = now
+			}
+			// check if condition was active for long enough
+			if !condition.Status && !condition.TriggerTime.Add(condition.GetActiveFor()).After(now) {
+				log.Debugf("Updating status of condition %v %v %v to true",
+					condition.Metric, condition.Operator, condition.Threshold,
+				)
+				condition.Status = true
+			}
+
+			// condition is not true or backend is not active
+		} else {
+			condition.TriggerTime = time.Time{}
+			condition.Status = false
+		}
+
+		if !condition.Status && condition.TriggerTime.IsZero() {
+			if result != cycleFailed {
+				result, decisive = cycleFailed, condition
+			}
+		} else if !condition.Status && result == cyclePassed {
+			result, decisive = cyclePending, condition
+		}
+	}
+	return result, decisive
+}
+
+// abortsOn checks if an alert of the metric aborts the switchover
+func (s *Switchover) abortsOn(metric string) bool {
+	for _, m := range s.AbortOn {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// readRatesOfRoute reads the rates of the whole route if any condition
+// requires them. Otherwise nil is returned
+func (s *Switchover) readRatesOfRoute(now time.Time) (map[string]float64, error) {
+	for _, condition := range s.Conditions {
+		if condition.IsRouteSource() {
+			return s.Route.MetricsRepo.ReadRatesOfRoute(s.Route.Name, now.Add(-s.Timeout), now)
+		}
+	}
+	return nil, nil
+}
+
+// removeFrom removes the old backend of a successful switchover. Before it is
+// removed, it lingers for the configured duration in which it receives no new
+// traffic but still serves the sessions that are pinned to it
+func (s *Switchover) removeFrom() {
+	backend := s.From
+	if s.Linger > 0 {
+		log.Infof("Switchover %d - %v lingers for %v before it is removed", s.ID, backend.ID, s.Linger)
+		atomic.StoreInt32(&backend.lingering, 1)
+		time.Sleep(s.Linger)
+		atomic.StoreInt32(&backend.lingering, 0)
+	}
+
+	// the weight is checked and the backend removed under the same lock so
+	// that a concurrent weight change cannot be missed
+	r := s.Route
+	r.mux.Lock()
+	if _, found := r.Backends[backend.ID]; !found {
+		r.mux.Unlock()
+		return
+	}
+	if weight := backend.Weigth; weight > 0 {
+		r.mux.Unlock()
+		// weight was changed in the meantime => backend is still in use
+		log.Warnf("Switchover %d - %v has weight %d and is not removed", s.ID, backend.ID, weight)
+		return
+	}
+	log.Infof("Switchover %d - Removing %v from %s", s.ID, backend.ID, r.Name)
+	backend.Stop()
+	delete(r.Backends, backend.ID)
+	r.mux.Unlock()
+
+	if r.MetricsRepo != nil {
+		r.MetricsRepo.RemoveBackend(backend.ID)
+	}
+	r.updateWeights()
+}
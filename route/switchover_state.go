@@ -0,0 +1,166 @@
+package route
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rgumi/depoy/conditional"
+	"github.com/rgumi/depoy/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// SwitchoverState is the state of a switchover which is persisted so that
+// the switchover can be resumed after a restart of the gateway
+type SwitchoverState struct {
+	Route              string                   `json:"route"`
+	ID                 int                      `json:"id"`
+	From               string                   `json:"from"`
+	To                 string                   `json:"to"`
+	Status             string                   `json:"status"`
+	Conditions         []*conditional.Condition `json:"conditions"`
+	WeightChange       uint8                    `json:"weight_change"`
+	Steps              []int                    `json:"steps,omitempty"`
+	AbortOn            []string                 `json:"abort_on,omitempty"`
+	Timeout            util.ConfigDuration      `json:"timeout"`
+	MaxDuration        util.ConfigDuration      `json:"max_duration"`
+	AllowedFailures    int                      `json:"allowed_failures"`
+	FailureCounter     int                      `json:"failure_counter"`
+	Rollback           bool                     `json:"rollback"`
+	RemoveOnSuccess    bool                     `json:"remove_on_success"`
+	Linger             util.ConfigDuration      `json:"linger"`
+	StartAt            time.Time                `json:"start_at"`
+	Started            time.Time                `json:"started"` // time at which the switchover began running
+	Cycles             int                      `json:"cycles"`
+	FromWeight         uint8                    `json:"from_weight"`
+	ToWeight           uint8                    `json:"to_weight"`
+	FromRollbackWeight uint8                    `json:"from_rollback_weight"` // weights which are restored on rollback
+	ToRollbackWeight   uint8                    `json:"to_rollback_weight"`
+}
+
+// State returns a snapshot of the switchover which can be persisted
+func (s *Switchover) State() SwitchoverState {
+	progress := s.Progress()
+	s.statusMux.RLock()
+	defer s.statusMux.RUnlock()
+	return SwitchoverState{
+		Route:              s.Route.Name,
+		ID:                 s.ID,
+		From:               s.From.Name,
+		To:                 s.To.Name,
+		Status:             s.Status,
+		Conditions:         s.Conditions,
+		WeightChange:       s.WeightChange,
+		Steps:              s.Steps,
+		AbortOn:            s.AbortOn,
+		Timeout:            util.ConfigDuration{Duration: s.Timeout},
+		MaxDuration:        util.ConfigDuration{Duration: s.MaxDuration},
+		AllowedFailures:    s.AllowedFailures,
+		FailureCounter:     s.FailureCounter,
+		Rollback:           s.Rollback,
+		RemoveOnSuccess:    s.RemoveOnSuccess,
+		Linger:             util.ConfigDuration{Duration: s.Linger},
+		StartAt:            s.StartAt,
+		Started:            s.started,
+		Cycles:             s.cycles,
+		FromWeight:         progress.FromWeight,
+		ToWeight:           progress.ToWeight,
+		FromRollbackWeight: s.fromRollbackWeight,
+		ToRollbackWeight:   s.toRollbackWeight,
+	}
+}
+
+// changed notifies the route that the state of the switchover changed
+func (s *Switchover) changed() {
+	if s.Route != nil && s.Route.switchoverChanged != nil {
+		s.Route.switchoverChanged()
+	}
+}
+
+// OnSwitchoverChange sets the function which is called whenever the state of
+// a switchover of the route changes. It must not block
+func (r *Route) OnSwitchoverChange(f func()) {
+	r.switchoverChanged = f
+}
+
+// RestoreSwitchover recreates the switchover of the persisted state and resumes it.
+// The weights of the backends are set to the persisted weights. A running or paused
+// switchover continues with its failures, cycles and rollback weights. A scheduled
+// switchover is started again. Nothing is changed if the state is invalid
+func (r *Route) RestoreSwitchover(state SwitchoverState) (*Switchover, error) {
+	if state.Status != "Running" && state.Status != "Paused" && state.Status != "Scheduled" {
+		return nil, fmt.Errorf("Cannot restore switchover with status %s", state.Status)
+	}
+	if current := r.CurrentSwitchover(); current != nil && current.IsActive() {
+		return nil, fmt.Errorf("Only one switchover can be active per route")
+	}
+	if !supportsSwitchover(r.Strategy) {
+		return nil, fmt.Errorf("Switchover requires Strategy \"canary\" or \"slippery\" but %s has none", r.Name)
+	}
+	var from, to *Backend
+	for _, backend := range r.Backends {
+		if backend.Name == state.From {
+			from = backend
+		} else if backend.Name == state.To {
+			to = backend
+		}
+	}
+	if from == nil {
+		return nil, fmt.Errorf("Cannot find backend with Name %v", state.From)
+	}
+	if to == nil {
+		return nil, fmt.Errorf("Cannot find backend with Name %v", state.To)
+	}
+	// the weights at the start of the switchover are validated as the weights
+	// of a running switchover may already favor To
+	fromWeight, toWeight := state.FromRollbackWeight, state.ToRollbackWeight
+	if state.Status == "Scheduled" {
+		fromWeight, toWeight = state.FromWeight, state.ToWeight
+	}
+	if fromWeight < toWeight {
+		return nil, fmt.Errorf("Weight of Switchover.From must be larger then Switchover.To")
+	}
+
+	// the trigger times are not persisted, hence the conditions start over
+	for _, condition := range state.Conditions {
+		condition.Status = false
+		condition.TriggerTime = time.Time{}
+	}
+	switchover, err := newSwitchover(
+		from, to, r, state.Conditions, state.Timeout.Duration, state.MaxDuration.Duration,
+		state.AllowedFailures, state.WeightChange, state.Steps, state.AbortOn,
+		state.Rollback, state.RemoveOnSuccess, state.Linger.Duration, state.StartAt)
+	if err != nil {
+		return nil, err
+	}
+	r.setWeights(from, to, state.FromWeight, state.ToWeight)
+	r.updateWeights()
+
+	switchover.ID = state.ID
+	if counter < state.ID {
+		counter = state.ID
+	}
+	if state.Status == "Scheduled" {
+		log.Infof("Restoring scheduled Switchover %d of %s", state.ID, r.Name)
+		r.setSwitchover(switchover)
+		go switchover.Start()
+		return switchover, nil
+	}
+
+	log.Infof("Resuming Switchover %d of %s at weights %d/%d", state.ID, r.Name, state.FromWeight, state.ToWeight)
+	switchover.resume(state)
+	r.setSwitchover(switchover)
+	go switchover.run()
+	return switchover, nil
+}
+
+// resume sets the progress of the persisted state
+func (s *Switchover) resume(state SwitchoverState) {
+	s.statusMux.Lock()
+	defer s.statusMux.Unlock()
+	s.Status = state.Status
+	s.FailureCounter = state.FailureCounter
+	s.cycles = state.Cycles
+	s.started = state.Started
+	s.fromRollbackWeight = state.FromRollbackWeight
+	s.toRollbackWeight = state.ToRollbackWeight
+}
@@ -0,0 +1,117 @@
+package route
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/conditional"
+)
+
+func Test_Switchover_RestoreMidRamp(t *testing.T) {
+	s := newTestSwitchover(t, time.Hour, 20, nil, time.Time{})
+	s.Rollback = true
+	go s.Start()
+	waitForStatus(t, s, "Running")
+	// two cycles of the ramp and a failure before the restart
+	s.shiftWeights()
+	s.shiftWeights()
+	s.statusMux.Lock()
+	s.cycles, s.FailureCounter = 2, 1
+	s.statusMux.Unlock()
+	b, err := json.Marshal(s.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	// the restarted route has the weights of the config
+	r := newTestSwitchover(t, time.Hour, 20, nil, time.Time{}).Route
+	strategy, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+	state := SwitchoverState{}
+	if err = json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Timeout.Duration = 20 * time.Millisecond
+	resumed, err := r.RestoreSwitchover(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ID != s.ID || resumed.GetStatus() != "Running" {
+		t.Errorf("Expected switchover %d to be running, got %d with %s", s.ID, resumed.ID, resumed.GetStatus())
+	}
+	if from, to := weightOf(resumed.Route, resumed.From), weightOf(resumed.Route, resumed.To); from != 60 || to != 40 {
+		t.Errorf("Expected the saved weights 60/40, got %d/%d", from, to)
+	}
+
+	// the ramp continues from the saved weights
+	deadline := time.Now().Add(2 * time.Second)
+	for weightOf(resumed.Route, resumed.To) < 60 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the resumed switchover to change the weights")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = resumed.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if progress := resumed.Progress(); progress.ToWeight != 60 || progress.Cycles != 3 || progress.FailureCounter != 1 {
+		t.Errorf("Expected the third cycle to reach 60, got %+v", progress)
+	}
+
+	// an abort after the restart rolls back to the weights before the switchover
+	resumed.finish("Failed", "aborted")
+	resumed.Stop()
+	if from, to := weightOf(resumed.Route, resumed.From), weightOf(resumed.Route, resumed.To); from != 100 || to != 0 {
+		t.Errorf("Expected the rollback to 100/0, got %d/%d", from, to)
+	}
+}
+
+func Test_Switchover_RestoreFinished(t *testing.T) {
+	r := newTestSwitchover(t, time.Hour, 20, nil, time.Time{}).Route
+	strategy, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+	if _, err = r.RestoreSwitchover(SwitchoverState{Status: "Success", From: "a", To: "b"}); err == nil {
+		t.Error("Expected a finished switchover to not be restored")
+	}
+}
+
+func Test_Switchover_RestoreInvalid(t *testing.T) {
+	r := newTestSwitchover(t, time.Hour, 20, nil, time.Time{}).Route
+	strategy, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strategy)
+	valid := SwitchoverState{
+		Status: "Running", From: "a", To: "b", WeightChange: 20,
+		FromWeight: 60, ToWeight: 40, FromRollbackWeight: 100, ToRollbackWeight: 0,
+	}
+
+	invalid := map[string]func(*SwitchoverState){
+		"steps":            func(s *SwitchoverState) { s.Steps = []int{50, 20} },
+		"rollback weights": func(s *SwitchoverState) { s.FromRollbackWeight, s.ToRollbackWeight = 0, 100 },
+		"condition":        func(s *SwitchoverState) { s.Conditions = []*conditional.Condition{{Operator: "xor"}} },
+	}
+	for name, change := range invalid {
+		state := valid
+		change(&state)
+		if _, err = r.RestoreSwitchover(state); err == nil {
+			t.Errorf("%s: expected the state to be rejected", name)
+		}
+		// the weights are only changed once the state is valid
+		if from, to := weightOf(r, backendByName(r, "a")), weightOf(r, backendByName(r, "b")); from != 100 || to != 0 {
+			t.Errorf("%s: expected the weights to be unchanged, got %d/%d", name, from, to)
+		}
+	}
+	if r.CurrentSwitchover() != nil {
+		t.Error("Expected no switchover to be restored")
+	}
+}
@@ -0,0 +1,543 @@
+package route
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/conditional"
+	"github.com/rgumi/depoy/metrics"
+)
+
+// newTestSwitchover returns a switchover from a to b whose conditions are met
+// every cycle as no backend returns errors
+func newTestSwitchover(t *testing.T, timeout time.Duration, weightChange uint8, steps []int, startAt time.Time) *Switchover {
+	r := newTestRoute(t, map[string]uint8{"a": 100, "b": 0})
+	r.MetricsRepo = &metrics.Repository{
+		Storage:   &fakeStorage{errors: make(map[uuid.UUID]int)},
+		InChannel: make(chan *metrics.Metrics, 100),
+	}
+	conditions := []*conditional.Condition{conditional.NewCondition("5xxRate", "<", 0.1, time.Nanosecond, 0)}
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, conditions,
+		timeout, 0, 0, weightChange, steps, nil, false, false, 0, startAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitForStatus waits until the switchover has the status
+func waitForStatus(t *testing.T, s *Switchover, status string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for s.GetStatus() != status {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected status %s, got %s", status, s.GetStatus())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_Switchover_Scheduled(t *testing.T) {
+	startAt := time.Now().Add(200 * time.Millisecond)
+	s := newTestSwitchover(t, time.Hour, 10, nil, startAt)
+	go s.Start()
+	defer s.Stop()
+
+	waitForStatus(t, s, "Scheduled")
+	waitForStatus(t, s, "Running")
+	if time.Now().Before(startAt) {
+		t.Error("Expected the switchover to run after the start time")
+	}
+}
+
+func Test_Switchover_StartInPast(t *testing.T) {
+	s := newTestSwitchover(t, time.Hour, 10, nil, time.Now().Add(-time.Hour))
+	go s.Start()
+	defer s.Stop()
+
+	waitForStatus(t, s, "Running")
+}
+
+func Test_Switchover_StopScheduled(t *testing.T) {
+	s := newTestSwitchover(t, time.Hour, 10, nil, time.Now().Add(time.Hour))
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+
+	waitForStatus(t, s, "Scheduled")
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the scheduled switchover to be cancelled")
+	}
+	if s.GetStatus() != "Stopped" {
+		t.Errorf("Expected status Stopped, got %s", s.GetStatus())
+	}
+}
+
+// weightOf reads the weight of the backend while the switchover may update it
+func weightOf(r *Route, b *Backend) uint8 {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return b.Weigth
+}
+
+func Test_Switchover_PauseResume(t *testing.T) {
+	s := newTestSwitchover(t, 5*time.Millisecond, 10, nil, time.Time{})
+	if err := s.Pause(); err == nil {
+		t.Error("Expected a switchover which is not running to be not pausable")
+	}
+	go s.Start()
+	defer s.Stop()
+	waitForStatus(t, s, "Running")
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	// let a cycle which was already evaluated before the pause finish
+	time.Sleep(20 * time.Millisecond)
+	from, to := weightOf(s.Route, s.From), weightOf(s.Route, s.To)
+	time.Sleep(100 * time.Millisecond)
+	if weightOf(s.Route, s.From) != from || weightOf(s.Route, s.To) != to {
+		t.Errorf("Expected the weights %d/%d to be unchanged while paused, got %d/%d",
+			from, to, weightOf(s.Route, s.From), weightOf(s.Route, s.To))
+	}
+	if s.GetStatus() != "Paused" || !s.IsActive() {
+		t.Errorf("Expected the switchover to be paused and active, got %s", s.GetStatus())
+	}
+
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Resume(); err == nil {
+		t.Error("Expected a running switchover to be not resumable")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for weightOf(s.Route, s.To) <= to {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the weights to change after resume, got %d", weightOf(s.Route, s.To))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if weightOf(s.Route, s.To)-to != s.WeightChange {
+		t.Errorf("Expected the ramp to continue from %d, got %d", to, weightOf(s.Route, s.To))
+	}
+}
+
+func Test_Switchover_StopPaused(t *testing.T) {
+	s := newTestSwitchover(t, time.Hour, 10, nil, time.Time{})
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	waitForStatus(t, s, "Running")
+	s.Pause()
+
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the paused switchover to be stopped")
+	}
+	if s.GetStatus() != "Stopped" {
+		t.Errorf("Expected status Stopped, got %s", s.GetStatus())
+	}
+}
+
+func Test_Switchover_Steps(t *testing.T) {
+	steps := []int{1, 2, 5, 10, 25, 50, 100}
+	s := newTestSwitchover(t, time.Millisecond, 10, steps, time.Time{})
+	var weights []int
+	for s.To.Weigth < 100 {
+		weights = append(weights, int(s.To.Weigth+s.nextChange(s.To.Weigth)))
+		s.To.Weigth += s.nextChange(s.To.Weigth)
+	}
+	if fmt.Sprint(weights) != fmt.Sprint(steps) {
+		t.Errorf("Expected the weights %v, got %v", steps, weights)
+	}
+
+	s = newTestSwitchover(t, time.Millisecond, 10, steps, time.Time{})
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		s.Stop()
+		t.Fatal("Expected the switchover to complete")
+	}
+	if s.GetStatus() != "Success" || s.From.Weigth != 0 || s.To.Weigth != 100 {
+		t.Errorf("Expected a successful switchover to 100, got %s with %d/%d", s.GetStatus(), s.From.Weigth, s.To.Weigth)
+	}
+}
+
+func Test_Switchover_InvalidSteps(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100, "b": 0})
+	for _, steps := range [][]int{{10, 5, 100}, {0, 100}, {10, 50}, {50, 101}} {
+		if _, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, nil,
+			time.Second, 0, 0, 0, steps, nil, false, false, 0, time.Time{}); err == nil {
+			t.Errorf("Expected the steps %v to be rejected", steps)
+		}
+	}
+}
+
+func Test_Switchover_WeightChangeExceedsRemaining(t *testing.T) {
+	for _, c := range []struct {
+		from, to, weightChange uint8
+		wantFrom, wantTo       uint8
+	}{
+		{30, 20, 50, 0, 70},    // change exceeds the weight of From
+		{100, 0, 200, 0, 100},  // change exceeds 100
+		{100, 95, 10, 90, 100}, // To would exceed 100
+	} {
+		r := newTestRoute(t, map[string]uint8{"a": c.from, "b": c.to})
+		s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, nil,
+			time.Second, 0, 0, c.weightChange, nil, nil, false, false, 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.shiftWeights()
+		if s.From.Weigth != c.wantFrom || s.To.Weigth != c.wantTo {
+			t.Errorf("Expected %d/%d to become %d/%d, got %d/%d",
+				c.from, c.to, c.wantFrom, c.wantTo, s.From.Weigth, s.To.Weigth)
+		}
+		if change := s.nextChange(s.To.Weigth); c.wantTo == 100 && change != 0 {
+			t.Errorf("Expected no change once To has all traffic, got %d", change)
+		}
+	}
+}
+
+func Test_Switchover_HistoryOfFailure(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 90, "b": 10})
+	st := &fakeStorage{errors: map[uuid.UUID]int{backendByName(r, "b").ID: 50}}
+	r.MetricsRepo = &metrics.Repository{Storage: st, InChannel: make(chan *metrics.Metrics, 100)}
+	conditions := []*conditional.Condition{conditional.NewCondition("5xxRate", "<", 0.1, time.Nanosecond, 0)}
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, conditions,
+		time.Millisecond, 0, 2, 10, nil, nil, true, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		s.Stop()
+		t.Fatal("Expected the switchover to fail")
+	}
+
+	progress := s.Progress()
+	if progress.Status != "Failed" || progress.FailureCounter != 3 || progress.Cycles != 0 {
+		t.Errorf("Unexpected progress %+v", progress)
+	}
+	history := r.SwitchoverHistory()
+	if len(history) != 1 {
+		t.Fatalf("Expected one record in the history, got %d", len(history))
+	}
+	record := history[0]
+	if record.ID != s.ID || record.Result != "Failed" || record.Reason != "Condition 5xxRate was false in more than 2 cycles" {
+		t.Errorf("Expected the reason of the failure to be recorded, got %+v", record)
+	}
+	if record.FromWeight != 90 || record.ToWeight != 10 || record.Start.IsZero() || record.End.Before(record.Start) {
+		t.Errorf("Expected the final weights and timeframe to be recorded, got %+v", record)
+	}
+
+	// stopping the switchover again does not add another record
+	s.Stop()
+	if len(r.SwitchoverHistory()) != 1 {
+		t.Error("Expected the outcome to be recorded once")
+	}
+}
+
+func Test_Route_SwitchoverHistoryBounded(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	for i := 1; i <= MaxSwitchoverHistory+5; i++ {
+		r.addSwitchoverRecord(SwitchoverRecord{ID: i})
+	}
+	history := r.SwitchoverHistory()
+	if len(history) != MaxSwitchoverHistory || history[0].ID != 6 || history[len(history)-1].ID != MaxSwitchoverHistory+5 {
+		t.Errorf("Expected the last %d records, got %+v", MaxSwitchoverHistory, history)
+	}
+}
+
+func Test_Switchover_AbortOnAlert(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 90, "b": 10})
+	r.MetricsRepo = &metrics.Repository{
+		Storage:   &fakeStorage{errors: make(map[uuid.UUID]int)},
+		InChannel: make(chan *metrics.Metrics, 100),
+	}
+	to := backendByName(r, "b")
+
+	conditions := []*conditional.Condition{conditional.NewCondition("5xxRate", "<", 0.1, time.Nanosecond, 0)}
+	s, err := NewSwitchover(backendByName(r, "a"), to, r, conditions,
+		5*time.Millisecond, 0, 0, 1, nil, []string{"5xxRate"}, true, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	defer s.Stop()
+
+	// wait until the ramp has begun
+	deadline := time.Now().Add(2 * time.Second)
+	for weightOf(r, to) <= 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the weights to change")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// alerts are published by Backend.Monitor. Alerts of other metrics are ignored
+	to.publishAlert(metrics.Alert{Type: "Alarming", BackendID: to.ID, Metric: "ResponseTime", Threshhold: 100, Value: 500})
+	to.publishAlert(metrics.Alert{Type: "Pending", BackendID: to.ID, Metric: "5xxRate", Threshhold: 0.1, Value: 0.5})
+	time.Sleep(20 * time.Millisecond)
+	if s.GetStatus() != "Running" {
+		t.Fatalf("Expected the switchover to ignore the alerts, got %s", s.GetStatus())
+	}
+	to.publishAlert(metrics.Alert{Type: "Alarming", BackendID: to.ID, Metric: "5xxRate", Threshhold: 0.1, Value: 0.5})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the switchover to be aborted")
+	}
+	if s.GetStatus() != "Failed" {
+		t.Errorf("Expected status Failed, got %s", s.GetStatus())
+	}
+	if from := weightOf(r, backendByName(r, "a")); from != 90 || weightOf(r, to) != 10 {
+		t.Errorf("Expected the weights to be rolled back to 90/10, got %d/%d", from, weightOf(r, to))
+	}
+	if reason := r.SwitchoverHistory()[0].Reason; reason != "Backend b was alarming on 5xxRate (0.5 > 0.1)" {
+		t.Errorf("Expected the alert to be recorded as reason, got %s", reason)
+	}
+}
+
+func Test_Switchover_EvaluateTrending(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100, "b": 0})
+	errorRate := conditional.NewCondition("5xxRate", "<", 0.1, time.Minute, 0)
+	responseTime := conditional.NewCondition("ResponseTime", "<", 100, time.Nanosecond, 0)
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r,
+		[]*conditional.Condition{errorRate, responseTime}, time.Second, 0, 0, 10, nil, nil, false, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthy := map[string]float64{"5xxRate": 0, "ResponseTime": 50}
+	now := time.Now()
+
+	// the error rate is trending but not yet true for a minute
+	for _, elapsed := range []time.Duration{0, 30 * time.Second} {
+		if result, condition := s.evaluate(now.Add(elapsed), healthy, nil); result != cyclePending || condition != errorRate {
+			t.Fatalf("Expected the cycle after %v to be pending on the error rate, got %d", elapsed, result)
+		}
+	}
+	if result, _ := s.evaluate(now.Add(time.Minute), healthy, nil); result != cyclePassed {
+		t.Fatalf("Expected the cycle to pass once the error rate is true for a minute, got %d", result)
+	}
+
+	// a condition which is false fails the cycle even if another one is trending
+	errorRate.TriggerTime, errorRate.Status = time.Time{}, false
+	s.evaluate(now, healthy, nil)
+	slow := map[string]float64{"5xxRate": 0, "ResponseTime": 500}
+	if result, condition := s.evaluate(now.Add(time.Second), slow, nil); result != cycleFailed || condition != responseTime {
+		t.Fatalf("Expected the cycle to fail on the response time, got %d", result)
+	}
+	// the trending condition drops back once it is false
+	unhealthy := map[string]float64{"5xxRate": 0.5, "ResponseTime": 50}
+	if result, condition := s.evaluate(now.Add(2*time.Second), unhealthy, nil); result != cycleFailed || condition != errorRate {
+		t.Fatalf("Expected the cycle to fail on the error rate, got %d", result)
+	}
+	if !errorRate.TriggerTime.IsZero() {
+		t.Error("Expected the trigger of the false condition to be reset")
+	}
+}
+
+func Test_Switchover_TrendingIsNoFailure(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100, "b": 0})
+	r.MetricsRepo = &metrics.Repository{
+		Storage:   &fakeStorage{errors: make(map[uuid.UUID]int)},
+		InChannel: make(chan *metrics.Metrics, 100),
+	}
+	conditions := []*conditional.Condition{conditional.NewCondition("5xxRate", "<", 0.1, time.Hour, 0)}
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, conditions,
+		time.Millisecond, 0, 1, 10, nil, nil, false, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	waitForStatus(t, s, "Running")
+	time.Sleep(50 * time.Millisecond)
+
+	progress := s.Progress()
+	if progress.Status != "Running" || progress.FailureCounter != 0 || progress.ToWeight != 0 {
+		t.Errorf("Expected pending cycles to neither fail nor change weights, got %+v", progress)
+	}
+}
+
+func Test_Switchover_EvaluateRouteSource(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100, "b": 0})
+	r.MetricsRepo = &metrics.Repository{
+		Storage:   &fakeStorage{errors: make(map[uuid.UUID]int), routeErrors: 30},
+		InChannel: make(chan *metrics.Metrics, 100),
+	}
+	backendErrors := conditional.NewCondition("5xxRate", "<", 0.1, time.Nanosecond, 0)
+	routeErrors := conditional.NewCondition("ErrorRate", "<", 0.1, time.Nanosecond, 0)
+	routeErrors.Source = conditional.SourceRoute
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r,
+		[]*conditional.Condition{backendErrors}, time.Second, 0, 0, 10, nil, nil, false, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// the route is only read if a condition requires its rates
+	if routeRates, err := s.readRatesOfRoute(now); err != nil || routeRates != nil {
+		t.Fatalf("Expected the route not to be read without a condition of the route, got %v %v", routeRates, err)
+	}
+	s.Conditions = append(s.Conditions, routeErrors)
+	routeRates, err := s.readRatesOfRoute(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routeRates["ErrorRate"] != 0.3 {
+		t.Fatalf("Expected the error rate of the route, got %v", routeRates)
+	}
+
+	// the new backend is healthy but the clients of the route receive errors
+	healthy := map[string]float64{"5xxRate": 0, "ErrorRate": 0}
+	if result, condition := s.evaluate(now, healthy, routeRates); result != cycleFailed || condition != routeErrors {
+		t.Fatalf("Expected the cycle to fail on the error rate of the route, got %d", result)
+	}
+	if backendErrors.TriggerTime.IsZero() {
+		t.Error("Expected the condition of the backend to use the rates of the backend")
+	}
+	s.evaluate(now.Add(time.Second), healthy, map[string]float64{"ErrorRate": 0.05})
+	if result, _ := s.evaluate(now.Add(2*time.Second), healthy, map[string]float64{"ErrorRate": 0.05}); result != cyclePassed {
+		t.Errorf("Expected the cycle to pass once the route is healthy, got %d", result)
+	}
+}
+
+func Test_Switchover_FailsOnRouteSource(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 90, "b": 10})
+	r.MetricsRepo = &metrics.Repository{
+		Storage:   &fakeStorage{errors: make(map[uuid.UUID]int), routeErrors: 50},
+		InChannel: make(chan *metrics.Metrics, 100),
+	}
+	routeErrors := conditional.NewCondition("ErrorRate", "<", 0.1, time.Nanosecond, 0)
+	routeErrors.Source = conditional.SourceRoute
+	conditions := []*conditional.Condition{
+		conditional.NewCondition("5xxRate", "<", 0.1, time.Nanosecond, 0), routeErrors,
+	}
+	s, err := NewSwitchover(backendByName(r, "a"), backendByName(r, "b"), r, conditions,
+		time.Millisecond, 0, 1, 10, nil, nil, false, false, 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		s.Stop()
+		t.Fatal("Expected the switchover to fail on the errors of the route")
+	}
+
+	history := r.SwitchoverHistory()
+	if len(history) != 1 || history[0].Result != "Failed" ||
+		history[0].Reason != "Condition ErrorRate was false in more than 1 cycles" {
+		t.Errorf("Expected the condition of the route to fail the switchover, got %+v", history)
+	}
+}
+
+func Test_Switchover_MaxDuration(t *testing.T) {
+	s := newTestSwitchover(t, time.Hour, 10, nil, time.Time{})
+	s.MaxDuration = 50 * time.Millisecond
+	s.Rollback = true
+	go s.Start()
+	waitForStatus(t, s, "Running")
+	// a partial ramp which is pinned as the conditions are never evaluated
+	s.Route.setWeights(s.From, s.To, 70, 30)
+
+	waitForStatus(t, s, "TimedOut")
+	// the outcome is recorded after the rollback
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Route.SwitchoverHistory()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the outcome of the switchover to be recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if weightOf(s.Route, s.From) != 100 || weightOf(s.Route, s.To) != 0 {
+		t.Errorf("Expected the weights to be rolled back to 100/0, got %d/%d", weightOf(s.Route, s.From), weightOf(s.Route, s.To))
+	}
+	history := s.Route.SwitchoverHistory()
+	if history[0].Result != "TimedOut" || history[0].Reason != "Did not complete within 50ms" {
+		t.Errorf("Expected the timeout to be recorded, got %+v", history[0])
+	}
+
+	// stopping the switchover after it timed out neither blocks
+	// nor rolls back the weights which were changed in the meantime
+	s.Route.setWeights(s.From, s.To, 50, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	if weightOf(s.Route, s.From) != 50 || weightOf(s.Route, s.To) != 50 {
+		t.Errorf("Expected the weights to be kept after the switchover was stopped, got %d/%d", weightOf(s.Route, s.From), weightOf(s.Route, s.To))
+	}
+	if s.GetStatus() != "TimedOut" {
+		t.Errorf("Expected status TimedOut, got %s", s.GetStatus())
+	}
+}
+
+// hasBackend checks if the backend is still part of the route
+func hasBackend(r *Route, b *Backend) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	_, found := r.Backends[b.ID]
+	return found
+}
+
+func Test_Switchover_RemoveOnSuccess(t *testing.T) {
+	s := newTestSwitchover(t, time.Millisecond, 50, nil, time.Time{})
+	s.RemoveOnSuccess = true
+	go s.Start()
+
+	waitForStatus(t, s, "Success")
+	deadline := time.Now().Add(2 * time.Second)
+	for hasBackend(s.Route, s.From) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the old backend to be removed after the successful switchover")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !hasBackend(s.Route, s.To) {
+		t.Error("Expected the new backend to be kept")
+	}
+	for _, entry := range s.Route.Distribution() {
+		if entry.Name != "b" {
+			t.Errorf("Expected only b to be distributed, got %+v", entry)
+		}
+	}
+}
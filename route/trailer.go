@@ -0,0 +1,114 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// responseHeadersKey is the user value of the function which sets the headers
+// that the route adds to every response (see GetHandler)
+const responseHeadersKey = "depoy.responseHeaders"
+
+// trailerNames returns the trailers which are announced by the Trailer header
+func trailerNames(header *fasthttp.ResponseHeader) []string {
+	names := []string{}
+	for _, name := range strings.Split(string(header.Peek(fasthttp.HeaderTrailer)), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// trailerLines returns the announced trailers which have a value as header lines
+func trailerLines(header *fasthttp.ResponseHeader) []string {
+	lines := []string{}
+	for _, name := range trailerNames(header) {
+		if value := header.Peek(name); len(value) > 0 {
+			lines = append(lines, name+": "+string(value))
+		}
+	}
+	return lines
+}
+
+// chunkWriter writes every write as a chunk of a chunked body and flushes it
+type chunkWriter struct {
+	w *bufio.Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), cw.w.Flush()
+}
+
+// returnWithTrailers copies the upstream response with its trailers to the client.
+// fasthttp cannot send trailers, hence the connection is hijacked and the response
+// is written with a chunked body which is followed by the trailers. The connection
+// is closed afterwards. The body of streamed responses is flushed with the flushInterval.
+// As the header is written before the handler of the route returns, the headers of the
+// route (request ID and CORS) are set beforehand
+func returnWithTrailers(ctx *fasthttp.RequestCtx, resp *fasthttp.Response, flushInterval time.Duration) {
+	// the values of streamed trailers are only known once the body is read
+	streamed := resp.IsBodyStream()
+	var body []byte
+	if !streamed {
+		body = append(body, resp.Body()...)
+	}
+	trailers := trailerLines(&resp.Header)
+	for _, name := range trailerNames(&resp.Header) {
+		ctx.Response.Header.Del(name)
+	}
+	if setHeaders, ok := ctx.UserValue(responseHeadersKey).(func()); ok {
+		setHeaders()
+	}
+	ctx.Response.Header.SetContentLength(-1)
+	ctx.Response.Header.SetConnectionClose()
+	header := append([]byte(nil), ctx.Response.Header.Header()...)
+
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(c net.Conn) {
+		w := bufio.NewWriter(c)
+		w.Write(header)
+		chunks := bufio.NewWriter(&chunkWriter{w})
+		if streamed {
+			defer fasthttp.ReleaseResponse(resp)
+			fw := newFlushWriter(chunks, flushInterval)
+			err := resp.BodyWriteTo(fw)
+			fw.stop()
+			if err != nil {
+				log.Debugf("Streaming response to %s aborted: %v", c.RemoteAddr(), err)
+				return
+			}
+			trailers = trailerLines(&resp.Header)
+		} else {
+			chunks.Write(body)
+		}
+		if err := chunks.Flush(); err != nil {
+			return
+		}
+
+		w.WriteString("0\r\n")
+		for _, trailer := range trailers {
+			w.WriteString(trailer + "\r\n")
+		}
+		w.WriteString("\r\n")
+		w.Flush()
+	})
+}
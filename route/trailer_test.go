@@ -0,0 +1,121 @@
+package route
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newTrailerUpstream returns an upstream which sends its response chunked
+// with the trailers Grpc-Status and Grpc-Message
+func newTrailerUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", req.URL.Query().Get("type"))
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(" world"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}))
+}
+
+func Test_Trailers(t *testing.T) {
+	upstream := newTrailerUpstream()
+	defer upstream.Close()
+
+	r := newTestRouteTo(t, strings.TrimPrefix(upstream.URL, "http://"), map[string]uint8{"a": 100})
+	// the trailers are read by the streaming upstream client
+	r.FlushInterval = 10 * time.Millisecond
+	if err := r.SetConnectionPool(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.releaseClients()
+	addr, stop := serveRoute(t, r)
+	defer stop()
+
+	for _, contentType := range []string{"text/plain", "text/event-stream"} {
+		resp, err := http.Get("http://" + addr + "/?type=" + contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "hello world" {
+			t.Errorf("%s: expected the body, got %q (%v)", contentType, body, err)
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+			t.Errorf("%s: expected the trailers, got %v", contentType, resp.Trailer)
+		}
+		if len(resp.Header["Content-Type"]) != 1 || resp.Header.Get("Grpc-Status") != "" {
+			t.Errorf("%s: expected the headers without the trailers, got %v", contentType, resp.Header)
+		}
+	}
+}
+
+func Test_Trailers_RouteHeaders(t *testing.T) {
+	upstream := newTrailerUpstream()
+	defer upstream.Close()
+
+	r := newTestRouteTo(t, strings.TrimPrefix(upstream.URL, "http://"), map[string]uint8{"a": 100})
+	r.FlushInterval = 10 * time.Millisecond
+	if err := r.SetConnectionPool(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.releaseClients()
+	r.CORS = &CORS{AllowedOrigins: []string{"https://example.com"}}
+	if err := r.CORS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	strat, err := NewCanaryStrategy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetStrategy(strat)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&fasthttp.Server{Handler: r.GetHandler()}).Serve(ln)
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set(DefaultRequestIDHeader, "4711")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected the trailers, got %v", resp.Trailer)
+	}
+	if id := resp.Header.Get(DefaultRequestIDHeader); id != "4711" {
+		t.Errorf("Expected the request ID in the response with trailers, got %q", id)
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://example.com" {
+		t.Errorf("Expected the CORS headers in the response with trailers, got %v", resp.Header)
+	}
+}
+
+func Test_Trailers_BufferedClient(t *testing.T) {
+	upstream := newTrailerUpstream()
+	defer upstream.Close()
+
+	// the fasthttp client of buffered routes cannot read trailers
+	r := newTestRouteTo(t, strings.TrimPrefix(upstream.URL, "http://"), map[string]uint8{"a": 100})
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI(upstream.URL)
+	req, release := r.prepareRequest(ctx)
+	defer release()
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err == nil {
+		t.Errorf("Expected a response with trailers to fail without streaming, got %q", ctx.Response.Body())
+	}
+}
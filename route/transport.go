@@ -0,0 +1,154 @@
+package route
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/rgumi/depoy/upstreamclient"
+)
+
+// Transport configures the TLS settings and the protocol which are used to
+// connect to a backend. Backends without a transport use the client of the route.
+// Backends with the same transport share a client
+type Transport struct {
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecureSkipVerify"`
+	ServerName         string `json:"server_name,omitempty" yaml:"serverName,omitempty"`
+	CAFile             string `json:"ca_file,omitempty" yaml:"caFile,omitempty"`
+	CertFile           string `json:"cert_file,omitempty" yaml:"certFile,omitempty"` // client certificate for mutual TLS
+	KeyFile            string `json:"key_file,omitempty" yaml:"keyFile,omitempty"`   // private key of the client certificate
+	HTTP2              bool   `json:"http2" yaml:"http2"`                            // use HTTP/2 (h2c for http backends)
+}
+
+func (t *Transport) key() string {
+	return fmt.Sprintf("%t|%s|%s|%s|%s|%t",
+		t.InsecureSkipVerify, t.ServerName, t.CAFile, t.CertFile, t.KeyFile, t.HTTP2)
+}
+
+// TLSConfig returns the tls config of the transport. If a client certificate
+// is configured, it is presented to upstreams which request one
+func (t *Transport) TLSConfig() (*tls.Config, error) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("Client certificate requires both cert_file and key_file")
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// clientConfig identifies the config of the upstream clients of the route
+func (r *Route) clientConfig() string {
+	return fmt.Sprintf("%v|%v|%v|%d|%d|%d|%t", r.ReadTimeout, r.WriteTimeout, r.IdleTimeout,
+		r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost, r.FlushInterval != 0)
+}
+
+// acquireDefaultClient returns the shared client of backends without transport.
+// The previous client of the route is released
+func (r *Route) acquireDefaultClient() UpstreamClient {
+	r.clientsMux.Lock()
+	defer r.clientsMux.Unlock()
+
+	if r.clientKey != "" {
+		upstreamclient.DefaultPool.Release(r.clientKey)
+	}
+	r.clientKey = fmt.Sprintf("%s|default|%t", r.clientConfig(), upstreamclient.SkipTLSVerify)
+	return upstreamclient.DefaultPool.Acquire(r.clientKey, func() upstreamclient.Client {
+		if r.FlushInterval != 0 {
+			return upstreamclient.NewStreamClient(r.ReadTimeout, r.WriteTimeout, r.IdleTimeout,
+				r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost,
+				&tls.Config{InsecureSkipVerify: upstreamclient.SkipTLSVerify},
+			)
+		}
+		return upstreamclient.NewUpstreamclient(r.ReadTimeout, r.WriteTimeout, r.IdleTimeout,
+			r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost, upstreamclient.SkipTLSVerify,
+		)
+	})
+}
+
+// addClientFor acquires the shared client for the transport of the backend
+// if the route does not use it yet
+func (r *Route) addClientFor(backend *Backend) error {
+	if backend.Transport == nil {
+		return nil
+	}
+	r.clientsMux.Lock()
+	defer r.clientsMux.Unlock()
+
+	key := backend.Transport.key()
+	if _, found := r.clients[key]; found {
+		return nil
+	}
+	tlsConfig, err := backend.Transport.TLSConfig()
+	if err != nil {
+		return err
+	}
+	poolKey := r.clientConfig() + "|" + key
+	r.poolKeys = append(r.poolKeys, poolKey)
+	r.clients[key] = upstreamclient.DefaultPool.Acquire(poolKey, func() upstreamclient.Client {
+		if backend.Transport.HTTP2 {
+			return upstreamclient.NewHTTP2Client(r.ReadTimeout, r.WriteTimeout, tlsConfig)
+		}
+		if r.FlushInterval != 0 {
+			return upstreamclient.NewStreamClient(r.ReadTimeout, r.WriteTimeout, r.IdleTimeout,
+				r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost, tlsConfig,
+			)
+		}
+		return upstreamclient.NewUpstreamclientWithTLS(
+			r.ReadTimeout, r.WriteTimeout, r.IdleTimeout,
+			r.MaxIdleConns, r.MaxIdleConnsPerHost, r.MaxConnsPerHost, tlsConfig,
+		)
+	})
+	return nil
+}
+
+// releaseClients releases all shared clients of the route. Clients which are
+// not used by other routes are closed
+func (r *Route) releaseClients() {
+	r.clientsMux.Lock()
+	defer r.clientsMux.Unlock()
+
+	if r.clientKey != "" {
+		upstreamclient.DefaultPool.Release(r.clientKey)
+		r.clientKey = ""
+	}
+	for _, key := range r.poolKeys {
+		upstreamclient.DefaultPool.Release(key)
+	}
+	r.poolKeys = nil
+	r.clients = make(map[string]UpstreamClient)
+}
+
+// clientFor returns the client which is used for requests to the backend
+func (r *Route) clientFor(backend *Backend) UpstreamClient {
+	if backend.Transport == nil {
+		return r.Client
+	}
+	r.clientsMux.Lock()
+	defer r.clientsMux.Unlock()
+
+	if client, found := r.clients[backend.Transport.key()]; found {
+		return client
+	}
+	return r.Client
+}
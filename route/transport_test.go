@@ -0,0 +1,298 @@
+package route
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/upstreamclient"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func Test_Transport_H2C(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Host", req.Host)
+		w.Write([]byte(req.Proto))
+	}), &http2.Server{}))
+	defer server.Close()
+
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MetricsRepo = &metrics.Repository{InChannel: make(chan *metrics.Metrics, 100)}
+	addr, _ := url.Parse(server.URL)
+	backend, err := NewBackend("h2c", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Transport = &Transport{HTTP2: true}
+	if _, err = r.AddExistingBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	r.updateWeights()
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.SetHost("public.example.com")
+	r.forward(ctx, backendByName(r, "h2c"), nil)
+
+	if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "HTTP/2.0" {
+		t.Errorf("Expected the backend to be reached over HTTP/2, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if host := string(ctx.Response.Header.Peek("X-Host")); host != "public.example.com" {
+		t.Errorf("Expected the host of the client to be forwarded, got %s", host)
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key to dir
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "depoy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certFile, keyFile
+}
+
+func Test_Transport_ClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MetricsRepo = &metrics.Repository{InChannel: make(chan *metrics.Metrics, 100)}
+	addr, _ := url.Parse(server.URL)
+	for name, transport := range map[string]*Transport{
+		"mtls":   {CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+		"nocert": {CAFile: caFile},
+	} {
+		backend, err := NewBackend(name, addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.Transport = transport
+		if _, err = r.AddExistingBackend(backend); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.updateWeights()
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.forward(ctx, backendByName(r, "mtls"), nil)
+	if ctx.Response.StatusCode() != 200 || string(ctx.Response.Body()) != "depoy" {
+		t.Errorf("Expected the client certificate to be verified, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	r.forward(ctx, backendByName(r, "nocert"), nil)
+	if ctx.Response.StatusCode() == 200 {
+		t.Error("Expected the upstream to reject requests without client certificate")
+	}
+}
+
+func Test_Transport_ClientCertificateRequiresKey(t *testing.T) {
+	if _, err := (&Transport{CertFile: "client.crt"}).TLSConfig(); err == nil {
+		t.Error("Expected a client certificate without key to be rejected")
+	}
+}
+
+func Test_Route_SetConnectionPool(t *testing.T) {
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SetConnectionPool(-1, 0, 0); err == nil {
+		t.Error("Expected negative pool sizes to be rejected")
+	}
+	if err = r.SetConnectionPool(100, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := url.Parse("https://backend:8443")
+	backend, _ := NewBackend("tls", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	backend.Transport = &Transport{InsecureSkipVerify: true}
+	if _, err = r.AddExistingBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []UpstreamClient{r.Client, r.clientFor(backendByName(r, "tls"))} {
+		c := client.(*upstreamclient.Upstreamclient)
+		if c.MaxIdleConns != 100 || c.MaxIdleConnsPerHost != 10 || c.MaxConnsPerHost != 20 {
+			t.Errorf("Expected the pool of the route, got %d/%d/%d", c.MaxIdleConns, c.MaxIdleConnsPerHost, c.MaxConnsPerHost)
+		}
+	}
+}
+
+func Test_Route_SharedClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	newRoute := func(name string) *Route {
+		r, err := New(name, "/"+name, "/", "", "", []string{"GET"},
+			time.Second, 2*time.Second, 3*time.Second, time.Second, time.Second, time.Second, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	a, b := newRoute("a"), newRoute("b")
+	if a.Client != b.Client {
+		t.Fatal("Expected routes with the same config to share the client")
+	}
+	if refs := upstreamclient.DefaultPool.Refs(a.clientKey); refs != 2 {
+		t.Errorf("Expected two references of the client, got %d", refs)
+	}
+
+	a.Delete()
+	if refs := upstreamclient.DefaultPool.Refs(b.clientKey); refs != 1 {
+		t.Errorf("Expected the deleted route to release its client, got %d references", refs)
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(server.URL)
+	resp, err := b.Client.Send("", req, new(metrics.Metrics), time.Second)
+	if err != nil {
+		t.Fatalf("Expected the client of the remaining route to work, got %v", err)
+	}
+	fasthttp.ReleaseResponse(resp)
+	b.Delete()
+}
+
+func Test_Route_ClientFor(t *testing.T) {
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.releaseClients()
+	addr, _ := url.Parse("https://backend:8443")
+	transports := map[string]*Transport{
+		"default":  nil,
+		"insecure": {InsecureSkipVerify: true},
+		"same":     {InsecureSkipVerify: true},
+		"sni":      {InsecureSkipVerify: true, ServerName: "backend.local"},
+		"h2":       {HTTP2: true},
+	}
+	for name, transport := range transports {
+		backend, _ := NewBackend(name, addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+		backend.Transport = transport
+		if _, err = r.AddExistingBackend(backend); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientOf := func(name string) UpstreamClient { return r.clientFor(backendByName(r, name)) }
+
+	if clientOf("default") != r.Client {
+		t.Error("Expected backends without transport to use the client of the route")
+	}
+	if clientOf("insecure") == r.Client || clientOf("insecure") != clientOf("same") {
+		t.Error("Expected backends with the same transport to share their own client")
+	}
+	if clientOf("sni") == clientOf("insecure") {
+		t.Error("Expected backends with different transports to use different clients")
+	}
+	if _, ok := clientOf("h2").(*upstreamclient.HTTP2Client); !ok {
+		t.Errorf("Expected a HTTP/2 client, got %T", clientOf("h2"))
+	}
+	if _, ok := clientOf("insecure").(*upstreamclient.Upstreamclient); !ok {
+		t.Errorf("Expected a fasthttp client, got %T", clientOf("insecure"))
+	}
+	if len(r.clients) != 3 {
+		t.Errorf("Expected one client per transport, got %d", len(r.clients))
+	}
+
+	invalid, _ := NewBackend("invalid", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	invalid.Transport = &Transport{CAFile: "does-not-exist.crt"}
+	if _, err = r.AddExistingBackend(invalid); err == nil {
+		t.Error("Expected a backend with an invalid transport to be rejected")
+	}
+	if backendByName(r, "invalid") != nil || len(r.clients) != 3 {
+		t.Error("Expected the invalid backend not to be added")
+	}
+
+	// a transport whose client is not acquired falls back to the client of the route
+	unknown, _ := NewBackend("unknown", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	unknown.Transport = &Transport{ServerName: "other.local"}
+	if r.clientFor(unknown) != r.Client {
+		t.Error("Expected an unknown transport to use the client of the route")
+	}
+}
+
+func Test_Route_StreamingTransport(t *testing.T) {
+	r, err := New("test", "/", "/", "", "", []string{"GET"},
+		time.Second, time.Second, time.Second, time.Second, time.Second, time.Second, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.releaseClients()
+	r.FlushInterval = -1
+	addr, _ := url.Parse("https://backend:8443")
+	backend, _ := NewBackend("tls", addr, &url.URL{}, &url.URL{}, nil, nil, 100)
+	backend.Transport = &Transport{InsecureSkipVerify: true}
+	if _, err = r.AddExistingBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	if client := r.clientFor(backendByName(r, "tls")); client == nil {
+		t.Fatal("Expected a client for the transport")
+	} else if _, ok := client.(*upstreamclient.StreamClient); !ok {
+		t.Errorf("Expected a streaming client for routes with a flush interval, got %T", client)
+	}
+}
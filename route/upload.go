@@ -0,0 +1,68 @@
+package route
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// errBodyReleased is returned by reads of an upload body after the
+// downstream request was released
+var errBodyReleased = errors.New("Body of the downstream request was released")
+
+// uploadBody reads the body of the downstream request without copying it.
+// Once it is released, reads fail as the downstream request may be reused
+// (e.g. by a client which still sends the request after a timeout)
+type uploadBody struct {
+	mux      sync.Mutex
+	body     []byte
+	released bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.released {
+		return 0, errBodyReleased
+	}
+	if len(b.body) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.body)
+	b.body = b.body[n:]
+	return n, nil
+}
+
+func (b *uploadBody) release() {
+	b.mux.Lock()
+	b.released = true
+	b.body = nil
+	b.mux.Unlock()
+}
+
+// streamRequest returns the request that forwards the downstream request of a
+// route with StreamingUpload. The headers and the uri are copied but the body is
+// read from the downstream request while it is sent. Hence, the body is not
+// buffered a second time and the downstream request is never modified.
+// Note: fasthttp reads the complete request body before the handler is invoked,
+// so the body is still held in memory once (limited by the MaxRequestBodySize
+// of the server). As the body can only be read once, the request is not replayed
+func streamRequest(ctx *fasthttp.RequestCtx) (*fasthttp.Request, func()) {
+	req := fasthttp.AcquireRequest()
+	ctx.Request.Header.CopyTo(&req.Header)
+	ctx.Request.URI().CopyTo(req.URI())
+
+	body := ctx.Request.Body()
+	if len(body) == 0 {
+		return req, func() { fasthttp.ReleaseRequest(req) }
+	}
+	upload := &uploadBody{body: body}
+	req.SetBodyStream(upload, len(body))
+	return req, func() {
+		upload.release()
+		fasthttp.ReleaseRequest(req)
+	}
+}
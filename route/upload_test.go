@@ -0,0 +1,135 @@
+package route
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// drainClient reads the body of every request while it is sent and
+// records if it was passed as body stream
+type drainClient struct {
+	mux      sync.Mutex
+	streamed []bool
+	bodies   []string
+	keep     bool // keep the bodies for assertions
+}
+
+func (c *drainClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.streamed = append(c.streamed, req.IsBodyStream())
+	if c.keep {
+		var body bytes.Buffer
+		if err := req.BodyWriteTo(&body); err != nil {
+			return nil, err
+		}
+		c.bodies = append(c.bodies, body.String())
+	} else if err := req.BodyWriteTo(ioutil.Discard); err != nil {
+		return nil, err
+	}
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(200)
+	return resp, nil
+}
+
+func newUploadRoute(t *testing.T, streaming bool) (*Route, *drainClient) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	r.StreamingUpload = streaming
+	client := &drainClient{keep: true}
+	r.Client = client
+	return r, client
+}
+
+func Test_StreamingUpload_Request(t *testing.T) {
+	r, client := newUploadRoute(t, true)
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod("PUT")
+	ctx.Request.SetRequestURI("http://depoy.local/upload?part=1")
+	ctx.Request.Header.Set("Connection", "close")
+	ctx.Request.Header.Set("Keep-Alive", "timeout=5")
+	ctx.Request.SetBodyString("payload")
+	req, release := r.prepareRequest(ctx)
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if len(client.streamed) != 1 || !client.streamed[0] || client.bodies[0] != "payload" {
+		t.Errorf("Expected the body to be streamed to the upstream, got %v %q", client.streamed, client.bodies)
+	}
+	// the downstream request is still used by the server and the access log
+	if uri := ctx.Request.URI().String(); uri != "http://depoy.local/upload?part=1" {
+		t.Errorf("Expected the downstream uri to be unchanged, got %s", uri)
+	}
+	if !ctx.Request.Header.ConnectionClose() || len(ctx.Request.Header.Peek("Keep-Alive")) == 0 {
+		t.Error("Expected the hop headers of the downstream request to be kept")
+	}
+	if body := string(ctx.Request.Body()); body != "payload" {
+		t.Errorf("Expected the downstream body to be unchanged, got %q", body)
+	}
+
+	// requests without a body are not streamed
+	if _, err := doRequest(r, "GET", "", backendByName(r, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if client.streamed[1] {
+		t.Error("Expected a request without body not to be streamed")
+	}
+}
+
+func Test_StreamingUpload_Released(t *testing.T) {
+	body := &uploadBody{body: []byte("payload")}
+	p := make([]byte, 3)
+	if n, err := body.Read(p); n != 3 || err != nil || string(p) != "pay" {
+		t.Fatalf("Expected the start of the body, got %d %v %q", n, err, p)
+	}
+	body.release()
+	if _, err := body.Read(p); err != errBodyReleased {
+		t.Errorf("Expected reads of a released body to fail, got %v", err)
+	}
+}
+
+// allocatedBytes returns the bytes allocated while the upload is forwarded
+func allocatedBytes(t *testing.T, r *Route, body string) uint64 {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/upload")
+	ctx.Request.SetBodyString(body)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	req, release := r.prepareRequest(ctx)
+	if err := r.HTTPDo(req, backendByName(r, "a"), HTTPReturn(ctx, nil, r.FlushInterval)); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func Test_StreamingUpload_NoCopy(t *testing.T) {
+	body := strings.Repeat("x", 8<<20)
+
+	buffered, client := newUploadRoute(t, false)
+	client.keep = false
+	if allocated := allocatedBytes(t, buffered, body); allocated < uint64(len(body)) {
+		t.Fatalf("Expected the body to be copied without streaming, allocated %d bytes", allocated)
+	}
+
+	streamed, client := newUploadRoute(t, true)
+	client.keep = false
+	if allocated := allocatedBytes(t, streamed, body); allocated > uint64(len(body))/4 {
+		t.Errorf("Expected the streamed body not to be copied, allocated %d bytes", allocated)
+	}
+}
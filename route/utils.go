@@ -1,6 +1,8 @@
 package route
 
 import (
+	"strings"
+
 	"github.com/valyala/fasthttp"
 )
 
@@ -17,6 +19,28 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+// setForwardedHeaders appends the client to X-Forwarded-For and sets X-Forwarded-Proto
+// and X-Forwarded-Host based on the downstream request. If trusted is set, the
+// X-Forwarded-Proto and X-Forwarded-Host headers set by the client are kept
+func setForwardedHeaders(req *fasthttp.Request, ctx *fasthttp.RequestCtx, trusted bool) {
+	appendXForwardForHeader(req, ctx.RemoteAddr().String())
+
+	if !trusted || len(req.Header.Peek("X-Forwarded-Proto")) == 0 {
+		proto := "http"
+		if ctx.IsTLS() {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trusted || len(req.Header.Peek("X-Forwarded-Host")) == 0 {
+		if host := ctx.Host(); len(host) > 0 {
+			req.Header.SetBytesV("X-Forwarded-Host", host)
+		} else {
+			req.Header.Del("X-Forwarded-Host")
+		}
+	}
+}
+
 func appendXForwardForHeader(req *fasthttp.Request, host string) {
 	prior := string(req.Header.Peek("X-Forwarded-For"))
 
@@ -62,3 +86,39 @@ func ggT(a, b uint8) uint8 {
 	}
 	return a
 }
+
+// maxSwitchoverWeight is the weight of a backend which receives all traffic of a switchover
+const maxSwitchoverWeight = 100
+
+// addWeight increases the weight by change. The result is capped at
+// maxSwitchoverWeight instead of overflowing
+func addWeight(weight, change uint8) uint8 {
+	if int(weight)+int(change) > maxSwitchoverWeight {
+		return maxSwitchoverWeight
+	}
+	return weight + change
+}
+
+// subWeight decreases the weight by change. The result is capped at 0 instead
+// of underflowing
+func subWeight(weight, change uint8) uint8 {
+	if change >= weight {
+		return 0
+	}
+	return weight - change
+}
+
+// replacePrefix replaces the prefix of the path with replacement. The prefix
+// matches with and without trailing slash (/api matches /api and /api/users but
+// not /apis) and the result contains no duplicate slash at the joint
+func replacePrefix(path, prefix, replacement string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest != "" && rest[0] != '/' {
+		return path
+	}
+	return strings.TrimSuffix(replacement, "/") + "/" + strings.TrimLeft(rest, "/")
+}
@@ -0,0 +1,121 @@
+package route
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// tlsConn pretends to be a tls connection
+type tlsConn struct {
+	net.Conn
+}
+
+func (c *tlsConn) Handshake() error { return nil }
+
+func (c *tlsConn) ConnectionState() tls.ConnectionState { return tls.ConnectionState{} }
+
+func forwardedCtx(isTLS bool) *fasthttp.RequestCtx {
+	client, server := net.Pipe()
+	client.Close()
+	var conn net.Conn = server
+	if isTLS {
+		conn = &tlsConn{server}
+	}
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Init2(conn, nil, false)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.SetHost("public.example.com")
+	ctx.Request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	return ctx
+}
+
+func Test_ForwardedHeaders(t *testing.T) {
+	for isTLS, proto := range map[bool]string{false: "http", true: "https"} {
+		ctx := forwardedCtx(isTLS)
+		ctx.Request.Header.Set("X-Forwarded-Proto", "spoofed")
+
+		req := &fasthttp.Request{}
+		ctx.Request.CopyTo(req)
+		setForwardedHeaders(req, ctx, false)
+
+		if got := string(req.Header.Peek("X-Forwarded-Proto")); got != proto {
+			t.Errorf("Expected X-Forwarded-Proto %s, got %s", proto, got)
+		}
+		if got := string(req.Header.Peek("X-Forwarded-Host")); got != "public.example.com" {
+			t.Errorf("Expected X-Forwarded-Host public.example.com, got %s", got)
+		}
+		if got := string(req.Header.Peek("X-Forwarded-For")); got != "10.0.0.1, "+ctx.RemoteAddr().String() {
+			t.Errorf("Expected the client to be appended to X-Forwarded-For, got %s", got)
+		}
+	}
+}
+
+func Test_ForwardedHeaders_Trusted(t *testing.T) {
+	ctx := forwardedCtx(false)
+	ctx.Request.Header.Set("X-Forwarded-Proto", "https")
+	ctx.Request.Header.Set("X-Forwarded-Host", "origin.example.com")
+
+	req := &fasthttp.Request{}
+	ctx.Request.CopyTo(req)
+	setForwardedHeaders(req, ctx, true)
+
+	if got := string(req.Header.Peek("X-Forwarded-Proto")); got != "https" {
+		t.Errorf("Expected X-Forwarded-Proto of the proxy to be kept, got %s", got)
+	}
+	if got := string(req.Header.Peek("X-Forwarded-Host")); got != "origin.example.com" {
+		t.Errorf("Expected X-Forwarded-Host of the proxy to be kept, got %s", got)
+	}
+}
+
+func Test_ReplacePrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix, replacement, expected string
+	}{
+		{"/api/users", "/api/", "/", "/users"},
+		{"/api/users", "/api", "/", "/users"},
+		{"/api/users/", "/api/", "/", "/users/"},
+		{"/api", "/api/", "/", "/"},
+		{"/api/", "/api", "/", "/"},
+		{"/api//users", "/api/", "/", "/users"},
+		{"/apis/users", "/api", "/", "/apis/users"},
+		{"/other", "/api/", "/", "/other"},
+		{"/api/users", "/api/", "/v2/", "/v2/users"},
+		{"/api/users", "/api/", "/v2", "/v2/users"},
+		{"/users", "/", "/v2/", "/v2/users"},
+	}
+	for _, tt := range tests {
+		if got := replacePrefix(tt.path, tt.prefix, tt.replacement); got != tt.expected {
+			t.Errorf("replacePrefix(%q, %q, %q): expected %q, got %q", tt.path, tt.prefix, tt.replacement, tt.expected, got)
+		}
+	}
+}
+
+func Test_StripPrefix(t *testing.T) {
+	r := newTestRoute(t, map[string]uint8{"a": 100})
+	a := backendByName(r, "a")
+	upstreamPath := func(path string) string {
+		uri := &fasthttp.URI{}
+		uri.SetPath(path)
+		r.formateURI(uri, a)
+		return string(uri.Path())
+	}
+
+	r.Prefix, r.Rewrite = "/api/", ""
+	if path := upstreamPath("/api/users"); path != "/api/users" {
+		t.Errorf("Expected the path to be unchanged by default, got %s", path)
+	}
+	r.StripPrefix = true
+	if path := upstreamPath("/api/users"); path != "/users" {
+		t.Errorf("Expected the prefix to be stripped, got %s", path)
+	}
+	if path := r.reversePath("/users"); path != "/api/users" {
+		t.Errorf("Expected the stripped prefix to be reversed, got %s", path)
+	}
+	r.Rewrite = "/v2/"
+	if path := upstreamPath("/api/users"); path != "/v2/users" {
+		t.Errorf("Expected the rest of the path to be appended to the rewrite, got %s", path)
+	}
+}
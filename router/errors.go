@@ -0,0 +1,66 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+)
+
+// codes of the errors of the router
+const (
+	ErrorNotFound         = "not_found"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorInternal         = "internal_error"
+)
+
+// ErrorResponse is the JSON envelope of an error response, e.g.
+// {"error":{"code":"not_found","message":"Not Found","request_id":"..."}}
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes the error of an ErrorResponse
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteJSONError replaces the body of the response with the JSON error envelope.
+// The headers of the response are kept
+func WriteJSONError(ctx *fasthttp.RequestCtx, status int, code, message, requestID string) {
+	b, err := json.Marshal(ErrorResponse{ErrorDetail{Code: code, Message: message, RequestID: requestID}})
+	if err != nil {
+		// cannot happen as the envelope only contains strings
+		b = []byte(fmt.Sprintf(`{"error":{"code":%q}}`, code))
+	}
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
+
+// UseJSONErrors replaces the ErrorHandler, NotFoundHandler and MethodNotAllowedHandler
+// of the router with handlers which respond with the JSON error envelope. The request
+// ID of the envelope is read from the first of the requestIDHeaders which is set
+func (r *Router) UseJSONErrors(requestIDHeaders ...string) {
+	requestID := func(ctx *fasthttp.RequestCtx) string {
+		for _, header := range requestIDHeaders {
+			if id := ctx.Request.Header.Peek(header); len(id) > 0 {
+				return string(id)
+			}
+		}
+		return ""
+	}
+	r.ErrorHandler = func(ctx *fasthttp.RequestCtx, e error) {
+		WriteJSONError(ctx, fasthttp.StatusInternalServerError, ErrorInternal, e.Error(), requestID(ctx))
+	}
+	r.NotFoundHandler = func(ctx *fasthttp.RequestCtx) {
+		WriteJSONError(ctx, fasthttp.StatusNotFound, ErrorNotFound,
+			fasthttp.StatusMessage(fasthttp.StatusNotFound), requestID(ctx))
+	}
+	r.MethodNotAllowedHandler = func(ctx *fasthttp.RequestCtx) {
+		WriteJSONError(ctx, fasthttp.StatusMethodNotAllowed, ErrorMethodNotAllowed,
+			fasthttp.StatusMessage(fasthttp.StatusMethodNotAllowed), requestID(ctx))
+	}
+}
@@ -0,0 +1,211 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// paramsKey is the key of the user value which contains the path parameters
+const paramsKey = "depoy.router.params"
+
+// paramHandle is a handle whose prefix contains named segments (e.g. /users/:id/orders)
+// or ends with a catch-all segment (e.g. /static/*filepath). Like all handles it
+// matches as a prefix of the request path. A catch-all captures the remainder of
+// the path including all slashes (which may be empty). The captured remainder is
+// not counted as matched for the precedence of handles. Therefore, a more specific
+// handle registered under the same subtree (e.g. /static/css/) wins over the
+// catch-all and a static handle with the same prefix (e.g. /static/) shadows it
+type paramHandle struct {
+	prefix string
+	static int // number of static characters of the prefix
+	handle *handle
+}
+
+// Params returns the path parameters of the request. If the matched handle
+// does not contain any parameter, an empty map is returned
+func Params(ctx *fasthttp.RequestCtx) map[string]string {
+	if params, ok := ctx.UserValue(paramsKey).(map[string]string); ok {
+		return params
+	}
+	return map[string]string{}
+}
+
+func hasParams(prefix string) bool {
+	return strings.Contains(prefix, "/:") || strings.Contains(prefix, "/*")
+}
+
+// newParamHandle validates the prefix and returns a new paramHandle without handler
+func newParamHandle(prefix string) (*paramHandle, error) {
+	names := make(map[string]bool)
+	static := 0
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] != ':' && prefix[i] != '*' {
+			static++
+			continue
+		}
+		if prefix[i-1] != '/' {
+			return nil, fmt.Errorf("Parameter must start a segment in prefix %s", prefix)
+		}
+		end := i + 1
+		for end < len(prefix) && prefix[end] != '/' {
+			end++
+		}
+		if prefix[i] == '*' && end != len(prefix) {
+			return nil, fmt.Errorf("Catch-all parameter must be the last segment in prefix %s", prefix)
+		}
+		name := prefix[i+1 : end]
+		if name == "" {
+			return nil, fmt.Errorf("Parameter name cannot be empty in prefix %s", prefix)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Parameter %s is defined more than once in prefix %s", name, prefix)
+		}
+		names[name] = true
+		i = end - 1
+	}
+	return &paramHandle{
+		prefix: prefix,
+		static: static,
+		handle: &handle{},
+	}, nil
+}
+
+// match checks if the prefix of the handle matches the path and returns
+// the number of matched characters of the path and the parameters.
+// If fold is set, the static characters of the path are compared case-insensitively
+// (the prefix is expected to be lowercase) while the parameters keep their casing
+func (h *paramHandle) match(path string, fold bool) (int, map[string]string, bool) {
+	var params map[string]string
+	i, j := 0, 0
+	for i < len(h.prefix) {
+		if h.prefix[i] == '*' {
+			// catch-all captures the remainder of the path
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[h.prefix[i+1:]] = path[j:]
+			return j, params, true
+		}
+		if h.prefix[i] == ':' {
+			end := i + 1
+			for end < len(h.prefix) && h.prefix[end] != '/' {
+				end++
+			}
+			start := j
+			for j < len(path) && path[j] != '/' {
+				j++
+			}
+			if j == start {
+				// segment of path is empty
+				return 0, nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[h.prefix[i+1:end]] = path[start:j]
+			i = end
+			continue
+		}
+		if j >= len(path) {
+			return 0, nil, false
+		}
+		if c := path[j]; h.prefix[i] != c && !(fold && h.prefix[i] == lowerASCII(c)) {
+			return 0, nil, false
+		}
+		i++
+		j++
+	}
+	return j, params, true
+}
+
+// lookup returns the handler of the method which matches the path and query best.
+// The longest match wins. If a static and a parameterized handle match the same
+// length, the static handle wins. Between parameterized handles, the one with
+// more static characters wins. A prefix whose handles do not match the query
+// is skipped. If no prefix matches, the regex handles are tried.
+// The caller must hold the lock of the router
+func (r *Router) lookup(method, path string, args *fasthttp.Args) (fasthttp.RequestHandler, map[string]string, bool) {
+	handler, params, _ := r.match(method, path, args)
+	if handler == nil {
+		handler, params = r.matchRegex(method, path)
+	}
+	return handler, params, handler != nil
+}
+
+// match returns the best handler of the method for the path and query and
+// the number of matched characters of the path (-1 if none matches)
+func (r *Router) match(method, path string, args *fasthttp.Args) (fasthttp.RequestHandler, map[string]string, int) {
+	var handler fasthttp.RequestHandler
+	var params map[string]string
+	length := -1
+
+	key := path
+	if r.CaseInsensitive {
+		key = lowerPath(path)
+	}
+	if tree, found := r.tree[method]; found {
+		// the prefixes are walked from the shortest to the longest
+		tree.WalkPath(key, func(prefix string, h interface{}) bool {
+			if resolved := h.(*handle).resolve(args); resolved != nil {
+				handler = resolved
+				length = len(prefix)
+			}
+			return false
+		})
+	}
+
+	best := -1 // static characters of the best parameterized handle
+	for _, h := range r.params[method] {
+		n, p, ok := h.match(path, r.CaseInsensitive)
+		if !ok || n < length {
+			continue
+		}
+		if n == length && (best < 0 || h.static <= best) {
+			// static handles and handles with more static characters win ties
+			continue
+		}
+		resolved := h.handle.resolve(args)
+		if resolved == nil {
+			continue
+		}
+		handler, params, length, best = resolved, p, n, h.static
+	}
+	return handler, params, length
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// lowerPath lowercases the ASCII letters of the path. Other characters
+// are kept so that the length of the path does not change
+func lowerPath(path string) string {
+	b := []byte(path)
+	for i := range b {
+		b[i] = lowerASCII(b[i])
+	}
+	return string(b)
+}
+
+// lowerPrefix lowercases the static segments of the prefix.
+// The names of parameters keep their casing
+func lowerPrefix(prefix string) string {
+	b := []byte(prefix)
+	param := false
+	for i := range b {
+		switch {
+		case b[i] == '/':
+			param = false
+		case (b[i] == ':' || b[i] == '*') && i > 0 && b[i-1] == '/':
+			param = true
+		case !param:
+			b[i] = lowerASCII(b[i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,152 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// handle is the entry of a prefix in the router. A request is dispatched to the
+// first query handle whose query matches. Otherwise the handler is used
+type handle struct {
+	handler fasthttp.RequestHandler // nil if the prefix only has query handles
+	queries []*queryHandle          // sorted by precedence
+}
+
+// queryHandle is a handle which requires the query parameters of the request
+// to match. A parameter with an empty value only needs to be present
+type queryHandle struct {
+	query   map[string]string
+	key     string // canonical form of the query
+	handler fasthttp.RequestHandler
+}
+
+// CanonicalQuery returns the query parameters sorted by key, e.g. a=1&b=2.
+// Query handles with the same canonical query conflict
+func CanonicalQuery(query map[string]string) string {
+	pairs := make([]string, 0, len(query))
+	for key, value := range query {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// matches checks if the request has all query parameters of the handle
+func (q *queryHandle) matches(args *fasthttp.Args) bool {
+	if args == nil {
+		return false
+	}
+	for key, value := range q.query {
+		if value == "" {
+			if !args.Has(key) {
+				return false
+			}
+			continue
+		}
+		if string(args.Peek(key)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the handler of the request. If neither a query handle matches
+// nor a handler without query exists, nil is returned
+func (h *handle) resolve(args *fasthttp.Args) fasthttp.RequestHandler {
+	for _, q := range h.queries {
+		if q.matches(args) {
+			return q.handler
+		}
+	}
+	return h.handler
+}
+
+// empty checks if the handle can be removed from the router
+func (h *handle) empty() bool {
+	return h.handler == nil && len(h.queries) == 0
+}
+
+// addQuery adds the query handle. The handles are sorted so that the handle with
+// more query parameters wins. Handles with the same number of parameters are
+// ordered by their canonical query
+func (h *handle) addQuery(q *queryHandle) error {
+	for _, existing := range h.queries {
+		if existing.key == q.key {
+			return fmt.Errorf("Handle already exists for query %s", q.key)
+		}
+	}
+	h.queries = append(h.queries, q)
+	sort.Slice(h.queries, func(i, j int) bool {
+		if len(h.queries[i].query) != len(h.queries[j].query) {
+			return len(h.queries[i].query) > len(h.queries[j].query)
+		}
+		return h.queries[i].key < h.queries[j].key
+	})
+	return nil
+}
+
+// HandleQuery registers the handler for requests of the method and prefix whose
+// query parameters match. Among the handles of the same prefix, the one with the
+// most matching parameters wins. If none matches, the handle without query is used.
+// Without query, HandleQuery is the same as Handle
+func (r *Router) HandleQuery(method, prefix string, query map[string]string, handler fasthttp.RequestHandler) error {
+	if len(query) == 0 {
+		return r.Handle(method, prefix, handler)
+	}
+	httpMethod := strings.ToUpper(method)
+	if err := validateHandle(httpMethod, prefix); err != nil {
+		return err
+	}
+	for key := range query {
+		if key == "" {
+			return fmt.Errorf("Query parameter cannot be empty")
+		}
+	}
+	prefix = r.normalizePrefix(prefix)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	h, err := r.getOrCreate(httpMethod, prefix)
+	if err != nil {
+		return err
+	}
+	q := &queryHandle{query: query, key: CanonicalQuery(query), handler: handler}
+	if err := h.addQuery(q); err != nil {
+		return fmt.Errorf("Handle already exists for method %s and prefix %s with query %s", httpMethod, prefix, q.key)
+	}
+	log.Debugf("Adding new Handle {Method:%s Prefix: %s Query: %s} to Router", httpMethod, prefix, q.key)
+	return nil
+}
+
+// RemoveQueryHandle removes the handle of the method and prefix with the query
+func (r *Router) RemoveQueryHandle(method, prefix string, query map[string]string) error {
+	if len(query) == 0 {
+		return r.RemoveHandle(method, prefix)
+	}
+	httpMethod := strings.ToUpper(method)
+	prefix = r.normalizePrefix(prefix)
+	key := CanonicalQuery(query)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	h := r.get(httpMethod, prefix)
+	if h == nil {
+		return fmt.Errorf("Handle does not exist")
+	}
+	for i, q := range h.queries {
+		if q.key == key {
+			h.queries = append(h.queries[:i], h.queries[i+1:]...)
+			if h.empty() {
+				return r.delete(httpMethod, prefix)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Handle does not exist")
+}
@@ -0,0 +1,94 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// regexHandle is a handle whose pattern is matched against the path of the request.
+// Regex handles are kept apart from the prefix tree and are only tried if no prefix
+// handle matches. Hence, they do not slow down the lookup of prefix handles
+type regexHandle struct {
+	pattern *regexp.Regexp
+	handler fasthttp.RequestHandler
+}
+
+// HandleRegex registers the handler for requests of the method whose path matches
+// the pattern. Regex handles are tried in the order of registration after no prefix
+// handle matched and the first match wins. Named groups (e.g. (?P<id>\d+)) are
+// captured as path parameters. The pattern is not anchored implicitly and it is
+// matched case-sensitively unless it sets the flag (?i)
+func (r *Router) HandleRegex(method string, pattern *regexp.Regexp, handler fasthttp.RequestHandler) error {
+	httpMethod := strings.ToUpper(method)
+	if httpMethod == "" {
+		return fmt.Errorf("Method cannot be empty")
+	}
+	if pattern == nil {
+		return fmt.Errorf("Pattern cannot be nil")
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, h := range r.regex[httpMethod] {
+		if h.pattern.String() == pattern.String() {
+			return fmt.Errorf("Handle already exists for method %s and pattern %s", httpMethod, pattern)
+		}
+	}
+	log.Debugf("Adding new Handle {Method:%s Pattern: %s} to Router", httpMethod, pattern)
+	r.regex[httpMethod] = append(r.regex[httpMethod], &regexHandle{pattern: pattern, handler: handler})
+	return nil
+}
+
+// RemoveRegexHandle removes the regex handle of the method and pattern
+func (r *Router) RemoveRegexHandle(method, pattern string) error {
+	httpMethod := strings.ToUpper(method)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for i, h := range r.regex[httpMethod] {
+		if h.pattern.String() == pattern {
+			r.regex[httpMethod] = append(r.regex[httpMethod][:i], r.regex[httpMethod][i+1:]...)
+			if len(r.regex[httpMethod]) == 0 {
+				delete(r.regex, httpMethod)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Handle does not exist")
+}
+
+// match checks if the pattern matches the path and returns the named groups
+func (h *regexHandle) match(path string) (map[string]string, bool) {
+	submatches := h.pattern.FindStringSubmatch(path)
+	if submatches == nil {
+		return nil, false
+	}
+	var params map[string]string
+	for i, name := range h.pattern.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = submatches[i]
+	}
+	return params, true
+}
+
+// matchRegex returns the handler of the first regex handle of the method which
+// matches the path. The caller must hold the lock of the router
+func (r *Router) matchRegex(method, path string) (fasthttp.RequestHandler, map[string]string) {
+	for _, h := range r.regex[method] {
+		if params, ok := h.match(path); ok {
+			return h.handler, params
+		}
+	}
+	return nil, nil
+}
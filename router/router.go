@@ -2,7 +2,11 @@ package router
 
 import (
 	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/valyala/fasthttp"
 
@@ -19,83 +23,204 @@ func defaultNotFoundHandler(ctx *fasthttp.RequestCtx) {
 	ctx.Response.SetStatusCode(404)
 }
 
+func defaultMethodNotAllowedHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.SetStatusCode(405)
+}
+
+// Router dispatches requests to the handle with the longest matching prefix.
+// If no prefix matches, the regex handles are tried in order of registration.
+// If the path matches under other methods only, the MethodNotAllowedHandler is
+// called with the Allow header set. Otherwise the NotFoundHandler is called
 type Router struct {
-	tree            map[string]*radix.Tree
-	ErrorHandler    func(ctx *fasthttp.RequestCtx, e error)
-	NotFoundHandler func(ctx *fasthttp.RequestCtx)
+	mux                     sync.RWMutex // guards tree, params and regex
+	tree                    map[string]*radix.Tree
+	params                  map[string][]*paramHandle // handles with path parameters by method
+	regex                   map[string][]*regexHandle // regex handles by method in order of registration
+	ErrorHandler            func(ctx *fasthttp.RequestCtx, e error)
+	NotFoundHandler         func(ctx *fasthttp.RequestCtx)
+	MethodNotAllowedHandler func(ctx *fasthttp.RequestCtx)
+	// AutoHEAD answers HEAD requests with the GET handle of the path if no
+	// HEAD handle exists. The body of the response is discarded
+	AutoHEAD bool
+	// AutoOPTIONS answers OPTIONS requests with 204 and an Allow header which
+	// lists the allowed methods of the path if no OPTIONS handle exists
+	AutoOPTIONS bool
+	// CaseInsensitive matches the path of requests case-insensitively (ASCII only).
+	// Prefixes of handles are lowercased on registration, hence it must be set before
+	// any handle is registered. Path parameters keep the casing of the request.
+	// It only applies to the path and not to the query string
+	CaseInsensitive bool
+	middleware      []func(fasthttp.RequestHandler) fasthttp.RequestHandler
 }
 
 func NewRouter() *Router {
 	return &Router{
-		tree:            make(map[string]*radix.Tree),
-		ErrorHandler:    defaultErrorHandler,
-		NotFoundHandler: defaultNotFoundHandler,
+		tree:                    make(map[string]*radix.Tree),
+		params:                  make(map[string][]*paramHandle),
+		regex:                   make(map[string][]*regexHandle),
+		ErrorHandler:            defaultErrorHandler,
+		NotFoundHandler:         defaultNotFoundHandler,
+		MethodNotAllowedHandler: defaultMethodNotAllowedHandler,
 	}
 }
 
 func (r *Router) CheckIfHandleExists(method, prefix string) (bool, error) {
-	var err error
+	if err := validateHandle(method, prefix); err != nil {
+		return false, err
+	}
+	prefix = r.normalizePrefix(prefix)
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.exists(method, prefix) {
+		// handle already exists with this method
+		return true, fmt.Errorf("Handle already exists for method %s and prefix %s", method, prefix)
+	}
+	// Handle does not exist
+	return false, nil
+}
 
+func validateHandle(method, prefix string) error {
 	// method cannot be empty
 	if method == "" {
-		err = fmt.Errorf("Method cannot be empty")
+		return fmt.Errorf("Method cannot be empty")
 	}
 	// Prefix needs to be not empty and start with a /
 	if prefix == "" || string(prefix[0]) != "/" {
-		err = fmt.Errorf("Prefix cannot be empty and must start with a \"/\"")
+		return fmt.Errorf("Prefix cannot be empty and must start with a \"/\"")
 	}
-	if err != nil {
-		return false, err
+	return nil
+}
+
+// normalizePrefix lowercases the prefix if the router is case-insensitive
+func (r *Router) normalizePrefix(prefix string) string {
+	if r.CaseInsensitive {
+		return lowerPrefix(prefix)
 	}
+	return prefix
+}
+
+// exists checks if a handle without query exists for the method and prefix.
+// The caller must hold the lock of the router
+func (r *Router) exists(method, prefix string) bool {
+	h := r.get(method, prefix)
+	return h != nil && h.handler != nil
+}
+
+// get returns the handle of the method and prefix or nil.
+// The caller must hold the lock of the router
+func (r *Router) get(method, prefix string) *handle {
+	if tree, found := r.tree[method]; found {
+		if h, exists := tree.Get(prefix); exists {
+			return h.(*handle)
+		}
+	}
+	for _, h := range r.params[method] {
+		if h.prefix == prefix {
+			return h.handle
+		}
+	}
+	return nil
+}
 
+// getOrCreate returns the handle of the method and prefix. If it does not exist,
+// an empty handle is added. The caller must hold the lock of the router
+func (r *Router) getOrCreate(method, prefix string) (*handle, error) {
+	if h := r.get(method, prefix); h != nil {
+		return h, nil
+	}
 	// if no tree exists with given method, initialize it
 	if r.tree[method] == nil {
 		r.tree[method] = radix.New()
-
-		// if no tree existed, no handle can exist for it
-		return false, nil
 	}
+	if hasParams(prefix) {
+		h, err := newParamHandle(prefix)
+		if err != nil {
+			return nil, err
+		}
+		r.params[method] = append(r.params[method], h)
+		return h.handle, nil
+	}
+	h := &handle{}
+	if _, updated := r.tree[method].Insert(prefix, h); updated {
+		return nil, fmt.Errorf("Updated an entry")
+	}
+	return h, nil
+}
 
-	if _, exists := r.tree[method].Get(prefix); exists {
-		// handle already exists with this method
-		return true, fmt.Errorf("Handle already exists for method %s and prefix %s", method, prefix)
+// delete removes the handle of the method and prefix.
+// The caller must hold the lock of the router
+func (r *Router) delete(method, prefix string) error {
+	for i, h := range r.params[method] {
+		if h.prefix == prefix {
+			r.params[method] = append(r.params[method][:i], r.params[method][i+1:]...)
+			return nil
+		}
 	}
-	// Handle does not exist
-	return false, nil
+	if _, deleted := r.tree[method].Delete(prefix); !deleted {
+		return fmt.Errorf("Could not delete handle")
+	}
+	return nil
 }
 
 func (r *Router) Handle(method, prefix string, handler fasthttp.RequestHandler) error {
-	var err error
 	httpMethod := strings.ToUpper(method)
-	// check if the prefix & method combination already exists
-	_, err = r.CheckIfHandleExists(httpMethod, prefix)
-	if err != nil {
+	if err := validateHandle(httpMethod, prefix); err != nil {
 		return err
 	}
+	prefix = r.normalizePrefix(prefix)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// check if the prefix & method combination already exists
+	if r.exists(httpMethod, prefix) {
+		return fmt.Errorf("Handle already exists for method %s and prefix %s", httpMethod, prefix)
+	}
+
 	log.Debugf("Adding new Handle {Method:%s Prefix: %s} to Router", httpMethod, prefix)
-	if _, updated := r.tree[httpMethod].Insert(prefix, handler); updated {
-		return fmt.Errorf("Updated an entry")
+	h, err := r.getOrCreate(httpMethod, prefix)
+	if err != nil {
+		return err
 	}
+	h.handler = handler
 	return nil
 }
 
+// RemoveHandle removes the handle without query of the method and prefix.
+// Query handles of the prefix are kept
 func (r *Router) RemoveHandle(method, prefix string) error {
-	var err error
 	httpMethod := strings.ToUpper(method)
-	// check if the prefix & method combination already exists
-	_, err = r.CheckIfHandleExists(httpMethod, prefix)
-	if err == nil {
+	prefix = r.normalizePrefix(prefix)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// check if the prefix & method combination exists
+	if !r.exists(httpMethod, prefix) {
 		return fmt.Errorf("Handle does not exist")
 	}
-
-	if _, deleted := r.tree[httpMethod].Delete(prefix); !deleted {
-		return fmt.Errorf("Could not delete handle")
+	h := r.get(httpMethod, prefix)
+	h.handler = nil
+	if h.empty() {
+		return r.delete(httpMethod, prefix)
 	}
-
-	// delete successful
 	return nil
 }
 
+// Use registers a middleware which wraps the dispatched handler of all requests.
+// Middleware are applied in the order of registration (the first registered
+// is the outermost). They also wrap the NotFoundHandler, the MethodNotAllowedHandler
+// and automatic HEAD/OPTIONS responses. Panics are propagated through the middleware
+// and are handled by the ErrorHandler outside of the chain
+func (r *Router) Use(mw func(fasthttp.RequestHandler) fasthttp.RequestHandler) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.middleware = append(r.middleware, mw)
+}
+
 func (r *Router) ServeHTTP(ctx *fasthttp.RequestCtx) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -103,12 +228,199 @@ func (r *Router) ServeHTTP(ctx *fasthttp.RequestCtx) {
 			r.ErrorHandler(ctx, err.(error))
 		}
 	}()
+
+	r.mux.RLock()
+	middleware := r.middleware
+	r.mux.RUnlock()
+
+	handler := fasthttp.RequestHandler(r.dispatch)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	handler(ctx)
+}
+
+// dispatch invokes the matched handler of the request or one of
+// the handlers for OPTIONS, not allowed methods and unknown paths
+func (r *Router) dispatch(ctx *fasthttp.RequestCtx) {
 	method := string(ctx.Method())
-	if _, found := r.tree[method]; found {
-		if _, h, found := r.tree[method].LongestPrefix(string(ctx.URI().Path())); found {
-			h.(fasthttp.RequestHandler)(ctx)
-			return
+	path := string(ctx.URI().Path())
+	args := ctx.QueryArgs()
+
+	// the lock is released before the handler is invoked
+	r.mux.RLock()
+	h, params, found := r.lookup(method, path, args)
+	autoHead := false
+	if !found && r.AutoHEAD && method == fasthttp.MethodHead {
+		h, params, found = r.lookup(fasthttp.MethodGet, path, args)
+		autoHead = found
+	}
+	var allowed []string
+	if !found {
+		allowed = r.allowedMethods(path, args)
+	}
+	r.mux.RUnlock()
+
+	if len(allowed) > 0 && r.AutoOPTIONS && method == fasthttp.MethodOptions {
+		ctx.Response.Header.Set("Allow", strings.Join(allowed, ", "))
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	if found {
+		if params != nil {
+			ctx.SetUserValue(paramsKey, params)
 		}
+		h(ctx)
+		if autoHead {
+			// keep the headers (including Content-Length) but discard the body
+			ctx.Response.Header.SetContentLength(len(ctx.Response.Body()))
+			ctx.Response.SkipBody = true
+		}
+		return
+	}
+	// the path is unknown for the method (or the method has no handles at all).
+	// If the path exists for any other method, the method is not allowed
+	if len(allowed) > 0 {
+		ctx.Response.Header.Set("Allow", strings.Join(allowed, ", "))
+		r.MethodNotAllowedHandler(ctx)
+		return
 	}
 	r.NotFoundHandler(ctx)
 }
+
+// RouteEntry describes a handle which is registered in the router
+type RouteEntry struct {
+	Method  string `json:"method"`
+	Prefix  string `json:"prefix"`          // prefix or pattern of a regex handle
+	Query   string `json:"query,omitempty"` // canonical query of a query handle
+	Regex   bool   `json:"regex,omitempty"` // the prefix is the pattern of a regex handle
+	Handler string `json:"handler"`         // name of the handler function
+}
+
+// entries returns the route entries of the handle
+func (h *handle) entries(method, prefix string) []RouteEntry {
+	entries := []RouteEntry{}
+	if h.handler != nil {
+		entries = append(entries, RouteEntry{
+			Method:  method,
+			Prefix:  prefix,
+			Handler: handlerName(h.handler),
+		})
+	}
+	for _, q := range h.queries {
+		entries = append(entries, RouteEntry{
+			Method:  method,
+			Prefix:  prefix,
+			Query:   q.key,
+			Handler: handlerName(q.handler),
+		})
+	}
+	return entries
+}
+
+// Routes returns a snapshot of all registered handles sorted by prefix and method
+func (r *Router) Routes() []RouteEntry {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	entries := []RouteEntry{}
+	for method, tree := range r.tree {
+		tree.Walk(func(prefix string, h interface{}) bool {
+			entries = append(entries, h.(*handle).entries(method, prefix)...)
+			return false
+		})
+	}
+	for method, handles := range r.params {
+		for _, h := range handles {
+			entries = append(entries, h.handle.entries(method, h.prefix)...)
+		}
+	}
+	for method, handles := range r.regex {
+		for _, h := range handles {
+			entries = append(entries, RouteEntry{
+				Method:  method,
+				Prefix:  h.pattern.String(),
+				Regex:   true,
+				Handler: handlerName(h.handler),
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Prefix != entries[j].Prefix {
+			return entries[i].Prefix < entries[j].Prefix
+		}
+		if entries[i].Method != entries[j].Method {
+			return entries[i].Method < entries[j].Method
+		}
+		return entries[i].Query < entries[j].Query
+	})
+	return entries
+}
+
+func handlerName(h fasthttp.RequestHandler) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
+// AllowedMethods returns the sorted methods which have a handle for the
+// longest matching prefix of the path (or a matching regex handle if no prefix
+// matches). If AutoHEAD or AutoOPTIONS are enabled,
+// HEAD and OPTIONS are included accordingly. Query handles are not considered
+func (r *Router) AllowedMethods(path string) []string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.allowedMethods(path, nil)
+}
+
+// allowedMethods returns the allowed methods of the path and query.
+// The caller must hold the lock of the router
+func (r *Router) allowedMethods(path string, args *fasthttp.Args) []string {
+	allowed := []string{}
+	longest := -1
+	for method := range r.tree {
+		_, _, length := r.match(method, path, args)
+		if length < 0 || length < longest {
+			continue
+		}
+		if length > longest {
+			allowed = allowed[:0]
+			longest = length
+		}
+		allowed = append(allowed, method)
+	}
+	if len(allowed) == 0 {
+		// regex handles are only considered if no prefix matches
+		for method, handles := range r.regex {
+			for _, h := range handles {
+				if _, ok := h.match(path); ok {
+					allowed = append(allowed, method)
+					break
+				}
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return allowed
+	}
+
+	contains := func(method string) bool {
+		for _, m := range allowed {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+	if r.AutoHEAD && contains(fasthttp.MethodGet) && !contains(fasthttp.MethodHead) {
+		allowed = append(allowed, fasthttp.MethodHead)
+	}
+	if r.AutoOPTIONS && !contains(fasthttp.MethodOptions) {
+		allowed = append(allowed, fasthttp.MethodOptions)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
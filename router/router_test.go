@@ -1,6 +1,11 @@
 package router
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/valyala/fasthttp"
@@ -82,3 +87,645 @@ func Test_DeleteHandle(t *testing.T) {
 		t.Errorf("Removing non-existing handle did not return error")
 	}
 }
+
+func serve(r *Router, method, path string) int {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	r.ServeHTTP(ctx)
+	return ctx.Response.StatusCode()
+}
+
+func Test_NotFoundAndMethodNotAllowed(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/hello", testHandle)
+	r.Handle("POST", "/world", testHandle)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/hello", 200},          // path exists for method
+		{"POST", "/hello", 405},         // path exists under other method
+		{"PATCH", "/hello", 405},        // method unregistered, path exists elsewhere
+		{"GET", "/unknown", 404},        // path does not exist anywhere
+		{"PATCH", "/unknown", 404},      // method unregistered, path does not exist
+		{"GET", "/world/subpath", 405},  // prefix exists under other method
+		{"POST", "/world/subpath", 200}, // prefix exists for method
+	}
+	for _, tt := range tests {
+		if got := serve(r, tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s returned %d, expected %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func Test_MethodNotAllowedAllowHeader(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/api/users", testHandle)
+	r.Handle("PUT", "/api/users", testHandle)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/api/users")
+	r.ServeHTTP(ctx)
+	if ctx.Response.StatusCode() != 405 {
+		t.Errorf("Expected 405, got %d", ctx.Response.StatusCode())
+	}
+	if allow := string(ctx.Response.Header.Peek("Allow")); allow != "GET, PUT" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/unknown")
+	r.ServeHTTP(ctx)
+	if ctx.Response.StatusCode() != 404 {
+		t.Errorf("Expected 404, got %d", ctx.Response.StatusCode())
+	}
+	if allow := ctx.Response.Header.Peek("Allow"); len(allow) > 0 {
+		t.Errorf("Expected no Allow header for unknown path, got %q", allow)
+	}
+}
+
+func Test_MethodNotAllowedAfterRemove(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/hello", testHandle)
+	r.Handle("POST", "/hello", testHandle)
+	r.RemoveHandle("POST", "/hello")
+
+	if got := serve(r, "POST", "/hello"); got != 405 {
+		t.Errorf("Expected 405 for removed method, got %d", got)
+	}
+	r.RemoveHandle("GET", "/hello")
+	if got := serve(r, "POST", "/hello"); got != 404 {
+		t.Errorf("Expected 404 for removed path, got %d", got)
+	}
+}
+
+func Test_PathParams(t *testing.T) {
+	var params map[string]string
+	r := NewRouter()
+	r.Handle("GET", "/users/:id/orders", func(ctx *fasthttp.RequestCtx) {
+		params = Params(ctx)
+		ctx.SetStatusCode(200)
+	})
+
+	if got := serve(r, "GET", "/users/42/orders"); got != 200 {
+		t.Fatalf("Expected 200, got %d", got)
+	}
+	if params["id"] != "42" {
+		t.Errorf("Expected parameter id to be 42, got %q", params["id"])
+	}
+	if got := serve(r, "GET", "/users//orders"); got != 404 {
+		t.Errorf("Expected 404 for empty parameter, got %d", got)
+	}
+	if got := serve(r, "GET", "/users/42/invoices"); got != 404 {
+		t.Errorf("Expected 404 for unknown path, got %d", got)
+	}
+}
+
+func Test_StaticBeforeParam(t *testing.T) {
+	var matched string
+	r := NewRouter()
+	r.Handle("GET", "/a/:x/b", func(ctx *fasthttp.RequestCtx) {
+		matched = "param:" + Params(ctx)["x"]
+	})
+	r.Handle("GET", "/a/static/b", func(ctx *fasthttp.RequestCtx) {
+		matched = "static"
+	})
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/a/static/b", "static"},
+		{"/a/other/b", "param:other"},
+		{"/a/static/b/c", "static"}, // prefix matching still applies
+		{"/a/statics/b", "param:statics"},
+	}
+	for _, tt := range tests {
+		matched = ""
+		serve(r, "GET", tt.path)
+		if matched != tt.want {
+			t.Errorf("%s matched %q, expected %q", tt.path, matched, tt.want)
+		}
+	}
+}
+
+func Test_PrefixRoutesUnchanged(t *testing.T) {
+	var matched string
+	r := NewRouter()
+	r.Handle("GET", "/", func(ctx *fasthttp.RequestCtx) { matched = "/" })
+	r.Handle("GET", "/api/", func(ctx *fasthttp.RequestCtx) { matched = "/api/" })
+	r.Handle("GET", "/api/:version/users", func(ctx *fasthttp.RequestCtx) { matched = "users" })
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "/"},
+		{"/other", "/"},
+		{"/api/", "/api/"},
+		{"/api/v1", "/api/"},
+		{"/api/v1/users/1", "users"},
+	}
+	for _, tt := range tests {
+		matched = ""
+		serve(r, "GET", tt.path)
+		if matched != tt.want {
+			t.Errorf("%s matched %q, expected %q", tt.path, matched, tt.want)
+		}
+	}
+	if Params(&fasthttp.RequestCtx{})["version"] != "" {
+		t.Errorf("Expected no parameters without a match")
+	}
+}
+
+func Test_InvalidParams(t *testing.T) {
+	r := NewRouter()
+	if err := r.Handle("GET", "/users/:", testHandle); err == nil {
+		t.Errorf("Expected error for empty parameter name")
+	}
+	if err := r.Handle("GET", "/users/:id/:id", testHandle); err == nil {
+		t.Errorf("Expected error for duplicate parameter name")
+	}
+	if err := r.Handle("GET", "/users/:id", testHandle); err != nil {
+		t.Errorf("Unable to insert handle with parameter")
+	}
+	if err := r.Handle("GET", "/users/:id", testHandle); err == nil {
+		t.Errorf("Inserted an already existing handle with parameter")
+	}
+	if err := r.RemoveHandle("GET", "/users/:id"); err != nil {
+		t.Errorf("Unable to delete existing handle with parameter")
+	}
+}
+
+func Test_CatchAll(t *testing.T) {
+	var matched string
+	r := NewRouter()
+	r.Handle("GET", "/static/*filepath", func(ctx *fasthttp.RequestCtx) {
+		matched = "catchall:" + Params(ctx)["filepath"]
+	})
+	r.Handle("GET", "/static/css/", func(ctx *fasthttp.RequestCtx) {
+		matched = "css"
+	})
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/static/css/app/v2/main.css", "css"}, // more specific static handle wins
+		{"/static/js/app/v2/main.js", "catchall:js/app/v2/main.js"},
+		{"/static/", "catchall:"},
+		{"/static", ""},
+	}
+	for _, tt := range tests {
+		matched = ""
+		serve(r, "GET", tt.path)
+		if matched != tt.want {
+			t.Errorf("%s matched %q, expected %q", tt.path, matched, tt.want)
+		}
+	}
+
+	if err := r.Handle("GET", "/files/*filepath/more", testHandle); err == nil {
+		t.Errorf("Expected error for catch-all which is not the last segment")
+	}
+}
+
+func Test_ConcurrentHandleAndServe(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/", testHandle)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			prefix := fmt.Sprintf("/route%d/", i)
+			r.Handle("GET", prefix, testHandle)
+			r.Handle("POST", fmt.Sprintf("/route%d/:id", i), testHandle)
+			if i%2 == 0 {
+				r.RemoveHandle("GET", prefix)
+			}
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 200; i++ {
+		if got := serve(r, "GET", fmt.Sprintf("/route%d/", i)); got != 200 {
+			t.Errorf("Expected 200, got %d", got)
+		}
+		r.CheckIfHandleExists("GET", fmt.Sprintf("/route%d/", i))
+	}
+	<-done
+}
+
+func Test_AutoHEAD(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/health", func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Health", "ok")
+		ctx.SetStatusCode(200)
+		ctx.SetBodyString("healthy")
+	})
+	r.Handle("GET", "/explicit", testHandle)
+	r.Handle("HEAD", "/explicit", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(204)
+	})
+
+	if got := serve(r, "HEAD", "/health"); got != 405 {
+		t.Errorf("Expected 405 without AutoHEAD, got %d", got)
+	}
+
+	r.AutoHEAD = true
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("HEAD")
+	ctx.Request.SetRequestURI("/health")
+	r.ServeHTTP(ctx)
+
+	resp := &fasthttp.Response{SkipBody: true}
+	if err := resp.Read(bufio.NewReader(strings.NewReader(ctx.Response.String()))); err != nil {
+		t.Fatalf("Unable to read response: %v", err)
+	}
+	if resp.StatusCode() != 200 {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode())
+	}
+	if string(resp.Header.Peek("X-Health")) != "ok" {
+		t.Errorf("Expected header of GET handle to be set")
+	}
+	if resp.Header.ContentLength() != len("healthy") {
+		t.Errorf("Expected Content-Length %d, got %d", len("healthy"), resp.Header.ContentLength())
+	}
+	if strings.Contains(ctx.Response.String(), "healthy") {
+		t.Errorf("Expected body to be discarded")
+	}
+
+	if got := serve(r, "HEAD", "/explicit"); got != 204 {
+		t.Errorf("Expected explicit HEAD handle to be used, got %d", got)
+	}
+}
+
+func Test_AutoOPTIONS(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/", testHandle)
+	r.Handle("GET", "/api/users", testHandle)
+	r.Handle("POST", "/api/users", testHandle)
+	r.Handle("DELETE", "/api/", testHandle)
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/api/users", []string{"GET", "POST"}},
+		{"/api/users/1", []string{"GET", "POST"}}, // longest matching prefix is /api/users
+		{"/api/other", []string{"DELETE"}},
+		{"/other", []string{"GET"}},
+	}
+	for _, tt := range tests {
+		if got := r.AllowedMethods(tt.path); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("AllowedMethods(%s) returned %v, expected %v", tt.path, got, tt.want)
+		}
+	}
+
+	if got := serve(r, "OPTIONS", "/api/users"); got != 405 {
+		t.Errorf("Expected 405 without AutoOPTIONS, got %d", got)
+	}
+
+	r.AutoOPTIONS = true
+	r.AutoHEAD = true
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("OPTIONS")
+	ctx.Request.SetRequestURI("/api/users")
+	r.ServeHTTP(ctx)
+	if ctx.Response.StatusCode() != 204 {
+		t.Errorf("Expected 204, got %d", ctx.Response.StatusCode())
+	}
+	if allow := string(ctx.Response.Header.Peek("Allow")); allow != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+
+	empty := NewRouter()
+	empty.AutoOPTIONS = true
+	if got := serve(empty, "OPTIONS", "/unknown"); got != 404 {
+		t.Errorf("Expected 404 for unknown path, got %d", got)
+	}
+}
+
+func Test_Routes(t *testing.T) {
+	r := NewRouter()
+	r.Handle("POST", "/api/users", testHandle)
+	r.Handle("GET", "/api/users", testHandle)
+	r.Handle("GET", "/api/users/:id", testHandle)
+	r.Handle("GET", "/", testHandle)
+
+	want := []RouteEntry{
+		{Method: "GET", Prefix: "/"},
+		{Method: "GET", Prefix: "/api/users"},
+		{Method: "POST", Prefix: "/api/users"},
+		{Method: "GET", Prefix: "/api/users/:id"},
+	}
+	got := r.Routes()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d routes, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Method != want[i].Method || got[i].Prefix != want[i].Prefix {
+			t.Errorf("Route %d is %v, expected %v", i, got[i], want[i])
+		}
+		if !strings.HasSuffix(got[i].Handler, "router.testHandle") {
+			t.Errorf("Unexpected handler name %s", got[i].Handler)
+		}
+	}
+}
+
+func Test_MiddlewareOrder(t *testing.T) {
+	var calls []string
+	mw := func(name string) func(fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+			return func(ctx *fasthttp.RequestCtx) {
+				calls = append(calls, name+":before")
+				next(ctx)
+				calls = append(calls, name+":after")
+			}
+		}
+	}
+	r := NewRouter()
+	r.Handle("GET", "/hello", func(ctx *fasthttp.RequestCtx) {
+		calls = append(calls, "handler")
+	})
+	r.Use(mw("first"))
+	r.Use(mw("second"))
+
+	serve(r, "GET", "/hello")
+	want := "first:before,second:before,handler,second:after,first:after"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("Middleware called in order %s, expected %s", got, want)
+	}
+
+	// middleware also wraps unknown paths and not allowed methods
+	calls = nil
+	if got := serve(r, "GET", "/unknown"); got != 404 {
+		t.Errorf("Expected 404, got %d", got)
+	}
+	if got := strings.Join(calls, ","); got != "first:before,second:before,second:after,first:after" {
+		t.Errorf("Middleware was not applied to not-found path: %s", got)
+	}
+	calls = nil
+	if got := serve(r, "POST", "/hello"); got != 405 {
+		t.Errorf("Expected 405, got %d", got)
+	}
+	if len(calls) != 4 {
+		t.Errorf("Middleware was not applied to not allowed method: %v", calls)
+	}
+}
+
+func Test_CaseInsensitive(t *testing.T) {
+	var matched string
+	r := NewRouter()
+	r.CaseInsensitive = true
+	r.Handle("GET", "/API/Users", func(ctx *fasthttp.RequestCtx) { matched = "users" })
+	r.Handle("GET", "/api/Orders/:orderID", func(ctx *fasthttp.RequestCtx) {
+		matched = "order:" + Params(ctx)["orderID"]
+	})
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/api/users", "users"},
+		{"/API/USERS", "users"},
+		{"/Api/Orders/AbC-1", "order:AbC-1"}, // parameters keep the casing of the request
+		{"/api/orders/abc-1", "order:abc-1"},
+	}
+	for _, tt := range tests {
+		matched = ""
+		serve(r, "GET", tt.path)
+		if matched != tt.want {
+			t.Errorf("%s matched %q, expected %q", tt.path, matched, tt.want)
+		}
+	}
+
+	if exists, _ := r.CheckIfHandleExists("GET", "/api/USERS"); !exists {
+		t.Errorf("Expected handle to exist case-insensitively")
+	}
+	if err := r.Handle("GET", "/Api/users", testHandle); err == nil {
+		t.Errorf("Inserted a handle which already exists case-insensitively")
+	}
+	if err := r.RemoveHandle("GET", "/api/users"); err != nil {
+		t.Errorf("Unable to remove handle case-insensitively")
+	}
+
+	sensitive := NewRouter()
+	sensitive.Handle("GET", "/API/Users", testHandle)
+	if got := serve(sensitive, "GET", "/api/users"); got != 404 {
+		t.Errorf("Expected case-sensitive router to return 404, got %d", got)
+	}
+}
+
+// statusHandle answers with the status
+func statusHandle(status int) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(status)
+	}
+}
+
+func Test_QueryHandle(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/search", statusHandle(200))
+	r.HandleQuery("GET", "/search", map[string]string{"mode": "fast"}, statusHandle(201))
+	r.HandleQuery("GET", "/search", map[string]string{"mode": "thorough"}, statusHandle(202))
+	r.HandleQuery("GET", "/search", map[string]string{"mode": "fast", "debug": ""}, statusHandle(203))
+	r.HandleQuery("GET", "/search/:index", map[string]string{"mode": "fast"}, statusHandle(204))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/search?mode=fast", 201},
+		{"/search?mode=thorough&page=2", 202},
+		{"/search?mode=fast&debug", 203},     // more specific param set wins
+		{"/search?mode=fast&debug=1", 203},   // empty value only requires presence
+		{"/search?mode=slow", 200},           // falls back to the handle without query
+		{"/search", 200},                     // falls back to the handle without query
+		{"/search/books?mode=fast", 204},     // query handles of parameterized prefixes
+		{"/search/books?mode=thorough", 202}, // falls back to the shorter prefix
+		{"/search/books", 200},
+	}
+	for _, tt := range tests {
+		if got := serve(r, "GET", tt.path); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.want, got)
+		}
+	}
+}
+
+func Test_QueryHandle_WithoutFallback(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/", statusHandle(200))
+	r.HandleQuery("GET", "/search", map[string]string{"mode": "fast"}, statusHandle(201))
+
+	if got := serve(r, "GET", "/search?mode=fast"); got != 201 {
+		t.Errorf("Expected the query handle, got %d", got)
+	}
+	if got := serve(r, "GET", "/search?mode=slow"); got != 200 {
+		t.Errorf("Expected the shorter prefix without a matching query, got %d", got)
+	}
+	if got := serve(r, "POST", "/search?mode=fast"); got != 405 {
+		t.Errorf("Expected 405 for another method, got %d", got)
+	}
+
+	// the handle without query can be added later and removed independently
+	if err := r.Handle("GET", "/search", statusHandle(202)); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve(r, "GET", "/search?mode=slow"); got != 202 {
+		t.Errorf("Expected the handle without query, got %d", got)
+	}
+	if err := r.RemoveHandle("GET", "/search"); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve(r, "GET", "/search?mode=fast"); got != 201 {
+		t.Errorf("Expected the query handle to be kept, got %d", got)
+	}
+	if err := r.RemoveQueryHandle("GET", "/search", map[string]string{"mode": "fast"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve(r, "GET", "/search?mode=fast"); got != 200 {
+		t.Errorf("Expected the query handle to be removed, got %d", got)
+	}
+}
+
+func Test_QueryHandle_Conflict(t *testing.T) {
+	r := NewRouter()
+	if err := r.HandleQuery("GET", "/search", map[string]string{"mode": "fast", "page": "1"}, testHandle); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HandleQuery("get", "/search", map[string]string{"page": "1", "mode": "fast"}, testHandle); err == nil {
+		t.Error("Expected the same query to conflict")
+	}
+	if err := r.HandleQuery("GET", "/search", map[string]string{"mode": "fast"}, testHandle); err != nil {
+		t.Errorf("Expected a different query to be allowed: %v", err)
+	}
+	if err := r.HandleQuery("POST", "/search", map[string]string{"mode": "fast", "page": "1"}, testHandle); err != nil {
+		t.Errorf("Expected the same query of another method to be allowed: %v", err)
+	}
+	if err := r.HandleQuery("GET", "/search", map[string]string{"": "fast"}, testHandle); err == nil {
+		t.Error("Expected an empty parameter to be rejected")
+	}
+
+	routes := r.Routes()
+	if len(routes) != 3 || routes[0].Query != "mode=fast" || routes[1].Query != "mode=fast&page=1" {
+		t.Errorf("Expected the query handles in the routes, got %+v", routes)
+	}
+}
+
+func Test_RegexHandle(t *testing.T) {
+	var params map[string]string
+	r := NewRouter()
+	r.Handle("GET", "/users/admin", statusHandle(200))
+	r.HandleRegex("GET", regexp.MustCompile(`^/users/(?P<id>\d+)/profile$`), func(ctx *fasthttp.RequestCtx) {
+		params = Params(ctx)
+		ctx.SetStatusCode(201)
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/users/42/profile", 201},
+		{"/users/admin", 200},         // prefix handles are matched first
+		{"/users/abc/profile", 404},   // not numeric
+		{"/users/42/profile/x", 404},  // anchored pattern
+		{"/users/admin/profile", 200}, // prefix match wins over the pattern
+	}
+	for _, tt := range tests {
+		if got := serve(r, "GET", tt.path); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.want, got)
+		}
+	}
+	serve(r, "GET", "/users/42/profile")
+	if params["id"] != "42" {
+		t.Errorf("Expected the named group id to be 42, got %v", params)
+	}
+	if got := serve(r, "POST", "/users/42/profile"); got != 405 {
+		t.Errorf("Expected 405 for another method, got %d", got)
+	}
+
+	if err := r.HandleRegex("get", regexp.MustCompile(`^/users/(?P<id>\d+)/profile$`), testHandle); err == nil {
+		t.Error("Expected the same pattern to conflict")
+	}
+	if err := r.RemoveRegexHandle("GET", `^/users/(?P<id>\d+)/profile$`); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve(r, "GET", "/users/42/profile"); got != 404 {
+		t.Errorf("Expected the regex handle to be removed, got %d", got)
+	}
+}
+
+func Test_RegexHandle_Overlapping(t *testing.T) {
+	r := NewRouter()
+	r.HandleRegex("GET", regexp.MustCompile(`^/files/.+\.png$`), statusHandle(201))
+	r.HandleRegex("GET", regexp.MustCompile(`^/files/(?P<name>[^/]+)$`), statusHandle(202))
+	r.HandleRegex("GET", regexp.MustCompile(`^/files/`), statusHandle(203))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/files/logo.png", 201},  // matches all patterns, the first registered wins
+		{"/files/readme.md", 202}, // skips the first pattern
+		{"/files/img/logo.png", 201},
+		{"/files/docs/readme.md", 203},
+		{"/other", 404},
+	}
+	for _, tt := range tests {
+		if got := serve(r, "GET", tt.path); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.want, got)
+		}
+	}
+
+	routes := r.Routes()
+	if len(routes) != 3 || !routes[0].Regex || routes[0].Prefix != `^/files/` {
+		t.Errorf("Expected the regex handles in the routes, got %+v", routes)
+	}
+}
+
+func Test_JSONErrors(t *testing.T) {
+	r := NewRouter()
+	r.UseJSONErrors("X-Request-Id")
+	r.Handle("GET", "/hello", testHandle)
+	r.Handle("GET", "/panic", func(ctx *fasthttp.RequestCtx) {
+		panic(fmt.Errorf("broken"))
+	})
+
+	tests := []struct {
+		method, path string
+		status       int
+		expected     ErrorDetail
+	}{
+		{"GET", "/unknown", 404, ErrorDetail{Code: ErrorNotFound, Message: "Not Found", RequestID: "req-1"}},
+		{"POST", "/hello", 405, ErrorDetail{Code: ErrorMethodNotAllowed, Message: "Method Not Allowed", RequestID: "req-1"}},
+		{"GET", "/panic", 500, ErrorDetail{Code: ErrorInternal, Message: "broken", RequestID: "req-1"}},
+	}
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(tt.method)
+		ctx.Request.SetRequestURI(tt.path)
+		ctx.Request.Header.Set("X-Request-Id", "req-1")
+		r.ServeHTTP(ctx)
+
+		envelope := ErrorResponse{}
+		if err := json.Unmarshal(ctx.Response.Body(), &envelope); err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		if ctx.Response.StatusCode() != tt.status || envelope.Error != tt.expected {
+			t.Errorf("%s %s: expected %d %+v, got %d %s", tt.method, tt.path,
+				tt.status, tt.expected, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		if contentType := string(ctx.Response.Header.ContentType()); contentType != "application/json" {
+			t.Errorf("%s %s: expected the JSON content type, got %s", tt.method, tt.path, contentType)
+		}
+	}
+
+	// the Allow header is kept
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/hello")
+	r.ServeHTTP(ctx)
+	if allow := string(ctx.Response.Header.Peek("Allow")); allow != "GET" {
+		t.Errorf("Expected the Allow header GET, got %q", allow)
+	}
+}
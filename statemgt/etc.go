@@ -26,6 +26,29 @@ func (s *StateMgt) SetCurrentConfig(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	b := ctx.Request.Body()
+	newConfig, err := config.ParseInputGateway(json.Unmarshal, b)
+	if err != nil {
+		log.Error(err)
+		returnError(ctx, 400, err, nil)
+		return
+	}
+	diff, err := config.Diff(config.Snapshot(s.Gateway), newConfig)
+	if err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+
+	if !diff.GatewayChanged {
+		// only the changed routes and backends are replaced
+		if err = config.ApplyDiff(s.Gateway, diff); err != nil {
+			log.Error(err)
+			returnError(ctx, 400, err, nil)
+			return
+		}
+		ctx.SetStatusCode(201)
+		return
+	}
+
 	newGateway, err := config.ParseFromBinary(json.Unmarshal, b)
 	if err != nil {
 		log.Error(err)
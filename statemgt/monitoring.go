@@ -2,6 +2,7 @@ package statemgt
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -32,6 +33,53 @@ func getTimeDurationFromURLQuery(paramName string, ctx *fasthttp.RequestCtx, def
 	return defaultValue
 }
 
+// getTimeRangeFromURLQuery returns the timeframe of the query parameters start and end
+// (RFC3339 or unix seconds). end defaults to now. start defaults to end minus the
+// timeframe parameter or, if it is not set either, the defaultTimeframe rounded up
+// to a multiple of the granularity
+func getTimeRangeFromURLQuery(ctx *fasthttp.RequestCtx, defaultTimeframe, granularity time.Duration) (time.Time, time.Time, error) {
+	end, err := getTimeFromURLQuery("end", ctx, time.Now())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if granularity > 0 && defaultTimeframe%granularity != 0 {
+		defaultTimeframe += granularity - defaultTimeframe%granularity
+	}
+	timeframe := getTimeDurationFromURLQuery("timeframe", ctx, defaultTimeframe)
+	start, err := getTimeFromURLQuery("start", ctx, end.Add(-timeframe))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("End %v must be after start %v", end, start)
+	}
+	return start, end, nil
+}
+
+func getTimeFromURLQuery(paramName string, ctx *fasthttp.RequestCtx, defaultValue time.Time) (time.Time, error) {
+	queryValue := string(ctx.QueryArgs().Peek(paramName))
+	if queryValue == "" {
+		return defaultValue, nil
+	}
+	if seconds, err := strconv.ParseInt(queryValue, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	value, err := time.Parse(time.RFC3339, queryValue)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q of %s", queryValue, paramName)
+	}
+	return value, nil
+}
+
+// defaultTimeframe returns the monitoring window of the backends which match
+// the route and backend ID (see Repository.MonitoringWindow) or DefaultTimeframe
+func (s *StateMgt) defaultTimeframe(route string, backendID uuid.UUID) time.Duration {
+	if window := s.Gateway.MetricsRepo.MonitoringWindow(route, backendID); window > 0 {
+		return window
+	}
+	return DefaultTimeframe
+}
+
 func (s *StateMgt) GetMetricsOfAllRoutes(ctx *fasthttp.RequestCtx) {
 	timeframe := getTimeDurationFromURLQuery("timeframe", ctx, DefaultTimeframe)
 	granularity := getTimeDurationFromURLQuery("granularity", ctx, timeframe)
@@ -128,6 +176,58 @@ func (s *StateMgt) GetMetricsOfRoute(ctx *fasthttp.RequestCtx) {
 	marshalAndReturn(ctx, data)
 }
 
+// GetTimeSeriesOfBackend returns the metrics of the backend as a time series
+// in steps of the granularity, ordered by time. The timeframe defaults to the
+// monitoring window of the backend and the granularity to the one of the repository
+func (s *StateMgt) GetTimeSeriesOfBackend(ctx *fasthttp.RequestCtx) {
+	backendID, err := uuid.Parse(string(ctx.QueryArgs().Peek("backend")))
+	if err != nil {
+		returnError(ctx, 400, fmt.Errorf("Backend does not exist"), nil)
+		return
+	}
+	granularity := getTimeDurationFromURLQuery("granularity", ctx, s.Gateway.MetricsRepo.Granularity)
+	start, end, err := getTimeRangeFromURLQuery(ctx, s.defaultTimeframe("", backendID), granularity)
+	if err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+
+	series, err := s.Gateway.MetricsRepo.ReadBackendTimeSeries(backendID, start, end, granularity)
+	if err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+	marshalAndReturn(ctx, series)
+}
+
+// GetTimeSeriesOfRoute returns the metrics of the route as a time series
+// in steps of the granularity, ordered by time. The timeframe defaults to the
+// monitoring window of the route and the granularity to the one of the repository
+func (s *StateMgt) GetTimeSeriesOfRoute(ctx *fasthttp.RequestCtx) {
+	routeName := string(ctx.QueryArgs().Peek("route"))
+	if routeName == "" {
+		returnError(ctx, 400, fmt.Errorf("Route must be set"), nil)
+		return
+	}
+	if s.Gateway.GetRoute(routeName) == nil {
+		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
+		return
+	}
+	granularity := getTimeDurationFromURLQuery("granularity", ctx, s.Gateway.MetricsRepo.Granularity)
+	start, end, err := getTimeRangeFromURLQuery(ctx, s.defaultTimeframe(routeName, uuid.Nil), granularity)
+	if err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+
+	series, err := s.Gateway.MetricsRepo.ReadRouteTimeSeries(routeName, start, end, granularity)
+	if err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+	marshalAndReturn(ctx, series)
+}
+
 func (s *StateMgt) GetPromMetrics(ctx *fasthttp.RequestCtx) {
 
 	var metrics interface{}
@@ -164,3 +264,24 @@ func (s *StateMgt) GetActiveAlerts(ctx *fasthttp.RequestCtx) {
 	alerts := s.Gateway.MetricsRepo.GetActiveAlerts()
 	marshalAndReturn(ctx, alerts)
 }
+
+// ClearAlert removes the active alert of the given backend and metric
+func (s *StateMgt) ClearAlert(ctx *fasthttp.RequestCtx) {
+	backendID, err := uuid.Parse(string(ctx.QueryArgs().Peek("backend")))
+	if err != nil {
+		err := fmt.Errorf("Unable to parse backendID from query parameter (%v)", err)
+		returnError(ctx, 400, err, nil)
+		return
+	}
+	metric := string(ctx.QueryArgs().Peek("metric"))
+	if metric == "" {
+		returnError(ctx, 400, fmt.Errorf("Query parameter metric is required"), nil)
+		return
+	}
+
+	if err = s.Gateway.MetricsRepo.ClearAlert(backendID, metric); err != nil {
+		returnError(ctx, 404, err, nil)
+		return
+	}
+	ctx.SetStatusCode(200)
+}
@@ -0,0 +1,77 @@
+package statemgt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/rgumi/depoy/router"
+)
+
+func serveTimeSeriesAPI(t *testing.T) (string, *metrics.Repository, func()) {
+	url, g, stop := serveTestAPI(t, func(s *StateMgt, r *router.Router) {
+		r.Handle("GET", "/v1/routes/timeseries", s.GetTimeSeriesOfRoute)
+	})
+	return url + "/timeseries", g.MetricsRepo, stop
+}
+
+func Test_GetTimeSeriesOfRoute_Defaults(t *testing.T) {
+	url, repo, stop := serveTimeSeriesAPI(t)
+	defer stop()
+
+	// the window is set once the monitoring of the backends is started
+	deadline := time.Now().Add(time.Second)
+	window := repo.MonitoringWindow("canary", uuid.Nil)
+	for window == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		window = repo.MonitoringWindow("canary", uuid.Nil)
+	}
+	if window == 0 {
+		window = DefaultTimeframe
+	}
+	// the default timeframe is rounded up to a multiple of the granularity
+	steps := int((window + repo.Granularity - 1) / repo.Granularity)
+
+	series := []metrics.TimeSeriesPoint{}
+	if status := doRequest(t, "GET", url+"?route=canary", "", &series); status != 200 {
+		t.Fatalf("Expected the time series with the default params, got %d", status)
+	}
+	if len(series) != steps {
+		t.Fatalf("Expected %d steps of the granularity %v, got %d", steps, repo.Granularity, len(series))
+	}
+	for i := 1; i < len(series); i++ {
+		if step := series[i].Timestamp.Sub(series[i-1].Timestamp); step != repo.Granularity {
+			t.Errorf("Expected the points to be apart by the granularity, got %v", step)
+		}
+	}
+
+	end := time.Now().Truncate(time.Second)
+	query := fmt.Sprintf("%s?route=canary&start=%s&end=%d&granularity=10",
+		url, end.Add(-time.Minute).Format(time.RFC3339), end.Unix())
+	if status := doRequest(t, "GET", query, "", &series); status != 200 || len(series) != 6 {
+		t.Errorf("Expected 6 points of the given range, got %d points (%d)", len(series), status)
+	}
+}
+
+func Test_GetTimeSeriesOfRoute_InvalidRange(t *testing.T) {
+	url, _, stop := serveTimeSeriesAPI(t)
+	defer stop()
+	end := time.Now().Unix()
+
+	for query, reason := range map[string]string{
+		fmt.Sprintf("start=%d&end=%d", end, end-60):                "end before start",
+		fmt.Sprintf("start=%d&end=%d", end, end):                   "empty timeframe",
+		fmt.Sprintf("start=%d&end=%d&granularity=30", end-10, end): "timeframe shorter than granularity",
+		fmt.Sprintf("start=%d&end=%d&granularity=7", end-60, end):  "timeframe not a multiple of granularity",
+		"start=yesterday": "invalid time",
+	} {
+		if status := doRequest(t, "GET", url+"?route=canary&"+query, "", nil); status != 400 {
+			t.Errorf("Expected %s to be rejected, got %d", reason, status)
+		}
+	}
+	if status := doRequest(t, "GET", url+"?route=unknown", "", nil); status != 404 {
+		t.Errorf("Expected an unknown route to be rejected, got %d", status)
+	}
+}
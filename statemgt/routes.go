@@ -2,8 +2,12 @@ package statemgt
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/rgumi/depoy/config"
+	"github.com/rgumi/depoy/middleware"
+	"github.com/rgumi/depoy/route"
+	"github.com/rgumi/depoy/router"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 
@@ -193,10 +197,95 @@ func (s *StateMgt) RemoveBackendFromRoute(ctx *fasthttp.RequestCtx) {
 	marshalAndReturn(ctx, config.ConvertRouteToInputRoute(route))
 }
 
+// UpdateBackendWeight sets the weight of a backend of the given route and returns
+// the resulting target distribution. While a switchover is active, the weights are
+// controlled by the switchover and cannot be changed
+func (s *StateMgt) UpdateBackendWeight(ctx *fasthttp.RequestCtx) {
+	routeName := string(ctx.QueryArgs().Peek("route"))
+	backendID, err := uuid.Parse(string(ctx.QueryArgs().Peek("backend")))
+	if err != nil {
+		returnError(ctx, 400, fmt.Errorf("Invalid uuid for backendID"), nil)
+		return
+	}
+	weight, err := strconv.Atoi(string(ctx.QueryArgs().Peek("weight")))
+	if err != nil || weight < 0 || weight > 100 {
+		returnError(ctx, 400, fmt.Errorf("Weight must be a number between 0 and 100"), nil)
+		return
+	}
+
+	route, found := s.Gateway.Routes[routeName]
+	if !found {
+		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
+		return
+	}
+	if _, found = route.Backends[backendID]; !found {
+		returnError(ctx, 404, fmt.Errorf("Could not find backend %v of route", backendID), nil)
+		return
+	}
+	if switchover := route.CurrentSwitchover(); switchover != nil && switchover.IsActive() {
+		returnError(ctx, 409, fmt.Errorf("Weights cannot be changed while a switchover is active"), nil)
+		return
+	}
+	if err = route.UpdateBackendWeight(backendID, uint8(weight)); err != nil {
+		returnError(ctx, 400, err, nil)
+		return
+	}
+	marshalAndReturn(ctx, route.Distribution())
+}
+
+// GetBackendHealth returns the outcome of the recent healthchecks of all backends
+// of the given route by backend ID
+func (s *StateMgt) GetBackendHealth(ctx *fasthttp.RequestCtx) {
+	routeName := string(ctx.QueryArgs().Peek("route"))
+
+	route, found := s.Gateway.Routes[routeName]
+	if !found {
+		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
+		return
+	}
+	marshalAndReturn(ctx, route.BackendHealth())
+}
+
 /*
 	Switchover
 */
 
+// RegisterSwitchoverHandlers registers the handlers which create, inspect and stop
+// the switchovers of the routes on the router
+func (s *StateMgt) RegisterSwitchoverHandlers(router *router.Router) {
+	router.Handle("POST", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.CreateSwitchover))
+	router.Handle("GET", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.GetSwitchover))
+	router.Handle("DELETE", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.DeleteSwitchover))
+	router.Handle("POST", s.Prefix+"v1/routes/switchover/pause", middleware.LogRequest(s.PauseSwitchover))
+	router.Handle("POST", s.Prefix+"v1/routes/switchover/resume", middleware.LogRequest(s.ResumeSwitchover))
+	router.Handle("GET", s.Prefix+"v1/routes/switchover/history", middleware.LogRequest(s.GetSwitchoverHistory))
+}
+
+// currentSwitchover returns the route and switchover of the request. If the
+// optional query parameter id is set, it has to match the id of the switchover.
+// Otherwise the error is returned to the client and false is returned
+func (s *StateMgt) currentSwitchover(ctx *fasthttp.RequestCtx) (*route.Route, *route.Switchover, bool) {
+	routeName := string(ctx.QueryArgs().Peek("route"))
+
+	myRoute, found := s.Gateway.Routes[routeName]
+	if !found {
+		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
+		return nil, nil, false
+	}
+	switchover := myRoute.CurrentSwitchover()
+	if switchover == nil {
+		returnError(ctx, 404, fmt.Errorf("Route does not have a swtichover active"), nil)
+		return nil, nil, false
+	}
+	if id := ctx.QueryArgs().Peek("id"); len(id) > 0 {
+		if n, err := strconv.Atoi(string(id)); err != nil || n != switchover.ID {
+			returnError(ctx, 404, fmt.Errorf("Could not find switchover %s of route", id), nil)
+			return nil, nil, false
+		}
+	}
+	return myRoute, switchover, true
+}
+
 // CreateSwitchover adds a switchover struct to the given route
 func (s *StateMgt) CreateSwitchover(ctx *fasthttp.RequestCtx) {
 	mySwitchOver := config.NewInputSwitchover()
@@ -216,10 +305,16 @@ func (s *StateMgt) CreateSwitchover(ctx *fasthttp.RequestCtx) {
 		mySwitchOver.To,
 		mySwitchOver.Conditions,
 		mySwitchOver.Timeout.Duration,
+		mySwitchOver.MaxDuration.Duration,
 		mySwitchOver.AllowedFailures,
 		mySwitchOver.WeightChange,
+		mySwitchOver.Steps,
+		mySwitchOver.AbortOn,
 		mySwitchOver.Force,
 		mySwitchOver.Rollback,
+		mySwitchOver.RemoveOnSuccess,
+		mySwitchOver.Linger.Duration,
+		mySwitchOver.StartAt,
 	)
 	if err != nil {
 		returnError(ctx, 400, err, nil)
@@ -229,26 +324,27 @@ func (s *StateMgt) CreateSwitchover(ctx *fasthttp.RequestCtx) {
 
 }
 
-// GetSwitchover returns the state of the current switchover of the given route
-func (s *StateMgt) GetSwitchover(ctx *fasthttp.RequestCtx) {
+// GetDistribution returns the current target distribution of the given route
+func (s *StateMgt) GetDistribution(ctx *fasthttp.RequestCtx) {
 	routeName := string(ctx.QueryArgs().Peek("route"))
 
-	route, found := s.Gateway.Routes[routeName]
-	if !found {
+	route := s.Gateway.GetRoute(routeName)
+	if route == nil {
 		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
 		return
 	}
+	marshalAndReturn(ctx, route.Distribution())
+}
 
-	if route.Switchover == nil {
-		returnError(ctx, 404, fmt.Errorf("Route does not have a swtichover active"), nil)
-		return
+// GetSwitchover returns the state of the current switchover of the given route
+func (s *StateMgt) GetSwitchover(ctx *fasthttp.RequestCtx) {
+	if _, switchover, ok := s.currentSwitchover(ctx); ok {
+		marshalAndReturn(ctx, config.ConvertSwitchoverToInputSwitchover(switchover))
 	}
-	marshalAndReturn(ctx, config.ConvertSwitchoverToInputSwitchover(route.Switchover))
 }
 
-// DeleteSwitchover stops and removes the switchover of the given route
-// if no switchover is active, 404 is returned
-func (s *StateMgt) DeleteSwitchover(ctx *fasthttp.RequestCtx) {
+// GetSwitchoverHistory returns the outcomes of the past switchovers of the given route
+func (s *StateMgt) GetSwitchoverHistory(ctx *fasthttp.RequestCtx) {
 	routeName := string(ctx.QueryArgs().Peek("route"))
 
 	route, found := s.Gateway.Routes[routeName]
@@ -256,11 +352,36 @@ func (s *StateMgt) DeleteSwitchover(ctx *fasthttp.RequestCtx) {
 		returnError(ctx, 404, fmt.Errorf("Could not find route"), nil)
 		return
 	}
+	marshalAndReturn(ctx, route.SwitchoverHistory())
+}
 
-	if route.Switchover == nil {
-		returnError(ctx, 404, fmt.Errorf("Route does not have a swtichover active"), nil)
+// DeleteSwitchover stops and removes the switchover of the given route
+// if no switchover is active, 404 is returned
+func (s *StateMgt) DeleteSwitchover(ctx *fasthttp.RequestCtx) {
+	if myRoute, _, ok := s.currentSwitchover(ctx); ok {
+		myRoute.RemoveSwitchOver()
+		ctx.SetStatusCode(200)
+	}
+}
+
+// PauseSwitchover freezes the weights of the switchover of the given route
+func (s *StateMgt) PauseSwitchover(ctx *fasthttp.RequestCtx) {
+	s.changeSwitchover(ctx, (*route.Switchover).Pause)
+}
+
+// ResumeSwitchover continues the paused switchover of the given route
+func (s *StateMgt) ResumeSwitchover(ctx *fasthttp.RequestCtx) {
+	s.changeSwitchover(ctx, (*route.Switchover).Resume)
+}
+
+func (s *StateMgt) changeSwitchover(ctx *fasthttp.RequestCtx, change func(*route.Switchover) error) {
+	_, switchover, ok := s.currentSwitchover(ctx)
+	if !ok {
+		return
+	}
+	if err := change(switchover); err != nil {
+		returnError(ctx, 409, err, nil)
 		return
 	}
-	route.RemoveSwitchOver()
-	ctx.SetStatusCode(200)
+	marshalAndReturn(ctx, config.ConvertSwitchoverToInputSwitchover(switchover))
 }
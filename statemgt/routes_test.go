@@ -0,0 +1,167 @@
+package statemgt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rgumi/depoy/config"
+	"github.com/rgumi/depoy/gateway"
+	"github.com/rgumi/depoy/route"
+	"github.com/rgumi/depoy/router"
+	"github.com/valyala/fasthttp"
+)
+
+// serveTestAPI serves the handlers which are registered by register for a gateway
+// with the routes canary (canary strategy) and rr (roundrobin strategy). The
+// url of the routes API is returned
+func serveTestAPI(t *testing.T, register func(*StateMgt, *router.Router)) (string, *gateway.Gateway, func()) {
+	backends := `[{"name": "v1", "addr": "http://127.0.0.1:9999", "weight": 100},
+		{"name": "v2", "addr": "http://127.0.0.1:9998", "weight": 0}]`
+	g, err := config.ParseFromBinary(json.Unmarshal, []byte(fmt.Sprintf(`{"addr": ":0", "routes": [
+		{"name": "canary", "prefix": "/canary/", "rewrite": "/", "healthcheck_bool": false, "strategy": {"type": "canary"}, "backends": %s},
+		{"name": "rr", "prefix": "/rr/", "rewrite": "/", "healthcheck_bool": false, "strategy": {"type": "roundrobin"}, "backends": %s}]}`,
+		backends, backends)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateMgt("", g, "/")
+	r := router.NewRouter()
+	register(s, r)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fasthttp.Serve(ln, r.ServeHTTP)
+	return "http://" + ln.Addr().String() + "/v1/routes", g, func() {
+		ln.Close()
+		g.Shutdown(context.Background())
+	}
+}
+
+func serveSwitchoverAPI(t *testing.T) (string, func()) {
+	url, _, stop := serveTestAPI(t, (*StateMgt).RegisterSwitchoverHandlers)
+	return url + "/switchover", stop
+}
+
+func doRequest(t *testing.T, method, url, body string, out interface{}) int {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == 200 {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func Test_SwitchoverAPI(t *testing.T) {
+	url, stop := serveSwitchoverAPI(t)
+	defer stop()
+	definition := `{"from": "v1", "to": "v2", "weight_change": 10, "timeout": "1h", "allowed_failures": 3,
+		"rollback": false, "conditions": [{"metric": "5xxRate", "operator": "<", "threshold": 0.1}]}`
+
+	created := &config.InputSwitchover{}
+	if status := doRequest(t, "POST", url+"?route=canary", definition, created); status != 200 {
+		t.Fatalf("Expected the switchover to be created, got %d", status)
+	}
+	if created.ID == 0 || created.From != "v1" || created.To != "v2" || created.Rollback || created.WeightChange != 10 {
+		t.Errorf("Expected the created switchover with its id, got %+v", created)
+	}
+	if status := doRequest(t, "POST", url+"?route=canary", definition, nil); status != 400 {
+		t.Errorf("Expected a second switchover of the route to be rejected, got %d", status)
+	}
+
+	current := &config.InputSwitchover{}
+	if status := doRequest(t, "GET", fmt.Sprintf("%s?route=canary&id=%d", url, created.ID), "", current); status != 200 {
+		t.Fatalf("Expected the status of the switchover, got %d", status)
+	}
+	if current.ID != created.ID || current.Status == "" || current.Progress == nil {
+		t.Errorf("Expected the status of the created switchover, got %+v", current)
+	}
+	if status := doRequest(t, "GET", fmt.Sprintf("%s?route=canary&id=%d", url, created.ID+1), "", nil); status != 404 {
+		t.Errorf("Expected an unknown id to be rejected, got %d", status)
+	}
+
+	if status := doRequest(t, "DELETE", fmt.Sprintf("%s?route=canary&id=%d", url, created.ID), "", nil); status != 200 {
+		t.Errorf("Expected the switchover to be stopped, got %d", status)
+	}
+	if status := doRequest(t, "GET", url+"?route=canary", "", nil); status != 404 {
+		t.Errorf("Expected the stopped switchover to be removed, got %d", status)
+	}
+}
+
+func Test_SwitchoverAPI_Validation(t *testing.T) {
+	url, stop := serveSwitchoverAPI(t)
+	defer stop()
+	definition := `{"from": "v1", "to": "v2", "conditions": [{"metric": "5xxRate", "operator": "<", "threshold": 0.1}]}`
+
+	if status := doRequest(t, "POST", url+"?route=unknown", definition, nil); status != 404 {
+		t.Errorf("Expected an unknown route to be rejected, got %d", status)
+	}
+	if status := doRequest(t, "POST", url+"?route=rr", definition, nil); status != 400 {
+		t.Errorf("Expected the roundrobin strategy to be rejected, got %d", status)
+	}
+	if status := doRequest(t, "POST", url+"?route=canary", `{"from": "v1", "to": "v2"}`, nil); status != 400 {
+		t.Errorf("Expected a switchover without conditions to be rejected, got %d", status)
+	}
+	if status := doRequest(t, "DELETE", url+"?route=canary", "", nil); status != 404 {
+		t.Errorf("Expected stopping a missing switchover to be rejected, got %d", status)
+	}
+}
+
+func Test_UpdateBackendWeight(t *testing.T) {
+	url, g, stop := serveTestAPI(t, func(s *StateMgt, r *router.Router) {
+		r.Handle("PATCH", "/v1/routes/backends/weight", s.UpdateBackendWeight)
+	})
+	defer stop()
+	url += "/backends/weight"
+	canary := g.GetRoute("canary")
+	var v1, v2 *route.Backend
+	for _, backend := range canary.Backends {
+		if backend.Name == "v1" {
+			v1 = backend
+		} else {
+			v2 = backend
+		}
+	}
+
+	distribution := []route.DistributionEntry{}
+	if status := doRequest(t, "PATCH", fmt.Sprintf("%s?route=canary&backend=%v&weight=25", url, v2.ID), "", &distribution); status != 200 {
+		t.Fatalf("Expected the weight to be changed, got %d", status)
+	}
+	if v2.Weigth != 25 || len(distribution) != 2 {
+		t.Fatalf("Expected v1 and v2 to be distributed, got %+v", distribution)
+	}
+	for _, entry := range distribution {
+		if expected := map[string]float64{"v1": 0.8, "v2": 0.2}[entry.Name]; entry.Share != expected {
+			t.Errorf("Expected %s to have a share of %v, got %+v", entry.Name, expected, entry)
+		}
+	}
+
+	if status := doRequest(t, "PATCH", fmt.Sprintf("%s?route=canary&backend=%v&weight=101", url, v1.ID), "", nil); status != 400 {
+		t.Errorf("Expected a weight larger than 100 to be rejected, got %d", status)
+	}
+	if status := doRequest(t, "PATCH", fmt.Sprintf("%s?route=canary&backend=%v&weight=-1", url, v1.ID), "", nil); status != 400 {
+		t.Errorf("Expected a negative weight to be rejected, got %d", status)
+	}
+	if status := doRequest(t, "PATCH", fmt.Sprintf("%s?route=canary&backend=%v&weight=50", url, uuid.New()), "", nil); status != 404 {
+		t.Errorf("Expected an unknown backend to be rejected, got %d", status)
+	}
+	if v1.Weigth != 100 || v2.Weigth != 25 {
+		t.Errorf("Expected the rejected changes to keep the weights, got %d and %d", v1.Weigth, v2.Weigth)
+	}
+}
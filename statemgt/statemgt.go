@@ -89,22 +89,26 @@ func (s *StateMgt) Start() {
 	router.Handle("GET", s.Prefix+"v1/routes", middleware.LogRequest(s.GetAllRoutes))
 	router.Handle("POST", s.Prefix+"v1/routes", middleware.LogRequest(s.CreateRoute))
 	router.Handle("PUT", s.Prefix+"v1/routes", middleware.LogRequest(s.UpdateRouteByName))
+	router.Handle("GET", s.Prefix+"v1/routes/distribution", middleware.LogRequest(s.GetDistribution))
 
 	// route backends
 	router.Handle("PATCH", s.Prefix+"v1/routes/backends", middleware.LogRequest(s.AddNewBackendToRoute))
 	router.Handle("DELETE", s.Prefix+"v1/routes/backends", middleware.LogRequest(s.RemoveBackendFromRoute))
+	router.Handle("PATCH", s.Prefix+"v1/routes/backends/weight", middleware.LogRequest(s.UpdateBackendWeight))
+	router.Handle("GET", s.Prefix+"v1/routes/backends/health", middleware.LogRequest(s.GetBackendHealth))
 
 	// route switchover
-	router.Handle("POST", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.CreateSwitchover))
-	router.Handle("GET", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.GetSwitchover))
-	router.Handle("DELETE", s.Prefix+"v1/routes/switchover", middleware.LogRequest(s.DeleteSwitchover))
+	s.RegisterSwitchoverHandlers(router)
 
 	// monitoring
 	router.Handle("GET", s.Prefix+"v1/monitoring", middleware.LogRequest(s.GetMetricsData))
 	router.Handle("GET", s.Prefix+"v1/monitoring/backends", middleware.LogRequest(s.GetMetricsOfBackend))
 	router.Handle("GET", s.Prefix+"v1/monitoring/routes", middleware.LogRequest(s.GetMetricsOfRoute))
+	router.Handle("GET", s.Prefix+"v1/monitoring/backends/timeseries", middleware.LogRequest(s.GetTimeSeriesOfBackend))
+	router.Handle("GET", s.Prefix+"v1/monitoring/routes/timeseries", middleware.LogRequest(s.GetTimeSeriesOfRoute))
 	router.Handle("GET", s.Prefix+"v1/monitoring/prometheus", middleware.LogRequest(s.GetPromMetrics))
 	router.Handle("GET", s.Prefix+"v1/monitoring/alerts", middleware.LogRequest(s.GetActiveAlerts))
+	router.Handle("DELETE", s.Prefix+"v1/monitoring/alerts", middleware.LogRequest(s.ClearAlert))
 
 	if err := updateBaseUrl(s.Box, s.Prefix); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// influxMeasurement is the measurement of all points written by depoy
+	influxMeasurement = "depoy"
+	// influxBatchSize is the number of points after which the batch is flushed
+	// even if the flush interval did not pass yet
+	influxBatchSize = 5000
+	// influxCustomPrefix is the prefix of the fields of scraped metrics
+	influxCustomPrefix = "custom_"
+	// influxMethodPrefix is the prefix of the fields which count the responses by
+	// request method, e.g. method_POST_status_500. They are summed up
+	influxMethodPrefix = "method_"
+)
+
+// fields which are summed up when points are aggregated. All other fields are averaged
+var influxSumFields = []string{
+	"responses", "status_200", "status_300", "status_400", "status_500", "status_600",
+}
+
+// InfluxStorage stores the metrics in an InfluxDB 2.x bucket so that they survive restarts.
+// Points are written in batches which are flushed every FlushInterval
+type InfluxStorage struct {
+	URL             string
+	Org             string
+	Bucket          string
+	FlushInterval   time.Duration
+	RetentionPeriod time.Duration // timeframe of the data which is returned by ReadData
+	Granularity     time.Duration // window of the data which is returned by ReadData
+	token           string
+	client          *http.Client
+	mux             sync.Mutex
+	batch           []string
+	killChan        chan int
+}
+
+// NewInfluxStorage returns a new InfluxStorage which writes to the bucket of the org
+// using the API token of the InfluxDB at url
+func NewInfluxStorage(url, token, org, bucket string, flushInterval, retentionPeriod, granularity time.Duration) *InfluxStorage {
+	st := &InfluxStorage{
+		URL:             strings.TrimSuffix(url, "/"),
+		Org:             org,
+		Bucket:          bucket,
+		FlushInterval:   flushInterval,
+		RetentionPeriod: retentionPeriod,
+		Granularity:     granularity,
+		token:           token,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		killChan:        make(chan int, 1),
+	}
+	go st.Job()
+	return st
+}
+
+// Job flushes the batch every FlushInterval
+func (st *InfluxStorage) Job() {
+	for {
+		select {
+		case _ = <-st.killChan:
+			st.Flush()
+			return
+		case _ = <-time.After(st.FlushInterval):
+			st.Flush()
+		}
+	}
+}
+
+// Stop flushes the remaining points and stops the job loop
+func (st *InfluxStorage) Stop() {
+	log.Warn("Shutting down storage")
+	st.killChan <- 1
+}
+
+// Write adds a point of the request to the batch
+func (st *InfluxStorage) Write(
+	routeName string,
+	backend uuid.UUID,
+	customMetrics map[string]float64,
+	responseTime, contentLength int64,
+	responseStatus int, requestMethod string) {
+
+	status := responseStatus / 100 * 100
+	if status < 200 {
+		status = 200
+	} else if status > 600 {
+		status = 600
+	}
+	fields := []string{"responses=1i"}
+	for _, class := range []int{200, 300, 400, 500, 600} {
+		value := 0
+		if class == status {
+			value = 1
+		}
+		fields = append(fields, fmt.Sprintf("status_%d=%di", class, value))
+	}
+	fields = append(fields,
+		"response_time="+strconv.FormatInt(responseTime, 10),
+		"content_length="+strconv.FormatInt(contentLength, 10))
+	if requestMethod != "" {
+		prefix := escapeInflux(influxMethodPrefix+requestMethod, ",= ")
+		fields = append(fields, prefix+"_responses=1i", fmt.Sprintf("%s_status_%d=1i", prefix, status))
+	}
+	for key, value := range customMetrics {
+		fields = append(fields, escapeInflux(influxCustomPrefix+key, ",= ")+"="+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	line := fmt.Sprintf("%s,route=%s,backend=%v %s %d",
+		influxMeasurement, escapeInflux(routeName, ",= "), backend, strings.Join(fields, ","), time.Now().UnixNano())
+
+	st.mux.Lock()
+	st.batch = append(st.batch, line)
+	full := len(st.batch) >= influxBatchSize
+	st.mux.Unlock()
+	if full {
+		go st.Flush()
+	}
+}
+
+// Flush writes the batch to InfluxDB. If the write fails, the points are dropped
+func (st *InfluxStorage) Flush() {
+	st.mux.Lock()
+	batch := st.batch
+	st.batch = nil
+	st.mux.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	params := url.Values{"org": {st.Org}, "bucket": {st.Bucket}, "precision": {"ns"}}
+	req, err := http.NewRequest("POST", st.URL+"/api/v2/write?"+params.Encode(), strings.NewReader(strings.Join(batch, "\n")))
+	if err != nil {
+		log.Errorf("Failed to write %d points to InfluxDB: %v", len(batch), err)
+		return
+	}
+	req.Header.Set("Authorization", "Token "+st.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := st.client.Do(req)
+	if err != nil {
+		log.Errorf("Failed to write %d points to InfluxDB: %v", len(batch), err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Errorf("Failed to write %d points to InfluxDB (%d): %s", len(batch), resp.StatusCode, body)
+	}
+}
+
+// ReadData returns the data of all routes and backends within the retention period.
+// The data is aggregated in windows of the granularity
+func (st *InfluxStorage) ReadData() map[string]map[uuid.UUID]map[time.Time]Metric {
+	end := time.Now()
+	data := make(map[string]map[uuid.UUID]map[time.Time]Metric)
+	err := st.query("true", end.Add(-st.RetentionPeriod), end, st.Granularity, func(row influxRow) {
+		backend, err := uuid.Parse(row.backend)
+		if err != nil {
+			return
+		}
+		if _, found := data[row.route]; !found {
+			data[row.route] = make(map[uuid.UUID]map[time.Time]Metric)
+		}
+		if _, found := data[row.route][backend]; !found {
+			data[row.route][backend] = make(map[time.Time]Metric)
+		}
+		metric := data[row.route][backend][row.time]
+		metric.apply(row.field, row.value)
+		data[row.route][backend][row.time] = metric
+	})
+	if err != nil {
+		log.Errorf("Failed to read data from InfluxDB: %v", err)
+	}
+	return data
+}
+
+// ReadBackend returns the aggregated metrics of the backend within the given timeframe
+func (st *InfluxStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (Metric, error) {
+	return st.readAggregate(fmt.Sprintf(`r.backend == "%v"`, backend), start, end)
+}
+
+// ReadRoute returns the aggregated metrics of the route within the given timeframe
+func (st *InfluxStorage) ReadRoute(route string, start, end time.Time) (Metric, error) {
+	return st.readAggregate(fmt.Sprintf(`r.route == %s`, strconv.Quote(route)), start, end)
+}
+
+func (st *InfluxStorage) readAggregate(filter string, start, end time.Time) (Metric, error) {
+	metric := Metric{}
+	found := false
+	err := st.query(filter, start, end, 0, func(row influxRow) {
+		found = true
+		metric.apply(row.field, row.value)
+	})
+	if err != nil {
+		return Metric{}, err
+	}
+	if !found {
+		return Metric{}, fmt.Errorf("Could not find relevant metrics for provided timeframe")
+	}
+	return metric, nil
+}
+
+// apply sets the aggregated value of the field
+func (m *Metric) apply(field string, value float64) {
+	switch field {
+	case "responses":
+		m.TotalResponses = int(value)
+	case "status_200":
+		m.ResponseStatus200 = int(value)
+	case "status_300":
+		m.ResponseStatus300 = int(value)
+	case "status_400":
+		m.ResponseStatus400 = int(value)
+	case "status_500":
+		m.ResponseStatus500 = int(value)
+	case "status_600":
+		m.ResponseStatus600 = int(value)
+	case "response_time":
+		m.ResponseTime = value
+	case "content_length":
+		m.ContentLength = value
+	default:
+		if strings.HasPrefix(field, influxMethodPrefix) {
+			m.applyMethod(strings.TrimPrefix(field, influxMethodPrefix), value)
+		} else if strings.HasPrefix(field, influxCustomPrefix) {
+			if m.CustomMetrics == nil {
+				m.CustomMetrics = make(map[string]float64)
+			}
+			m.CustomMetrics[strings.TrimPrefix(field, influxCustomPrefix)] = value
+		}
+	}
+}
+
+// applyMethod sets the aggregated value of a field which counts the responses
+// of a request method, e.g. POST_responses or POST_status_500
+func (m *Metric) applyMethod(field string, value float64) {
+	var method, counter string
+	if i := strings.LastIndex(field, "_status_"); i > 0 {
+		method, counter = field[:i], field[i+1:]
+	} else if strings.HasSuffix(field, "_responses") {
+		method, counter = strings.TrimSuffix(field, "_responses"), "responses"
+	} else {
+		return
+	}
+	if m.Methods == nil {
+		m.Methods = make(map[string]MethodMetric)
+	}
+	methodMetric := m.Methods[method]
+	switch counter {
+	case "responses":
+		methodMetric.TotalResponses = int(value)
+	case "status_200":
+		methodMetric.ResponseStatus200 = int(value)
+	case "status_300":
+		methodMetric.ResponseStatus300 = int(value)
+	case "status_400":
+		methodMetric.ResponseStatus400 = int(value)
+	case "status_500":
+		methodMetric.ResponseStatus500 = int(value)
+	case "status_600":
+		methodMetric.ResponseStatus600 = int(value)
+	}
+	m.Methods[method] = methodMetric
+}
+
+type influxRow struct {
+	route   string
+	backend string
+	time    time.Time
+	field   string
+	value   float64
+}
+
+// fluxQuery returns the query which aggregates the points matching the filter.
+// If window is larger than 0, the points are aggregated per route, backend and window.
+// Otherwise all points are aggregated into one value per field
+func (st *InfluxStorage) fluxQuery(filter string, start, end time.Time, window time.Duration) string {
+	sumFilter := make([]string, len(influxSumFields))
+	for i, field := range influxSumFields {
+		sumFilter[i] = fmt.Sprintf(`r._field == "%s"`, field)
+	}
+	sumFilter = append(sumFilter, fmt.Sprintf(`strings.hasPrefix(v: r._field, prefix: "%s")`, influxMethodPrefix))
+	isSum := strings.Join(sumFilter, " or ")
+
+	aggregate := func(fn string) string {
+		if window > 0 {
+			return fmt.Sprintf(`aggregateWindow(every: %dms, fn: %s, createEmpty: false)`, window.Milliseconds(), fn)
+		}
+		return `group(columns: ["_field"]) |> ` + fn + `()`
+	}
+	return fmt.Sprintf(`import "strings"
+
+data = from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == "%s" and %s)
+union(tables: [
+  data |> filter(fn: (r) => %s) |> %s,
+  data |> filter(fn: (r) => not (%s)) |> %s,
+])`,
+		strconv.Quote(st.Bucket), start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano),
+		influxMeasurement, filter, isSum, aggregate("sum"), isSum, aggregate("mean"))
+}
+
+// query executes the flux query and passes every row of the result to fn
+func (st *InfluxStorage) query(filter string, start, end time.Time, window time.Duration, fn func(influxRow)) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":   st.fluxQuery(filter, start, end, window),
+		"type":    "flux",
+		"dialect": map[string]interface{}{"annotations": []string{}},
+	})
+	req, err := http.NewRequest("POST", st.URL+"/api/v2/query?"+url.Values{"org": {st.Org}}.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+st.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("InfluxDB query failed (%d): %s", resp.StatusCode, msg)
+	}
+	return parseFluxCSV(resp.Body, fn)
+}
+
+// parseFluxCSV parses the CSV result of a flux query. Every table of the result
+// starts with a header row
+func parseFluxCSV(r io.Reader, fn func(influxRow)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	columns := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) == 1 && record[0] == "" {
+			continue // empty line between tables
+		}
+		if containsString(record, "_value") {
+			columns = map[string]int{}
+			for i, name := range record {
+				columns[name] = i
+			}
+			continue
+		}
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		value, err := strconv.ParseFloat(get("_value"), 64)
+		if err != nil {
+			continue // e.g. mean of an empty table
+		}
+		row := influxRow{route: get("route"), backend: get("backend"), field: get("_field"), value: value}
+		row.time, _ = time.Parse(time.RFC3339Nano, get("_time"))
+		fn(row)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeInflux escapes the characters of a tag or field key in the line protocol
+func escapeInflux(s, chars string) string {
+	for _, c := range chars {
+		s = strings.Replace(s, string(c), `\`+string(c), -1)
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+//go:build influxdb
+// +build influxdb
+
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Test_InfluxStorage_Integration requires a running InfluxDB 2.x, e.g.
+// INFLUXDB_URL=http://localhost:8086 INFLUXDB_ORG=depoy INFLUXDB_BUCKET=test INFLUXDB_TOKEN=...
+// go test -tags influxdb ./storage/
+func Test_InfluxStorage_Integration(t *testing.T) {
+	url := os.Getenv("INFLUXDB_URL")
+	if url == "" {
+		t.Skip("INFLUXDB_URL is not set")
+	}
+	st := NewInfluxStorage(url, os.Getenv("INFLUXDB_TOKEN"), os.Getenv("INFLUXDB_ORG"),
+		os.Getenv("INFLUXDB_BUCKET"), time.Hour, time.Hour, time.Minute)
+	defer st.Stop()
+
+	backend := uuid.New()
+	start := time.Now()
+	st.Write("integration", backend, map[string]float64{"cpu": 0.5}, 100, 10, 200, "GET")
+	st.Write("integration", backend, map[string]float64{"cpu": 1.5}, 300, 30, 503, "POST")
+	st.Flush()
+	end := time.Now().Add(time.Second)
+
+	metric, err := st.ReadBackend(backend, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric.TotalResponses != 2 || metric.ResponseStatus200 != 1 || metric.ResponseStatus500 != 1 {
+		t.Errorf("Expected 2 responses of which one failed, got %+v", metric)
+	}
+	if metric.ResponseTime != 200 || metric.ContentLength != 20 || metric.CustomMetrics["cpu"] != 1 {
+		t.Errorf("Expected the averages of both requests, got %+v", metric)
+	}
+	if metric.Methods["POST"].ResponseStatus500 != 1 || metric.Methods["GET"].ResponseStatus200 != 1 {
+		t.Errorf("Expected the responses by method, got %+v", metric.Methods)
+	}
+
+	if _, err := st.ReadRoute("integration", start, end); err != nil {
+		t.Error(err)
+	}
+	if _, found := st.ReadData()["integration"][backend]; !found {
+		t.Error("Expected the backend in the data")
+	}
+	if _, err := st.ReadBackend(uuid.New(), start, end); err == nil {
+		t.Error("Expected an error for a backend without data")
+	}
+}
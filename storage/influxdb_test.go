@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func Test_InfluxStorage_Flush(t *testing.T) {
+	lines := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "metrics" ||
+			r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	st := NewInfluxStorage(server.URL, "secret", "depoy", "metrics", time.Hour, time.Hour, time.Minute)
+	defer st.Stop()
+	backend := uuid.New()
+	st.Write("my route", backend, map[string]float64{"cpu": 0.5}, 12, 34, 503, "POST")
+	st.Flush()
+
+	line := <-lines
+	expected := "depoy,route=my\\ route,backend=" + backend.String() +
+		" responses=1i,status_200=0i,status_300=0i,status_400=0i,status_500=1i,status_600=0i," +
+		"response_time=12,content_length=34,method_POST_responses=1i,method_POST_status_500=1i,custom_cpu=0.5 "
+	if !strings.HasPrefix(line, expected) {
+		t.Errorf("Expected %s, got %s", expected, line)
+	}
+}
+
+func Test_InfluxStorage_ReadBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("" +
+			",result,table,_field,_value\r\n" +
+			",_result,0,responses,4\r\n" +
+			",_result,1,status_500,1\r\n" +
+			"\r\n" +
+			",result,table,_field,_value\r\n" +
+			",_result,2,response_time,12.5\r\n" +
+			",_result,3,custom_cpu,0.75\r\n" +
+			",_result,4,method_POST_responses,3\r\n" +
+			",_result,5,method_POST_status_500,1\r\n"))
+	}))
+	defer server.Close()
+
+	st := NewInfluxStorage(server.URL, "secret", "depoy", "metrics", time.Hour, time.Hour, time.Minute)
+	defer st.Stop()
+	metric, err := st.ReadBackend(uuid.New(), time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric.TotalResponses != 4 || metric.ResponseStatus500 != 1 || metric.ResponseTime != 12.5 || metric.CustomMetrics["cpu"] != 0.75 {
+		t.Errorf("Expected the metric to be reconstructed, got %+v", metric)
+	}
+	if post := metric.Methods["POST"]; post.TotalResponses != 3 || post.ResponseStatus500 != 1 {
+		t.Errorf("Expected the responses of POST to be reconstructed, got %+v", metric.Methods)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,12 +16,13 @@ type LocalStorage struct {
 	puffer          map[string]map[uuid.UUID][]Metric // puffer storage until the averaging job is executed
 	RetentionPeriod time.Duration                     // time after which an entry is deleted from storage
 	Granularity     time.Duration                     // time after which the puffer is read and averages are saved in data
+	MaxBuckets      int                               // maximal number of entries per backend, 0 is unlimited
 	killChan        chan int
 
 	data map[string]map[uuid.UUID]map[time.Time]Metric // map of backend to metrics
 }
 
-func NewLocalStorage(retentionPeriod, granularity time.Duration) *LocalStorage {
+func NewLocalStorage(retentionPeriod, granularity time.Duration, maxBuckets int) *LocalStorage {
 	st := new(LocalStorage)
 	st.data = make(map[string]map[uuid.UUID]map[time.Time]Metric)
 	st.puffer = make(map[string]map[uuid.UUID][]Metric)
@@ -28,6 +30,7 @@ func NewLocalStorage(retentionPeriod, granularity time.Duration) *LocalStorage {
 
 	st.RetentionPeriod = retentionPeriod
 	st.Granularity = granularity
+	st.MaxBuckets = maxBuckets
 
 	// time for averiging and saving to data
 	go st.Job()
@@ -68,7 +71,7 @@ func (st *LocalStorage) Write(
 	backend uuid.UUID,
 	customMetrics map[string]float64,
 	responseTime, contentLength int64,
-	responseStatus int) {
+	responseStatus int, requestMethod string) {
 
 	// this only writes to putter. Therefore, lock pufferMux
 	st.pufferMux.Lock()
@@ -97,6 +100,11 @@ func (st *LocalStorage) Write(
 	default:
 		tmpMetric.ResponseStatus600++
 	}
+	if requestMethod != "" {
+		methodMetric := MethodMetric{}
+		methodMetric.count(responseStatus)
+		tmpMetric.Methods = map[string]MethodMetric{requestMethod: methodMetric}
+	}
 
 	st.puffer[routeName][backend] = append(st.puffer[routeName][backend], tmpMetric)
 }
@@ -108,8 +116,20 @@ func (st *LocalStorage) ReadData() map[string]map[uuid.UUID]map[time.Time]Metric
 	return st.data
 }
 
+// checkRetention returns an error if the timeframe ended before the retention period
+// as the data of the timeframe has already been deleted
+func (st *LocalStorage) checkRetention(end time.Time) error {
+	if oldest := time.Now().Add(-st.RetentionPeriod); end.Before(oldest) {
+		return fmt.Errorf("Timeframe ending at %v is older than the retention period of %v", end.Format(time.RFC3339), st.RetentionPeriod)
+	}
+	return nil
+}
+
 // ReadBackend returns all metrics for the backend that are within the given timeframe
 func (st *LocalStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (Metric, error) {
+	if err := st.checkRetention(end); err != nil {
+		return Metric{}, err
+	}
 	st.mux.RLock()
 	defer st.mux.RUnlock()
 
@@ -135,6 +155,9 @@ func (st *LocalStorage) ReadBackend(backend uuid.UUID, start, end time.Time) (Me
 
 // ReadRoute returns all metrics for the route that are within the given timeframe
 func (st *LocalStorage) ReadRoute(route string, start, end time.Time) (Metric, error) {
+	if err := st.checkRetention(end); err != nil {
+		return Metric{}, err
+	}
 	st.mux.RLock()
 	defer st.mux.RUnlock()
 
@@ -185,14 +208,32 @@ func (st *LocalStorage) readPuffer() {
 }
 func (st *LocalStorage) deleteOldData() {
 	now := time.Now()
-	for _, routeData := range st.data { // for each route
-		for _, backendData := range routeData { // for each backend of route
+	for routeName, routeData := range st.data { // for each route
+		for backendID, backendData := range routeData { // for each backend of route
 			for timestamp := range backendData { // for each timestamp
 				// "full table scan" as go maps are not sorted
 				if timestamp.Add(st.RetentionPeriod).Before(now) {
 					delete(backendData, timestamp) // metric is out of retention period => delete it
 				}
 			}
+			if st.MaxBuckets > 0 && len(backendData) > st.MaxBuckets {
+				// evict the oldest entries which exceed the cap
+				timestamps := make([]time.Time, 0, len(backendData))
+				for timestamp := range backendData {
+					timestamps = append(timestamps, timestamp)
+				}
+				sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+				for _, timestamp := range timestamps[:len(timestamps)-st.MaxBuckets] {
+					delete(backendData, timestamp)
+				}
+			}
+			// backends which are removed do not receive new data
+			if len(backendData) == 0 {
+				delete(routeData, backendID)
+			}
+		}
+		if len(routeData) == 0 {
+			delete(st.data, routeName)
 		}
 	}
 }
@@ -228,6 +269,14 @@ func makeAverageBackend(in []Metric) Metric {
 		for key, val := range metric.CustomMetrics {
 			finalMetric.CustomMetrics[key] += val
 		}
+		for method, methodMetric := range metric.Methods {
+			if finalMetric.Methods == nil {
+				finalMetric.Methods = make(map[string]MethodMetric)
+			}
+			sum := finalMetric.Methods[method]
+			sum.add(methodMetric)
+			finalMetric.Methods[method] = sum
+		}
 	}
 	finalMetric.ContentLength = finalMetric.ContentLength / float64(length)
 	finalMetric.ResponseTime = finalMetric.ResponseTime / float64(length)
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestStorage(retentionPeriod time.Duration, maxBuckets int, buckets map[uuid.UUID][]time.Time) *LocalStorage {
+	st := NewLocalStorage(retentionPeriod, time.Hour, maxBuckets)
+	st.data["test"] = make(map[uuid.UUID]map[time.Time]Metric)
+	for backend, timestamps := range buckets {
+		st.data["test"][backend] = make(map[time.Time]Metric)
+		for _, timestamp := range timestamps {
+			st.data["test"][backend][timestamp] = Metric{TotalResponses: 1}
+		}
+	}
+	return st
+}
+
+func Test_LocalStorage_Retention(t *testing.T) {
+	now := time.Now()
+	old, recent := uuid.New(), uuid.New()
+	st := newTestStorage(time.Minute, 0, map[uuid.UUID][]time.Time{
+		old:    {now.Add(-3 * time.Minute), now.Add(-2 * time.Minute)},
+		recent: {now.Add(-2 * time.Minute), now.Add(-10 * time.Second)},
+	})
+	defer st.Stop()
+
+	st.deleteOldData()
+	if _, found := st.data["test"][old]; found {
+		t.Error("Expected the backend without recent data to be reclaimed")
+	}
+	if buckets := len(st.data["test"][recent]); buckets != 1 {
+		t.Errorf("Expected only the recent bucket to be retained, got %d", buckets)
+	}
+
+	_, err := st.ReadBackend(recent, now.Add(-5*time.Minute), now.Add(-2*time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "retention period") {
+		t.Errorf("Expected an error for a timeframe before the retention period, got %v", err)
+	}
+	if _, err := st.ReadRoute("test", now.Add(-time.Minute), now); err != nil {
+		t.Errorf("Expected the recent data to be read, got %v", err)
+	}
+}
+
+func Test_LocalStorage_MaxBuckets(t *testing.T) {
+	now := time.Now()
+	backend := uuid.New()
+	timestamps := []time.Time{}
+	for i := 0; i < 10; i++ {
+		timestamps = append(timestamps, now.Add(-time.Duration(i)*time.Second))
+	}
+	st := newTestStorage(time.Hour, 3, map[uuid.UUID][]time.Time{backend: timestamps})
+	defer st.Stop()
+
+	st.deleteOldData()
+	if buckets := len(st.data["test"][backend]); buckets != 3 {
+		t.Fatalf("Expected the buckets to be capped at 3, got %d", buckets)
+	}
+	for _, timestamp := range timestamps[:3] {
+		if _, found := st.data["test"][backend][timestamp]; !found {
+			t.Errorf("Expected the newest bucket %v to be retained", timestamp)
+		}
+	}
+}
+
+func Test_LocalStorage_RouteReclaimed(t *testing.T) {
+	st := newTestStorage(time.Minute, 0, map[uuid.UUID][]time.Time{uuid.New(): {time.Now().Add(-time.Hour)}})
+	defer st.Stop()
+
+	st.deleteOldData()
+	if _, found := st.data["test"]; found {
+		t.Error("Expected the route without data to be reclaimed")
+	}
+}
+
+func Test_LocalStorage_Methods(t *testing.T) {
+	st := NewLocalStorage(time.Hour, time.Hour, 0)
+	defer st.Stop()
+	backend := uuid.New()
+	for _, request := range []struct {
+		method string
+		status int
+	}{{"GET", 200}, {"GET", 200}, {"GET", 404}, {"POST", 503}, {"POST", 200}} {
+		st.Write("test", backend, nil, 10, 10, request.status, request.method)
+	}
+	st.mux.Lock()
+	st.pufferMux.Lock()
+	st.readPuffer()
+	st.pufferMux.Unlock()
+	st.mux.Unlock()
+
+	metric, err := st.ReadBackend(backend, time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric.TotalResponses != 5 || metric.ResponseStatus500 != 1 {
+		t.Errorf("Expected the responses of all methods, got %+v", metric)
+	}
+	get, post := metric.Methods["GET"], metric.Methods["POST"]
+	if get.TotalResponses != 3 || get.ResponseStatus200 != 2 || get.ResponseStatus400 != 1 || get.ResponseStatus500 != 0 {
+		t.Errorf("Unexpected responses of GET %+v", get)
+	}
+	if post.TotalResponses != 2 || post.ResponseStatus200 != 1 || post.ResponseStatus500 != 1 {
+		t.Errorf("Unexpected responses of POST %+v", post)
+	}
+}
@@ -12,4 +12,42 @@ type Metric struct {
 	ContentLength     float64
 	ResponseTime      float64
 	CustomMetrics     map[string]float64
+	Methods           map[string]MethodMetric // responses by request method
+}
+
+// MethodMetric counts the responses of the requests of one method
+type MethodMetric struct {
+	TotalResponses    int
+	ResponseStatus200 int
+	ResponseStatus300 int
+	ResponseStatus400 int
+	ResponseStatus500 int
+	ResponseStatus600 int
+}
+
+// count adds a response with the status
+func (m *MethodMetric) count(responseStatus int) {
+	m.TotalResponses++
+	switch status := responseStatus; {
+	case status < 300:
+		m.ResponseStatus200++
+	case status < 400:
+		m.ResponseStatus300++
+	case status < 500:
+		m.ResponseStatus400++
+	case status < 600:
+		m.ResponseStatus500++
+	default:
+		m.ResponseStatus600++
+	}
+}
+
+// add adds the responses of other
+func (m *MethodMetric) add(other MethodMetric) {
+	m.TotalResponses += other.TotalResponses
+	m.ResponseStatus200 += other.ResponseStatus200
+	m.ResponseStatus300 += other.ResponseStatus300
+	m.ResponseStatus400 += other.ResponseStatus400
+	m.ResponseStatus500 += other.ResponseStatus500
+	m.ResponseStatus600 += other.ResponseStatus600
 }
@@ -3,8 +3,11 @@ package upstreamclient
 import (
 	"crypto/tls"
 	"flag"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rgumi/depoy/metrics"
 	"github.com/valyala/fasthttp"
 )
@@ -23,37 +26,192 @@ func init() {
 	flag.BoolVar(&DisableKeepAlives, "client.keepAlives", true, "defines if http-keep-alive")
 }
 
+// doer is implemented by fasthttp.Client and fasthttp.HostClient
+type doer interface {
+	Do(req *fasthttp.Request, resp *fasthttp.Response) error
+	DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error
+}
+
 type Upstreamclient struct {
-	client *fasthttp.Client
+	MaxIdleConns        int // idle connections of all hosts
+	MaxIdleConnsPerHost int // idle connections of a single host
+	MaxConnsPerHost     int // open connections of a single host
+	client              *fasthttp.Client
+	hostClients         map[string]*fasthttp.HostClient // clients of addresses which differ from the host of the request
+	mux                 sync.Mutex
+	conns               map[*countedConn]struct{} // open connections which are closed by Close
+	connsMux            sync.Mutex
 }
 
 func NewUpstreamclient(
 	readTimeout, writeTimeout, idleTimeout time.Duration,
-	maxIdleConnsPerHost int, tlsVerify bool) *Upstreamclient {
-
-	return &Upstreamclient{
-		client: &fasthttp.Client{
-			NoDefaultUserAgentHeader:      true,
-			DisablePathNormalizing:        false,
-			DisableHeaderNamesNormalizing: false,
-			ReadTimeout:                   readTimeout,
-			WriteTimeout:                  writeTimeout,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: SkipTLSVerify,
-			},
-			MaxConnsPerHost:           maxIdleConnsPerHost,
-			MaxIdleConnDuration:       idleTimeout,
-			MaxConnDuration:           0, // unlimited
-			MaxIdemponentCallAttempts: 2,
+	maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int, tlsVerify bool) *Upstreamclient {
+	return NewUpstreamclientWithTLS(readTimeout, writeTimeout, idleTimeout,
+		maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost, &tls.Config{
+			InsecureSkipVerify: SkipTLSVerify,
 		},
+	)
+}
+
+// poolSize returns the sizing of the connection pool. Zero values are replaced
+// by the defaults of the flags and the idle connections of a host cannot exceed
+// the idle connections of all hosts. As fasthttp keeps every released connection
+// idle until the idle timeout, the open connections of a host are limited to
+// its idle connections unless maxConnsPerHost is set
+func poolSize(maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int) (int, int, int) {
+	if maxIdleConns <= 0 {
+		maxIdleConns = MaxIdleConns
+	}
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = MaxIdleConnsPerHost
+	}
+	if maxIdleConnsPerHost > maxIdleConns {
+		maxIdleConnsPerHost = maxIdleConns
+	}
+	if maxConnsPerHost <= 0 {
+		maxConnsPerHost = maxIdleConnsPerHost
+	}
+	return maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost
+}
+
+// NewUpstreamclientWithTLS returns a new Upstreamclient which uses
+// the provided tls config for connections to https upstreams
+func NewUpstreamclientWithTLS(
+	readTimeout, writeTimeout, idleTimeout time.Duration,
+	maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int, tlsConfig *tls.Config) *Upstreamclient {
+
+	maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost = poolSize(
+		maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost)
+	c := &Upstreamclient{
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		MaxConnsPerHost:     maxConnsPerHost,
+		conns:               make(map[*countedConn]struct{}),
 	}
+	c.client = &fasthttp.Client{
+		NoDefaultUserAgentHeader:      true,
+		DisablePathNormalizing:        false,
+		DisableHeaderNamesNormalizing: false,
+		ReadTimeout:                   readTimeout,
+		WriteTimeout:                  writeTimeout,
+		TLSConfig:                     tlsConfig,
+		MaxConnsPerHost:               maxConnsPerHost,
+		MaxIdleConnDuration:           idleTimeout,
+		MaxConnDuration:               0, // unlimited
+		MaxIdemponentCallAttempts:     2,
+		Dial:                          c.dial,
+	}
+	c.hostClients = make(map[string]*fasthttp.HostClient)
+	return c
+}
 
+// countedConn decrements the connection gauge of its upstream once it is closed
+type countedConn struct {
+	net.Conn
+	gauge     prometheus.Gauge
+	owner     *Upstreamclient
+	closeOnce sync.Once
 }
 
-func (c *Upstreamclient) Send(req *fasthttp.Request, m *metrics.Metrics) (*fasthttp.Response, error) {
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.gauge.Dec()
+		c.owner.connsMux.Lock()
+		delete(c.owner.conns, c)
+		c.owner.connsMux.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// dial opens a connection to addr which is counted by metrics.UpstreamConnections
+func (c *Upstreamclient) dial(addr string) (net.Conn, error) {
+	conn, err := fasthttp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	gauge := metrics.UpstreamConnections.With(prometheus.Labels{"upstream": addr})
+	gauge.Inc()
+	counted := &countedConn{Conn: conn, gauge: gauge, owner: c}
+	c.connsMux.Lock()
+	c.conns[counted] = struct{}{}
+	c.connsMux.Unlock()
+	return counted, nil
+}
+
+// Close closes all connections of the client. It must not be used afterwards
+func (c *Upstreamclient) Close() {
+	c.connsMux.Lock()
+	conns := make([]*countedConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.connsMux.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// hostClient returns the client which connects to addr regardless of
+// the host of the request
+func (c *Upstreamclient) hostClient(addr string, isTLS bool) *fasthttp.HostClient {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	key := addr
+	if isTLS {
+		key = "https://" + addr
+	}
+	if hc, found := c.hostClients[key]; found {
+		return hc
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if isTLS {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	hc := &fasthttp.HostClient{
+		Addr:                          addr,
+		IsTLS:                         isTLS,
+		NoDefaultUserAgentHeader:      c.client.NoDefaultUserAgentHeader,
+		DisablePathNormalizing:        c.client.DisablePathNormalizing,
+		DisableHeaderNamesNormalizing: c.client.DisableHeaderNamesNormalizing,
+		ReadTimeout:                   c.client.ReadTimeout,
+		WriteTimeout:                  c.client.WriteTimeout,
+		TLSConfig:                     c.client.TLSConfig,
+		MaxConns:                      c.client.MaxConnsPerHost,
+		MaxIdleConnDuration:           c.client.MaxIdleConnDuration,
+		MaxConnDuration:               c.client.MaxConnDuration,
+		MaxIdemponentCallAttempts:     c.client.MaxIdemponentCallAttempts,
+		Dial:                          c.client.Dial,
+	}
+	c.hostClients[key] = hc
+	return hc
+}
+
+// Send sends the request to the upstream at addr. The Host header of the request
+// is set to the host of its uri which may differ from addr. If addr is empty, the
+// host of the uri is used. If timeout is larger than 0, the request is aborted
+// after the given duration
+func (c *Upstreamclient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	var err error
+	var client doer = c.client
+
+	uri := req.URI()
+	if addr != "" && addr != string(uri.Host()) {
+		client = c.hostClient(addr, string(uri.Scheme()) == "https")
+	}
+
 	resp := fasthttp.AcquireResponse()
 	start := time.Now()
-	if err := c.client.Do(req, resp); err != nil {
+	if timeout > 0 {
+		err = client.DoTimeout(req, resp, timeout)
+	} else {
+		err = client.Do(req, resp)
+	}
+	if err != nil {
+		fasthttp.ReleaseResponse(resp)
 		return nil, err
 	}
 	m.UpstreamResponseTime = time.Since(start).Milliseconds()
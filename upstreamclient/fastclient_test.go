@@ -0,0 +1,87 @@
+package upstreamclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// connections scrapes the connection gauge of the upstream from the default registry
+func connections(t *testing.T, upstream string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "ingress_depoy_upstream_connections" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == upstream {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func Test_Upstreamclient_ConnectionGauge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	upstream := strings.TrimPrefix(server.URL, "http://")
+
+	client := NewUpstreamclient(time.Second, time.Second, 50*time.Millisecond, 10, 10, 10, false)
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(server.URL)
+	resp, err := client.Send(upstream, req, new(metrics.Metrics), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fasthttp.ReleaseResponse(resp)
+
+	if value := connections(t, upstream); value != 1 {
+		t.Errorf("Expected one open connection, got %v", value)
+	}
+	// the idle keep-alive connection is closed after the idle timeout
+	deadline := time.Now().Add(2 * time.Second)
+	for connections(t, upstream) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the connection to be closed, got %v", connections(t, upstream))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Upstreamclient_PoolSize(t *testing.T) {
+	tests := []struct {
+		name                     string
+		idle, idlePerHost, conns int
+		expected                 [3]int
+	}{
+		{"configured", 100, 10, 20, [3]int{100, 10, 20}},
+		{"defaults", 0, 0, 0, [3]int{MaxIdleConns, MaxIdleConnsPerHost, MaxIdleConnsPerHost}},
+		{"conns default to idle per host", 100, 10, 0, [3]int{100, 10, 10}},
+		{"idle per host capped", 5, 10, 0, [3]int{5, 5, 5}},
+	}
+	for _, test := range tests {
+		client := NewUpstreamclient(time.Second, time.Second, time.Second, test.idle, test.idlePerHost, test.conns, false)
+		actual := [3]int{client.MaxIdleConns, client.MaxIdleConnsPerHost, client.MaxConnsPerHost}
+		if actual != test.expected {
+			t.Errorf("%s: expected pool %v, got %v", test.name, test.expected, actual)
+		}
+		if client.client.MaxConnsPerHost != test.expected[2] {
+			t.Errorf("%s: expected the client to open %d connections per host, got %d",
+				test.name, test.expected[2], client.client.MaxConnsPerHost)
+		}
+		if hc := client.hostClient("127.0.0.1:8080", false); hc.MaxConns != test.expected[2] {
+			t.Errorf("%s: expected the host client to open %d connections, got %d", test.name, test.expected[2], hc.MaxConns)
+		}
+	}
+}
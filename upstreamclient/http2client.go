@@ -0,0 +1,98 @@
+package upstreamclient
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Client sends requests to the upstream over HTTP/2. Upstreams with
+// the scheme http are connected with h2c (HTTP/2 over plaintext with prior knowledge)
+type HTTP2Client struct {
+	h2c          *http2.Transport
+	h2           *http2.Transport
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// NewHTTP2Client returns a new HTTP2Client which uses the provided
+// tls config for connections to https upstreams
+func NewHTTP2Client(readTimeout, writeTimeout time.Duration, tlsConfig *tls.Config) *HTTP2Client {
+	dialer := &net.Dialer{Timeout: writeTimeout}
+	return &HTTP2Client{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		},
+		h2: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// Send sends the request to the upstream at addr. The Host header of the request
+// is set to the host of its uri which may differ from addr. If addr is empty, the
+// host of the uri is used. If timeout is larger than 0, the request is aborted
+// after the given duration. Otherwise the read and write timeouts are applied
+func (c *HTTP2Client) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	transport := c.h2c
+	if string(req.URI().Scheme()) == "https" {
+		transport = c.h2
+	}
+
+	if timeout <= 0 {
+		timeout = c.readTimeout + c.writeTimeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	httpReq, stopBody, err := newHTTPRequest(ctx, addr, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stopBody()
+
+	start := time.Now()
+	httpResp, err := transport.RoundTrip(httpReq)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fasthttp.ErrTimeout
+		}
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fasthttp.ErrTimeout
+		}
+		return nil, err
+	}
+	m.UpstreamResponseTime = time.Since(start).Milliseconds()
+
+	resp := fasthttp.AcquireResponse()
+	copyResponseHeader(resp, httpResp)
+	copyTrailer(resp, httpResp.Trailer)
+	resp.SetBody(body)
+	return resp, nil
+}
+
+// Close closes the idle connections of the client
+func (c *HTTP2Client) Close() {
+	c.h2c.CloseIdleConnections()
+	c.h2.CloseIdleConnections()
+}
@@ -0,0 +1,82 @@
+package upstreamclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Client is an upstream client which can be shared in a Pool
+type Client interface {
+	Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error)
+	Close()
+}
+
+// DefaultPool shares the upstream clients of all routes
+var DefaultPool = NewPool()
+
+// Pool shares the clients with the same config. Each client is reference counted
+// and closed once it is released by all of its users
+type Pool struct {
+	mux     sync.Mutex
+	clients map[string]*pooledClient
+}
+
+type pooledClient struct {
+	client Client
+	refs   int
+}
+
+// NewPool returns a new empty Pool
+func NewPool() *Pool {
+	return &Pool{clients: make(map[string]*pooledClient)}
+}
+
+// Acquire returns the client of the config key. If the key is not in use,
+// the client is created with newClient. Every Acquire requires a Release
+func (p *Pool) Acquire(key string, newClient func() Client) Client {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	pooled, found := p.clients[key]
+	if !found {
+		log.Debugf("Creating new upstream client for %s", key)
+		pooled = &pooledClient{client: newClient()}
+		p.clients[key] = pooled
+	}
+	pooled.refs++
+	return pooled.client
+}
+
+// Release drops a reference of the client of the key. The client is closed
+// once it has no references left
+func (p *Pool) Release(key string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	pooled, found := p.clients[key]
+	if !found {
+		return
+	}
+	pooled.refs--
+	if pooled.refs > 0 {
+		return
+	}
+	log.Debugf("Closing unused upstream client for %s", key)
+	delete(p.clients, key)
+	pooled.client.Close()
+}
+
+// Refs returns the number of references of the client of the key
+func (p *Pool) Refs(key string) int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if pooled, found := p.clients[key]; found {
+		return pooled.refs
+	}
+	return 0
+}
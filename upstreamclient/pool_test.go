@@ -0,0 +1,60 @@
+package upstreamclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_Pool_ReferenceCounting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	upstream := strings.TrimPrefix(server.URL, "http://")
+
+	pool := NewPool()
+	created := 0
+	newClient := func() Client {
+		created++
+		return NewUpstreamclient(time.Second, time.Second, time.Minute, 10, 10, 10, false)
+	}
+	send := func(client Client) error {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.SetRequestURI(server.URL)
+		resp, err := client.Send(upstream, req, new(metrics.Metrics), time.Second)
+		if err == nil {
+			fasthttp.ReleaseResponse(resp)
+		}
+		return err
+	}
+
+	first := pool.Acquire("a", newClient)
+	second := pool.Acquire("a", newClient)
+	if first != second || created != 1 || pool.Refs("a") != 2 {
+		t.Fatalf("Expected the client to be shared, created %d clients", created)
+	}
+	if err := send(first); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Release("a")
+	if err := send(second); err != nil {
+		t.Errorf("Expected the client to be usable by the remaining user, got %v", err)
+	}
+	if value := connections(t, upstream); value != 1 {
+		t.Errorf("Expected the idle connection to be kept, got %v", value)
+	}
+
+	pool.Release("a")
+	if value := connections(t, upstream); value != 0 {
+		t.Errorf("Expected the connections to be closed with the last reference, got %v", value)
+	}
+	if pool.Acquire("a", newClient); created != 2 {
+		t.Error("Expected a new client once the previous one was closed")
+	}
+}
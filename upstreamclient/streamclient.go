@@ -0,0 +1,257 @@
+package upstreamclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+// StreamingContentTypes are the content types of responses which are streamed
+// to the client instead of being read completely
+var StreamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+}
+
+// IsStreaming checks if responses with the content type are streamed
+func IsStreaming(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, streaming := range StreamingContentTypes {
+		if mediaType == streaming {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamClient sends requests to the upstream over HTTP/1.1. Unlike the Upstreamclient,
+// the body of streaming responses (see IsStreaming) is not read before the response is
+// returned. It is set as body stream of the response and has to be read or closed by
+// releasing the response. The timeout of a request only applies until the headers of
+// a streaming response are received
+type StreamClient struct {
+	transport    *http.Transport
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// NewStreamClient returns a new StreamClient which uses the provided
+// tls config for connections to https upstreams
+func NewStreamClient(
+	readTimeout, writeTimeout, idleTimeout time.Duration,
+	maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int,
+	tlsConfig *tls.Config) *StreamClient {
+
+	maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost = poolSize(maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost)
+	dialer := &net.Dialer{Timeout: writeTimeout}
+	return &StreamClient{
+		transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			MaxConnsPerHost:     maxConnsPerHost,
+			IdleConnTimeout:     idleTimeout,
+			DisableCompression:  true,
+		},
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// streamBody closes the upstream request once the body is closed. The
+// trailers of the upstream are copied to the response once the body is read
+type streamBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	resp    *fasthttp.Response
+	trailer http.Header
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		copyTrailer(b.resp, b.trailer)
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Send sends the request to the upstream at addr. The Host header of the request
+// is set to the host of its uri which may differ from addr. If addr is empty, the
+// host of the uri is used. If timeout is larger than 0, the request is aborted
+// after the given duration. Otherwise the read and write timeouts are applied
+func (c *StreamClient) Send(addr string, req *fasthttp.Request, m *metrics.Metrics, timeout time.Duration) (*fasthttp.Response, error) {
+	if timeout <= 0 {
+		timeout = c.readTimeout + c.writeTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// stopTimeout stops the timeout and reports whether it already aborted the request
+	stopTimeout := func() bool { return false }
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, cancel)
+		stopTimeout = func() bool { return !timer.Stop() }
+	}
+
+	httpReq, stopBody, err := newHTTPRequest(ctx, addr, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer stopBody()
+	start := time.Now()
+	httpResp, err := c.transport.RoundTrip(httpReq)
+	if err != nil {
+		cancel()
+		if stopTimeout() {
+			return nil, fasthttp.ErrTimeout
+		}
+		return nil, err
+	}
+	m.UpstreamResponseTime = time.Since(start).Milliseconds()
+
+	resp := fasthttp.AcquireResponse()
+	copyResponseHeader(resp, httpResp)
+	if IsStreaming(httpResp.Header.Get("Content-Type")) {
+		if stopTimeout() {
+			httpResp.Body.Close()
+			cancel()
+			fasthttp.ReleaseResponse(resp)
+			return nil, fasthttp.ErrTimeout
+		}
+		resp.SetBodyStream(&streamBody{httpResp.Body, cancel, resp, httpResp.Trailer}, -1)
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	cancel()
+	if stopTimeout() {
+		fasthttp.ReleaseResponse(resp)
+		return nil, fasthttp.ErrTimeout
+	}
+	if err != nil {
+		fasthttp.ReleaseResponse(resp)
+		return nil, err
+	}
+	copyTrailer(resp, httpResp.Trailer)
+	resp.SetBody(body)
+	return resp, nil
+}
+
+// Close closes the idle connections of the client
+func (c *StreamClient) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+// newHTTPRequest converts the fasthttp request to a net/http request to the upstream at addr.
+// A body stream of the request is piped to the upstream without reading it into memory. The
+// returned function stops the pipe and must be called before the request is released
+func newHTTPRequest(ctx context.Context, addr string, req *fasthttp.Request) (*http.Request, func(), error) {
+	uri := req.URI()
+	if addr == "" {
+		addr = string(uri.Host())
+	}
+	var body io.Reader
+	stopBody := func() {}
+	if req.IsBodyStream() {
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			pw.CloseWithError(req.BodyWriteTo(pw))
+			close(done)
+		}()
+		body = pr
+		stopBody = func() {
+			pr.Close()
+			<-done
+		}
+	} else {
+		body = bytes.NewReader(req.Body())
+	}
+	httpReq, err := http.NewRequest(string(req.Header.Method()),
+		string(uri.Scheme())+"://"+addr+string(uri.RequestURI()), body)
+	if err != nil {
+		stopBody()
+		return nil, nil, err
+	}
+	if req.IsBodyStream() {
+		// -1 sends the body chunked
+		httpReq.ContentLength = int64(req.Header.ContentLength())
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Host = string(uri.Host())
+	req.Header.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case fasthttp.HeaderHost, fasthttp.HeaderContentLength:
+			// set by the transport
+		default:
+			httpReq.Header.Add(string(key), string(value))
+		}
+	})
+	return httpReq, stopBody, nil
+}
+
+// copyResponseHeader copies the status and headers of the net/http response.
+// The declared trailers are announced with the Trailer header
+func copyResponseHeader(resp *fasthttp.Response, httpResp *http.Response) {
+	resp.SetStatusCode(httpResp.StatusCode)
+	for key, values := range httpResp.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case fasthttp.HeaderContentLength, fasthttp.HeaderTrailer:
+			// set with the body and the trailers
+			continue
+		}
+		for i, value := range values {
+			// fasthttp only parses special headers like Content-Type on Set
+			if i == 0 {
+				resp.Header.Set(key, value)
+			} else {
+				resp.Header.Add(key, value)
+			}
+		}
+	}
+	copyTrailer(resp, httpResp.Trailer)
+}
+
+// copyTrailer copies the trailers of the net/http response to the header of the
+// response and announces them with the Trailer header. fasthttp does not support
+// trailers, hence they have to be split from the header by the receiver of the response
+func copyTrailer(resp *fasthttp.Response, trailer http.Header) {
+	if len(trailer) == 0 {
+		return
+	}
+	names := make([]string, 0, len(trailer))
+	for key, values := range trailer {
+		names = append(names, key)
+		if len(values) == 0 {
+			continue
+		}
+		resp.Header.Set(key, values[0])
+		for _, value := range values[1:] {
+			resp.Header.Add(key, value)
+		}
+	}
+	sort.Strings(names)
+	resp.Header.Set(fasthttp.HeaderTrailer, strings.Join(names, ", "))
+}
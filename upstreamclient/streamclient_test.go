@@ -0,0 +1,47 @@
+package upstreamclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgumi/depoy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_StreamClient_BodyStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(body)
+	}))
+	defer server.Close()
+	upstream := strings.TrimPrefix(server.URL, "http://")
+	client := NewStreamClient(time.Second, time.Second, time.Second, 10, 10, 10, nil)
+	defer client.Close()
+
+	body := strings.Repeat("depoy streams uploads. ", 10000)
+	for _, size := range []int{len(body), -1} {
+		req := fasthttp.AcquireRequest()
+		req.Header.SetMethod("PUT")
+		req.SetRequestURI(server.URL)
+		req.SetBodyStream(strings.NewReader(body), size)
+		resp, err := client.Send(upstream, req, new(metrics.Metrics), time.Second)
+		fasthttp.ReleaseRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body()) != body {
+			t.Errorf("Expected the streamed body to be received, got %d bytes", len(resp.Body()))
+		}
+		// a body of unknown size is sent chunked
+		if length := string(resp.Header.Peek("X-Content-Length")); length != strconv.Itoa(size) {
+			t.Errorf("Expected a content length of %d, got %s", size, length)
+		}
+		fasthttp.ReleaseResponse(resp)
+	}
+}